@@ -7,19 +7,28 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/pint/internal/checks"
 	"github.com/cloudflare/pint/internal/config"
 	"github.com/cloudflare/pint/internal/discovery"
 	"github.com/cloudflare/pint/internal/git"
+	"github.com/cloudflare/pint/internal/promapi"
 	"github.com/cloudflare/pint/internal/reporter"
 
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 )
 
-var baseBranchFlag = "base-branch"
+var (
+	baseBranchFlag = "base-branch"
+	warmupFlag     = "warmup"
+)
+
+// warmupTimeout is how long to wait for each server to accept a connection
+// when warming up connections.
+const warmupTimeout = time.Second * 5
 
 var ciCmd = &cli.Command{
 	Name:   "ci",
@@ -38,6 +47,11 @@ var ciCmd = &cli.Command{
 			Value:   "",
 			Usage:   "Set base branch to use for PR checks (main, master, ...)",
 		},
+		&cli.BoolFlag{
+			Name:  warmupFlag,
+			Value: false,
+			Usage: "Open connections to all Prometheus servers before running checks",
+		},
 	},
 }
 
@@ -77,6 +91,9 @@ func actionCI(c *cli.Context) error {
 		prom.StartWorkers()
 	}
 	defer meta.cleanup()
+	if c.Bool(warmupFlag) {
+		warmupServers(meta.cfg.PrometheusServers)
+	}
 
 	ctx := context.WithValue(context.Background(), config.CommandKey, config.CICommand)
 	summary := checkRules(ctx, meta.workers, meta.cfg, entries)
@@ -250,3 +267,20 @@ func detectGithubActions(gh *config.GitHub) *config.GitHub {
 	}
 	return gh
 }
+
+// warmupServers opens a connection to all servers at once, so checks don't
+// pay the cost of connecting to each server one by one.
+// Servers that don't accept a connection within warmupTimeout are skipped.
+func warmupServers(servers []*promapi.FailoverGroup) {
+	var wg sync.WaitGroup
+	for _, prom := range servers {
+		wg.Add(1)
+		go func(prom *promapi.FailoverGroup) {
+			defer wg.Done()
+			if err := prom.Warmup(context.Background(), warmupTimeout); err != nil {
+				log.Debug().Err(err).Str("name", prom.Name()).Msg("Failed to warm up connection")
+			}
+		}(prom)
+	}
+	wg.Wait()
+}
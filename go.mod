@@ -5,6 +5,8 @@ go 1.19
 require (
 	github.com/fatih/color v1.13.0
 	github.com/gkampitakis/go-snaps v0.4.0
+	github.com/go-kit/log v0.2.1
+	github.com/golang/snappy v0.0.4
 	github.com/google/go-cmp v0.5.9
 	github.com/google/go-github/v37 v37.0.0
 	github.com/hashicorp/golang-lru v0.5.4
@@ -40,12 +42,11 @@ require (
 	github.com/edsrzf/mmap-go v1.1.0 // indirect
 	github.com/gkampitakis/ciinfo v0.1.1 // indirect
 	github.com/gkampitakis/go-diff v1.3.0 // indirect
-	github.com/go-kit/log v0.2.1 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
 	github.com/go-logr/logr v1.2.3 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/grafana/regexp v0.0.0-20220304095617-2e8d9baf4ac2 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
@@ -435,7 +435,7 @@ func (c SeriesCheck) instantSeriesCount(ctx context.Context, query string) (int,
 }
 
 func (c SeriesCheck) seriesTimeRanges(ctx context.Context, query string, lookback, step time.Duration, promUptime *timeRanges) (tr *timeRanges, err error) {
-	qr, err := c.prom.RangeQuery(ctx, query, promapi.NewRelativeRange(lookback, step))
+	qr, err := c.prom.RangeQuery(ctx, query, promapi.NewRelativeRange(lookback, step), promapi.RangeQueryOptions{})
 	if err != nil {
 		return nil, err
 	}
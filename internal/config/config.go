@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"time"
 
@@ -16,6 +17,15 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// recordDirEnv is the environment variable with a directory where all
+	// Prometheus responses will be saved.
+	recordDirEnv = "PINT_RECORD_DIR"
+	// replayDirEnv is the environment variable with a directory of responses
+	// saved using recordDirEnv, if set all queries are answered from it.
+	replayDirEnv = "PINT_REPLAY_DIR"
+)
+
 type Config struct {
 	CI                *CI                      `hcl:"ci,block" json:"ci,omitempty"`
 	Parser            *Parser                  `hcl:"parser,block" json:"parser,omitempty"`
@@ -264,11 +274,46 @@ func Load(path string, failOnMissing bool) (cfg Config, err error) {
 			cfg.Prometheus[i].RateLimit = rateLimit
 		}
 
+		opts := []promapi.PrometheusOption{
+			promapi.WithRetries(prom.Retries),
+		}
+		if prom.LookbackDelta != "" {
+			lookbackDelta, _ := parseDuration(prom.LookbackDelta)
+			opts = append(opts, promapi.WithLookbackDelta(lookbackDelta))
+		}
+		if prom.ErrorLogWindow != "" {
+			errorLogWindow, _ := parseDuration(prom.ErrorLogWindow)
+			opts = append(opts, promapi.WithErrorLogWindow(errorLogWindow))
+		}
+		if prom.ProxyURL != "" {
+			proxyURL, _ := url.Parse(prom.ProxyURL)
+			opts = append(opts, promapi.WithProxy(proxyURL))
+		}
+		if prom.CacheMaxBytes > 0 {
+			opts = append(opts, promapi.WithCacheMaxBytes(prom.CacheMaxBytes))
+		}
+		if prom.CacheCompression {
+			opts = append(opts, promapi.WithCacheCompression())
+		}
+		if prom.AutoConcurrency {
+			opts = append(opts, promapi.WithAdaptiveConcurrency())
+		}
+		if prom.DisableKeepAlives {
+			opts = append(opts, promapi.WithoutKeepAlives())
+		}
+
+		if dir := os.Getenv(recordDirEnv); dir != "" {
+			opts = append(opts, promapi.WithRecordDir(dir))
+		}
+		if dir := os.Getenv(replayDirEnv); dir != "" {
+			opts = append(opts, promapi.WithReplayDir(dir))
+		}
+
 		upstreams := []*promapi.Prometheus{
-			promapi.NewPrometheus(prom.Name, prom.URI, timeout, concurrency, cacheSize, rateLimit),
+			promapi.NewPrometheus(prom.Name, prom.URI, timeout, concurrency, cacheSize, rateLimit, opts...),
 		}
 		for _, uri := range prom.Failover {
-			upstreams = append(upstreams, promapi.NewPrometheus(prom.Name, uri, timeout, concurrency, cacheSize, rateLimit))
+			upstreams = append(upstreams, promapi.NewPrometheus(prom.Name, uri, timeout, concurrency, cacheSize, rateLimit, opts...))
 		}
 		cfg.PrometheusServers = append(cfg.PrometheusServers, promapi.NewFailoverGroup(prom.Name, upstreams, prom.Required))
 	}
@@ -2,20 +2,29 @@ package config
 
 import (
 	"errors"
+	"net/url"
 	"regexp"
 )
 
 type PrometheusConfig struct {
-	Name        string   `hcl:",label" json:"name"`
-	URI         string   `hcl:"uri" json:"uri"`
-	Failover    []string `hcl:"failover,optional" json:"failover,omitempty"`
-	Timeout     string   `hcl:"timeout,optional"  json:"timeout"`
-	Concurrency int      `hcl:"concurrency,optional" json:"concurrency"`
-	RateLimit   int      `hcl:"rateLimit,optional" json:"rateLimit"`
-	Cache       int      `hcl:"cache,optional" json:"cache"`
-	Include     []string `hcl:"include,optional" json:"include,omitempty"`
-	Exclude     []string `hcl:"exclude,optional" json:"exclude,omitempty"`
-	Required    bool     `hcl:"required,optional" json:"required"`
+	Name              string   `hcl:",label" json:"name"`
+	URI               string   `hcl:"uri" json:"uri"`
+	Failover          []string `hcl:"failover,optional" json:"failover,omitempty"`
+	Timeout           string   `hcl:"timeout,optional"  json:"timeout"`
+	Concurrency       int      `hcl:"concurrency,optional" json:"concurrency"`
+	AutoConcurrency   bool     `hcl:"autoConcurrency,optional" json:"autoConcurrency,omitempty"`
+	RateLimit         int      `hcl:"rateLimit,optional" json:"rateLimit"`
+	Cache             int      `hcl:"cache,optional" json:"cache"`
+	CacheMaxBytes     int      `hcl:"cacheMaxBytes,optional" json:"cacheMaxBytes,omitempty"`
+	CacheCompression  bool     `hcl:"cacheCompression,optional" json:"cacheCompression,omitempty"`
+	Include           []string `hcl:"include,optional" json:"include,omitempty"`
+	Exclude           []string `hcl:"exclude,optional" json:"exclude,omitempty"`
+	Required          bool     `hcl:"required,optional" json:"required"`
+	Retries           int      `hcl:"retries,optional" json:"retries,omitempty"`
+	LookbackDelta     string   `hcl:"lookbackDelta,optional" json:"lookbackDelta,omitempty"`
+	ProxyURL          string   `hcl:"proxyURL,optional" json:"proxyURL,omitempty"`
+	ErrorLogWindow    string   `hcl:"errorLogWindow,optional" json:"errorLogWindow,omitempty"`
+	DisableKeepAlives bool     `hcl:"disableKeepAlives,optional" json:"disableKeepAlives,omitempty"`
 }
 
 func (pc PrometheusConfig) validate() error {
@@ -29,6 +38,32 @@ func (pc PrometheusConfig) validate() error {
 		}
 	}
 
+	if pc.LookbackDelta != "" {
+		if _, err := parseDuration(pc.LookbackDelta); err != nil {
+			return err
+		}
+	}
+
+	if pc.ErrorLogWindow != "" {
+		if _, err := parseDuration(pc.ErrorLogWindow); err != nil {
+			return err
+		}
+	}
+
+	if pc.ProxyURL != "" {
+		if _, err := url.Parse(pc.ProxyURL); err != nil {
+			return err
+		}
+	}
+
+	if pc.Retries < 0 {
+		return errors.New("prometheus retries cannot be negative")
+	}
+
+	if pc.CacheMaxBytes < 0 {
+		return errors.New("prometheus cacheMaxBytes cannot be negative")
+	}
+
 	for _, path := range pc.Include {
 		if _, err := regexp.Compile(path); err != nil {
 			return err
@@ -64,6 +64,65 @@ func TestPrometheusConfig(t *testing.T) {
 			},
 			err: errors.New("error parsing regexp: invalid nested repetition operator: `++`"),
 		},
+		{
+			conf: PrometheusConfig{
+				URI:     "http://localhost",
+				Retries: -1,
+			},
+			err: errors.New("prometheus retries cannot be negative"),
+		},
+		{
+			conf: PrometheusConfig{
+				URI:           "http://localhost",
+				CacheMaxBytes: 1024 * 1024,
+			},
+		},
+		{
+			conf: PrometheusConfig{
+				URI:           "http://localhost",
+				CacheMaxBytes: -1,
+			},
+			err: errors.New("prometheus cacheMaxBytes cannot be negative"),
+		},
+		{
+			conf: PrometheusConfig{
+				URI:           "http://localhost",
+				LookbackDelta: "5m",
+			},
+		},
+		{
+			conf: PrometheusConfig{
+				URI:           "http://localhost",
+				LookbackDelta: "foo",
+			},
+			err: errors.New(`not a valid duration string: "foo"`),
+		},
+		{
+			conf: PrometheusConfig{
+				URI:            "http://localhost",
+				ErrorLogWindow: "1m",
+			},
+		},
+		{
+			conf: PrometheusConfig{
+				URI:            "http://localhost",
+				ErrorLogWindow: "1 minute",
+			},
+			err: errors.New(`not a valid duration string: "1 minute"`),
+		},
+		{
+			conf: PrometheusConfig{
+				URI:      "http://localhost",
+				ProxyURL: "http://proxy.example.com:3128",
+			},
+		},
+		{
+			conf: PrometheusConfig{
+				URI:      "http://localhost",
+				ProxyURL: "http://proxy:foo",
+			},
+			err: errors.New(`parse "http://proxy:foo": invalid port ":foo" after host`),
+		},
 	}
 
 	for _, tc := range testCases {
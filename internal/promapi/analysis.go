@@ -0,0 +1,59 @@
+package promapi
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// WouldFire returns labels of all series that would make an alerting rule fire.
+// result should be obtained by running a range query for the alert expression,
+// series will be returned if it had a continuous run of values where
+// the time between first and last value is at least forDur.
+// Values are considered to be continuous if they are not more than step apart,
+// any bigger gap would reset the alert state.
+func WouldFire(result *RangeQueryResult, forDur, step time.Duration) []model.Metric {
+	var firing []model.Metric
+	for _, s := range result.Samples {
+		if seriesWouldFire(s.Values, forDur, step) {
+			firing = append(firing, s.Metric)
+		}
+	}
+	return firing
+}
+
+func seriesWouldFire(values []model.SamplePair, forDur, step time.Duration) bool {
+	var activeAt, prev model.Time
+	for i, v := range values {
+		if i == 0 || v.Timestamp.Sub(prev) > step {
+			activeAt = v.Timestamp
+		}
+		if v.Timestamp.Sub(activeAt) >= forDur {
+			return true
+		}
+		prev = v.Timestamp
+	}
+	return false
+}
+
+// MetricNames returns sorted names of all metrics present in the result,
+// each name is returned only once. Series without a metric name, like
+// those returned by queries using aggregations, are ignored.
+func MetricNames(result *RangeQueryResult) []string {
+	seen := map[model.LabelValue]struct{}{}
+	names := []string{}
+	for _, s := range result.Samples {
+		name, ok := s.Metric[model.MetricNameLabel]
+		if !ok || name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,122 @@
+package promapi_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestWouldFire(t *testing.T) {
+	type testCaseT struct {
+		samples []*model.SampleStream
+		forDur  time.Duration
+		step    time.Duration
+		firing  []model.Metric
+	}
+
+	start := time.Unix(1655164800, 0)
+
+	testCases := []testCaseT{
+		{
+			forDur: time.Minute * 5,
+			step:   time.Minute,
+		},
+		{
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: generateSamples(start, start.Add(time.Minute*10), time.Minute)},
+			},
+			forDur: 0,
+			step:   time.Minute,
+			firing: []model.Metric{{"instance": "1"}},
+		},
+		{
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: generateSamples(start, start.Add(time.Minute*10), time.Minute)},
+				{Metric: model.Metric{"instance": "2"}, Values: generateSamples(start, start.Add(time.Minute*4), time.Minute)},
+				{Metric: model.Metric{"instance": "3"}, Values: generateSamples(start, start.Add(time.Minute*5), time.Minute)},
+			},
+			forDur: time.Minute * 5,
+			step:   time.Minute,
+			firing: []model.Metric{{"instance": "1"}, {"instance": "3"}},
+		},
+		{
+			samples: []*model.SampleStream{
+				{
+					Metric: model.Metric{"instance": "1"},
+					Values: append(
+						generateSamples(start, start.Add(time.Minute*4), time.Minute),
+						generateSamples(start.Add(time.Minute*6), start.Add(time.Minute*10), time.Minute)...,
+					),
+				},
+				{
+					Metric: model.Metric{"instance": "2"},
+					Values: append(
+						generateSamples(start, start.Add(time.Minute*4), time.Minute),
+						generateSamples(start.Add(time.Minute*6), start.Add(time.Minute*11), time.Minute)...,
+					),
+				},
+			},
+			forDur: time.Minute * 5,
+			step:   time.Minute,
+			firing: []model.Metric{{"instance": "2"}},
+		},
+		{
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: generateSamples(start, start.Add(time.Minute*10), time.Minute*2)},
+			},
+			forDur: time.Minute * 5,
+			step:   time.Minute,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			result := promapi.RangeQueryResult{Samples: tc.samples, Start: start, End: start.Add(time.Hour)}
+			require.Equal(t, tc.firing, promapi.WouldFire(&result, tc.forDur, tc.step))
+		})
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	type testCaseT struct {
+		samples []*model.SampleStream
+		names   []string
+	}
+
+	testCases := []testCaseT{
+		{
+			names: []string{},
+		},
+		{
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}},
+				{Metric: model.Metric{}},
+			},
+			names: []string{},
+		},
+		{
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{model.MetricNameLabel: "up", "instance": "1"}},
+				{Metric: model.Metric{"instance": "1"}},
+				{Metric: model.Metric{model.MetricNameLabel: "foo_total", "instance": "1"}},
+				{Metric: model.Metric{model.MetricNameLabel: "up", "instance": "2"}},
+				{Metric: model.Metric{model.MetricNameLabel: ""}},
+				{Metric: model.Metric{model.MetricNameLabel: "bar", "instance": "1"}},
+				{Metric: model.Metric{model.MetricNameLabel: "foo_total", "instance": "2"}},
+			},
+			names: []string{"bar", "foo_total", "up"},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			result := promapi.RangeQueryResult{Samples: tc.samples}
+			require.Equal(t, tc.names, promapi.MetricNames(&result))
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package promapi
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// anchorQuery replaces all `@ start()` and `@ end()` modifiers with explicit
+// `@` timestamps of the whole query range. Prometheus resolves start() and
+// end() using the range of each request, so without it every slice of
+// a range query would be anchored to a different time.
+func anchorQuery(expr string, start, end time.Time) (string, error) {
+	node, err := parser.ParseExpr(expr)
+	if err != nil {
+		return "", fmt.Errorf("failed to anchor query %q: %w", expr, err)
+	}
+
+	var changed bool
+	anchor := func(ts **int64, startOrEnd *parser.ItemType) {
+		var t time.Time
+		switch *startOrEnd {
+		case parser.START:
+			t = start
+		case parser.END:
+			t = end
+		default:
+			return
+		}
+		ms := t.UnixMilli()
+		*ts = &ms
+		*startOrEnd = 0
+		changed = true
+	}
+
+	parser.Inspect(node, func(n parser.Node, _ []parser.Node) error {
+		switch e := n.(type) {
+		case *parser.VectorSelector:
+			anchor(&e.Timestamp, &e.StartOrEnd)
+		case *parser.SubqueryExpr:
+			anchor(&e.Timestamp, &e.StartOrEnd)
+		}
+		return nil
+	})
+
+	if !changed {
+		return expr, nil
+	}
+	return node.String(), nil
+}
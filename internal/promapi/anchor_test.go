@@ -0,0 +1,42 @@
+package promapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnchorQuery(t *testing.T) {
+	type testCaseT struct {
+		expr   string
+		output string
+		err    string
+	}
+
+	testCases := []testCaseT{
+		{expr: "up", output: "up"},
+		{expr: "up @ 1655164900", output: "up @ 1655164900"},
+		{expr: "up offset 5m", output: "up offset 5m"},
+		{expr: "up @ start()", output: "up @ 1655164800.000"},
+		{expr: "up @ end()", output: "up @ 1655172000.000"},
+		{expr: "rate(http_requests_total[5m] @ end() offset 1h)", output: "rate(http_requests_total[5m] @ 1655172000.000 offset 1h)"},
+		{expr: "max_over_time(rate(foo[5m])[1h:5m] @ start())", output: "max_over_time(rate(foo[5m])[1h:5m] @ 1655164800.000)"},
+		{expr: "sum(foo @ start()) / sum(bar @ end())", output: "sum(foo @ 1655164800.000) / sum(bar @ 1655172000.000)"},
+		{expr: "sum(", err: `failed to anchor query "sum(": 1:5: parse error: unclosed left parenthesis`},
+	}
+
+	start := time.Unix(1655164800, 0)
+	end := start.Add(time.Hour * 2)
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			output, err := anchorQuery(tc.expr, start, end)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.output, output)
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package promapi
+
+import (
+	"context"
+)
+
+// QueryAPI is the query surface of a Prometheus server.
+// It's implemented by both Prometheus and FailoverGroup, code that only
+// needs to run queries should accept it, so it can be tested with a canned
+// implementation instead of a real (or mocked over HTTP) Prometheus server.
+type QueryAPI interface {
+	Query(ctx context.Context, expr string) (*QueryResult, error)
+	RangeQuery(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions) (*RangeQueryResult, error)
+}
+
+var (
+	_ QueryAPI = (*Prometheus)(nil)
+	_ QueryAPI = (*FailoverGroup)(nil)
+	_ QueryAPI = (*TSDB)(nil)
+)
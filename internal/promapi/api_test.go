@@ -0,0 +1,67 @@
+package promapi_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+type cannedAPI struct {
+	series  map[string][]model.Sample
+	samples map[string][]*model.SampleStream
+}
+
+func (c cannedAPI) Query(_ context.Context, expr string) (*promapi.QueryResult, error) {
+	series, ok := c.series[expr]
+	if !ok {
+		return nil, errors.New("unknown query")
+	}
+	return &promapi.QueryResult{URI: "canned", Series: series}, nil
+}
+
+func (c cannedAPI) RangeQuery(_ context.Context, expr string, params promapi.RangeQueryTimes, _ promapi.RangeQueryOptions) (*promapi.RangeQueryResult, error) {
+	samples, ok := c.samples[expr]
+	if !ok {
+		return nil, errors.New("unknown query")
+	}
+	return &promapi.RangeQueryResult{URI: "canned", Samples: samples, Start: params.Start(), End: params.End()}, nil
+}
+
+func countSeries(ctx context.Context, api promapi.QueryAPI, expr string) (int, error) {
+	qr, err := api.RangeQuery(ctx, expr, promapi.NewRelativeRange(time.Hour, time.Minute), promapi.RangeQueryOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return len(qr.Samples), nil
+}
+
+func TestQueryAPI(t *testing.T) {
+	api := cannedAPI{
+		series: map[string][]model.Sample{
+			"up": {{Metric: model.Metric{"job": "foo"}, Value: 1}},
+		},
+		samples: map[string][]*model.SampleStream{
+			"up": {
+				{Metric: model.Metric{"job": "foo"}},
+				{Metric: model.Metric{"job": "bar"}},
+			},
+		},
+	}
+
+	n, err := countSeries(context.Background(), api, "up")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	_, err = countSeries(context.Background(), api, "down")
+	require.EqualError(t, err, "unknown query")
+
+	qr, err := api.Query(context.Background(), "up")
+	require.NoError(t, err)
+	require.Len(t, qr.Series, 1)
+}
@@ -0,0 +1,72 @@
+package promapi
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// apiVersionHeader is used to ask for a specific version of the HTTP API
+// and to find out which version was used by the server to respond.
+const apiVersionHeader = "X-Prometheus-API-Version"
+
+// knownAPIVersions are all API versions that responses can be parsed for.
+var knownAPIVersions = map[string]struct{}{
+	"v1": {},
+}
+
+// WithAPIVersion sends the X-Prometheus-API-Version header with given
+// version on every request. Servers that don't support API versioning
+// will ignore it.
+// The version reported by the server in responses is always recorded,
+// whether this is set or not, see APIVersion.
+func WithAPIVersion(version string) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.headers.Set(apiVersionHeader, version)
+	}
+}
+
+// apiVersionTracker records the API version reported by the server.
+type apiVersionTracker struct {
+	mtx     sync.Mutex
+	version string
+	// warned holds all unknown versions that were already logged.
+	warned map[string]struct{}
+}
+
+// observe records the API version from response headers. Unknown versions
+// are logged once per version, responses are still parsed as v1.
+func (vt *apiVersionTracker) observe(uri string, header http.Header) {
+	version := header.Get(apiVersionHeader)
+	if version == "" {
+		return
+	}
+
+	vt.mtx.Lock()
+	defer vt.mtx.Unlock()
+	vt.version = version
+	if _, ok := knownAPIVersions[version]; ok {
+		return
+	}
+	if _, ok := vt.warned[version]; ok {
+		return
+	}
+	if vt.warned == nil {
+		vt.warned = map[string]struct{}{}
+	}
+	vt.warned[version] = struct{}{}
+	log.Warn().
+		Str("uri", uri).
+		Str("version", version).
+		Msg("Prometheus server responded using an unknown API version, responses might not be parsed correctly")
+}
+
+// APIVersion returns the API version reported by the server in the
+// X-Prometheus-API-Version header of the most recent response.
+// It's empty if the server never reported it.
+func (prom *Prometheus) APIVersion() string {
+	prom.apiVersion.mtx.Lock()
+	defer prom.apiVersion.mtx.Unlock()
+	return prom.apiVersion.version
+}
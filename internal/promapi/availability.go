@@ -0,0 +1,50 @@
+package promapi
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// DefaultStaleness is the lookback delta Prometheus uses by default when
+// looking for the most recent sample of a series.
+const DefaultStaleness = time.Minute * 5
+
+// Availability returns the fraction of steps within the range of given
+// result where series had a value of 1. The value at each step is taken from
+// the most recent sample that's no older than staleness, the same way
+// Prometheus selects samples. Steps with no such sample count as unavailable.
+// Zero staleness means DefaultStaleness.
+// Values of the series must be sorted by timestamp. NaN is returned if the
+// range has no steps.
+func Availability(rqr *RangeQueryResult, series *model.SampleStream, step, staleness time.Duration) float64 {
+	if step <= 0 || rqr.End.Before(rqr.Start) {
+		return math.NaN()
+	}
+	if staleness <= 0 {
+		staleness = DefaultStaleness
+	}
+
+	var steps, up int
+	var idx int
+	values := series.Values
+	for ts := rqr.Start; !ts.After(rqr.End); ts = ts.Add(step) {
+		steps++
+		t := model.TimeFromUnixNano(ts.UnixNano())
+		for idx < len(values) && !values[idx].Timestamp.After(t) {
+			idx++
+		}
+		if idx == 0 {
+			continue
+		}
+		last := values[idx-1]
+		if t.Sub(last.Timestamp) >= staleness {
+			continue
+		}
+		if last.Value == 1 {
+			up++
+		}
+	}
+	return float64(up) / float64(steps)
+}
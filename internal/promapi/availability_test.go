@@ -0,0 +1,138 @@
+package promapi_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestAvailability(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+	ts := func(d time.Duration) model.Time {
+		return model.TimeFromUnixNano(start.Add(d).UnixNano())
+	}
+	values := func(step time.Duration, vals ...float64) []model.SamplePair {
+		pairs := make([]model.SamplePair, 0, len(vals))
+		for i, v := range vals {
+			if math.IsInf(v, -1) {
+				// -Inf marks a gap with no sample.
+				continue
+			}
+			pairs = append(pairs, model.SamplePair{Timestamp: ts(step * time.Duration(i)), Value: model.SampleValue(v)})
+		}
+		return pairs
+	}
+	gap := math.Inf(-1)
+
+	type testCaseT struct {
+		name      string
+		end       time.Duration
+		step      time.Duration
+		staleness time.Duration
+		values    []model.SamplePair
+		result    float64
+	}
+
+	testCases := []testCaseT{
+		{
+			name:   "always up",
+			end:    time.Minute * 9,
+			step:   time.Minute,
+			values: values(time.Minute, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1),
+			result: 1,
+		},
+		{
+			name:   "always down",
+			end:    time.Minute * 9,
+			step:   time.Minute,
+			values: values(time.Minute, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0),
+			result: 0,
+		},
+		{
+			name:   "zeros",
+			end:    time.Minute * 9,
+			step:   time.Minute,
+			values: values(time.Minute, 1, 0, 1, 1, 0, 1, 1, 1, 1, 0),
+			result: 0.7,
+		},
+		{
+			name:   "no samples",
+			end:    time.Minute * 9,
+			step:   time.Minute,
+			result: 0,
+		},
+		{
+			name:      "short gap within staleness",
+			end:       time.Minute * 9,
+			step:      time.Minute,
+			staleness: time.Minute * 3,
+			values:    values(time.Minute, 1, 1, gap, gap, 1, 1, 1, 1, 1, 1),
+			result:    1,
+		},
+		{
+			name:      "long gap over staleness",
+			end:       time.Minute * 9,
+			step:      time.Minute,
+			staleness: time.Minute * 2,
+			values:    values(time.Minute, 1, gap, gap, gap, gap, 1, 1, 1, 1, 1),
+			result:    0.7,
+		},
+		{
+			name:      "gap with a zero before it",
+			end:       time.Minute * 9,
+			step:      time.Minute,
+			staleness: time.Minute * 3,
+			values:    values(time.Minute, 1, 0, gap, gap, 1, 1, 1, 1, 1, 1),
+			result:    0.7,
+		},
+		{
+			name:   "default staleness",
+			end:    time.Minute * 19,
+			step:   time.Minute,
+			values: values(time.Minute, 1, gap, gap, gap, gap, gap, gap, gap, gap, gap, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1),
+			result: 0.75,
+		},
+		{
+			name:   "series starts late",
+			end:    time.Minute * 9,
+			step:   time.Minute,
+			values: values(time.Minute, gap, gap, gap, gap, gap, 1, 1, 1, 1, 1),
+			result: 0.5,
+		},
+		{
+			name:   "scrape interval longer than step",
+			end:    time.Minute * 9,
+			step:   time.Minute,
+			values: values(time.Minute*2, 1, 1, 0, 1, 1),
+			result: 0.8,
+		},
+		{
+			name:   "no steps",
+			end:    -time.Minute,
+			step:   time.Minute,
+			values: values(time.Minute, 1),
+			result: math.NaN(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rqr := promapi.RangeQueryResult{
+				Start: start,
+				End:   start.Add(tc.end),
+			}
+			series := &model.SampleStream{Metric: model.Metric{"__name__": "up"}, Values: tc.values}
+			result := promapi.Availability(&rqr, series, tc.step, tc.staleness)
+			if math.IsNaN(tc.result) {
+				require.True(t, math.IsNaN(result), "expected NaN, got %f", result)
+				return
+			}
+			require.InDelta(t, tc.result, result, 0.0001)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package promapi
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+)
+
+// earliestDataSteps is the maximum number of steps used by each HasData
+// query when searching for the earliest data, all steps are sent in
+// a single request.
+const earliestDataSteps = 100
+
+// EarliestData finds the oldest time between start and end where selector
+// returns any data, which can be used to check how far back a recording
+// rule was backfilled. It does a binary search using HasData, so it only
+// needs a few cheap queries even for long time ranges.
+// Returned time is at most resolution after the oldest sample.
+// Zero time is returned if there's no data in the whole range.
+func (p *Prometheus) EarliestData(ctx context.Context, selector string, start, end time.Time, resolution time.Duration) (time.Time, error) {
+	if _, err := parser.ParseMetricSelector(selector); err != nil {
+		return time.Time{}, fmt.Errorf("invalid selector %q: %w", selector, err)
+	}
+	if resolution < time.Second {
+		resolution = time.Second
+	}
+
+	lo, hi := start.UTC(), end.UTC()
+	ok, err := p.hasDataBetween(ctx, selector, lo, hi, resolution)
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+
+	for hi.Sub(lo) > resolution {
+		// Keep all windows a multiple of resolution, so every step is too.
+		half := hi.Sub(lo) / 2
+		half -= half % resolution
+		if half == 0 {
+			half = resolution
+		}
+		mid := lo.Add(half)
+		if ok, err = p.hasDataBetween(ctx, selector, lo, mid, resolution); err != nil {
+			return time.Time{}, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	log.Debug().
+		Str("uri", p.uri).
+		Str("selector", selector).
+		Str("earliest", hi.Format(time.RFC3339)).
+		Msg("Found earliest data")
+	return hi, nil
+}
+
+// hasDataBetween returns true if selector has any sample after lo and
+// before or at hi. Every step is a count_over_time covering the whole step,
+// so samples are never missed between steps. Steps are aligned to hi, so the
+// first step might also cover some time before lo, which is fine since
+// EarliestData only calls it once it knows there's no data before lo,
+// or with lo equal to the start of the search.
+func (p *Prometheus) hasDataBetween(ctx context.Context, selector string, lo, hi time.Time, resolution time.Duration) (bool, error) {
+	window := hi.Sub(lo)
+	step := window / earliestDataSteps
+	if rem := step % resolution; rem > 0 || step == 0 {
+		step += resolution - rem
+	}
+	if step > window {
+		step = window
+	}
+	steps := int64((window + step - 1) / step)
+	params := NewAbsoluteRange(hi.Add(-time.Duration(steps-1)*step), hi, step)
+	expr := fmt.Sprintf("count_over_time(%s[%s])", selector, model.Duration(step))
+	return p.HasData(ctx, expr, params, RangeQueryOptions{Alignment: StartAligned, MaxSlices: 1})
+}
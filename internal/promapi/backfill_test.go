@@ -0,0 +1,99 @@
+package promapi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestEarliestData(t *testing.T) {
+	queryRe := regexp.MustCompile(`^count_over_time\(([a-z_:]+)\[([0-9a-z]+)\]\)$`)
+	end := time.Date(2022, 6, 14, 12, 0, 0, 0, time.UTC)
+	// recorded_total has data since the cutoff, which is the only data
+	// there is, and missing_total has no data at all.
+	cutoff := end.Add(-time.Hour*24*3 - time.Minute*17 - time.Second*30)
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.AddInt32(&requests, 1)
+		m := queryRe.FindStringSubmatch(r.Form.Get("query"))
+		if m == nil {
+			t.Errorf("unexpected query: %s", r.Form.Get("query"))
+			w.WriteHeader(400)
+			return
+		}
+		rng, _ := model.ParseDuration(m[2])
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		stop, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+		if time.Duration(rng).Seconds() != step {
+			t.Errorf("range selector must cover the whole step, got %s for %fs step", m[2], step)
+		}
+
+		var values []string
+		if m[1] == "recorded_total" {
+			for ts := start; ts <= stop; ts += step {
+				if ts >= float64(cutoff.Unix()) {
+					values = append(values, fmt.Sprintf(`[%f,"1"]`, ts))
+				}
+			}
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		if len(values) == 0 {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[%s]}]}}`, strings.Join(values, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 4, 1000, 1000)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := end.Add(-time.Hour * 24 * 30)
+	for _, resolution := range []time.Duration{time.Minute, time.Minute * 5, time.Hour} {
+		t.Run(resolution.String(), func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			earliest, err := prom.EarliestData(context.Background(), "recorded_total", start, end, resolution)
+			require.NoError(t, err)
+			require.False(t, earliest.Before(cutoff), "%s is before data starts at %s", earliest, cutoff)
+			require.False(t, earliest.After(cutoff.Add(resolution)), "%s is more than %s after %s", earliest, resolution, cutoff)
+			require.Less(t, atomic.LoadInt32(&requests), int32(25), "binary search should only need a few queries")
+		})
+	}
+
+	t.Run("data before start", func(t *testing.T) {
+		earliest, err := prom.EarliestData(context.Background(), "recorded_total", cutoff.Add(time.Hour), end, time.Minute)
+		require.NoError(t, err)
+		require.False(t, earliest.After(cutoff.Add(time.Hour+time.Minute)))
+	})
+
+	t.Run("no data", func(t *testing.T) {
+		earliest, err := prom.EarliestData(context.Background(), "missing_total", start, end, time.Minute)
+		require.NoError(t, err)
+		require.True(t, earliest.IsZero())
+	})
+
+	t.Run("invalid selector", func(t *testing.T) {
+		_, err := prom.EarliestData(context.Background(), "sum(foo)", start, end, time.Minute)
+		require.ErrorContains(t, err, `invalid selector "sum(foo)": `)
+	})
+}
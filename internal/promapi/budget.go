@@ -0,0 +1,45 @@
+package promapi
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// countingReader counts read bytes and the time spent waiting for reads.
+// If budget is set then reads fail with ErrResultTooLarge once all readers
+// sharing it read more bytes than allowed.
+type countingReader struct {
+	r        io.Reader
+	n        int64
+	wait     time.Duration
+	budget   *byteBudget
+	exceeded bool
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	if cr.exceeded {
+		return 0, ErrResultTooLarge
+	}
+	start := time.Now()
+	n, err := cr.r.Read(p)
+	cr.wait += time.Since(start)
+	cr.n += int64(n)
+	if cr.budget != nil && !cr.budget.take(int64(n)) {
+		cr.exceeded = true
+		return n, ErrResultTooLarge
+	}
+	return n, err
+}
+
+// byteBudget is the number of bytes all slices of a query can read.
+type byteBudget struct {
+	limit int64
+	read  atomic.Int64
+}
+
+// take records n more bytes being read, it returns false if that puts
+// the total over the limit.
+func (bb *byteBudget) take(n int64) bool {
+	return bb.read.Add(n) <= bb.limit
+}
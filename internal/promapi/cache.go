@@ -0,0 +1,352 @@
+package promapi
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/klauspost/compress/zstd"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// CacheEntryInfo describes a single entry stored in the query cache.
+type CacheEntryInfo struct {
+	Key      string
+	Endpoint string
+	// Size is the approximate size of cached value in bytes.
+	// For compressed entries it's the size after compression.
+	Size int
+	// RawSize is the approximate size of cached value before compression,
+	// it's the same as Size for entries that are not compressed.
+	RawSize int
+	Age     time.Duration
+	// Idle is the time since the entry was last added or read.
+	Idle time.Duration
+	Hits int
+}
+
+type cacheEntry struct {
+	endpoint string
+	result   queryResult
+	added    time.Time
+	size     int
+	rawSize  int
+	// packed holds the compressed value of the result if compression is
+	// enabled, the value isn't kept in the result then.
+	packed     []byte
+	packedType string
+	hits       atomic.Int64
+	// lastUsed is the Unix time in nanoseconds when this entry was
+	// last added or read.
+	lastUsed atomic.Int64
+}
+
+// QueryCache wraps the LRU cache and tracks metadata of each entry.
+type QueryCache struct {
+	entries  *lru.ARCCache
+	compress bool
+
+	// mtx guards all fields used to enforce maxBytes.
+	mtx      sync.Mutex
+	maxBytes int
+	// sizes holds the size of every entry added since the last eviction,
+	// total is the sum of all sizes. Entries evicted by the LRU cache itself
+	// are only removed from sizes when total goes over maxBytes.
+	sizes map[string]int
+	total int
+}
+
+func NewQueryCache(size int) *QueryCache {
+	return NewBoundedQueryCache(size, 0)
+}
+
+// NewBoundedQueryCache creates a cache that holds up to size entries, just
+// like NewQueryCache, but it also limits the total size of all entries.
+// Once it goes over maxBytes least recently used entries are evicted until
+// it's back under the limit. Sizes are approximate, see CacheEntryInfo.
+// Zero maxBytes means no limit.
+func NewBoundedQueryCache(size, maxBytes int) *QueryCache {
+	entries, _ := lru.NewARC(size)
+	return &QueryCache{entries: entries, maxBytes: maxBytes, sizes: map[string]int{}}
+}
+
+// NewCompressedQueryCache creates a cache just like NewBoundedQueryCache,
+// but all values are stored compressed and decompressed every time they're
+// read. This uses less memory at the cost of extra CPU time, CacheEntryInfo
+// shows the size of each entry before and after compression.
+func NewCompressedQueryCache(size, maxBytes int) *QueryCache {
+	c := NewBoundedQueryCache(size, maxBytes)
+	c.compress = true
+	return c
+}
+
+func (c *QueryCache) get(key string, now time.Time) (queryResult, bool) {
+	val, ok := c.entries.Get(key)
+	if !ok {
+		return queryResult{}, false
+	}
+	e := val.(*cacheEntry)
+	if !e.result.expires.IsZero() && e.result.expires.Before(now) {
+		c.remove(key)
+		return queryResult{}, false
+	}
+	result := e.result
+	if e.packed != nil {
+		v, err := unpackValue(e.packedType, e.packed)
+		if err != nil {
+			c.remove(key)
+			return queryResult{}, false
+		}
+		result.value = v
+	}
+	e.hits.Add(1)
+	e.lastUsed.Store(now.UnixNano())
+	return result, true
+}
+
+func (c *QueryCache) add(key, endpoint string, result queryResult, now time.Time) {
+	e := &cacheEntry{
+		endpoint: endpoint,
+		result:   result,
+		added:    now,
+		size:     len(key) + sizeOf(result.value),
+	}
+	e.rawSize = e.size
+	if c.compress {
+		// Values that can't be compressed are stored as is.
+		if typ, packed, err := packValue(result.value); err == nil {
+			e.packed = packed
+			e.packedType = typ
+			e.result.value = nil
+			e.size = len(key) + len(packed)
+		}
+	}
+	e.lastUsed.Store(now.UnixNano())
+	c.entries.Add(key, e)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.total += e.size - c.sizes[key]
+	c.sizes[key] = e.size
+	if c.total > c.maxBytes {
+		c.evict(now)
+	}
+}
+
+// setMaxBytes changes the limit of the total size of all entries, evicting
+// entries if the cache is already over it.
+func (c *QueryCache) setMaxBytes(maxBytes int, now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.maxBytes = maxBytes
+	c.total = 0
+	c.sizes = map[string]int{}
+	for _, e := range c.info(now) {
+		c.sizes[e.Key] = e.Size
+		c.total += e.Size
+	}
+	if c.maxBytes > 0 && c.total > c.maxBytes {
+		c.evict(now)
+	}
+}
+
+func (c *QueryCache) remove(key string) {
+	c.entries.Remove(key)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.total -= c.sizes[key]
+	delete(c.sizes, key)
+}
+
+// evict removes least recently used entries until the total size of all
+// entries is not over maxBytes. It must be called with the lock held.
+func (c *QueryCache) evict(now time.Time) {
+	// Forget entries already evicted by the LRU cache first, those don't
+	// use any memory so there might be nothing else to evict.
+	for key, size := range c.sizes {
+		if !c.entries.Contains(key) {
+			c.total -= size
+			delete(c.sizes, key)
+		}
+	}
+	if c.total <= c.maxBytes {
+		return
+	}
+
+	for _, e := range c.evictionOrder(now) {
+		if c.total <= c.maxBytes {
+			break
+		}
+		c.entries.Remove(e.Key)
+		c.total -= c.sizes[e.Key]
+		delete(c.sizes, e.Key)
+	}
+}
+
+func (c *QueryCache) len() int {
+	return c.entries.Len()
+}
+
+func (c *QueryCache) purgeExpired(now time.Time) {
+	for _, key := range c.entries.Keys() {
+		if val, found := c.entries.Peek(key); found {
+			e := val.(*cacheEntry)
+			if !e.result.expires.IsZero() && e.result.expires.Before(now) {
+				c.remove(key.(string))
+			}
+		}
+	}
+}
+
+func (c *QueryCache) info(now time.Time) []CacheEntryInfo {
+	keys := c.entries.Keys()
+	entries := make([]CacheEntryInfo, 0, len(keys))
+	for _, key := range keys {
+		if val, found := c.entries.Peek(key); found {
+			e := val.(*cacheEntry)
+			entries = append(entries, CacheEntryInfo{
+				Key:      key.(string),
+				Endpoint: e.endpoint,
+				Size:     e.size,
+				RawSize:  e.rawSize,
+				Age:      now.Sub(e.added),
+				Idle:     now.Sub(time.Unix(0, e.lastUsed.Load())),
+				Hits:     int(e.hits.Load()),
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// evictionOrder returns details of all entries in the order they would be
+// evicted because of size pressure, least recently used first.
+func (c *QueryCache) evictionOrder(now time.Time) []CacheEntryInfo {
+	entries := c.info(now)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Idle > entries[j].Idle
+	})
+	return entries
+}
+
+var (
+	packEncoder, _ = zstd.NewWriter(nil)
+	packDecoder, _ = zstd.NewReader(nil)
+)
+
+// Samples are packed using gob instead of the JSON encoding of recorded
+// responses, since JSON turns staleness markers into regular NaN values.
+const (
+	packedVector = "vector+gob"
+	packedMatrix = "matrix+gob"
+)
+
+// packValue returns the compressed value together with its type.
+// Samples are encoded using gob, which keeps exact float values, all other
+// values use the same encoding as recorded responses.
+func packValue(v any) (typ string, packed []byte, err error) {
+	var data []byte
+	switch v.(type) {
+	case []model.Sample:
+		typ = packedVector
+		data, err = gobEncode(v)
+	case []model.SampleStream:
+		typ = packedMatrix
+		data, err = gobEncode(v)
+	default:
+		typ, data, err = encodeFixtureValue(v)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return typ, packEncoder.EncodeAll(data, nil), nil
+}
+
+func unpackValue(typ string, packed []byte) (any, error) {
+	data, err := packDecoder.DecodeAll(packed, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case packedVector:
+		var v []model.Sample
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+		return v, err
+	case packedMatrix:
+		var v []model.SampleStream
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+		return v, err
+	default:
+		return decodeFixtureValue(typ, data)
+	}
+}
+
+func gobEncode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sizeOf returns approximate memory usage of a cached value.
+func sizeOf(v any) (size int) {
+	switch val := v.(type) {
+	case string:
+		return len(val)
+	case []string:
+		for _, s := range val {
+			size += len(s)
+		}
+	case []model.SampleStream:
+		for _, s := range val {
+			size += sizeOfMetric(s.Metric) + len(s.Values)*16
+		}
+	case []model.Sample:
+		for _, s := range val {
+			size += sizeOfMetric(s.Metric) + 16
+		}
+	case v1.FlagsResult:
+		for k, v := range val {
+			size += len(k) + len(v)
+		}
+	case map[string][]v1.Metadata:
+		for k, md := range val {
+			size += len(k)
+			for _, m := range md {
+				size += len(m.Type) + len(m.Help) + len(m.Unit)
+			}
+		}
+	case []v1.RuleGroup:
+		for _, g := range val {
+			size += len(g.Name) + len(g.File)
+			for _, r := range g.Rules {
+				switch rule := r.(type) {
+				case v1.RecordingRule:
+					size += len(rule.Name) + len(rule.Query) + sizeOfMetric(model.Metric(rule.Labels))
+				case v1.AlertingRule:
+					size += len(rule.Name) + len(rule.Query) + sizeOfMetric(model.Metric(rule.Labels)) + sizeOfMetric(model.Metric(rule.Annotations))
+				}
+			}
+		}
+	}
+	return size
+}
+
+func sizeOfMetric(m model.Metric) (size int) {
+	for k, v := range m {
+		size += len(k) + len(v)
+	}
+	return size
+}
@@ -0,0 +1,357 @@
+package promapi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestCacheEntries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/status/flags":
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"storage.tsdb.retention.time": "1d"}}`))
+		case "/api/v1/query":
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"1"},"value":[1614859502.068,"1"]}]}}`))
+		default:
+			w.WriteHeader(400)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"unhandled path"}`))
+		}
+	}))
+	defer srv.Close()
+
+	now := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	var mtx sync.Mutex
+	clock := func() time.Time {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return now
+	}
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithClock(clock))
+	prom.StartWorkers()
+	defer prom.Close()
+
+	require.Empty(t, prom.CacheEntries())
+
+	for i := 0; i < 3; i++ {
+		_, err := prom.Flags(context.Background())
+		require.NoError(t, err)
+	}
+
+	mtx.Lock()
+	now = now.Add(time.Minute)
+	mtx.Unlock()
+
+	_, err := prom.Query(context.Background(), "up")
+	require.NoError(t, err)
+
+	_, err = prom.Query(context.Background(), "error")
+	require.NoError(t, err)
+
+	mtx.Lock()
+	now = now.Add(time.Minute)
+	mtx.Unlock()
+
+	entries := prom.CacheEntries()
+	require.Len(t, entries, 3)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Endpoint != entries[j].Endpoint {
+			return entries[i].Endpoint < entries[j].Endpoint
+		}
+		return entries[i].Hits < entries[j].Hits
+	})
+
+	require.Equal(t, "/api/v1/query", entries[0].Endpoint)
+	require.Equal(t, 0, entries[0].Hits)
+	require.Equal(t, time.Minute, entries[0].Age)
+	require.Greater(t, entries[0].Size, len(entries[0].Key))
+
+	require.Equal(t, "/api/v1/status/flags", entries[2].Endpoint)
+	require.Equal(t, 2, entries[2].Hits)
+	require.Equal(t, time.Minute*2, entries[2].Age)
+	require.Equal(t, len(entries[2].Key)+len("storage.tsdb.retention.time")+len("1d"), entries[2].Size)
+	for _, e := range entries {
+		require.NotEmpty(t, e.Key)
+	}
+}
+
+func TestCacheServerIdentity(t *testing.T) {
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get("X-Scope-OrgID")
+		mtx.Lock()
+		requests[tenant]++
+		mtx.Unlock()
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"tenant":"` + tenant + `"},"value":[1614859502.068,"1"]}]}}`))
+	}))
+	defer srv.Close()
+
+	cache := promapi.NewQueryCache(100)
+	newProm := func(headers map[string]string) *promapi.Prometheus {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+			promapi.WithCache(cache),
+			promapi.WithHeaders(headers),
+		)
+		prom.StartWorkers()
+		t.Cleanup(prom.Close)
+		return prom
+	}
+
+	foo := newProm(map[string]string{"X-Scope-OrgID": "foo", "Authorization": "Bearer 1"})
+	bar := newProm(map[string]string{"X-Scope-OrgID": "bar"})
+	fooRotated := newProm(map[string]string{"X-Scope-OrgID": "foo", "Authorization": "Bearer 2"})
+
+	for _, tc := range []struct {
+		prom   *promapi.Prometheus
+		tenant string
+	}{
+		{prom: foo, tenant: "foo"},
+		{prom: bar, tenant: "bar"},
+		{prom: fooRotated, tenant: "foo"},
+		{prom: bar, tenant: "bar"},
+	} {
+		qr, err := tc.prom.Query(context.Background(), "up")
+		require.NoError(t, err)
+		require.Len(t, qr.Series, 1)
+		require.Equal(t, tc.tenant, string(qr.Series[0].Metric["tenant"]))
+	}
+
+	require.Equal(t, map[string]int{"foo": 1, "bar": 1}, requests, "servers with different tenants shouldn't share cache")
+	require.Len(t, foo.CacheEntries(), 2)
+}
+
+func TestCacheNamespace(t *testing.T) {
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	newServer := func(env string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			requests[env]++
+			mtx.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"env":"` + env + `"},"value":[1614859502.068,"1"]}]}}`))
+		}))
+	}
+	prod := newServer("prod")
+	defer prod.Close()
+	staging := newServer("staging")
+	defer staging.Close()
+
+	cache := promapi.NewQueryCache(100)
+	newProm := func(uri string, opts ...promapi.PrometheusOption) *promapi.Prometheus {
+		prom := promapi.NewPrometheus("test", uri, time.Second, 1, 100, 100, append(opts, promapi.WithCache(cache))...)
+		prom.StartWorkers()
+		t.Cleanup(prom.Close)
+		return prom
+	}
+
+	query := func(prom *promapi.Prometheus) string {
+		qr, err := prom.Query(context.Background(), "up")
+		require.NoError(t, err)
+		require.Len(t, qr.Series, 1)
+		return string(qr.Series[0].Metric["env"])
+	}
+
+	t.Run("default", func(t *testing.T) {
+		require.Equal(t, "prod", query(newProm(prod.URL)))
+		require.Equal(t, "staging", query(newProm(staging.URL)))
+		require.Equal(t, map[string]int{"prod": 1, "staging": 1}, requests)
+	})
+
+	t.Run("different namespaces", func(t *testing.T) {
+		require.Equal(t, "prod", query(newProm(prod.URL, promapi.WithCacheNamespace("prod"))))
+		require.Equal(t, "staging", query(newProm(staging.URL, promapi.WithCacheNamespace("staging"))))
+		require.Equal(t, map[string]int{"prod": 2, "staging": 2}, requests, "servers with different namespaces shouldn't share cache")
+	})
+
+	t.Run("same namespace", func(t *testing.T) {
+		require.Equal(t, "prod", query(newProm(prod.URL, promapi.WithCacheNamespace("prod"))))
+		require.Equal(t, "prod", query(newProm(staging.URL, promapi.WithCacheNamespace("prod"))), "result should be served from cache")
+		require.Equal(t, map[string]int{"prod": 2, "staging": 2}, requests)
+	})
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"1"},"value":[1614859502.068,"1"]}]}}`))
+	}))
+	defer srv.Close()
+
+	now := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	var mtx sync.Mutex
+	clock := func() time.Time {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return now
+	}
+	tick := func() {
+		mtx.Lock()
+		now = now.Add(time.Second)
+		mtx.Unlock()
+	}
+
+	// Every cached result is a 40 byte key plus 25 bytes of value,
+	// so the cache can only hold two of them.
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithClock(clock), promapi.WithCacheMaxBytes(150))
+	prom.StartWorkers()
+	defer prom.Close()
+
+	query := func(expr string) {
+		_, err := prom.Query(context.Background(), expr)
+		require.NoError(t, err)
+		tick()
+	}
+
+	query("a")
+	query("b")
+	entries := prom.CacheEntries()
+	require.Len(t, entries, 2)
+	require.Equal(t, 65, entries[0].Size)
+
+	// Read a again so b becomes the least recently used result.
+	query("a")
+	order := prom.CacheEvictionOrder()
+	require.Len(t, order, 2)
+	require.Equal(t, time.Second*2, order[0].Idle)
+	require.Equal(t, time.Second, order[1].Idle)
+	evicted := order[0].Key
+
+	query("c")
+	entries = prom.CacheEntries()
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		require.NotEqual(t, evicted, e.Key, "least recently used result should be evicted")
+	}
+	order = prom.CacheEvictionOrder()
+	require.Equal(t, time.Second*2, order[0].Idle)
+	require.Equal(t, time.Second, order[1].Idle)
+}
+
+func TestCacheMaxBytesSharedCache(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"1"},"value":[1614859502.068,"1"]}]}}`))
+	}))
+	defer srv.Close()
+
+	type testCaseT struct {
+		cache   *promapi.QueryCache
+		opts    []promapi.PrometheusOption
+		entries int
+	}
+
+	testCases := []testCaseT{
+		{
+			// Limit is applied to the shared cache.
+			cache:   promapi.NewQueryCache(100),
+			opts:    []promapi.PrometheusOption{promapi.WithCacheMaxBytes(150)},
+			entries: 2,
+		},
+		{
+			// Entries evicted because of the size limit don't count
+			// towards the byte limit.
+			cache:   promapi.NewBoundedQueryCache(2, 200),
+			entries: 2,
+		},
+		{
+			cache:   promapi.NewBoundedQueryCache(100, 200),
+			entries: 3,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			opts := append([]promapi.PrometheusOption{promapi.WithCache(tc.cache)}, tc.opts...)
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, opts...)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			for _, expr := range []string{"a", "b", "c", "d", "e"} {
+				_, err := prom.Query(context.Background(), expr)
+				require.NoError(t, err)
+			}
+			require.Len(t, prom.CacheEntries(), tc.entries)
+		})
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			values := make([]string, 0, 60)
+			for i := 0; i < 60; i++ {
+				values = append(values, fmt.Sprintf(`[%d,"%d"]`, 1655164800+i*60, i%3))
+			}
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"1"},"values":[%s]},
+				{"metric":{"instance":"2"},"values":[%s]}
+			]}}`, strings.Join(values, ","), strings.Join(values, ","))))
+		case "/api/v1/status/flags":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"storage.tsdb.retention.time": "1d"}}`))
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+
+	query := func(prom *promapi.Prometheus) (*promapi.RangeQueryResult, *promapi.FlagsResult) {
+		qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		flags, err := prom.Flags(context.Background())
+		require.NoError(t, err)
+		return qr, flags
+	}
+
+	plain := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	plain.StartWorkers()
+	defer plain.Close()
+	expectedRange, expectedFlags := query(plain)
+	for _, e := range plain.CacheEntries() {
+		require.Equal(t, e.Size, e.RawSize)
+	}
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithCacheCompression())
+	prom.StartWorkers()
+	defer prom.Close()
+	for i := 0; i < 3; i++ {
+		qr, flags := query(prom)
+		require.Equal(t, expectedRange.Samples, qr.Samples)
+		require.Equal(t, expectedFlags.Flags, flags.Flags)
+	}
+
+	entries := prom.CacheEntries()
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		require.Equal(t, 2, e.Hits)
+		if e.Endpoint == "/api/v1/query_range" {
+			require.Less(t, e.Size, e.RawSize, "compressed entry should be smaller")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package promapi
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+)
+
+// CacheKeyPart is a single value used to calculate a cache key.
+type CacheKeyPart struct {
+	Name  string
+	Value string
+}
+
+// CacheKeyDescription holds a cache key together with all values used
+// to calculate it, in the order they are hashed.
+type CacheKeyDescription struct {
+	Key   string
+	Parts []CacheKeyPart
+}
+
+// hashCacheKeyParts returns the cache key for given parts, values are
+// hashed one per line.
+func hashCacheKeyParts(parts []CacheKeyPart) string {
+	h := sha1.New()
+	for i, part := range parts {
+		if i > 0 {
+			_, _ = io.WriteString(h, "\n")
+		}
+		_, _ = io.WriteString(h, part.Value)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// DescribeCacheKey returns cache keys that would be used for every slice
+// of a range query, in the same order as slices, together with all values
+// used to calculate each of them. It's meant for debugging why two queries
+// do or don't share cached results. The query isn't sent to Prometheus,
+// but the expression is rewritten and the time range is adjusted for clock
+// skew the same way it would be when running it.
+func (p *Prometheus) DescribeCacheKey(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions) ([]CacheKeyDescription, error) {
+	plan := p.newRangePlan(ctx, params, opts)
+	expr, err := p.rangeExpr(expr, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]CacheKeyDescription, 0, len(plan.slices))
+	for i := range plan.slices {
+		parts := plan.query(p, ctx, expr, "", i).cacheKeyParts()
+		keys = append(keys, CacheKeyDescription{Key: hashCacheKeyParts(parts), Parts: parts})
+	}
+	return keys, nil
+}
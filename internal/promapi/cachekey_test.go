@@ -0,0 +1,74 @@
+package promapi_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestDescribeCacheKey(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+		promapi.WithCacheNamespace("tenant-1"),
+		promapi.WithLookbackDelta(time.Minute*10),
+	)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*3), time.Minute)
+	opts := promapi.RangeQueryOptions{Stats: true, Engine: "thanos"}
+
+	keys, err := prom.DescribeCacheKey(context.Background(), "up", params, opts)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, []promapi.CacheKeyPart{
+		{Name: "version", Value: "1"},
+		{Name: "namespace", Value: "tenant-1"},
+		{Name: "endpoint", Value: "/api/v1/query_range"},
+		{Name: "expr", Value: "up"},
+		{Name: "start", Value: "2022-06-14T00:00:00Z"},
+		// End is rounded to the step.
+		{Name: "end", Value: "2022-06-14T02:00:00Z"},
+		{Name: "step", Value: "1m"},
+		{Name: "lookback", Value: "10m"},
+		{Name: "stats", Value: "stats"},
+		{Name: "engine", Value: "engine=thanos"},
+	}, keys[0].Parts)
+	require.Equal(t, "2022-06-14T02:00:00Z", keys[1].Parts[4].Value)
+	require.Equal(t, "2022-06-14T03:00:00Z", keys[1].Parts[5].Value)
+
+	for _, key := range keys {
+		values := make([]string, 0, len(key.Parts))
+		for _, part := range key.Parts {
+			values = append(values, part.Value)
+		}
+		require.Equal(t, fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(values, "\n")))), key.Key)
+	}
+
+	_, err = prom.RangeQuery(context.Background(), "up", params, opts)
+	require.NoError(t, err)
+	entries := prom.CacheEntries()
+	cached := make([]string, 0, len(entries))
+	for _, e := range entries {
+		cached = append(cached, e.Key)
+	}
+	described := []string{keys[0].Key, keys[1].Key}
+	sort.Strings(described)
+	require.Equal(t, described, cached, "described keys should match keys used by RangeQuery")
+}
@@ -0,0 +1,56 @@
+package promapi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/rs/zerolog/log"
+)
+
+// watchCancel returns a function that must be called once the response
+// was handled, finished tells if the whole response was received. If it
+// wasn't and ctx is done then the query is cancelled on the server, a query
+// that completed before ctx was cancelled is left alone. It does nothing
+// unless WithQueryCancelEndpoint was used and the response includes a
+// query ID.
+func (prom *Prometheus) watchCancel(ctx context.Context, resp *http.Response) (stop func(finished bool)) {
+	if prom.cancelPath == "" {
+		return func(bool) {}
+	}
+	id := resp.Header.Get(prom.cancelHeader)
+	if id == "" {
+		return func(bool) {}
+	}
+
+	return func(finished bool) {
+		// Reading the body fails as soon as ctx is cancelled, so this runs
+		// right after the query was interrupted.
+		if finished || ctx.Err() == nil {
+			return
+		}
+		go prom.cancelQuery(id)
+	}
+}
+
+// cancelQuery asks the server to stop running the query with given ID.
+// Errors are only logged since the query was already abandoned.
+func (prom *Prometheus) cancelQuery(id string) {
+	log.Debug().Str("uri", prom.uri).Str("id", id).Msg("Cancelling query on the server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), prom.timeout)
+	defer cancel()
+
+	args := url.Values{}
+	args.Set("id", id)
+	resp, err := prom.doRequest(ctx, http.MethodPost, prom.cancelPath, args, nil)
+	if err != nil {
+		log.Debug().Err(err).Str("uri", prom.uri).Str("id", id).Msg("Failed to cancel query on the server")
+		return
+	}
+	defer resp.Body.Close()
+	dummyReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		log.Debug().Str("uri", prom.uri).Str("id", id).Int("code", resp.StatusCode).Msg("Failed to cancel query on the server")
+	}
+}
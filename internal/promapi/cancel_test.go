@@ -0,0 +1,122 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestQueryCancelEndpoint(t *testing.T) {
+	cancelled := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		switch r.URL.Path {
+		case "/api/v1/cancel":
+			cancelled <- r.Form.Get("id")
+			w.WriteHeader(200)
+			return
+		case "/api/v1/query":
+			if r.Form.Get("query") == "fast" {
+				w.Header().Set("X-Query-ID", "fast-id")
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+				return
+			}
+		}
+		// Send headers with the query ID and block until the client goes away.
+		w.Header().Set("X-Query-ID", r.Form.Get("query")+"-id")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(`{"status":"success",`))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	type testCaseT struct {
+		name string
+		opts []promapi.PrometheusOption
+		run  func(ctx context.Context, prom *promapi.Prometheus) error
+		id   string
+		ok   bool
+	}
+
+	testCases := []testCaseT{
+		{
+			name: "disabled",
+			run: func(ctx context.Context, prom *promapi.Prometheus) error {
+				_, err := prom.Query(ctx, "slow")
+				return err
+			},
+		},
+		{
+			name: "instant",
+			opts: []promapi.PrometheusOption{promapi.WithQueryCancelEndpoint("X-Query-ID", "/api/v1/cancel")},
+			run: func(ctx context.Context, prom *promapi.Prometheus) error {
+				_, err := prom.Query(ctx, "slow")
+				return err
+			},
+			id: "slow-id",
+		},
+		{
+			name: "range",
+			opts: []promapi.PrometheusOption{promapi.WithQueryCancelEndpoint("X-Query-ID", "/api/v1/cancel")},
+			run: func(ctx context.Context, prom *promapi.Prometheus) error {
+				start := time.Unix(1655164800, 0)
+				_, err := prom.RangeQuery(ctx, "range", promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute), promapi.RangeQueryOptions{})
+				return err
+			},
+			id: "range-id",
+		},
+		{
+			name: "finished",
+			opts: []promapi.PrometheusOption{promapi.WithQueryCancelEndpoint("X-Query-ID", "/api/v1/cancel")},
+			run: func(ctx context.Context, prom *promapi.Prometheus) error {
+				_, err := prom.Query(ctx, "fast")
+				return err
+			},
+			ok: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100, tc.opts...)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+			err := tc.run(ctx, prom)
+			if tc.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+
+			if tc.id == "" {
+				select {
+				case id := <-cancelled:
+					t.Fatalf("cancel endpoint was called with %q", id)
+				case <-time.After(time.Millisecond * 300):
+				}
+				return
+			}
+
+			select {
+			case id := <-cancelled:
+				require.Equal(t, tc.id, id)
+			case <-time.After(time.Second * 5):
+				t.Fatal("cancel endpoint wasn't called")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package promapi
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// Checksum returns a hash of all series and values in the result.
+// It doesn't depend on the order of series, so two results with the same
+// data always have the same checksum, regardless of which server or
+// which order of slices they came from.
+func (rqr *RangeQueryResult) Checksum() string {
+	series := make([]*model.SampleStream, len(rqr.Samples))
+	copy(series, rqr.Samples)
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Metric.String() < series[j].Metric.String()
+	})
+
+	h := sha1.New()
+	buf := make([]byte, 8)
+	for _, s := range series {
+		_, _ = io.WriteString(h, s.Metric.String())
+		_, _ = io.WriteString(h, "\n")
+		for _, v := range s.Values {
+			binary.LittleEndian.PutUint64(buf, uint64(v.Timestamp))
+			_, _ = h.Write(buf)
+			f := float64(v.Value)
+			if math.IsNaN(f) {
+				// NaN can have many different bit patterns.
+				f = math.NaN()
+			}
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
+			_, _ = h.Write(buf)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Equivalent returns true if both results have the same set of series and
+// every series has values at the same timestamps, with each pair of values
+// differing by no more than tol. Order of series doesn't matter.
+// NaN values are only equal to other NaN values and infinite values are
+// only equal to infinite values with the same sign.
+func Equivalent(a, b *RangeQueryResult, tol float64) bool {
+	if len(a.Samples) != len(b.Samples) {
+		return false
+	}
+
+	index := make(map[model.Fingerprint][]*model.SampleStream, len(b.Samples))
+	for _, s := range b.Samples {
+		fp := s.Metric.Fingerprint()
+		index[fp] = append(index[fp], s)
+	}
+
+	for _, sa := range a.Samples {
+		var sb *model.SampleStream
+		for _, s := range index[sa.Metric.Fingerprint()] {
+			if s.Metric.Equal(sa.Metric) {
+				sb = s
+				break
+			}
+		}
+		if sb == nil || !equivalentValues(sa.Values, sb.Values, tol) {
+			return false
+		}
+	}
+	return true
+}
+
+func equivalentValues(a, b []model.SamplePair, tol float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Timestamp != b[i].Timestamp {
+			return false
+		}
+		va, vb := float64(a[i].Value), float64(b[i].Value)
+		switch {
+		case math.IsNaN(va) || math.IsNaN(vb):
+			if math.IsNaN(va) != math.IsNaN(vb) {
+				return false
+			}
+		case math.IsInf(va, 0) || math.IsInf(vb, 0):
+			if va != vb {
+				return false
+			}
+		case math.Abs(va-vb) > tol:
+			return false
+		}
+	}
+	return true
+}
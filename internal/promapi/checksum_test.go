@@ -0,0 +1,174 @@
+package promapi_test
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestChecksum(t *testing.T) {
+	foo := &model.SampleStream{
+		Metric: model.Metric{"instance": "foo"},
+		Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: model.SampleValue(math.NaN())}},
+	}
+	bar := &model.SampleStream{
+		Metric: model.Metric{"instance": "bar"},
+		Values: []model.SamplePair{{Timestamp: 1000, Value: 2}},
+	}
+
+	a := promapi.RangeQueryResult{Samples: []*model.SampleStream{foo, bar}}
+	b := promapi.RangeQueryResult{Samples: []*model.SampleStream{bar, foo}}
+	require.Equal(t, a.Checksum(), b.Checksum(), "checksum shouldn't depend on series order")
+	require.Equal(t, []*model.SampleStream{foo, bar}, a.Samples, "checksum shouldn't modify the result")
+
+	c := promapi.RangeQueryResult{Samples: []*model.SampleStream{foo}}
+	require.NotEqual(t, a.Checksum(), c.Checksum())
+
+	empty := promapi.RangeQueryResult{}
+	require.NotEqual(t, a.Checksum(), empty.Checksum())
+}
+
+func TestEquivalent(t *testing.T) {
+	series := func(instance string, values ...float64) *model.SampleStream {
+		s := &model.SampleStream{Metric: model.Metric{"instance": model.LabelValue(instance)}}
+		for i, v := range values {
+			s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(1000 * (i + 1)), Value: model.SampleValue(v)})
+		}
+		return s
+	}
+	result := func(series ...*model.SampleStream) *promapi.RangeQueryResult {
+		return &promapi.RangeQueryResult{Samples: series}
+	}
+
+	type testCaseT struct {
+		name       string
+		a          *promapi.RangeQueryResult
+		b          *promapi.RangeQueryResult
+		tol        float64
+		equivalent bool
+	}
+
+	testCases := []testCaseT{
+		{
+			name:       "empty",
+			a:          result(),
+			b:          result(),
+			equivalent: true,
+		},
+		{
+			name:       "equal",
+			a:          result(series("foo", 1, 2), series("bar", 3)),
+			b:          result(series("bar", 3), series("foo", 1, 2)),
+			equivalent: true,
+		},
+		{
+			name:       "within tolerance",
+			a:          result(series("foo", 1, 2)),
+			b:          result(series("foo", 1.0001, 1.9999)),
+			tol:        0.001,
+			equivalent: true,
+		},
+		{
+			name: "drifted",
+			a:    result(series("foo", 1, 2)),
+			b:    result(series("foo", 1, 2.1)),
+			tol:  0.001,
+		},
+		{
+			name:       "NaN",
+			a:          result(series("foo", math.NaN(), math.Inf(1))),
+			b:          result(series("foo", math.NaN(), math.Inf(1))),
+			equivalent: true,
+		},
+		{
+			name: "NaN and value",
+			a:    result(series("foo", math.NaN())),
+			b:    result(series("foo", 1)),
+			tol:  math.Inf(1),
+		},
+		{
+			name: "different infinity",
+			a:    result(series("foo", math.Inf(1))),
+			b:    result(series("foo", math.Inf(-1))),
+			tol:  math.Inf(1),
+		},
+		{
+			name: "missing series",
+			a:    result(series("foo", 1), series("bar", 1)),
+			b:    result(series("foo", 1)),
+		},
+		{
+			name: "different series",
+			a:    result(series("foo", 1)),
+			b:    result(series("bar", 1)),
+		},
+		{
+			name: "missing value",
+			a:    result(series("foo", 1, 2)),
+			b:    result(series("foo", 1)),
+		},
+		{
+			name: "different timestamps",
+			a:    result(series("foo", 1)),
+			b: result(&model.SampleStream{
+				Metric: model.Metric{"instance": "foo"},
+				Values: []model.SamplePair{{Timestamp: 2000, Value: 1}},
+			}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.equivalent, promapi.Equivalent(tc.a, tc.b, tc.tol))
+			require.Equal(t, tc.equivalent, promapi.Equivalent(tc.b, tc.a, tc.tol))
+		})
+	}
+}
+
+func TestRangeSignificantFigures(t *testing.T) {
+	newServer := func(values string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"},"values":[` + values + `]}]}}`))
+		}))
+	}
+	// Both replicas return the same values, but with different floating point noise.
+	replica1 := newServer(`[1655164800,"0.30000000000000004"],[1655164860,"1234.5678"],[1655164920,"0"],[1655164980,"NaN"]`)
+	defer replica1.Close()
+	replica2 := newServer(`[1655164800,"0.29999999999999993"],[1655164860,"1234.5678000001"],[1655164920,"0"],[1655164980,"NaN"]`)
+	defer replica2.Close()
+
+	start := time.Unix(1655164800, 0)
+	rr := promapi.NewAbsoluteRange(start, start.Add(time.Minute*3), time.Minute)
+
+	query := func(uri string, figures int) *promapi.RangeQueryResult {
+		prom := promapi.NewPrometheus("test", uri, time.Second, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+		qr, err := prom.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{SignificantFigures: figures})
+		require.NoError(t, err)
+		require.Len(t, qr.Samples, 1)
+		return qr
+	}
+
+	require.NotEqual(t, query(replica1.URL, 0).Checksum(), query(replica2.URL, 0).Checksum(), "values are not rounded by default")
+
+	qr1 := query(replica1.URL, 6)
+	qr2 := query(replica2.URL, 6)
+	require.Equal(t, qr1.Checksum(), qr2.Checksum())
+	require.Equal(t, qr1.Samples[0].Values[:3], qr2.Samples[0].Values[:3])
+	require.Equal(t, model.SampleValue(0.3), qr1.Samples[0].Values[0].Value)
+	require.Equal(t, model.SampleValue(1234.57), qr1.Samples[0].Values[1].Value)
+	require.Equal(t, model.SampleValue(0), qr1.Samples[0].Values[2].Value)
+	require.True(t, math.IsNaN(float64(qr1.Samples[0].Values[3].Value)))
+
+	require.Equal(t, model.SampleValue(1000), query(replica1.URL, 1).Samples[0].Values[1].Value)
+}
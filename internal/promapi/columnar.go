@@ -0,0 +1,48 @@
+package promapi
+
+import (
+	"math"
+	"sort"
+)
+
+// Columnar returns all values in the result aligned to a common timestamp
+// axis, which is the sorted list of all timestamps used by any series,
+// in milliseconds. Each series is keyed by its metric string and has one
+// value for every timestamp, timestamps without a value are set to NaN.
+func (rqr *RangeQueryResult) Columnar() (timestamps []int64, series map[string][]float64) {
+	seen := map[int64]struct{}{}
+	for _, s := range rqr.Samples {
+		for _, v := range s.Values {
+			seen[int64(v.Timestamp)] = struct{}{}
+		}
+	}
+
+	timestamps = make([]int64, 0, len(seen))
+	for ts := range seen {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	index := make(map[int64]int, len(timestamps))
+	for i, ts := range timestamps {
+		index[ts] = i
+	}
+
+	series = make(map[string][]float64, len(rqr.Samples))
+	for _, s := range rqr.Samples {
+		key := s.Metric.String()
+		values, ok := series[key]
+		if !ok {
+			values = make([]float64, len(timestamps))
+			for i := range values {
+				values[i] = math.NaN()
+			}
+			series[key] = values
+		}
+		for _, v := range s.Values {
+			values[index[int64(v.Timestamp)]] = float64(v.Value)
+		}
+	}
+
+	return timestamps, series
+}
@@ -0,0 +1,87 @@
+package promapi_test
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func requireColumn(t *testing.T, expected, got []float64) {
+	t.Helper()
+	require.Len(t, got, len(expected))
+	for i := range expected {
+		if math.IsNaN(expected[i]) {
+			require.True(t, math.IsNaN(got[i]), "value %d should be NaN, got %v", i, got[i])
+		} else {
+			require.Equal(t, expected[i], got[i], "value %d", i)
+		}
+	}
+}
+
+func TestColumnar(t *testing.T) {
+	nan := math.NaN()
+
+	t.Run("empty", func(t *testing.T) {
+		rqr := promapi.RangeQueryResult{}
+		timestamps, series := rqr.Columnar()
+		require.Empty(t, timestamps)
+		require.Empty(t, series)
+	})
+
+	t.Run("gaps", func(t *testing.T) {
+		rqr := promapi.RangeQueryResult{Samples: []*model.SampleStream{
+			{
+				Metric: model.Metric{"instance": "a"},
+				Values: []model.SamplePair{{Timestamp: 3000, Value: 3}, {Timestamp: 4000, Value: 4}},
+			},
+			{
+				Metric: model.Metric{"instance": "b"},
+				Values: []model.SamplePair{{Timestamp: 1000, Value: 10}, {Timestamp: 3000, Value: 30}, {Timestamp: 5000, Value: 50}},
+			},
+			{
+				Metric: model.Metric{"instance": "c"},
+				Values: []model.SamplePair{},
+			},
+		}}
+
+		timestamps, series := rqr.Columnar()
+		require.Equal(t, []int64{1000, 3000, 4000, 5000}, timestamps)
+		require.Len(t, series, 3)
+		requireColumn(t, []float64{nan, 3, 4, nan}, series[`{instance="a"}`])
+		requireColumn(t, []float64{10, 30, nan, 50}, series[`{instance="b"}`])
+		requireColumn(t, []float64{nan, nan, nan, nan}, series[`{instance="c"}`])
+	})
+
+	t.Run("query", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__name__":"up","instance":"1"},"values":[[1655164800,"1"],[1655164860,"1"],[1655164920,"0"]]},
+				{"metric":{"__name__":"up","instance":"2"},"values":[[1655164860,"1"],[1655164980,"1"]]}
+			]}}`))
+		}))
+		defer srv.Close()
+
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		start := time.Unix(1655164800, 0)
+		qr, err := prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(start, start.Add(time.Minute*3), time.Minute), promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+
+		timestamps, series := qr.Columnar()
+		require.Equal(t, []int64{1655164800000, 1655164860000, 1655164920000, 1655164980000}, timestamps)
+		require.Len(t, series, 2)
+		requireColumn(t, []float64{1, 1, 0, nan}, series[`up{instance="1"}`])
+		requireColumn(t, []float64{nan, 1, nan, 1}, series[`up{instance="2"}`])
+	})
+}
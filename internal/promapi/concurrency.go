@@ -0,0 +1,133 @@
+package promapi
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// concurrencyLimiter adjusts the number of queries that can run at the same
+// time based on how the server responds, using AIMD (additive increase,
+// multiplicative decrease). Responses telling us that the server is
+// overloaded halve the limit, while the limit grows by one after a full
+// limit worth of successful responses. The limit never goes below 1 or
+// above the number of workers.
+// Like with TCP congestion control the limit is only halved once per round
+// trip, responses to requests that were sent before the last decrease don't
+// change it, so a burst of errors from a single overload halves it once.
+type concurrencyLimiter struct {
+	mu        sync.Mutex
+	max       int
+	limit     int
+	running   int
+	successes int
+	// decreased is the time the limit was last halved.
+	decreased time.Time
+	// changed is closed and replaced every time a slot might be available.
+	changed chan struct{}
+	closed  bool
+}
+
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	return &concurrencyLimiter{max: max, limit: max, changed: make(chan struct{})}
+}
+
+// acquire blocks until there's less queries running than the limit allows.
+// It returns an error if ctx is cancelled or the limiter is closed first.
+func (cl *concurrencyLimiter) acquire(ctx context.Context) error {
+	if cl == nil {
+		return nil
+	}
+
+	for {
+		cl.mu.Lock()
+		if cl.closed {
+			cl.mu.Unlock()
+			return errWorkersStopped
+		}
+		if cl.running < cl.limit {
+			cl.running++
+			cl.mu.Unlock()
+			return nil
+		}
+		changed := cl.changed
+		cl.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (cl *concurrencyLimiter) release() {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.running--
+	cl.notify()
+}
+
+// close wakes up everything waiting in acquire, all future acquire calls
+// return an error.
+func (cl *concurrencyLimiter) close() {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.closed = true
+	cl.notify()
+}
+
+// notify must be called with the lock held.
+func (cl *concurrencyLimiter) notify() {
+	close(cl.changed)
+	cl.changed = make(chan struct{})
+}
+
+// observe adjusts the limit based on the status code of a response to
+// a request sent at given time.
+// Responses that are neither successful nor tell us that the server is
+// overloaded don't change it.
+func (cl *concurrencyLimiter) observe(code int, sent time.Time) {
+	if cl == nil {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	switch {
+	case code == http.StatusTooManyRequests, code == http.StatusServiceUnavailable:
+		cl.successes = 0
+		if sent.Before(cl.decreased) {
+			return
+		}
+		cl.decreased = time.Now()
+		if cl.limit > 1 {
+			cl.limit /= 2
+		}
+	case code/100 == 2:
+		if cl.limit >= cl.max {
+			return
+		}
+		cl.successes++
+		if cl.successes >= cl.limit {
+			cl.successes = 0
+			cl.limit++
+			cl.notify()
+		}
+	}
+}
+
+func (cl *concurrencyLimiter) current() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.limit
+}
@@ -0,0 +1,215 @@
+package promapi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	var mtx sync.Mutex
+	var status, running, maxRunning int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		code := status
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mtx.Unlock()
+		defer func() {
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+		}()
+
+		time.Sleep(time.Millisecond * 5)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	setStatus := func(code int) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		status = code
+		maxRunning = 0
+	}
+	getMaxRunning := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return maxRunning
+	}
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 8, 100, 1000, promapi.WithAdaptiveConcurrency())
+	prom.StartWorkers()
+	defer prom.Close()
+
+	var queries int
+	query := func() error {
+		queries++
+		_, err := prom.Query(context.Background(), fmt.Sprintf(`up{query="%d"}`, queries))
+		return err
+	}
+	require.Equal(t, 8, prom.ConcurrencyLimit())
+
+	setStatus(http.StatusTooManyRequests)
+	require.Error(t, query())
+	require.Equal(t, 4, prom.ConcurrencyLimit(), "429 should halve the limit")
+
+	setStatus(http.StatusServiceUnavailable)
+	require.Error(t, query())
+	require.Equal(t, 2, prom.ConcurrencyLimit(), "503 should halve the limit")
+	require.Error(t, query())
+	require.Error(t, query())
+	require.Equal(t, 1, prom.ConcurrencyLimit(), "limit can't go below 1")
+
+	setStatus(http.StatusInternalServerError)
+	require.Error(t, query())
+	require.Equal(t, 1, prom.ConcurrencyLimit(), "other errors shouldn't change the limit")
+
+	setStatus(http.StatusOK)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		queries++
+		wg.Add(1)
+		go func(expr string) {
+			defer wg.Done()
+			_, err := prom.Query(context.Background(), expr)
+			require.NoError(t, err)
+		}(fmt.Sprintf(`up{query="%d"}`, queries))
+	}
+	wg.Wait()
+	require.LessOrEqual(t, getMaxRunning(), 4, "concurrency should only grow slowly")
+	require.Less(t, prom.ConcurrencyLimit(), 8)
+
+	for i := 0; i < 100 && prom.ConcurrencyLimit() < 8; i++ {
+		require.NoError(t, query())
+	}
+	require.Equal(t, 8, prom.ConcurrencyLimit(), "limit should recover after successful requests")
+	require.NoError(t, query())
+	require.Equal(t, 8, prom.ConcurrencyLimit(), "limit can't go above the number of workers")
+}
+
+func TestAdaptiveConcurrencyHalvesOncePerWindow(t *testing.T) {
+	const workers = 8
+
+	var mtx sync.Mutex
+	var received int
+	allReceived := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		received++
+		if received == workers {
+			close(allReceived)
+		}
+		mtx.Unlock()
+
+		// Respond only once all requests were sent, so they're all
+		// in flight when the server tells us it's overloaded.
+		select {
+		case <-allReceived:
+		case <-time.After(time.Second * 2):
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, workers, 100, 1000, promapi.WithAdaptiveConcurrency())
+	prom.StartWorkers()
+	defer prom.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := prom.Query(context.Background(), fmt.Sprintf(`up{query="%d"}`, i))
+			require.Error(t, err)
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, workers/2, prom.ConcurrencyLimit(), "a burst of errors should only halve the limit once")
+
+	_, err := prom.Query(context.Background(), `up{query="next"}`)
+	require.Error(t, err)
+	require.Equal(t, workers/4, prom.ConcurrencyLimit(), "requests sent after the decrease should halve it again")
+}
+
+func TestAdaptiveConcurrencyWaitCancelled(t *testing.T) {
+	var mtx sync.Mutex
+	status := http.StatusTooManyRequests
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		code := status
+		mtx.Unlock()
+		if code == http.StatusOK {
+			<-unblock
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 2, 100, 1000, promapi.WithAdaptiveConcurrency())
+	prom.StartWorkers()
+
+	_, err := prom.Query(context.Background(), `up{query="1"}`)
+	require.Error(t, err)
+	require.Equal(t, 1, prom.ConcurrencyLimit())
+
+	mtx.Lock()
+	status = http.StatusOK
+	mtx.Unlock()
+
+	// Occupy the only slot.
+	done := make(chan error, 1)
+	go func() {
+		_, err := prom.Query(context.Background(), `up{query="slow"}`)
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = prom.Query(ctx, `up{query="cancelled"}`)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := prom.Query(context.Background(), `up{query="closed"}`)
+		waiting <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	closed := make(chan struct{})
+	go func() {
+		prom.Close()
+		close(closed)
+	}()
+	select {
+	case err = <-waiting:
+		require.EqualError(t, err, "query workers are stopped")
+	case <-time.After(time.Second * 2):
+		t.Fatal("query waiting for a slot wasn't stopped by Close")
+	}
+
+	close(unblock)
+	require.NoError(t, <-done)
+	<-closed
+}
@@ -0,0 +1,98 @@
+package promapi
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errorLog collapses identical query errors so that a Prometheus server
+// going down doesn't flood logs with thousands of identical lines.
+// Only the first occurrence of each error is logged during a window,
+// the number of suppressed duplicates is reported once the window expires.
+type errorLog struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*errorLogEntry
+}
+
+type errorLogEntry struct {
+	first      time.Time
+	suppressed int
+}
+
+func newErrorLog(window time.Duration) *errorLog {
+	return &errorLog{window: window, entries: map[string]*errorLogEntry{}}
+}
+
+// maxErrorLogEntries is the maximum number of distinct errors tracked at
+// the same time, oldest errors are forgotten first.
+const maxErrorLogEntries = 1000
+
+// check returns true if given error should be logged, together with
+// the number of identical errors suppressed since it was last logged.
+// Errors with an expired window are forgotten, any suppressed duplicates
+// of those are logged by then.
+func (el *errorLog) check(uri string, err error) (ok bool, suppressed int) {
+	if el.window <= 0 {
+		return true, 0
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	now := time.Now()
+	key := err.Error()
+	if e, found := el.entries[key]; found && now.Sub(e.first) < el.window {
+		e.suppressed++
+		return false, 0
+	} else if found {
+		suppressed = e.suppressed
+		delete(el.entries, key)
+	}
+
+	el.expire(uri, now)
+	el.entries[key] = &errorLogEntry{first: now}
+	return true, suppressed
+}
+
+// expire removes all errors with an expired window, then the oldest error
+// if there's still no room for another one.
+func (el *errorLog) expire(uri string, now time.Time) {
+	var oldest string
+	for key, e := range el.entries {
+		if now.Sub(e.first) >= el.window {
+			el.forget(uri, key)
+			continue
+		}
+		if oldest == "" || e.first.Before(el.entries[oldest].first) {
+			oldest = key
+		}
+	}
+	if len(el.entries) >= maxErrorLogEntries {
+		el.forget(uri, oldest)
+	}
+}
+
+// forget removes an error, logging the number of its suppressed duplicates.
+func (el *errorLog) forget(uri, key string) {
+	if e := el.entries[key]; e.suppressed > 0 {
+		log.Error().
+			Str("error", key).
+			Str("uri", uri).
+			Int("suppressed", e.suppressed).
+			Msg("Repeated query errors were suppressed")
+	}
+	delete(el.entries, key)
+}
+
+// flush logs the number of suppressed errors that were never reported.
+func (el *errorLog) flush(uri string) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	for key := range el.entries {
+		el.forget(uri, key)
+	}
+}
@@ -5,15 +5,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"syscall"
+	"unicode/utf8"
 
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prymitive/current"
 )
 
 func IsUnavailableError(err error) bool {
+	if errors.Is(err, ErrResultTooLarge) {
+		// Other servers would return the same result.
+		return false
+	}
+
 	var e1 APIError
 	if ok := errors.As(err, &e1); ok {
 		return e1.ErrorType == v1.ErrServer
@@ -80,6 +87,31 @@ func decodeError(err error) string {
 	return err.Error()
 }
 
+const (
+	// maxErrorBodySize is the maximum number of bytes read from the body of
+	// an error response, anything after it is ignored.
+	maxErrorBodySize = 1 << 20
+	// maxErrorTextLength is the maximum length of error text decoded from
+	// an error response, longer text is truncated.
+	maxErrorTextLength = 1024
+)
+
+// truncateErrorText shortens s to at most maxErrorTextLength bytes, without
+// splitting any multi-byte character, and marks it with an ellipsis.
+func truncateErrorText(s string) string {
+	if len(s) <= maxErrorTextLength {
+		return s
+	}
+	n := maxErrorTextLength
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
+
+// tryDecodingAPIError decodes the JSON error envelope from a response with
+// a non-2xx status code. Only up to maxErrorBodySize bytes of the body are
+// read, so a misbehaving server can't make us buffer a huge error page.
 func tryDecodingAPIError(resp *http.Response) error {
 	var status, errType, errText string
 	decoder := current.Object(
@@ -87,14 +119,14 @@ func tryDecodingAPIError(resp *http.Response) error {
 			status = s
 		})),
 		current.Key("error", current.Value(func(s string, isNil bool) {
-			errText = s
+			errText = truncateErrorText(s)
 		})),
 		current.Key("errorType", current.Value(func(s string, isNil bool) {
 			errType = s
 		})),
 	)
 
-	dec := json.NewDecoder(resp.Body)
+	dec := json.NewDecoder(io.LimitReader(resp.Body, maxErrorBodySize))
 	if err := decoder.Stream(dec); err != nil {
 		switch resp.StatusCode / 100 {
 		case 4:
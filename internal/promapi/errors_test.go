@@ -0,0 +1,68 @@
+package promapi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestOversizedErrorBody(t *testing.T) {
+	type testCaseT struct {
+		name string
+		body string
+		err  string
+	}
+
+	testCases := []testCaseT{
+		{
+			name: "short",
+			body: `{"status":"error","errorType":"execution","error":"query failed"}`,
+			err:  "execution: query failed",
+		},
+		{
+			name: "long error",
+			body: fmt.Sprintf(`{"status":"error","errorType":"execution","error":"%s"}`, strings.Repeat("x", 100000)),
+			err:  "execution: " + strings.Repeat("x", 1024) + "…",
+		},
+		{
+			name: "multi-byte error",
+			body: fmt.Sprintf(`{"status":"error","errorType":"execution","error":"x%s"}`, strings.Repeat("ą", 1000)),
+			err:  "execution: x" + strings.Repeat("ą", 511) + "…",
+		},
+		{
+			name: "huge body",
+			body: fmt.Sprintf(`{"status":"error","errorType":"execution","error":"%s"}`, strings.Repeat("x", 5<<20)),
+			err:  "server_error: server error: 500",
+		},
+		{
+			name: "huge html page",
+			body: "<html>" + strings.Repeat("<p>error</p>", 1<<20) + "</html>",
+			err:  "server_error: server error: 500",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			_, err := prom.Query(context.Background(), "up")
+			require.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package promapi
 
 import (
 	"context"
+	"time"
 )
 
 type FailoverGroupError struct {
@@ -26,6 +27,11 @@ func (e *FailoverGroupError) IsStrict() bool {
 	return e.isStrict
 }
 
+// FailoverGroup sends all queries to the first server in the group and only
+// if that server is unavailable, because it can't be reached or it returned
+// a server error after all retries, the query is sent to the next server.
+// Errors caused by the query itself are returned without trying other
+// servers, since they would return the same error.
 type FailoverGroup struct {
 	name         string
 	servers      []*Prometheus
@@ -92,11 +98,11 @@ func (fg *FailoverGroup) Query(ctx context.Context, expr string) (qr *QueryResul
 	return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
 }
 
-func (fg *FailoverGroup) RangeQuery(ctx context.Context, expr string, params RangeQueryTimes) (rqr *RangeQueryResult, err error) {
+func (fg *FailoverGroup) RangeQuery(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions) (rqr *RangeQueryResult, err error) {
 	var uri string
 	for _, prom := range fg.servers {
 		uri = prom.uri
-		rqr, err = prom.RangeQuery(ctx, expr, params)
+		rqr, err = prom.RangeQuery(ctx, expr, params, opts)
 		if err == nil {
 			return
 		}
@@ -107,6 +113,60 @@ func (fg *FailoverGroup) RangeQuery(ctx context.Context, expr string, params Ran
 	return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
 }
 
+func (fg *FailoverGroup) HasData(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions) (ok bool, err error) {
+	var uri string
+	for _, prom := range fg.servers {
+		uri = prom.uri
+		ok, err = prom.HasData(ctx, expr, params, opts)
+		if err == nil {
+			return ok, nil
+		}
+		if !IsUnavailableError(err) {
+			return false, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+		}
+	}
+	return false, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+}
+
+func (fg *FailoverGroup) RemoteRead(ctx context.Context, selector string, params RangeQueryTimes, opts RangeQueryOptions) (rqr *RangeQueryResult, err error) {
+	var uri string
+	for _, prom := range fg.servers {
+		uri = prom.uri
+		rqr, err = prom.RemoteRead(ctx, selector, params, opts)
+		if err == nil {
+			return
+		}
+		if !IsUnavailableError(err) {
+			return rqr, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+		}
+	}
+	return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+}
+
+func (fg *FailoverGroup) RangeQueryBatch(ctx context.Context, exprs []string, params RangeQueryTimes, opts RangeQueryOptions) (map[string]*RangeQueryResult, map[string]error) {
+	results := map[string]*RangeQueryResult{}
+	errs := map[string]error{}
+	pending := exprs
+	for _, prom := range fg.servers {
+		if len(pending) == 0 {
+			break
+		}
+		rqrs, perrs := prom.RangeQueryBatch(ctx, pending, params, opts)
+		for expr, rqr := range rqrs {
+			results[expr] = rqr
+			delete(errs, expr)
+		}
+		pending = pending[:0:0]
+		for expr, err := range perrs {
+			errs[expr] = &FailoverGroupError{err: err, uri: prom.uri, isStrict: fg.strictErrors}
+			if IsUnavailableError(err) {
+				pending = append(pending, expr)
+			}
+		}
+	}
+	return results, errs
+}
+
 func (fg *FailoverGroup) Metadata(ctx context.Context, metric string) (metadata *MetadataResult, err error) {
 	var uri string
 	for _, prom := range fg.servers {
@@ -136,3 +196,88 @@ func (fg *FailoverGroup) Flags(ctx context.Context) (flags *FlagsResult, err err
 	}
 	return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
 }
+
+func (fg *FailoverGroup) Rules(ctx context.Context) (rules *RulesResult, err error) {
+	var uri string
+	for _, prom := range fg.servers {
+		uri = prom.uri
+		rules, err = prom.Rules(ctx)
+		if err == nil {
+			return
+		}
+		if !IsUnavailableError(err) {
+			return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+		}
+	}
+	return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+}
+
+func (fg *FailoverGroup) ServerTime(ctx context.Context) (st *ServerTimeResult, err error) {
+	var uri string
+	for _, prom := range fg.servers {
+		uri = prom.uri
+		st, err = prom.ServerTime(ctx)
+		if err == nil {
+			return
+		}
+		if !IsUnavailableError(err) {
+			return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+		}
+	}
+	return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+}
+
+func (fg *FailoverGroup) Ping(ctx context.Context) (pr *PingResult, err error) {
+	var uri string
+	for _, prom := range fg.servers {
+		uri = prom.uri
+		pr, err = prom.Ping(ctx)
+		if err == nil {
+			return
+		}
+		if !IsUnavailableError(err) {
+			return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+		}
+	}
+	return nil, &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+}
+
+// Warmup opens a connection to the first server in the group that accepts
+// it, since that's the server all queries will be sent to.
+// Each server gets up to timeout to accept the connection.
+func (fg *FailoverGroup) Warmup(ctx context.Context, timeout time.Duration) (err error) {
+	for _, prom := range fg.servers {
+		sctx, cancel := context.WithTimeout(ctx, timeout)
+		err = prom.Warmup(sctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// SlowestQueries returns at most n slowest queries sent to any server
+// in the group, slowest first.
+func (fg *FailoverGroup) SlowestQueries(n int) []SlowQuery {
+	lists := make([][]SlowQuery, 0, len(fg.servers))
+	for _, prom := range fg.servers {
+		lists = append(lists, prom.SlowestQueries())
+	}
+	return slowestQueries(n, lists...)
+}
+
+func (fg *FailoverGroup) ValidateExpr(ctx context.Context, expr string) (err error) {
+	var uri string
+	for _, prom := range fg.servers {
+		uri = prom.uri
+		err = prom.ValidateExpr(ctx, expr)
+		if err == nil {
+			return nil
+		}
+		if !IsUnavailableError(err) {
+			return &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+		}
+	}
+	return &FailoverGroupError{err: err, uri: uri, isStrict: fg.strictErrors}
+}
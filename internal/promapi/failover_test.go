@@ -0,0 +1,114 @@
+package promapi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestFailoverGroup(t *testing.T) {
+	newServer := func(status int, body string, requests *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(requests, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if status == 200 && r.URL.Path == "/api/v1/query_range" {
+				_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"secondary"},"values":[[1655164800,"1"]]}]}}`))
+				return
+			}
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+	vector := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"secondary"},"value":[1655164800,"1"]}]}}`
+
+	var downRequests, errorRequests, badRequests, okRequests int32
+	down := newServer(200, vector, &downRequests)
+	downURI := down.URL
+	down.Close()
+	unavailable := newServer(503, "Service Unavailable", &errorRequests)
+	defer unavailable.Close()
+	bad := newServer(400, `{"status":"error","errorType":"bad_data","error":"bad input data"}`, &badRequests)
+	defer bad.Close()
+	secondary := newServer(200, vector, &okRequests)
+	defer secondary.Close()
+
+	newGroup := func(uris ...string) *promapi.FailoverGroup {
+		servers := make([]*promapi.Prometheus, 0, len(uris))
+		for _, uri := range uris {
+			servers = append(servers, promapi.NewPrometheus("test", uri, time.Second, 1, 100, 100, promapi.WithRetries(1)))
+		}
+		fg := promapi.NewFailoverGroup("test", servers, true)
+		fg.StartWorkers()
+		return fg
+	}
+	reset := func() {
+		for _, c := range []*int32{&downRequests, &errorRequests, &badRequests, &okRequests} {
+			atomic.StoreInt32(c, 0)
+		}
+	}
+
+	t.Run("primary unreachable", func(t *testing.T) {
+		reset()
+		fg := newGroup(downURI, secondary.URL)
+		defer fg.Close()
+
+		qr, err := fg.Query(context.Background(), "up")
+		require.NoError(t, err)
+		require.Equal(t, secondary.URL, qr.URI)
+		require.Len(t, qr.Series, 1)
+		require.Equal(t, int32(1), atomic.LoadInt32(&okRequests))
+
+		start := time.Unix(1655164800, 0)
+		rqr, err := fg.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute), promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		require.Equal(t, secondary.URL, rqr.URI)
+		require.Len(t, rqr.Samples, 1)
+	})
+
+	t.Run("primary server error", func(t *testing.T) {
+		reset()
+		fg := newGroup(unavailable.URL, secondary.URL)
+		defer fg.Close()
+
+		qr, err := fg.Query(context.Background(), "up")
+		require.NoError(t, err)
+		require.Equal(t, secondary.URL, qr.URI)
+		require.Equal(t, int32(2), atomic.LoadInt32(&errorRequests), "primary should be retried before failing over")
+		require.Equal(t, int32(1), atomic.LoadInt32(&okRequests))
+	})
+
+	t.Run("query error", func(t *testing.T) {
+		reset()
+		fg := newGroup(bad.URL, secondary.URL)
+		defer fg.Close()
+
+		_, err := fg.Query(context.Background(), "up")
+		require.EqualError(t, err, "bad_data: bad input data")
+		var fge *promapi.FailoverGroupError
+		require.True(t, errors.As(err, &fge))
+		require.Equal(t, bad.URL, fge.URI())
+		require.Equal(t, int32(1), atomic.LoadInt32(&badRequests))
+		require.Equal(t, int32(0), atomic.LoadInt32(&okRequests), "secondary shouldn't be queried")
+	})
+
+	t.Run("all unavailable", func(t *testing.T) {
+		reset()
+		fg := newGroup(downURI, unavailable.URL)
+		defer fg.Close()
+
+		_, err := fg.Query(context.Background(), "up")
+		require.EqualError(t, err, "server_error: server error: 503")
+		var fge *promapi.FailoverGroupError
+		require.True(t, errors.As(err, &fge))
+		require.Equal(t, unavailable.URL, fge.URI())
+		require.True(t, promapi.IsUnavailableError(err))
+	})
+}
@@ -2,7 +2,6 @@ package promapi
 
 import (
 	"context"
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -37,12 +36,14 @@ func (q flagsQuery) Run() queryResult {
 	qr := queryResult{expires: q.timestamp.Add(cacheExpiry * 2)}
 
 	args := url.Values{}
-	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args)
+	qr.request = q.prom.describeRequest(http.MethodGet, q.Endpoint(), args)
+	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args, nil)
 	if err != nil {
 		qr.err = fmt.Errorf("failed to query Prometheus flags: %w", err)
 		return qr
 	}
 	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
 
 	if resp.StatusCode/100 != 2 {
 		qr.err = tryDecodingAPIError(resp)
@@ -62,7 +63,7 @@ func (q flagsQuery) String() string {
 }
 
 func (q flagsQuery) CacheKey() string {
-	h := sha1.New()
+	h := q.prom.newCacheKeyHash()
 	_, _ = io.WriteString(h, q.Endpoint())
 	_, _ = io.WriteString(h, "\n")
 	_, _ = io.WriteString(h, q.timestamp.Round(cacheExpiry).Format(time.RFC3339))
@@ -77,14 +78,14 @@ func (p *Prometheus) Flags(ctx context.Context) (*FlagsResult, error) {
 	defer p.locker.unlock(key)
 
 	resultChan := make(chan queryResult)
-	p.queries <- queryRequest{
-		query:  flagsQuery{prom: p, ctx: ctx, timestamp: time.Now()},
+	p.enqueue(ctx, queryRequest{
+		query:  flagsQuery{prom: p, ctx: ctx, timestamp: p.clock()},
 		result: resultChan,
-	}
+	})
 
 	result := <-resultChan
 	if result.err != nil {
-		return nil, QueryError{err: result.err, msg: decodeError(result.err)}
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
 	}
 
 	r := FlagsResult{URI: p.uri, Flags: result.value.(v1.FlagsResult)}
@@ -0,0 +1,197 @@
+package promapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/cloudflare/pint/internal/output"
+)
+
+// freshnessExpr is the default query used to find the most recent sample
+// on the server. A plain timestamp(up) would only see samples within the
+// lookback delta, so a subquery is used to look further back.
+const freshnessExpr = "max(max_over_time(timestamp(up)[1h:]))"
+
+// unknownLag is cached when the freshness query returns no data.
+const unknownLag = time.Duration(math.MinInt64)
+
+// WithFreshnessCheck enables data freshness detection for range queries,
+// which is useful when querying read replicas that might be lagging behind.
+// If the most recent sample on the Prometheus server is older than maxLag
+// then the time range of each range query will be shortened, so it ends at
+// that sample, instead of reporting missing data at the end of the range.
+// The most recent sample is found by running
+// max(max_over_time(timestamp(up)[1h:])), see WithFreshnessQuery.
+// If it returns no data then the lag is unknown and ranges are not changed.
+// Default is 0, which disables freshness detection.
+func WithFreshnessCheck(maxLag time.Duration) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.maxLag = maxLag
+	}
+}
+
+// WithFreshnessQuery sets the query used to find the most recent sample on
+// the server, for servers that don't have the up metric. It must return
+// a single sample with the timestamp of the most recent sample, in seconds,
+// as its value.
+func WithFreshnessQuery(expr string) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.freshness = expr
+	}
+}
+
+type FreshnessResult struct {
+	URI string
+	// Latest is the timestamp of the most recent sample on the server.
+	Latest time.Time
+	// Lag is how far behind the local clock is the most recent sample.
+	Lag time.Duration
+	// Unknown is true if the freshness query returned no data, Latest
+	// and Lag are not set then.
+	Unknown bool
+}
+
+type freshnessQuery struct {
+	prom      *Prometheus
+	ctx       context.Context
+	timestamp time.Time
+}
+
+func (q freshnessQuery) Run() queryResult {
+	log.Debug().
+		Str("uri", q.prom.uri).
+		Msg("Getting prometheus data freshness")
+
+	ctx, cancel := context.WithTimeout(q.ctx, q.prom.timeout)
+	defer cancel()
+
+	qr := queryResult{expires: q.timestamp.Add(cacheExpiry * 2)}
+
+	args := url.Values{}
+	args.Set("query", q.String())
+	qr.request = q.prom.describeRequest(http.MethodGet, q.Endpoint(), args)
+	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args, nil)
+	if err != nil {
+		qr.err = fmt.Errorf("failed to query Prometheus data freshness: %w", err)
+		return qr
+	}
+	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
+	now := q.prom.clock()
+
+	if resp.StatusCode/100 != 2 {
+		qr.err = tryDecodingAPIError(resp)
+		return qr
+	}
+
+	samples, err := streamSamples(resp.Body)
+	if err != nil {
+		qr.err = err
+		return qr
+	}
+	if len(samples) == 0 {
+		qr.value = unknownLag
+		return qr
+	}
+	latest := time.UnixMilli(int64(float64(samples[0].Value) * 1000))
+
+	// Lag is cached instead of the timestamp itself, since the timestamp
+	// keeps moving forward but the replica lag shouldn't change much.
+	qr.value = now.Sub(latest).Round(time.Second)
+	return qr
+}
+
+func (q freshnessQuery) Endpoint() string {
+	return "/api/v1/query"
+}
+
+func (q freshnessQuery) String() string {
+	if q.prom.freshness != "" {
+		return q.prom.freshness
+	}
+	return freshnessExpr
+}
+
+func (q freshnessQuery) CacheKey() string {
+	h := q.prom.newCacheKeyHash()
+	_, _ = io.WriteString(h, "freshness")
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.String())
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.timestamp.Round(cacheExpiry).Format(time.RFC3339))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Freshness returns the timestamp of the most recent sample on the
+// Prometheus server and how far behind the local clock it is.
+func (p *Prometheus) Freshness(ctx context.Context) (*FreshnessResult, error) {
+	log.Debug().Str("uri", p.uri).Msg("Scheduling Prometheus data freshness query")
+
+	key := "/api/v1/query/freshness"
+	p.locker.lock(key)
+	defer p.locker.unlock(key)
+
+	resultChan := make(chan queryResult)
+	p.enqueue(ctx, queryRequest{
+		query:  freshnessQuery{prom: p, ctx: ctx, timestamp: p.clock()},
+		result: resultChan,
+	})
+
+	result := <-resultChan
+	if result.err != nil {
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
+	}
+
+	lag := result.value.(time.Duration)
+	if lag == unknownLag {
+		return &FreshnessResult{URI: p.uri, Unknown: true}, nil
+	}
+	return &FreshnessResult{URI: p.uri, Latest: p.clock().Add(-lag), Lag: lag}, nil
+}
+
+// clampStale shortens given time range if it ends after the most recent
+// sample on the Prometheus server. It returns a warning if range was modified.
+func (p *Prometheus) clampStale(ctx context.Context, params RangeQueryTimes) (RangeQueryTimes, string) {
+	if p.maxLag <= 0 {
+		return params, ""
+	}
+
+	fr, err := p.Freshness(ctx)
+	if err != nil {
+		log.Debug().Err(err).Str("uri", p.uri).Msg("Failed to get data freshness, skipping lag detection")
+		return params, ""
+	}
+	if fr.Unknown {
+		log.Debug().Str("uri", p.uri).Msg("Data freshness query returned no data, skipping lag detection")
+		return params, ""
+	}
+	if fr.Lag <= p.maxLag {
+		return params, ""
+	}
+
+	end := params.End()
+	if !end.After(fr.Latest) {
+		return params, ""
+	}
+	log.Debug().
+		Str("uri", p.uri).
+		Str("lag", output.HumanizeDuration(fr.Lag)).
+		Msg("Prometheus server data is lagging behind")
+
+	if !fr.Latest.After(params.Start()) {
+		// Shortening the range would leave nothing to query.
+		return params, fmt.Sprintf("data on %s is %s behind, there's no data for the query range yet",
+			p.uri, output.HumanizeDuration(fr.Lag))
+	}
+
+	msg := fmt.Sprintf("data on %s is %s behind, query range end was moved back by %s",
+		p.uri, output.HumanizeDuration(fr.Lag), output.HumanizeDuration(end.Sub(fr.Latest)))
+	return NewAbsoluteRange(params.Start(), fr.Latest, params.Step()), msg
+}
@@ -0,0 +1,165 @@
+package promapi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	var lock sync.Mutex
+	var latest time.Time
+	var ends []float64
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/query":
+			lock.Lock()
+			queries = append(queries, r.URL.Query().Get("query"))
+			ts := latest
+			lock.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			if ts.IsZero() {
+				_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+				return
+			}
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[%d,"%d"]}]}}`,
+				now.Unix(), ts.Unix())))
+		case "/api/v1/query_range":
+			err := r.ParseForm()
+			if err != nil {
+				t.Fatal(err)
+			}
+			end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+			lock.Lock()
+			ends = append(ends, end)
+			lock.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		default:
+			w.WriteHeader(400)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"unhandled path"}`))
+		}
+	}))
+	defer srv.Close()
+
+	type testCaseT struct {
+		name     string
+		expr     string
+		lag      time.Duration
+		noData   bool
+		maxLag   time.Duration
+		end      time.Time
+		warnings []string
+	}
+
+	testCases := []testCaseT{
+		{
+			name:   "fresh",
+			lag:    time.Second * 15,
+			maxLag: time.Minute,
+			end:    now,
+		},
+		{
+			name:   "lagging, check disabled",
+			lag:    time.Minute * 10,
+			maxLag: 0,
+			end:    now,
+		},
+		{
+			name:   "lagging",
+			lag:    time.Minute * 10,
+			maxLag: time.Minute,
+			end:    now.Add(time.Minute * -10),
+			warnings: []string{
+				"data on " + srv.URL + " is 10m behind, query range end was moved back by 10m",
+			},
+		},
+		{
+			name:   "lagging behind the whole range",
+			lag:    time.Hour * 2,
+			maxLag: time.Minute,
+			end:    now,
+			warnings: []string{
+				"data on " + srv.URL + " is 2h behind, there's no data for the query range yet",
+			},
+		},
+		{
+			name:   "no data",
+			noData: true,
+			maxLag: time.Minute,
+			end:    now,
+		},
+		{
+			name:   "custom query",
+			expr:   "max(timestamp(prometheus_build_info))",
+			lag:    time.Minute * 10,
+			maxLag: time.Minute,
+			end:    now.Add(time.Minute * -10),
+			warnings: []string{
+				"data on " + srv.URL + " is 10m behind, query range end was moved back by 10m",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lock.Lock()
+			latest = now.Add(-tc.lag)
+			if tc.noData {
+				latest = time.Time{}
+			}
+			ends = nil
+			queries = nil
+			lock.Unlock()
+
+			opts := []promapi.PrometheusOption{promapi.WithClock(clock), promapi.WithFreshnessCheck(tc.maxLag)}
+			expr := "max(max_over_time(timestamp(up)[1h:]))"
+			if tc.expr != "" {
+				opts = append(opts, promapi.WithFreshnessQuery(tc.expr))
+				expr = tc.expr
+			}
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, opts...)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			fr, err := prom.Freshness(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, tc.noData, fr.Unknown)
+			require.Equal(t, tc.lag, fr.Lag)
+			if tc.noData {
+				require.True(t, fr.Latest.IsZero())
+			} else {
+				require.Equal(t, now.Add(-tc.lag), fr.Latest)
+			}
+
+			qr, err := prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(now.Add(time.Hour*-1), now, time.Minute), promapi.RangeQueryOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tc.end, qr.End)
+			require.Equal(t, tc.warnings, qr.Warnings)
+
+			lock.Lock()
+			defer lock.Unlock()
+			require.NotEmpty(t, ends)
+			require.Equal(t, float64(tc.end.Unix()), ends[len(ends)-1])
+			for _, q := range queries {
+				require.Equal(t, expr, q)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package promapi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzStreamSampleStream(f *testing.F) {
+	testcases := []string{
+		`{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"],[1655164860.5,"NaN"]]}]}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1655164800,"+Inf"]]}],"stats":{"timings":{"evalTotalTime":0.1},"samples":{"totalQueryableSamples":10}}}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[],"analysis":{"name":"[sum]","executionTime":"1ms","children":[]}}}`,
+		`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1614859502.068,"1"]}]}}`,
+		`{"status":"success"}`,
+		`{"status":"success","data":{}}`,
+		`{"status":"success","data":null}`,
+		`{"status":"error","errorType":"bad_data","error":"bad input data"}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":"foo","values":1}]}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":{}}}`,
+		`{"status":1,"data":[]}`,
+		`[]`,
+		`null`,
+		``,
+	}
+	for _, tc := range testcases {
+		f.Add([]byte(tc))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		samples, _, status, err := streamSampleStream(bytes.NewReader(data))
+		if err != nil {
+			if samples != nil {
+				t.Errorf("samples returned together with an error: %s", err)
+			}
+			return
+		}
+		if status != "success" {
+			t.Errorf("no error returned for status %q", status)
+		}
+		if samples == nil {
+			t.Error("no error and no samples returned")
+		}
+	})
+}
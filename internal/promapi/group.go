@@ -0,0 +1,43 @@
+package promapi
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// GroupByLabel returns all series grouped by the value of given label.
+// Series without that label are grouped under an empty value, the same way
+// Prometheus treats missing labels. Series in each group are kept in the
+// same order as in Samples.
+func (rqr *RangeQueryResult) GroupByLabel(name string) map[model.LabelValue][]*model.SampleStream {
+	groups := map[model.LabelValue][]*model.SampleStream{}
+	for _, s := range rqr.Samples {
+		val := s.Metric[model.LabelName(name)]
+		groups[val] = append(groups[val], s)
+	}
+	return groups
+}
+
+// LabelNames returns the sorted list of all label names used by any series.
+// It's calculated on the first call and cached on the result, so Samples
+// must not be modified after calling it. It's not safe to call it from
+// multiple goroutines at the same time.
+func (rqr *RangeQueryResult) LabelNames() []string {
+	if rqr.labelNames == nil {
+		seen := map[model.LabelName]struct{}{}
+		for _, s := range rqr.Samples {
+			for name := range s.Metric {
+				seen[name] = struct{}{}
+			}
+		}
+		rqr.labelNames = make([]string, 0, len(seen))
+		for name := range seen {
+			rqr.labelNames = append(rqr.labelNames, string(name))
+		}
+		sort.Strings(rqr.labelNames)
+	}
+	names := make([]string, len(rqr.labelNames))
+	copy(names, rqr.labelNames)
+	return names
+}
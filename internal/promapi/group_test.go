@@ -0,0 +1,57 @@
+package promapi_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestGroupByLabel(t *testing.T) {
+	foo1 := &model.SampleStream{Metric: model.Metric{"__name__": "up", "team": "foo", "instance": "1"}}
+	foo2 := &model.SampleStream{Metric: model.Metric{"__name__": "up", "team": "foo", "instance": "2"}}
+	bar := &model.SampleStream{Metric: model.Metric{"__name__": "up", "team": "bar", "instance": "3"}}
+	none := &model.SampleStream{Metric: model.Metric{"__name__": "up", "instance": "4"}}
+
+	rqr := promapi.RangeQueryResult{Samples: []*model.SampleStream{foo1, bar, none, foo2}}
+
+	require.Equal(t, map[model.LabelValue][]*model.SampleStream{
+		"foo": {foo1, foo2},
+		"bar": {bar},
+		"":    {none},
+	}, rqr.GroupByLabel("team"))
+
+	require.Equal(t, map[model.LabelValue][]*model.SampleStream{
+		"up": {foo1, bar, none, foo2},
+	}, rqr.GroupByLabel("__name__"))
+
+	require.Equal(t, map[model.LabelValue][]*model.SampleStream{
+		"": {foo1, bar, none, foo2},
+	}, rqr.GroupByLabel("job"))
+
+	empty := promapi.RangeQueryResult{}
+	require.Empty(t, empty.GroupByLabel("team"))
+}
+
+func TestLabelNames(t *testing.T) {
+	rqr := promapi.RangeQueryResult{Samples: []*model.SampleStream{
+		{Metric: model.Metric{"__name__": "up", "job": "foo", "instance": "1"}},
+		{Metric: model.Metric{"__name__": "up", "job": "bar", "team": "a"}},
+		{Metric: model.Metric{}},
+		{Metric: model.Metric{"zone": "x", "instance": "2"}},
+	}}
+
+	names := rqr.LabelNames()
+	require.Equal(t, []string{"__name__", "instance", "job", "team", "zone"}, names)
+
+	names[0] = "modified"
+	require.Equal(t, []string{"__name__", "instance", "job", "team", "zone"}, rqr.LabelNames(), "returned slice shouldn't be shared")
+
+	rqr.Samples = append(rqr.Samples, &model.SampleStream{Metric: model.Metric{"cluster": "a"}})
+	require.Equal(t, []string{"__name__", "instance", "job", "team", "zone"}, rqr.LabelNames(), "label names should be cached")
+
+	empty := promapi.RangeQueryResult{}
+	require.Empty(t, empty.LabelNames())
+}
@@ -0,0 +1,91 @@
+package promapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/cloudflare/pint/internal/output"
+)
+
+// hedgeAttempt is a single copy of a range query slice sent to workers.
+type hedgeAttempt struct {
+	// result is buffered, so workers never block on attempts nobody waits for.
+	result  chan queryResult
+	started chan struct{}
+	cancel  context.CancelFunc
+}
+
+// sendAttempt sends a copy of the query to workers with its own context,
+// so it can be cancelled without affecting any other copy.
+func (p *Prometheus) sendAttempt(q rangeQuery) hedgeAttempt {
+	ctx, cancel := context.WithCancel(q.ctx)
+	q.ctx = ctx
+	attempt := hedgeAttempt{result: make(chan queryResult, 1), started: make(chan struct{}), cancel: cancel}
+	p.enqueue(ctx, queryRequest{query: q, result: attempt.result, started: attempt.started})
+	return attempt
+}
+
+// enqueueHedged sends a range query slice to workers and returns a function
+// that waits for its result. If there's no result after delay, counted from
+// the moment a worker started running it, then a second copy of the slice is
+// sent and whichever returns first is used, the other one is cancelled.
+// If the first result is an error then the other copy is still given a chance
+// to succeed. No copy is sent if other queries are waiting for workers, since
+// it would only add more load to a busy server.
+func (p *Prometheus) enqueueHedged(q rangeQuery, delay time.Duration) func() queryResult {
+	primary := p.sendAttempt(q)
+	return func() queryResult {
+		defer primary.cancel()
+
+		select {
+		case qr := <-primary.result:
+			return qr
+		case <-primary.started:
+		}
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case qr := <-primary.result:
+			return qr
+		case <-timer.C:
+		}
+
+		if p.queueBusy() {
+			log.Debug().
+				Str("uri", p.uri).
+				Str("query", q.expr).
+				Msg("Range query slice is slow, but workers are busy, not sending a hedged request")
+			return <-primary.result
+		}
+
+		log.Debug().
+			Str("uri", p.uri).
+			Str("query", q.expr).
+			Str("start", q.r.Start.UTC().Format(time.RFC3339)).
+			Str("end", q.r.End.UTC().Format(time.RFC3339)).
+			Str("delay", output.HumanizeDuration(delay)).
+			Msg("Range query slice is slow, sending a hedged request")
+		hedge := p.sendAttempt(q)
+		defer hedge.cancel()
+
+		var qr queryResult
+		for i := 0; i < 2; i++ {
+			select {
+			case qr = <-primary.result:
+			case qr = <-hedge.result:
+			}
+			if qr.err == nil {
+				return qr
+			}
+		}
+		return qr
+	}
+}
+
+// queueBusy returns true if there are queries waiting for a free worker.
+func (p *Prometheus) queueBusy() bool {
+	return len(p.queries) > 0 || len(p.priorityQueries) > 0
+}
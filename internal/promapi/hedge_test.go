@@ -0,0 +1,149 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestRangeHedgeDelay(t *testing.T) {
+	var mtx sync.Mutex
+	var requests int
+	cancelled := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Body must be read for the request context to be cancelled
+		// when the client goes away.
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		requests++
+		first := requests == 1
+		mtx.Unlock()
+
+		if first {
+			// First request is stuck until it's cancelled.
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+				return
+			case <-time.After(time.Second * 5):
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"slow"},"values":[[1655166000,"1"]]}
+			]}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"fast"},"values":[[1655166000,"1"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+
+	t.Run("fast", func(t *testing.T) {
+		mtx.Lock()
+		requests = 1
+		mtx.Unlock()
+
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 2, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{HedgeDelay: time.Millisecond * 50})
+		require.NoError(t, err)
+		require.Len(t, qr.Samples, 1)
+		require.Equal(t, model.LabelValue("fast"), qr.Samples[0].Metric["instance"])
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		require.Equal(t, 2, requests, "fast slice shouldn't be hedged")
+	})
+
+	t.Run("slow", func(t *testing.T) {
+		mtx.Lock()
+		requests = 0
+		mtx.Unlock()
+
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 2, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		begin := time.Now()
+		qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{HedgeDelay: time.Millisecond * 50})
+		require.NoError(t, err)
+		require.Less(t, time.Since(begin), time.Second*5, "hedged request should win")
+		require.Len(t, qr.Samples, 1)
+		require.Equal(t, model.LabelValue("fast"), qr.Samples[0].Metric["instance"])
+
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second * 5):
+			t.Fatal("slow request wasn't cancelled")
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		require.Equal(t, 2, requests)
+	})
+}
+
+func TestRangeHedgeDelayQueued(t *testing.T) {
+	var mtx sync.Mutex
+	var rangeRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query":
+			// Keep all workers busy.
+			time.Sleep(time.Millisecond * 300)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			mtx.Lock()
+			rangeRequests++
+			mtx.Unlock()
+			time.Sleep(time.Millisecond * 20)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"1"},"values":[[1655166000,"1"]]}
+			]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 2, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	var wg sync.WaitGroup
+	for _, expr := range []string{"foo", "bar"} {
+		wg.Add(1)
+		go func(expr string) {
+			defer wg.Done()
+			_, _ = prom.Query(context.Background(), expr)
+		}(expr)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{HedgeDelay: time.Millisecond * 100})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	wg.Wait()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, 1, rangeRequests, "time spent in the queue shouldn't trigger hedging")
+}
@@ -0,0 +1,150 @@
+package promapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prymitive/current"
+	"github.com/rs/zerolog/log"
+)
+
+type LabelValuesResult struct {
+	URI    string
+	Values []string
+}
+
+type labelValuesQuery struct {
+	prom    *Prometheus
+	ctx     context.Context
+	label   string
+	matches []string
+	start   time.Time
+	end     time.Time
+}
+
+func (q labelValuesQuery) Run() queryResult {
+	log.Debug().
+		Str("uri", q.prom.uri).
+		Str("label", q.label).
+		Strs("match", q.matches).
+		Msg("Getting prometheus label values")
+
+	ctx, cancel := context.WithTimeout(q.ctx, q.prom.timeout)
+	defer cancel()
+
+	qr := queryResult{}
+
+	args := url.Values{}
+	args.Set("start", formatTime(q.start))
+	args.Set("end", formatTime(q.end))
+	for _, m := range q.matches {
+		args.Add("match[]", m)
+	}
+	qr.request = q.prom.describeRequest(http.MethodGet, q.Endpoint(), args)
+	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args, nil)
+	if err != nil {
+		qr.err = fmt.Errorf("failed to query Prometheus label values: %w", err)
+		return qr
+	}
+	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
+
+	if resp.StatusCode/100 != 2 {
+		qr.err = tryDecodingAPIError(resp)
+		return qr
+	}
+
+	qr.value, qr.err = streamLabelValues(resp.Body)
+	return qr
+}
+
+func (q labelValuesQuery) Endpoint() string {
+	return "/api/v1/label/" + url.PathEscape(q.label) + "/values"
+}
+
+func (q labelValuesQuery) String() string {
+	return q.label
+}
+
+func (q labelValuesQuery) CacheKey() string {
+	h := q.prom.newCacheKeyHash()
+	_, _ = io.WriteString(h, q.Endpoint())
+	for _, m := range q.matches {
+		_, _ = io.WriteString(h, "\n")
+		_, _ = io.WriteString(h, m)
+	}
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.start.UTC().Format(time.RFC3339))
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.end.Round(cacheExpiry).UTC().Format(time.RFC3339))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// LabelValues returns all values of given label across series matching any
+// of the selectors in matches, within the given time range. All series are
+// used if there are no selectors.
+// Label is part of the request path, so it must be a valid label name.
+func (p *Prometheus) LabelValues(ctx context.Context, label string, matches []string, start, end time.Time) (*LabelValuesResult, error) {
+	if !model.LabelName(label).IsValid() {
+		return nil, fmt.Errorf("invalid label name %q", label)
+	}
+
+	log.Debug().Str("uri", p.uri).Str("label", label).Strs("match", matches).Msg("Scheduling prometheus label values query")
+
+	key := fmt.Sprintf("/api/v1/label/%s/values/%s", label, strings.Join(matches, ","))
+	p.locker.lock(key)
+	defer p.locker.unlock(key)
+
+	resultChan := make(chan queryResult)
+	p.enqueue(ctx, queryRequest{
+		query:  labelValuesQuery{prom: p, ctx: ctx, label: label, matches: matches, start: start, end: end},
+		result: resultChan,
+	})
+
+	result := <-resultChan
+	if result.err != nil {
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
+	}
+
+	return &LabelValuesResult{URI: p.uri, Values: result.value.([]string)}, nil
+}
+
+func streamLabelValues(r io.Reader) (values []string, err error) {
+	defer dummyReadAll(r)
+
+	var status, errType, errText, val string
+	values = []string{}
+	decoder := current.Object(
+		current.Key("status", current.Value(func(s string, isNil bool) {
+			status = s
+		})),
+		current.Key("error", current.Value(func(s string, isNil bool) {
+			errText = s
+		})),
+		current.Key("errorType", current.Value(func(s string, isNil bool) {
+			errType = s
+		})),
+		current.Key("data", current.Array(&val, func() {
+			values = append(values, val)
+		})),
+	)
+
+	dec := json.NewDecoder(r)
+	if err = decoder.Stream(dec); err != nil {
+		return nil, APIError{Status: status, ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("JSON parse error: %s", err)}
+	}
+
+	if status != "success" {
+		return nil, APIError{Status: status, ErrorType: decodeErrorType(errType), Err: errText}
+	}
+
+	return values, nil
+}
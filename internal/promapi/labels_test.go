@@ -0,0 +1,71 @@
+package promapi_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestLabelValues(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/label/job/values":
+			require.Equal(t, []string{"up", `foo{instance="1"}`}, r.Form["match[]"])
+			require.Equal(t, "1655164800", r.Form.Get("start"))
+			require.Equal(t, "1655168400", r.Form.Get("end"))
+			_, _ = w.Write([]byte(`{"status":"success","data":["a","b"]}`))
+		case "/api/v1/label/error/values":
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"bad label"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	lv, err := prom.LabelValues(context.Background(), "job", []string{"up", `foo{instance="1"}`}, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, srv.URL, lv.URI)
+	require.Equal(t, []string{"a", "b"}, lv.Values)
+
+	_, err = prom.LabelValues(context.Background(), "error", nil, start, start.Add(time.Hour))
+	require.EqualError(t, err, "bad_data: bad label")
+	var qe promapi.QueryError
+	require.True(t, errors.As(err, &qe))
+	require.Equal(t, "GET", qe.Request().Method)
+}
+
+func TestLabelValuesInvalidLabel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL+"/prefix", time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	for _, label := range []string{"", "../../status/flags", "job/name", "job?x=1"} {
+		_, err := prom.LabelValues(context.Background(), label, nil, start, start.Add(time.Hour))
+		require.EqualError(t, err, fmt.Sprintf("invalid label name %q", label))
+	}
+}
@@ -0,0 +1,590 @@
+package promapi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+)
+
+// ErrStepMisaligned is returned when StrictStepAlignment is enabled and
+// Prometheus returned a sample that is not aligned to query step.
+var ErrStepMisaligned = errors.New("sample timestamp is not aligned to query step")
+
+// ErrSeriesTooLarge is returned when a single series has more values than
+// allowed by MaxValuesPerSeries.
+var ErrSeriesTooLarge = errors.New("series has too many values")
+
+// ErrResultTooLarge is returned when range query responses are bigger than
+// allowed by MaxTotalBytes.
+var ErrResultTooLarge = errors.New("query result is too large")
+
+// ErrDuplicateTimestamp is returned when RejectDuplicates is used and
+// a series in a slice response has multiple values with the same timestamp.
+var ErrDuplicateTimestamp = errors.New("series has multiple values with the same timestamp")
+
+// rangeMerger merges results of all range query slices into a single result.
+type rangeMerger struct {
+	start  time.Time
+	end    time.Time
+	step   time.Duration
+	opts   RangeQueryOptions
+	result *RangeQueryResult
+	index  map[model.Fingerprint][]int
+	err    error
+
+	// empty holds all series that were returned with no values at all,
+	// used only if DropEmptySeries is enabled.
+	empty map[model.Fingerprint][]model.Metric
+
+	// counts holds the number of values stored for each series,
+	// including values that were spilled to disk.
+	counts []int
+	// buffered is the number of values currently kept in memory.
+	buffered int
+	spill    *os.File
+	spillBuf *bufio.Writer
+	// spillSize is the number of bytes written to the spill file.
+	spillSize int64
+	// chunks holds the location of values spilled for each series.
+	chunks [][]spillChunk
+}
+
+// spillChunk is a continuous block of values of a single series in the
+// spill file.
+type spillChunk struct {
+	offset int64
+	count  int
+}
+
+// newRangeMerger creates a merger for given result, step is only used
+// for validating sample alignment and can be zero if samples are not
+// expected to be aligned.
+func newRangeMerger(result *RangeQueryResult, opts RangeQueryOptions, step time.Duration) *rangeMerger {
+	return &rangeMerger{
+		start:  result.Start,
+		end:    result.End,
+		step:   step,
+		opts:   opts,
+		result: result,
+		index:  map[model.Fingerprint][]int{},
+	}
+}
+
+// lookup returns the index of given series or -1 if it wasn't added yet.
+func (m *rangeMerger) lookup(metric model.Metric, fp model.Fingerprint) int {
+	for _, i := range m.index[fp] {
+		if m.result.Samples[i].Metric.Equal(metric) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *rangeMerger) series(metric model.Metric, size int) int {
+	fp := metric.Fingerprint()
+	if i := m.lookup(metric, fp); i >= 0 {
+		return i
+	}
+	s := model.SampleStream{
+		Metric: metric.Clone(),
+		Values: make([]model.SamplePair, 0, size),
+	}
+	m.index[fp] = append(m.index[fp], len(m.result.Samples))
+	m.result.Samples = append(m.result.Samples, &s)
+	m.result.labelNames = nil
+	m.counts = append(m.counts, 0)
+	return len(m.result.Samples) - 1
+}
+
+// addEmpty records a series that was returned with no values, it's only
+// counted as empty if no slice returned any values for it.
+func (m *rangeMerger) addEmpty(metric model.Metric) {
+	if m.empty == nil {
+		m.empty = map[model.Fingerprint][]model.Metric{}
+	}
+	fp := metric.Fingerprint()
+	for _, e := range m.empty[fp] {
+		if e.Equal(metric) {
+			return
+		}
+	}
+	m.empty[fp] = append(m.empty[fp], metric.Clone())
+}
+
+func (m *rangeMerger) add(samples []model.SampleStream) {
+	var ts time.Time
+	for _, sample := range samples {
+		if m.opts.DropEmptySeries && len(sample.Values) == 0 {
+			m.addEmpty(sample.Metric)
+			continue
+		}
+		values := make([]model.SamplePair, 0, len(sample.Values))
+		for _, v := range sample.Values {
+			ts = v.Timestamp.Time()
+			if !ts.Before(m.start) && !ts.After(m.end) {
+				if value.IsStaleNaN(float64(v.Value)) {
+					m.result.StaleMarkers++
+					if m.opts.DropStaleMarkers {
+						continue
+					}
+				}
+				if m.opts.DropInf && math.IsInf(float64(v.Value), 0) {
+					continue
+				}
+				v.Value = roundSignificant(v.Value, m.opts.SignificantFigures)
+				values = append(values, v)
+			}
+		}
+		if m.opts.Duplicates != KeepDuplicates {
+			values = m.checkDuplicates(sample.Metric, values)
+		}
+		if m.opts.StepTolerance > 0 && m.step > 0 {
+			m.checkAlignment(sample.Metric, values)
+		}
+		if m.opts.Decimate > 1 {
+			values = decimate(values, m.opts.Decimate)
+		}
+		idx := m.series(sample.Metric, len(values))
+		s := m.result.Samples[idx]
+		s.Values = append(s.Values, values...)
+		m.counts[idx] += len(values)
+		m.buffered += len(values)
+		if m.opts.MaxValuesPerSeries > 0 && m.counts[idx] > m.opts.MaxValuesPerSeries && m.err == nil {
+			m.err = fmt.Errorf("%w: %s has at least %d values, limit is %d",
+				ErrSeriesTooLarge, s.Metric, m.counts[idx], m.opts.MaxValuesPerSeries)
+		}
+	}
+	if m.opts.SpillThreshold > 0 && m.buffered > m.opts.SpillThreshold && m.err == nil {
+		if err := m.spillValues(); err != nil {
+			m.err = fmt.Errorf("failed to spill range query values to disk: %w", err)
+		}
+	}
+}
+
+// spillRecordSize is the size of a single value written to the spill file:
+// series index, timestamp and value.
+const spillRecordSize = 4 + 8 + 8
+
+// spillValues writes all values currently kept in memory to a temporary
+// file and releases them.
+func (m *rangeMerger) spillValues() (err error) {
+	if m.spill == nil {
+		if m.spill, err = os.CreateTemp("", "pint-range-*.spill"); err != nil {
+			return err
+		}
+		m.spillBuf = bufio.NewWriter(m.spill)
+	}
+
+	for len(m.chunks) < len(m.result.Samples) {
+		m.chunks = append(m.chunks, nil)
+	}
+
+	buf := make([]byte, spillRecordSize)
+	for i, s := range m.result.Samples {
+		if len(s.Values) > 0 {
+			m.chunks[i] = append(m.chunks[i], spillChunk{offset: m.spillSize, count: len(s.Values)})
+			m.spillSize += int64(len(s.Values) * spillRecordSize)
+		}
+		for _, v := range s.Values {
+			binary.LittleEndian.PutUint32(buf[0:], uint32(i))
+			binary.LittleEndian.PutUint64(buf[4:], uint64(v.Timestamp))
+			binary.LittleEndian.PutUint64(buf[12:], math.Float64bits(float64(v.Value)))
+			if _, err = m.spillBuf.Write(buf); err != nil {
+				return err
+			}
+		}
+		s.Values = nil
+	}
+	m.buffered = 0
+	return nil
+}
+
+// restoreValues reads back all values from the spill file.
+func (m *rangeMerger) restoreValues() error {
+	if err := m.spillBuf.Flush(); err != nil {
+		return err
+	}
+	if _, err := m.spill.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	for i, s := range m.result.Samples {
+		values := make([]model.SamplePair, 0, m.counts[i])
+		s.Values = append(values, s.Values...)
+	}
+
+	r := bufio.NewReader(m.spill)
+	buf := make([]byte, spillRecordSize)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		i := int(binary.LittleEndian.Uint32(buf[0:]))
+		if i >= len(m.result.Samples) {
+			return fmt.Errorf("invalid series index %d in spill file", i)
+		}
+		m.result.Samples[i].Values = append(m.result.Samples[i].Values, model.SamplePair{
+			Timestamp: model.Time(binary.LittleEndian.Uint64(buf[4:])),
+			Value:     model.SampleValue(math.Float64frombits(binary.LittleEndian.Uint64(buf[12:]))),
+		})
+	}
+}
+
+// readSpilled reads back all values of series with given index from
+// the spill file, buffered writes must be flushed first.
+func (m *rangeMerger) readSpilled(i int) ([]model.SamplePair, error) {
+	if i >= len(m.chunks) {
+		return nil, nil
+	}
+	var values []model.SamplePair
+	for _, c := range m.chunks[i] {
+		buf := make([]byte, c.count*spillRecordSize)
+		if _, err := m.spill.ReadAt(buf, c.offset); err != nil {
+			return nil, err
+		}
+		for off := 0; off < len(buf); off += spillRecordSize {
+			if idx := int(binary.LittleEndian.Uint32(buf[off:])); idx != i {
+				return nil, fmt.Errorf("invalid series index %d in spill file, expected %d", idx, i)
+			}
+			values = append(values, model.SamplePair{
+				Timestamp: model.Time(binary.LittleEndian.Uint64(buf[off+4:])),
+				Value:     model.SampleValue(math.Float64frombits(binary.LittleEndian.Uint64(buf[off+12:]))),
+			})
+		}
+	}
+	return values, nil
+}
+
+// close removes the spill file, if there is one.
+// It's safe to call it multiple times.
+func (m *rangeMerger) close() {
+	if m.spill == nil {
+		return
+	}
+	name := m.spill.Name()
+	_ = m.spill.Close()
+	_ = os.Remove(name)
+	m.spill = nil
+	m.spillBuf = nil
+	m.spillSize = 0
+	m.chunks = nil
+}
+
+// checkDuplicates finds values with the same timestamp and either removes
+// them, keeping the first one, or sets an error, depending on options.
+func (m *rangeMerger) checkDuplicates(metric model.Metric, values []model.SamplePair) []model.SamplePair {
+	sorted := true
+	for i := 1; i < len(values); i++ {
+		if !values[i-1].Timestamp.Before(values[i].Timestamp) {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		return values
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Timestamp.Before(values[j].Timestamp)
+	})
+	dst := values[:1]
+	for _, v := range values[1:] {
+		if v.Timestamp != dst[len(dst)-1].Timestamp {
+			dst = append(dst, v)
+			continue
+		}
+		if m.opts.Duplicates == RejectDuplicates {
+			if m.err == nil {
+				m.err = fmt.Errorf("%w: %s has multiple values at %s",
+					ErrDuplicateTimestamp, metric, v.Timestamp.Time().UTC().Format(time.RFC3339Nano))
+			}
+			return values
+		}
+	}
+	return dst
+}
+
+// checkAlignment verifies that all values are within the tolerance of
+// a step multiple from the query start.
+func (m *rangeMerger) checkAlignment(metric model.Metric, values []model.SamplePair) {
+	for _, v := range values {
+		offset := v.Timestamp.Time().Sub(m.start) % m.step
+		if offset < 0 {
+			offset += m.step
+		}
+		drift := offset
+		if m.step-offset < drift {
+			drift = m.step - offset
+		}
+		if drift <= m.opts.StepTolerance {
+			continue
+		}
+		msg := fmt.Sprintf("sample for %s at %s is %s away from the nearest step",
+			metric, v.Timestamp.Time().UTC().Format(time.RFC3339Nano), drift)
+		if m.opts.StrictStepAlignment {
+			if m.err == nil {
+				m.err = fmt.Errorf("%w: %s", ErrStepMisaligned, msg)
+			}
+		} else {
+			m.result.Warnings = append(m.result.Warnings, msg)
+		}
+		// Only report the first misaligned sample for each series.
+		return
+	}
+}
+
+// checkCompleteness adds a warning for every range of steps between start
+// and end without a value. Values must be sorted by timestamp.
+func (m *rangeMerger) checkCompleteness(s *model.SampleStream) {
+	var gapStart time.Time
+	var missing int
+	report := func(last time.Time) {
+		if missing > 0 {
+			m.result.Warnings = append(m.result.Warnings, fmt.Sprintf(
+				"%s has no values between %s and %s (%d steps)",
+				s.Metric, gapStart.UTC().Format(time.RFC3339), last.UTC().Format(time.RFC3339), missing))
+			missing = 0
+		}
+	}
+
+	var i int
+	var last time.Time
+	for ts := m.start; !ts.After(m.end); ts = ts.Add(m.step) {
+		tolerance := m.opts.StepTolerance
+		for i < len(s.Values) && s.Values[i].Timestamp.Time().Before(ts.Add(-tolerance)) {
+			i++
+		}
+		if i < len(s.Values) && !s.Values[i].Timestamp.Time().After(ts.Add(tolerance)) {
+			report(last)
+			continue
+		}
+		if missing == 0 {
+			gapStart = ts
+		}
+		missing++
+		last = ts
+	}
+	report(last)
+}
+
+func (m *rangeMerger) finish() error {
+	if m.spill != nil {
+		err := m.restoreValues()
+		m.close()
+		if err != nil {
+			return fmt.Errorf("failed to read spilled range query values: %w", err)
+		}
+	}
+	m.countSeries()
+	if m.opts.MaxLabelValues > 0 {
+		m.capLabelValues()
+	}
+	m.result.Coverage = make([]SeriesCoverage, len(m.result.Samples))
+	for k := range m.result.Samples {
+		m.result.Coverage[k] = m.finishSeries(m.result.Samples[k])
+	}
+	return nil
+}
+
+// finishStream is like finish, but instead of keeping all series in the
+// result it passes them to fn one at a time, in fingerprint order.
+// Values of each series are read back from the spill file only when that
+// series is passed to fn and released after fn returns.
+func (m *rangeMerger) finishStream(fn func(*model.SampleStream) error) error {
+	defer m.close()
+	if m.spill != nil {
+		if err := m.spillBuf.Flush(); err != nil {
+			return fmt.Errorf("failed to read spilled range query values: %w", err)
+		}
+	}
+
+	index := make(map[*model.SampleStream]int, len(m.result.Samples))
+	for i, s := range m.result.Samples {
+		index[s] = i
+	}
+	m.countSeries()
+	if m.opts.MaxLabelValues > 0 {
+		m.capLabelValues()
+	}
+
+	series := m.result.Samples
+	fps := make(map[*model.SampleStream]model.Fingerprint, len(series))
+	for _, s := range series {
+		fps[s] = s.Metric.Fingerprint()
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return fps[series[i]] < fps[series[j]]
+	})
+	m.result.Samples = nil
+	m.result.labelNames = nil
+	m.result.Coverage = make([]SeriesCoverage, 0, len(series))
+
+	for _, s := range series {
+		if m.spill != nil {
+			spilled, err := m.readSpilled(index[s])
+			if err != nil {
+				return fmt.Errorf("failed to read spilled range query values: %w", err)
+			}
+			s.Values = append(spilled, s.Values...)
+		}
+		m.result.Coverage = append(m.result.Coverage, m.finishSeries(s))
+		err := fn(s)
+		s.Values = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countSeries sets the number of matched and empty series.
+func (m *rangeMerger) countSeries() {
+	for fp, metrics := range m.empty {
+		for _, metric := range metrics {
+			if m.lookup(metric, fp) < 0 {
+				m.result.EmptySeries++
+			}
+		}
+	}
+	m.result.MatchedSeries = len(m.result.Samples)
+}
+
+// finishSeries sorts and trims values of a single series after all slices
+// were merged.
+func (m *rangeMerger) finishSeries(s *model.SampleStream) SeriesCoverage {
+	sort.SliceStable(s.Values, func(i, j int) bool {
+		return s.Values[i].Timestamp.Before(s.Values[j].Timestamp)
+	})
+	if m.opts.VerifyCompleteness && m.opts.Decimate < 2 && m.step > 0 {
+		m.checkCompleteness(s)
+	}
+	if m.opts.TrimNaN {
+		s.Values = trimNaN(s.Values)
+	}
+	if len(s.Values) == 0 {
+		return SeriesCoverage{}
+	}
+	m.result.RetainedSeries++
+	return SeriesCoverage{
+		First:  s.Values[0].Timestamp.Time().UTC(),
+		Last:   s.Values[len(s.Values)-1].Timestamp.Time().UTC(),
+		Points: len(s.Values),
+	}
+}
+
+// capLabelValues removes all series that have a label value that would go
+// over the MaxLabelValues limit for that label.
+func (m *rangeMerger) capLabelValues() {
+	order := make([]int, len(m.result.Samples))
+	fps := make([]model.Fingerprint, len(m.result.Samples))
+	for i, s := range m.result.Samples {
+		order[i] = i
+		fps[i] = s.Metric.Fingerprint()
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return fps[order[i]] < fps[order[j]]
+	})
+
+	kept := map[model.LabelName]map[model.LabelValue]struct{}{}
+	dropped := map[model.LabelName]map[model.LabelValue]struct{}{}
+	drop := make([]bool, len(m.result.Samples))
+	for _, i := range order {
+		metric := m.result.Samples[i].Metric
+		for name, val := range metric {
+			if _, ok := kept[name][val]; ok {
+				continue
+			}
+			if len(kept[name]) >= m.opts.MaxLabelValues {
+				drop[i] = true
+				if dropped[name] == nil {
+					dropped[name] = map[model.LabelValue]struct{}{}
+				}
+				dropped[name][val] = struct{}{}
+			}
+		}
+		if drop[i] {
+			continue
+		}
+		for name, val := range metric {
+			if kept[name] == nil {
+				kept[name] = map[model.LabelValue]struct{}{}
+			}
+			kept[name][val] = struct{}{}
+		}
+	}
+
+	samples := make([]*model.SampleStream, 0, len(m.result.Samples))
+	for i, s := range m.result.Samples {
+		if drop[i] {
+			m.result.DroppedSeries++
+			continue
+		}
+		samples = append(samples, s)
+	}
+	m.result.Samples = samples
+	m.result.labelNames = nil
+
+	if len(dropped) > 0 {
+		m.result.DroppedLabelValues = make(map[string]int, len(dropped))
+		for name, vals := range dropped {
+			m.result.DroppedLabelValues[string(name)] = len(vals)
+		}
+	}
+}
+
+// roundSignificant rounds v to n significant figures, n lower than 1
+// disables rounding.
+func roundSignificant(v model.SampleValue, n int) model.SampleValue {
+	if n < 1 {
+		return v
+	}
+	f := float64(v)
+	if f == 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return v
+	}
+	// Going through the decimal representation gives the same result
+	// as parsing a value that was written with n significant figures.
+	r, err := strconv.ParseFloat(strconv.FormatFloat(f, 'g', n, 64), 64)
+	if err != nil {
+		return v
+	}
+	return model.SampleValue(r)
+}
+
+// trimNaN removes leading and trailing NaN values, interior NaNs are kept.
+func trimNaN(values []model.SamplePair) []model.SamplePair {
+	first := 0
+	for first < len(values) && math.IsNaN(float64(values[first].Value)) {
+		first++
+	}
+	last := len(values)
+	for last > first && math.IsNaN(float64(values[last-1].Value)) {
+		last--
+	}
+	return values[first:last]
+}
+
+// decimate keeps every nth value, first and last values are always kept.
+func decimate(values []model.SamplePair, n int) []model.SamplePair {
+	if len(values) <= 2 {
+		return values
+	}
+	dst := make([]model.SamplePair, 0, len(values)/n+2)
+	for i := 0; i < len(values)-1; i += n {
+		dst = append(dst, values[i])
+	}
+	return append(dst, values[len(values)-1])
+}
@@ -2,7 +2,6 @@ package promapi
 
 import (
 	"context"
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -40,12 +39,14 @@ func (q metadataQuery) Run() queryResult {
 
 	args := url.Values{}
 	args.Set("metric", q.metric)
-	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args)
+	qr.request = q.prom.describeRequest(http.MethodGet, q.Endpoint(), args)
+	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args, nil)
 	if err != nil {
 		qr.err = fmt.Errorf("failed to query Prometheus metrics metadata: %w", err)
 		return qr
 	}
 	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
 
 	if resp.StatusCode/100 != 2 {
 		qr.err = tryDecodingAPIError(resp)
@@ -65,7 +66,7 @@ func (q metadataQuery) String() string {
 }
 
 func (q metadataQuery) CacheKey() string {
-	h := sha1.New()
+	h := q.prom.newCacheKeyHash()
 	_, _ = io.WriteString(h, q.Endpoint())
 	_, _ = io.WriteString(h, "\n")
 	_, _ = io.WriteString(h, q.metric)
@@ -82,14 +83,14 @@ func (p *Prometheus) Metadata(ctx context.Context, metric string) (*MetadataResu
 	defer p.locker.unlock(key)
 
 	resultChan := make(chan queryResult)
-	p.queries <- queryRequest{
-		query:  metadataQuery{prom: p, ctx: ctx, metric: metric, timestamp: time.Now()},
+	p.enqueue(ctx, queryRequest{
+		query:  metadataQuery{prom: p, ctx: ctx, metric: metric, timestamp: p.clock()},
 		result: resultChan,
-	}
+	})
 
 	result := <-resultChan
 	if result.err != nil {
-		return nil, QueryError{err: result.err, msg: decodeError(result.err)}
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
 	}
 
 	metadata := MetadataResult{URI: p.uri, Metadata: result.value.(map[string][]v1.Metadata)[metric]}
@@ -30,6 +30,10 @@ func TestMetadata(t *testing.T) {
 			w.WriteHeader(200)
 			w.Header().Set("Content-Type", "application/json")
 			_, _ = w.Write([]byte(`{"status":"success","data":{"counter":[{"type":"counter","help":"Text","unit":""}]}}`))
+		case "histogram":
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"histogram":[{"type":"histogram","help":"Text","unit":"seconds"}]}}`))
 		case "mixed":
 			w.WriteHeader(200)
 			w.Header().Set("Content-Type", "application/json")
@@ -82,6 +86,21 @@ func TestMetadata(t *testing.T) {
 				Metadata: []v1.Metadata{{Type: "counter", Help: "Text", Unit: ""}},
 			},
 		},
+		{
+			metric:  "histogram",
+			timeout: time.Second,
+			metadata: promapi.MetadataResult{
+				URI:      srv.URL,
+				Metadata: []v1.Metadata{{Type: "histogram", Help: "Text", Unit: "seconds"}},
+			},
+		},
+		{
+			metric:  "notfound",
+			timeout: time.Second,
+			metadata: promapi.MetadataResult{
+				URI: srv.URL,
+			},
+		},
 		{
 			metric:  "mixed",
 			timeout: time.Second,
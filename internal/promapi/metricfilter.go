@@ -0,0 +1,101 @@
+package promapi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ErrMetricDenied is returned when a query uses a metric that isn't allowed
+// by the MetricFilter set with WithMetricFilter.
+var ErrMetricDenied = errors.New("metric is not allowed to be queried")
+
+// MetricFilter decides if a metric can be queried, name is empty for
+// selectors without an exact metric name, like {job="foo"}.
+type MetricFilter func(name string) bool
+
+// NewMetricFilter returns a MetricFilter that allows all metrics matching
+// any of the allow regexps, or all metrics if allow is empty, unless they
+// also match any of the deny regexps. Regexps must match the whole name.
+// Selectors without a metric name can match anything, so they're only
+// allowed when there's no allow list.
+func NewMetricFilter(allow, deny []*regexp.Regexp) MetricFilter {
+	return func(name string) bool {
+		if name == "" {
+			return len(allow) == 0
+		}
+		for _, re := range deny {
+			if fullMatch(re, name) {
+				return false
+			}
+		}
+		if len(allow) == 0 {
+			return true
+		}
+		for _, re := range allow {
+			if fullMatch(re, name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func fullMatch(re *regexp.Regexp, s string) bool {
+	loc := re.FindStringIndex(s)
+	return loc != nil && loc[0] == 0 && loc[1] == len(s)
+}
+
+// WithMetricFilter makes the client check all selectors used in instant
+// and range queries with filter before sending them. Queries using
+// a metric rejected by the filter return ErrMetricDenied.
+func WithMetricFilter(filter MetricFilter) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.metricFilter = filter
+	}
+}
+
+func (prom *Prometheus) checkMetrics(expr string) error {
+	if prom.metricFilter == nil {
+		return nil
+	}
+
+	node, err := parser.ParseExpr(expr)
+	if err != nil {
+		return fmt.Errorf("failed to check metrics used in query %q: %w", expr, err)
+	}
+
+	var denied error
+	parser.Inspect(node, func(n parser.Node, _ []parser.Node) error {
+		vs, ok := n.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		name := selectorName(vs)
+		if !prom.metricFilter(name) {
+			if name == "" {
+				denied = fmt.Errorf("%w: selector %s has no metric name", ErrMetricDenied, vs.String())
+			} else {
+				denied = fmt.Errorf("%w: %s", ErrMetricDenied, name)
+			}
+			return denied
+		}
+		return nil
+	})
+	return denied
+}
+
+func selectorName(vs *parser.VectorSelector) string {
+	if vs.Name != "" {
+		return vs.Name
+	}
+	for _, m := range vs.LabelMatchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestMetricFilter(t *testing.T) {
+	var mtx sync.Mutex
+	queries := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		queries = append(queries, r.Form.Get("query"))
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	type testCaseT struct {
+		expr  string
+		allow []*regexp.Regexp
+		deny  []*regexp.Regexp
+		err   string
+		// denied is false for errors other than ErrMetricDenied.
+		denied bool
+	}
+
+	testCases := []testCaseT{
+		{
+			expr: "up",
+		},
+		{
+			expr: `{job="foo"}`,
+		},
+		{
+			expr:   "sum(rate(secret_tokens_total[5m])) / up",
+			deny:   []*regexp.Regexp{regexp.MustCompile("secret_.+")},
+			err:    "metric is not allowed to be queried: secret_tokens_total",
+			denied: true,
+		},
+		{
+			expr: "up",
+			deny: []*regexp.Regexp{regexp.MustCompile("secret_.+")},
+		},
+		{
+			expr: "not_secret_tokens",
+			deny: []*regexp.Regexp{regexp.MustCompile("secret_.+")},
+		},
+		{
+			expr:   `{__name__="secret_tokens_total"}`,
+			deny:   []*regexp.Regexp{regexp.MustCompile("secret_.+")},
+			err:    "metric is not allowed to be queried: secret_tokens_total",
+			denied: true,
+		},
+		{
+			expr:  "sum(up) by (job)",
+			allow: []*regexp.Regexp{regexp.MustCompile("up"), regexp.MustCompile("job:.+")},
+		},
+		{
+			expr:  "up unless on(job) job:foo:sum offset 5m",
+			allow: []*regexp.Regexp{regexp.MustCompile("up"), regexp.MustCompile("job:.+")},
+		},
+		{
+			expr:   "up / node_cpu_seconds_total",
+			allow:  []*regexp.Regexp{regexp.MustCompile("up"), regexp.MustCompile("job:.+")},
+			err:    "metric is not allowed to be queried: node_cpu_seconds_total",
+			denied: true,
+		},
+		{
+			expr:   `count({job="foo"})`,
+			allow:  []*regexp.Regexp{regexp.MustCompile("up")},
+			err:    `metric is not allowed to be queried: selector {job="foo"} has no metric name`,
+			denied: true,
+		},
+		{
+			expr:   "job:secret:sum",
+			allow:  []*regexp.Regexp{regexp.MustCompile("job:.+")},
+			deny:   []*regexp.Regexp{regexp.MustCompile(".+:secret:.+")},
+			err:    "metric is not allowed to be queried: job:secret:sum",
+			denied: true,
+		},
+		{
+			expr:  "sum(",
+			allow: []*regexp.Regexp{regexp.MustCompile("up")},
+			err:   `failed to check metrics used in query "sum(": 1:5: parse error: unclosed left parenthesis`,
+		},
+	}
+
+	start := time.Unix(1655164800, 0)
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+				promapi.WithMetricFilter(promapi.NewMetricFilter(tc.allow, tc.deny)))
+			prom.StartWorkers()
+			defer prom.Close()
+
+			mtx.Lock()
+			queries = queries[:0]
+			mtx.Unlock()
+
+			_, qerr := prom.Query(context.Background(), tc.expr)
+			_, rerr := prom.RangeQuery(context.Background(), tc.expr, promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute), promapi.RangeQueryOptions{})
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if tc.err != "" {
+				require.EqualError(t, qerr, tc.err)
+				require.EqualError(t, rerr, tc.err)
+				if tc.denied {
+					require.ErrorIs(t, rerr, promapi.ErrMetricDenied)
+				}
+				require.Empty(t, queries, "denied queries shouldn't be sent")
+			} else {
+				require.NoError(t, qerr)
+				require.NoError(t, rerr)
+				require.Len(t, queries, 2)
+			}
+		})
+	}
+}
@@ -51,6 +51,13 @@ var (
 		},
 		[]string{"name", "endpoint", "reason"},
 	)
+	prometheusQueryRetriesExhaustedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pint_prometheus_query_retries_exhausted_total",
+			Help: "Total number of prometheus queries that failed after all retries",
+		},
+		[]string{"name", "uri", "reason"},
+	)
 )
 
 func RegisterMetrics() {
@@ -60,6 +67,7 @@ func RegisterMetrics() {
 	prometheus.MustRegister(prometheusCacheMissTotal)
 	prometheus.MustRegister(prometheusQueriesTotal)
 	prometheus.MustRegister(prometheusQueryErrorsTotal)
+	prometheus.MustRegister(prometheusQueryRetriesExhaustedTotal)
 }
 
 func errReason(err error) string {
@@ -0,0 +1,215 @@
+package promapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// ErrMissingMetricName is returned by WriteOpenMetrics if any series has
+// no metric name, which is required by OpenMetrics.
+var ErrMissingMetricName = errors.New("series has no metric name")
+
+// openMetricsSuffixes lists sample name suffixes allowed for each metric type.
+var openMetricsSuffixes = map[v1.MetricType][]string{
+	v1.MetricTypeCounter:        {"_total", "_created"},
+	v1.MetricTypeGauge:          {""},
+	v1.MetricTypeHistogram:      {"_bucket", "_count", "_sum", "_created"},
+	v1.MetricTypeGaugeHistogram: {"_bucket", "_gcount", "_gsum"},
+	v1.MetricTypeSummary:        {"", "_count", "_sum", "_created"},
+	v1.MetricTypeInfo:           {"_info"},
+	v1.MetricTypeStateset:       {""},
+	v1.MetricTypeUnknown:        {""},
+}
+
+// openMetricsSampleSuffixes lists all suffixes from openMetricsSuffixes,
+// longer suffixes go first, so _gcount is checked before _count.
+var openMetricsSampleSuffixes = []string{"_created", "_bucket", "_gcount", "_total", "_count", "_gsum", "_info", "_sum", ""}
+
+type openMetricsFamily struct {
+	name     string
+	metadata v1.Metadata
+	series   []int
+}
+
+// WriteOpenMetrics writes all series in the OpenMetrics text format, with
+// one sample line per value. Metadata is keyed by metric family name, the
+// same way it's returned by the Prometheus metadata API, and it's used for
+// TYPE, UNIT and HELP lines. Series without metadata, or with metadata that
+// doesn't match their name, are written with the unknown type.
+// Series are grouped by metric family, but otherwise written in the same
+// order as in Samples, so histogram and summary values are written one series
+// at a time, not grouped by timestamp. Prometheus accepts that, but it might
+// not work with parsers that strictly validate histogram points.
+// Output is written as each value is formatted.
+func (rqr *RangeQueryResult) WriteOpenMetrics(w io.Writer, metadata map[string]v1.Metadata) error {
+	families, err := rqr.openMetricsFamilies(metadata)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 0, 256)
+	for _, f := range families {
+		buf = appendOpenMetricsMetadata(buf[:0], f)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+		for _, i := range f.series {
+			s := rqr.Samples[i]
+			buf = appendOpenMetricsSeries(buf[:0], s.Metric)
+			prefix := len(buf)
+			for _, v := range s.Values {
+				buf = append(buf[:prefix], ' ')
+				buf = appendOpenMetricsValue(buf, float64(v.Value))
+				buf = append(buf, ' ')
+				buf = strconv.AppendFloat(buf, float64(v.Timestamp)/1000, 'f', -1, 64)
+				buf = append(buf, '\n')
+				if _, err := bw.Write(buf); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if _, err := bw.WriteString("# EOF\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// openMetricsFamilies groups series by metric family, families are sorted
+// by the position of their first series.
+func (rqr *RangeQueryResult) openMetricsFamilies(metadata map[string]v1.Metadata) ([]*openMetricsFamily, error) {
+	families := []*openMetricsFamily{}
+	index := map[string]*openMetricsFamily{}
+	for i, s := range rqr.Samples {
+		name := string(s.Metric[model.MetricNameLabel])
+		if name == "" {
+			return nil, fmt.Errorf("%w: %s", ErrMissingMetricName, s.Metric)
+		}
+		family, md := lookupOpenMetricsFamily(name, metadata)
+		f, ok := index[family]
+		if !ok {
+			f = &openMetricsFamily{name: family, metadata: md}
+			index[family] = f
+			families = append(families, f)
+		}
+		f.series = append(f.series, i)
+	}
+	return families, nil
+}
+
+// lookupOpenMetricsFamily returns the name and metadata of the metric family
+// given sample name belongs to.
+func lookupOpenMetricsFamily(name string, metadata map[string]v1.Metadata) (string, v1.Metadata) {
+	// Counters scraped from the Prometheus text format are stored with
+	// the _total suffix in the metadata.
+	if md, ok := metadata[name]; ok && md.Type == v1.MetricTypeCounter && strings.HasSuffix(name, "_total") {
+		return strings.TrimSuffix(name, "_total"), md
+	}
+
+	for _, suffix := range openMetricsSampleSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		family := strings.TrimSuffix(name, suffix)
+		md, ok := metadata[family]
+		if !ok {
+			continue
+		}
+		for _, allowed := range openMetricsSuffixes[md.Type] {
+			if allowed == suffix {
+				return family, md
+			}
+		}
+	}
+	return name, v1.Metadata{Type: v1.MetricTypeUnknown}
+}
+
+func appendOpenMetricsMetadata(buf []byte, f *openMetricsFamily) []byte {
+	if f.metadata.Type != v1.MetricTypeUnknown {
+		buf = append(buf, "# TYPE "...)
+		buf = append(buf, f.name...)
+		buf = append(buf, ' ')
+		buf = append(buf, f.metadata.Type...)
+		buf = append(buf, '\n')
+	}
+	// Units must be used as the suffix of the family name.
+	if f.metadata.Unit != "" && strings.HasSuffix(f.name, "_"+f.metadata.Unit) {
+		buf = append(buf, "# UNIT "...)
+		buf = append(buf, f.name...)
+		buf = append(buf, ' ')
+		buf = append(buf, f.metadata.Unit...)
+		buf = append(buf, '\n')
+	}
+	if f.metadata.Help != "" {
+		buf = append(buf, "# HELP "...)
+		buf = append(buf, f.name...)
+		buf = append(buf, ' ')
+		buf = appendOpenMetricsEscaped(buf, f.metadata.Help)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+func appendOpenMetricsSeries(buf []byte, metric model.Metric) []byte {
+	buf = append(buf, metric[model.MetricNameLabel]...)
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		if name != model.MetricNameLabel {
+			names = append(names, string(name))
+		}
+	}
+	if len(names) == 0 {
+		return buf
+	}
+	sort.Strings(names)
+	buf = append(buf, '{')
+	for i, name := range names {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, name...)
+		buf = append(buf, `="`...)
+		buf = appendOpenMetricsEscaped(buf, string(metric[model.LabelName(name)]))
+		buf = append(buf, '"')
+	}
+	return append(buf, '}')
+}
+
+func appendOpenMetricsEscaped(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '"':
+			buf = append(buf, `\"`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		default:
+			buf = append(buf, s[i])
+		}
+	}
+	return buf
+}
+
+func appendOpenMetricsValue(buf []byte, v float64) []byte {
+	switch {
+	case math.IsNaN(v):
+		return append(buf, "NaN"...)
+	case math.IsInf(v, 1):
+		return append(buf, "+Inf"...)
+	case math.IsInf(v, -1):
+		return append(buf, "-Inf"...)
+	default:
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,117 @@
+package promapi_test
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gkampitakis/go-snaps/snaps"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestRangeQueryResultWriteOpenMetrics(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+	ts := func(d time.Duration) model.Time {
+		return model.TimeFromUnixNano(start.Add(d).UnixNano())
+	}
+	values := func(vals ...float64) []model.SamplePair {
+		pairs := make([]model.SamplePair, 0, len(vals))
+		for i, v := range vals {
+			pairs = append(pairs, model.SamplePair{Timestamp: ts(time.Minute * time.Duration(i)), Value: model.SampleValue(v)})
+		}
+		return pairs
+	}
+
+	rqr := promapi.RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{
+				Metric: model.Metric{"__name__": "up", "job": "foo", "instance": "1"},
+				Values: values(1, 0, 1),
+			},
+			{
+				Metric: model.Metric{"__name__": "request_duration_seconds_bucket", "job": "foo", "le": "0.5"},
+				Values: values(1, 2),
+			},
+			{
+				Metric: model.Metric{"__name__": "http_requests_total", "job": "foo", "path": `/a "b"\c`},
+				Values: values(10, 20),
+			},
+			{
+				Metric: model.Metric{"__name__": "request_duration_seconds_bucket", "job": "foo", "le": "+Inf"},
+				Values: values(2, 4),
+			},
+			{
+				Metric: model.Metric{"__name__": "up", "job": "bar", "instance": "2"},
+				Values: []model.SamplePair{{Timestamp: ts(time.Millisecond * 1500), Value: 1}},
+			},
+			{
+				Metric: model.Metric{"__name__": "request_duration_seconds_count", "job": "foo"},
+				Values: values(2, 4),
+			},
+			{
+				Metric: model.Metric{"__name__": "request_duration_seconds_sum", "job": "foo"},
+				Values: values(0.75, 1.5),
+			},
+			{
+				Metric: model.Metric{"__name__": "no_metadata", "job": "line\nbreak"},
+				Values: values(math.NaN(), math.Inf(1), math.Inf(-1), 1e21),
+			},
+			{
+				Metric: model.Metric{"__name__": "gauge_total"},
+				Values: values(1),
+			},
+			{
+				Metric: model.Metric{"__name__": "empty"},
+			},
+		},
+	}
+	metadata := map[string]v1.Metadata{
+		"up":                       {Type: v1.MetricTypeGauge, Help: `Target is "up".`},
+		"http_requests_total":      {Type: v1.MetricTypeCounter, Help: "Total number of\nrequests."},
+		"request_duration_seconds": {Type: v1.MetricTypeHistogram, Help: `Request duration \ in seconds.`, Unit: "seconds"},
+		"gauge_total":              {Type: v1.MetricTypeGauge},
+	}
+
+	var buf strings.Builder
+	require.NoError(t, rqr.WriteOpenMetrics(&buf, metadata))
+	snaps.MatchSnapshot(t, buf.String())
+
+	// Make sure that Prometheus can parse it.
+	var series int
+	p := textparse.NewOpenMetricsParser([]byte(buf.String()))
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		if entry == textparse.EntrySeries {
+			series++
+		}
+	}
+	require.Equal(t, 19, series)
+}
+
+func TestRangeQueryResultWriteOpenMetricsErrors(t *testing.T) {
+	rqr := promapi.RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{Metric: model.Metric{"__name__": "up"}, Values: []model.SamplePair{{Timestamp: 0, Value: 1}}},
+		},
+	}
+	require.EqualError(t, rqr.WriteOpenMetrics(failingWriter{}, nil), "write failed")
+
+	rqr.Samples = append(rqr.Samples, &model.SampleStream{Metric: model.Metric{"job": "foo"}})
+	var buf strings.Builder
+	err := rqr.WriteOpenMetrics(&buf, nil)
+	require.ErrorIs(t, err, promapi.ErrMissingMetricName)
+	require.EqualError(t, err, `series has no metric name: {job="foo"}`)
+	require.Empty(t, buf.String(), "nothing should be written if any series has no name")
+}
@@ -0,0 +1,48 @@
+package promapi
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// ValueOrder controls the order used by RangeQueryResult.SortedByValue.
+type ValueOrder int
+
+const (
+	// Ascending returns the lowest value first.
+	Ascending ValueOrder = iota
+	// Descending returns the highest value first.
+	Descending
+)
+
+// SortedByValue returns a copy of all series with values of each series
+// sorted by value instead of timestamp. Values that are equal are kept in
+// timestamp order and NaN values are always returned last.
+// Samples are not modified, so the timestamp order used elsewhere is kept.
+func (rqr *RangeQueryResult) SortedByValue(order ValueOrder) []*model.SampleStream {
+	sorted := make([]*model.SampleStream, 0, len(rqr.Samples))
+	for _, s := range rqr.Samples {
+		values := make([]model.SamplePair, len(s.Values))
+		copy(values, s.Values)
+		sort.SliceStable(values, func(i, j int) bool {
+			return lessValue(float64(values[i].Value), float64(values[j].Value), order)
+		})
+		sorted = append(sorted, &model.SampleStream{Metric: s.Metric, Values: values})
+	}
+	return sorted
+}
+
+func lessValue(a, b float64, order ValueOrder) bool {
+	switch {
+	case math.IsNaN(a):
+		return false
+	case math.IsNaN(b):
+		return true
+	case order == Descending:
+		return a > b
+	default:
+		return a < b
+	}
+}
@@ -0,0 +1,81 @@
+package promapi_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestSortedByValue(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+	ts := func(d time.Duration) model.Time {
+		return model.TimeFromUnixNano(start.Add(d).UnixNano())
+	}
+	pairs := func(m map[time.Duration]float64, order ...time.Duration) []model.SamplePair {
+		vals := make([]model.SamplePair, 0, len(order))
+		for _, d := range order {
+			vals = append(vals, model.SamplePair{Timestamp: ts(d), Value: model.SampleValue(m[d])})
+		}
+		return vals
+	}
+
+	values := map[time.Duration]float64{
+		0:               3,
+		time.Minute:     1,
+		time.Minute * 2: 5,
+		time.Minute * 3: 1,
+		time.Minute * 4: 4,
+	}
+	metric := model.Metric{"__name__": "up", "instance": "1"}
+	canonical := pairs(values, 0, time.Minute, time.Minute*2, time.Minute*3, time.Minute*4)
+	rqr := promapi.RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{Metric: metric, Values: canonical},
+			{Metric: model.Metric{"__name__": "up", "instance": "2"}},
+		},
+	}
+
+	asc := rqr.SortedByValue(promapi.Ascending)
+	require.Len(t, asc, 2)
+	require.Equal(t, metric, asc[0].Metric)
+	require.Equal(t, pairs(values, time.Minute, time.Minute*3, 0, time.Minute*4, time.Minute*2), asc[0].Values)
+	require.Empty(t, asc[1].Values)
+
+	desc := rqr.SortedByValue(promapi.Descending)
+	require.Len(t, desc, 2)
+	require.Equal(t, pairs(values, time.Minute*2, time.Minute*4, 0, time.Minute, time.Minute*3), desc[0].Values)
+
+	require.Equal(t, pairs(values, 0, time.Minute, time.Minute*2, time.Minute*3, time.Minute*4), rqr.Samples[0].Values, "samples should still be sorted by timestamp")
+}
+
+func TestSortedByValueNaN(t *testing.T) {
+	rqr := promapi.RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{
+				Metric: model.Metric{"__name__": "up"},
+				Values: []model.SamplePair{
+					{Timestamp: 1000, Value: model.SampleValue(math.NaN())},
+					{Timestamp: 2000, Value: 2},
+					{Timestamp: 3000, Value: 1},
+				},
+			},
+		},
+	}
+
+	asc := rqr.SortedByValue(promapi.Ascending)[0].Values
+	require.Len(t, asc, 3)
+	require.Equal(t, model.Time(3000), asc[0].Timestamp)
+	require.Equal(t, model.Time(2000), asc[1].Timestamp)
+	require.True(t, math.IsNaN(float64(asc[2].Value)), "NaN should be last")
+
+	desc := rqr.SortedByValue(promapi.Descending)[0].Values
+	require.Len(t, desc, 3)
+	require.Equal(t, model.Time(2000), desc[0].Timestamp)
+	require.Equal(t, model.Time(3000), desc[1].Timestamp)
+	require.True(t, math.IsNaN(float64(desc[2].Value)), "NaN should be last")
+}
@@ -0,0 +1,60 @@
+package promapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/cloudflare/pint/internal/output"
+)
+
+type PingResult struct {
+	URI string
+	// Latency is the time it took to get a response.
+	Latency time.Duration
+}
+
+// Ping runs a trivial vector(1) query to check if Prometheus is up and
+// able to run queries. Unlike other queries it's never cached and doesn't
+// wait for a free worker, so it can be used before starting any heavy work.
+func (p *Prometheus) Ping(ctx context.Context) (*PingResult, error) {
+	log.Debug().Str("uri", p.uri).Msg("Pinging Prometheus server")
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	path := "/api/v1/query"
+	args := url.Values{}
+	args.Set("query", "vector(1)")
+	req := p.describeRequest(http.MethodGet, path, args)
+
+	start := time.Now()
+	resp, err := p.doRequest(ctx, http.MethodGet, path, args, nil)
+	if err != nil {
+		return nil, QueryError{err: err, msg: decodeError(err), request: &req}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = tryDecodingAPIError(resp)
+		return nil, QueryError{err: err, msg: decodeError(err), request: &req}
+	}
+
+	samples, err := streamSamples(resp.Body)
+	if err != nil {
+		return nil, QueryError{err: err, msg: decodeError(err), request: &req}
+	}
+	if len(samples) != 1 || samples[0].Value != 1 {
+		err = fmt.Errorf("unexpected response to vector(1) query, got %d sample(s)", len(samples))
+		return nil, QueryError{err: err, msg: decodeError(err), request: &req}
+	}
+
+	r := PingResult{URI: p.uri, Latency: time.Since(start)}
+	log.Debug().Str("uri", p.uri).Str("latency", output.HumanizeDuration(r.Latency)).Msg("Prometheus server is up")
+
+	return &r, nil
+}
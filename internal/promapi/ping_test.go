@@ -0,0 +1,86 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestPing(t *testing.T) {
+	type testCaseT struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}
+
+	testCases := []testCaseT{
+		{
+			name:   "healthy",
+			status: 200,
+			body:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1614859502.068,"1"]}]}}`,
+		},
+		{
+			name:   "unhealthy",
+			status: 503,
+			body:   "Service Unavailable",
+			err:    "server_error: server error: 503",
+		},
+		{
+			name:   "empty",
+			status: 200,
+			body:   `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			err:    "unexpected response to vector(1) query, got 0 sample(s)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				err := r.ParseForm()
+				if err != nil {
+					t.Fatal(err)
+				}
+				require.Equal(t, "/api/v1/query", r.URL.Path)
+				require.Equal(t, "vector(1)", r.Form.Get("query"))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			pr, err := prom.Ping(context.Background())
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, srv.URL, pr.URI)
+			require.Positive(t, pr.Latency)
+		})
+	}
+}
+
+func TestPingDown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	uri := srv.URL
+	srv.Close()
+
+	prom := promapi.NewPrometheus("test", uri, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	_, err := prom.Ping(context.Background())
+	require.EqualError(t, err, "connection refused")
+	require.True(t, promapi.IsUnavailableError(err))
+}
@@ -0,0 +1,122 @@
+package promapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// PrefetchEntry is a single range query defined in a prefetch manifest.
+type PrefetchEntry struct {
+	Expr     string
+	Lookback time.Duration
+	Step     time.Duration
+}
+
+type prefetchManifestEntry struct {
+	Expr     string `yaml:"expr"`
+	Lookback string `yaml:"lookback"`
+	Step     string `yaml:"step"`
+}
+
+// ParsePrefetchManifest reads a list of range queries to prefetch.
+// Manifest can be either YAML or JSON document with a list of entries:
+//
+//   - expr: sum(rate(http_requests_total[5m]))
+//     lookback: 7d
+//     step: 5m
+func ParsePrefetchManifest(r io.Reader) ([]PrefetchEntry, error) {
+	var manifest []prefetchManifestEntry
+	if err := yaml.NewDecoder(r).Decode(&manifest); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse prefetch manifest: %w", err)
+	}
+
+	entries := make([]PrefetchEntry, 0, len(manifest))
+	for i, m := range manifest {
+		if m.Expr == "" {
+			return nil, fmt.Errorf("prefetch manifest entry #%d is missing expr", i+1)
+		}
+		lookback, err := model.ParseDuration(m.Lookback)
+		if err != nil {
+			return nil, fmt.Errorf("prefetch manifest entry #%d has invalid lookback: %w", i+1, err)
+		}
+		step, err := model.ParseDuration(m.Step)
+		if err != nil {
+			return nil, fmt.Errorf("prefetch manifest entry #%d has invalid step: %w", i+1, err)
+		}
+		if step <= 0 || lookback <= 0 {
+			return nil, fmt.Errorf("prefetch manifest entry #%d must have non-zero lookback and step", i+1)
+		}
+		entries = append(entries, PrefetchEntry{
+			Expr:     m.Expr,
+			Lookback: time.Duration(lookback),
+			Step:     time.Duration(step),
+		})
+	}
+	return entries, nil
+}
+
+// PrefetchResult holds the outcome of prefetching a single manifest entry.
+type PrefetchResult struct {
+	Entry  PrefetchEntry
+	Series int
+	// Duration is the time it took to run the batch this entry was part of.
+	Duration time.Duration
+	Err      error
+}
+
+type rangeBatcher interface {
+	RangeQueryBatch(ctx context.Context, exprs []string, params RangeQueryTimes, opts RangeQueryOptions) (map[string]*RangeQueryResult, map[string]error)
+}
+
+// Prefetch runs all entries as range queries, populating the query cache.
+// Entries using the same lookback and step are sent as a single batch.
+// Results are returned in the same order as entries.
+func Prefetch(ctx context.Context, prom rangeBatcher, entries []PrefetchEntry) []PrefetchResult {
+	type window struct {
+		lookback time.Duration
+		step     time.Duration
+	}
+
+	groups := map[window][]int{}
+	windows := []window{}
+	for i, e := range entries {
+		w := window{lookback: e.Lookback, step: e.Step}
+		if _, ok := groups[w]; !ok {
+			windows = append(windows, w)
+		}
+		groups[w] = append(groups[w], i)
+	}
+	sort.SliceStable(windows, func(i, j int) bool {
+		if windows[i].lookback != windows[j].lookback {
+			return windows[i].lookback < windows[j].lookback
+		}
+		return windows[i].step < windows[j].step
+	})
+
+	results := make([]PrefetchResult, len(entries))
+	for _, w := range windows {
+		exprs := make([]string, 0, len(groups[w]))
+		for _, i := range groups[w] {
+			exprs = append(exprs, entries[i].Expr)
+		}
+
+		start := time.Now()
+		qrs, errs := prom.RangeQueryBatch(ctx, exprs, NewRelativeRange(w.lookback, w.step), RangeQueryOptions{})
+		dur := time.Since(start)
+
+		for _, i := range groups[w] {
+			results[i] = PrefetchResult{Entry: entries[i], Duration: dur, Err: errs[entries[i].Expr]}
+			if qr, ok := qrs[entries[i].Expr]; ok {
+				results[i].Series = len(qr.Samples)
+			}
+		}
+	}
+	return results
+}
@@ -0,0 +1,170 @@
+package promapi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestParsePrefetchManifest(t *testing.T) {
+	type testCaseT struct {
+		name     string
+		manifest string
+		entries  []promapi.PrefetchEntry
+		err      string
+	}
+
+	testCases := []testCaseT{
+		{
+			name:     "empty",
+			manifest: "",
+			entries:  []promapi.PrefetchEntry{},
+		},
+		{
+			name: "yaml",
+			manifest: `
+- expr: up
+  lookback: 7d
+  step: 5m
+- expr: sum(rate(http_requests_total[5m]))
+  lookback: 1h
+  step: 1m
+`,
+			entries: []promapi.PrefetchEntry{
+				{Expr: "up", Lookback: time.Hour * 24 * 7, Step: time.Minute * 5},
+				{Expr: "sum(rate(http_requests_total[5m]))", Lookback: time.Hour, Step: time.Minute},
+			},
+		},
+		{
+			name:     "json",
+			manifest: `[{"expr": "up", "lookback": "2h", "step": "30s"}]`,
+			entries: []promapi.PrefetchEntry{
+				{Expr: "up", Lookback: time.Hour * 2, Step: time.Second * 30},
+			},
+		},
+		{
+			name:     "invalid",
+			manifest: `{"expr": "up"}`,
+			err:      "failed to parse prefetch manifest: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!map into []promapi.prefetchManifestEntry",
+		},
+		{
+			name:     "missing expr",
+			manifest: `[{"lookback": "2h", "step": "30s"}]`,
+			err:      "prefetch manifest entry #1 is missing expr",
+		},
+		{
+			name:     "bad lookback",
+			manifest: `[{"expr": "up", "lookback": "2h", "step": "30s"}, {"expr": "up", "lookback": "foo", "step": "30s"}]`,
+			err:      `prefetch manifest entry #2 has invalid lookback: not a valid duration string: "foo"`,
+		},
+		{
+			name:     "bad step",
+			manifest: `[{"expr": "up", "lookback": "2h", "step": "1 minute"}]`,
+			err:      `prefetch manifest entry #1 has invalid step: not a valid duration string: "1 minute"`,
+		},
+		{
+			name:     "zero step",
+			manifest: `[{"expr": "up", "lookback": "2h", "step": "0s"}]`,
+			err:      "prefetch manifest entry #1 must have non-zero lookback and step",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := promapi.ParsePrefetchManifest(strings.NewReader(tc.manifest))
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.entries, entries)
+			}
+		})
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var lock sync.Mutex
+	steps := map[string][]string{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expr := r.Form.Get("query")
+		lock.Lock()
+		steps[expr] = append(steps[expr], r.Form.Get("step"))
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if expr == "error" {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"bad query"}`))
+			return
+		}
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"},"values":[]},
+			{"metric":{"instance":"2"},"values":[]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	entries, err := promapi.ParsePrefetchManifest(strings.NewReader(`
+- expr: foo
+  lookback: 1h
+  step: 5m
+- expr: error
+  lookback: 1h
+  step: 5m
+- expr: bar
+  lookback: 30m
+  step: 1m
+`))
+	require.NoError(t, err)
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 2, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	results := promapi.Prefetch(context.Background(), prom, entries)
+	require.Len(t, results, 3)
+
+	require.Equal(t, entries[0], results[0].Entry)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, 2, results[0].Series)
+
+	require.Equal(t, entries[1], results[1].Entry)
+	var qe promapi.QueryError
+	require.True(t, errors.As(results[1].Err, &qe))
+	require.EqualError(t, results[1].Err, "bad_data: bad query")
+	require.Equal(t, 0, results[1].Series)
+
+	require.Equal(t, entries[2], results[2].Entry)
+	require.NoError(t, results[2].Err)
+	require.Equal(t, 2, results[2].Series)
+
+	for _, r := range results {
+		require.Greater(t, r.Duration, time.Duration(0))
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.NotEmpty(t, steps["foo"])
+	for _, step := range steps["foo"] {
+		require.Equal(t, "300", step)
+	}
+	require.NotEmpty(t, steps["bar"])
+	for _, step := range steps["bar"] {
+		require.Equal(t, "60", step)
+	}
+}
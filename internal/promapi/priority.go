@@ -0,0 +1,90 @@
+package promapi
+
+import (
+	"context"
+)
+
+// QueryPriority controls the order in which queued queries are run.
+type QueryPriority int
+
+const (
+	// NormalPriority is used by default.
+	NormalPriority QueryPriority = iota
+	// HighPriority queries are run before any queued normal priority query,
+	// queries that are already running are not interrupted.
+	HighPriority
+)
+
+type priorityKey struct{}
+
+// WithQueryPriority returns a context that will make all queries using it
+// run with given priority.
+func WithQueryPriority(ctx context.Context, priority QueryPriority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+func queryPriority(ctx context.Context) QueryPriority {
+	if p, ok := ctx.Value(priorityKey{}).(QueryPriority); ok {
+		return p
+	}
+	return NormalPriority
+}
+
+// enqueue sends a query to workers using the priority set on the context.
+// If the context is cancelled before any worker accepts the query, or
+// workers were stopped, then the error is sent as the query result instead,
+// so callers waiting for it never block.
+func (prom *Prometheus) enqueue(ctx context.Context, req queryRequest) {
+	req.ctx = ctx
+	req.priority = queryPriority(ctx)
+
+	prom.queueMtx.RLock()
+	defer prom.queueMtx.RUnlock()
+	if prom.stopped {
+		go reject(req, errWorkersStopped)
+		return
+	}
+
+	queue := prom.queries
+	if req.priority == HighPriority {
+		queue = prom.priorityQueries
+	}
+	select {
+	case queue <- req:
+	case <-ctx.Done():
+		go reject(req, ctx.Err())
+	}
+}
+
+func reject(req queryRequest, err error) {
+	req.result <- queryResult{err: err}
+}
+
+// nextQuery returns the next query to run, high priority queries are always
+// returned first. It returns false once both channels are closed.
+func nextQuery(queries, priority chan queryRequest) (queryRequest, bool) {
+	select {
+	case job, ok := <-priority:
+		if ok {
+			return job, true
+		}
+		priority = nil
+	default:
+	}
+
+	for queries != nil || priority != nil {
+		select {
+		case job, ok := <-priority:
+			if ok {
+				return job, true
+			}
+			priority = nil
+		case job, ok := <-queries:
+			if ok {
+				return job, true
+			}
+			queries = nil
+		}
+	}
+	return queryRequest{}, false
+}
@@ -2,27 +2,62 @@ package promapi
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"hash"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/klauspost/compress/gzhttp"
 	"github.com/rs/zerolog/log"
 	"go.uber.org/ratelimit"
+	"golang.org/x/exp/slices"
 
 	"github.com/cloudflare/pint/internal/output"
 )
 
 var cacheExpiry = time.Minute * 5
 
+// cacheKeyVersion is included in all cache keys, it must be bumped every
+// time the format of cached values changes so old entries are never reused.
+var cacheKeyVersion = "1"
+
+// sensitiveHeaders are never included in the server identity, since
+// they usually hold credentials that can be rotated.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// newCacheKeyHash returns a hash to be used for generating cache keys.
+// Cache namespace is always included, so results from different servers
+// never share cache entries unless they use the same namespace.
+func (prom *Prometheus) newCacheKeyHash() hash.Hash {
+	h := sha1.New()
+	for _, part := range prom.cacheKeyParts() {
+		_, _ = io.WriteString(h, part.Value)
+		_, _ = io.WriteString(h, "\n")
+	}
+	return h
+}
+
+// cacheKeyParts returns values included in all cache keys.
+func (prom *Prometheus) cacheKeyParts() []CacheKeyPart {
+	return []CacheKeyPart{
+		{Name: "version", Value: cacheKeyVersion},
+		{Name: "namespace", Value: prom.namespace},
+	}
+}
+
 type QueryError struct {
-	err error
-	msg string
+	err     error
+	msg     string
+	request *RequestDetails
 }
 
 func (qe QueryError) Error() string {
@@ -33,6 +68,22 @@ func (qe QueryError) Unwrap() error {
 	return qe.err
 }
 
+// Request returns details of the HTTP request that failed, if known.
+func (qe QueryError) Request() *RequestDetails {
+	return qe.request
+}
+
+// RequestDetails describes a single HTTP request sent to Prometheus.
+// It's meant for debugging, so that users can re-run the exact same
+// request with curl.
+// Any credentials stored in the URI are redacted.
+// Body is empty for POST requests sent using WithStreamingBody.
+type RequestDetails struct {
+	Method string
+	URI    string
+	Body   string
+}
+
 type querier interface {
 	Endpoint() string
 	String() string
@@ -41,14 +92,22 @@ type querier interface {
 }
 
 type queryRequest struct {
-	query  querier
-	result chan queryResult
+	ctx      context.Context
+	query    querier
+	result   chan queryResult
+	priority QueryPriority
+	// started is closed once a worker picks up the query, if it's set.
+	started chan struct{}
 }
 
 type queryResult struct {
-	value   any
-	err     error
-	expires time.Time
+	value    any
+	stats    *QueryStats
+	transfer TransferStats
+	status   string
+	err      error
+	expires  time.Time
+	request  RequestDetails
 }
 
 type Prometheus struct {
@@ -56,47 +115,380 @@ type Prometheus struct {
 	uri         string
 	timeout     time.Duration
 	concurrency int
-	client      http.Client
-	cache       *lru.ARCCache
-	locker      *partitionLocker
-	rateLimiter ratelimit.Limiter
-	wg          sync.WaitGroup
-	queries     chan queryRequest
+	adaptive    bool
+	limiter     *concurrencyLimiter
+	retries     int
+	lookback    time.Duration
+	proxy       *url.URL
+	errorLog    *errorLog
+	// exhaustedLog is used for errors returned after all retries failed,
+	// it always has a window, so those are never logged for every query.
+	exhaustedLog *errorLog
+	// safeURI is the URI with any password removed.
+	safeURI      string
+	slowLog      *slowLog
+	clock        func() time.Time
+	remoteRead   bool
+	jsonBody     bool
+	streamBody   bool
+	protobuf     bool
+	noTimeout    bool
+	noKeepAlive  bool
+	recordDir    string
+	recordClock  sync.Once
+	replayDir    string
+	sticky       string
+	cancelHeader string
+	cancelPath   string
+	maxSkew      time.Duration
+	maxLag       time.Duration
+	freshness    string
+	headers      http.Header
+	apiVersion   apiVersionTracker
+	namespace    string
+	rewriters    []QueryRewriter
+	metricFilter MetricFilter
+	client       http.Client
+	cache        *QueryCache
+	cacheBytes   int
+	compress     bool
+	locker       *partitionLocker
+	rateLimiter  ratelimit.Limiter
+	wg           sync.WaitGroup
+	queries      chan queryRequest
+	// priorityQueries holds high priority queries, workers always read
+	// from it before reading from queries.
+	priorityQueries chan queryRequest
+	// queueMtx guards closing both query channels, stopped is set once
+	// they're closed.
+	queueMtx sync.RWMutex
+	stopped  bool
+}
+
+// PrometheusOption allows to customise optional Prometheus client settings.
+type PrometheusOption func(*Prometheus)
+
+// WithRetries sets how many times a query will be retried if it fails
+// because Prometheus is unavailable.
+// Default is 0, which disables retries.
+func WithRetries(n int) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.retries = n
+	}
+}
+
+// WithLookbackDelta sets the lookback_delta parameter on all queries.
+// It should match the --query.lookback-delta flag of the Prometheus server.
+// Default is 0, which doesn't send lookback_delta and relies on the server
+// default.
+func WithLookbackDelta(d time.Duration) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.lookback = d
+	}
+}
+
+// WithProxy sets the proxy URL used for all requests to this server.
+// By default proxy is configured using HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables.
+func WithProxy(u *url.URL) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.proxy = u
+	}
+}
+
+// retriesExhaustedLogWindow is the minimum window used to collapse errors
+// returned after all retries failed, those happen when the server is down,
+// so every query would fail with the same error.
+const retriesExhaustedLogWindow = time.Minute
+
+// WithErrorLogWindow enables collapsing of identical query errors in logs.
+// Each error is logged only once per window, with the number of suppressed
+// duplicates included in the next log line.
+// Default is 0, which logs every error, except errors returned after all
+// retries failed, which are always logged at most once per minute.
+func WithErrorLogWindow(d time.Duration) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.errorLog = newErrorLog(d)
+	}
 }
 
-func NewPrometheus(name, uri string, timeout time.Duration, concurrency, cacheSize, rl int) *Prometheus {
-	cache, _ := lru.NewARC(cacheSize)
+// WithSlowQueryLog enables tracking of the n slowest queries sent to
+// Prometheus, they can be read using SlowestQueries.
+// Queries served from the cache are not tracked.
+// Default is 0, which disables tracking.
+func WithSlowQueryLog(n int) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.slowLog = newSlowLog(n)
+	}
+}
 
+// WithJSONBody makes all POST requests, which are used for instant and
+// range queries, send parameters as a JSON object instead of a form encoded
+// body. This is only needed for query gateways that don't accept forms.
+// Query cache keys don't depend on the body encoding.
+func WithJSONBody() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.jsonBody = true
+	}
+}
+
+// WithStreamingBody makes POST requests stream their body to the server
+// while it's being encoded, instead of encoding the whole body in memory
+// first. Streamed bodies can't be sent again, so the HTTP client won't be
+// able to follow redirects for such requests. Retries are not affected,
+// every retry encodes the body again.
+// Body of streamed requests is not included in RequestDetails.
+func WithStreamingBody() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.streamBody = true
+	}
+}
+
+// WithProtobufResponses makes range queries ask for protobuf responses,
+// which are much faster to decode than JSON for large results.
+// Prometheus itself only responds with JSON, this is for servers and
+// proxies that register their own response codec, which must encode range
+// query results as a prompb.QueryResult message, the same one used by
+// remote read. Responses with any other content type are decoded as JSON.
+func WithProtobufResponses() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.protobuf = true
+	}
+}
+
+// WithoutTimeoutParam stops sending the timeout parameter with instant
+// and range queries, for backends that reject it. Queries are still
+// cancelled by the client once the timeout is reached.
+func WithoutTimeoutParam() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.noTimeout = true
+	}
+}
+
+// WithoutKeepAlives disables connection reuse, every request will be sent
+// using a new connection. This is slower but it might be needed when there's
+// a load balancer that doesn't route pooled connections consistently.
+func WithoutKeepAlives() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.noKeepAlive = true
+	}
+}
+
+// WithClock sets the function used to get current time when building
+// query cache keys and expiring cached results.
+// Default is time.Now.
+func WithClock(clock func() time.Time) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.clock = clock
+	}
+}
+
+// WithStickyHeader enables sending the given header with all range query
+// requests. Header value is generated for each range query and shared by
+// all slices of it, so that proxies like Thanos or Cortex can route all
+// slices to the same backend, giving consistent results.
+func WithStickyHeader(name string) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.sticky = name
+	}
+}
+
+// WithQueryCancelEndpoint enables cancelling queries on servers that return
+// a query ID in the given response header and allow to cancel running
+// queries by sending a POST request with that ID as the id parameter to
+// the given path. If a query is cancelled, or times out, after response
+// headers were received then pint will make a best-effort attempt to
+// cancel it on the server too, so it stops computing a result nobody waits for.
+// This is only used for instant and range queries.
+func WithQueryCancelEndpoint(header, path string) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.cancelHeader = header
+		prom.cancelPath = path
+	}
+}
+
+// WithHeaders sets extra HTTP headers sent with every request, like
+// the tenant header needed by multi-tenant Prometheus compatible servers.
+func WithHeaders(headers map[string]string) PrometheusOption {
+	return func(prom *Prometheus) {
+		for k, v := range headers {
+			prom.headers.Set(k, v)
+		}
+	}
+}
+
+// WithCache makes Prometheus store query results in a cache that can be
+// shared with other servers. Cache size passed to NewPrometheus is ignored.
+func WithCache(cache *QueryCache) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.cache = cache
+	}
+}
+
+// WithCacheNamespace sets the namespace included in all cache keys.
+// Servers sharing a cache can only reuse each other's results if they use
+// the same namespace, this allows replicas of a single Prometheus server to
+// share cached results while keeping other servers separate.
+// Default namespace is derived from the URI and headers of the server.
+func WithCacheNamespace(ns string) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.namespace = ns
+	}
+}
+
+// WithCacheMaxBytes limits the total size of all query results stored in
+// the cache, least recently used results are evicted once it's crossed.
+// When WithCache is used the limit is applied to that cache, so it affects
+// all servers sharing it.
+// Default is 0, which only limits the number of cached results.
+func WithCacheMaxBytes(n int) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.cacheBytes = n
+	}
+}
+
+// WithCacheCompression makes the cache store all query results compressed,
+// which reduces memory usage of big caches at the cost of CPU time needed
+// to decompress results every time they're read.
+// It's ignored when WithCache is used, such caches should be created using
+// NewCompressedQueryCache instead.
+func WithCacheCompression() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.compress = true
+	}
+}
+
+// WithAdaptiveConcurrency makes the number of queries running at the same
+// time adapt to how the server responds. Every 429 or 503 response halves
+// it, and it slowly grows back, up to the number of workers, as requests
+// succeed. This lets pint back off from servers that can't handle all
+// the queries it sends.
+func WithAdaptiveConcurrency() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.adaptive = true
+	}
+}
+
+func NewPrometheus(name, uri string, timeout time.Duration, concurrency, cacheSize, rl int, opts ...PrometheusOption) *Prometheus {
 	prom := Prometheus{
 		name:        name,
 		uri:         uri,
 		timeout:     timeout,
-		client:      http.Client{Transport: gzhttp.Transport(http.DefaultTransport)},
-		cache:       cache,
 		locker:      newPartitionLocker((&sync.Mutex{})),
 		rateLimiter: ratelimit.New(rl),
 		concurrency: concurrency,
+		errorLog:    newErrorLog(0),
+		clock:       time.Now,
+		headers:     http.Header{},
+	}
+	for _, opt := range opts {
+		opt(&prom)
+	}
+	switch {
+	case prom.cache == nil && prom.compress:
+		prom.cache = NewCompressedQueryCache(cacheSize, prom.cacheBytes)
+	case prom.cache == nil:
+		prom.cache = NewBoundedQueryCache(cacheSize, prom.cacheBytes)
+	case prom.cacheBytes > 0:
+		prom.cache.setMaxBytes(prom.cacheBytes, prom.clock())
 	}
+	if prom.namespace == "" {
+		prom.namespace = serverIdentity(uri, prom.headers)
+	}
+	window := retriesExhaustedLogWindow
+	if prom.errorLog.window > window {
+		window = prom.errorLog.window
+	}
+	prom.exhaustedLog = newErrorLog(window)
+	prom.safeURI = redactURI(uri)
+	prom.pinReplayClock()
+	prom.client = http.Client{Transport: gzhttp.Transport(prom.newTransport())}
 	return &prom
 }
 
-func (prom *Prometheus) purgeExpiredCache() {
-	now := time.Now()
-	for _, key := range prom.cache.Keys() {
-		if val, found := prom.cache.Peek(key); found {
-			if c, ok := val.(queryResult); ok {
-				if !c.expires.IsZero() && c.expires.Before(now) {
-					prom.cache.Remove(key)
-				}
-			}
+// redactURI returns the URI with any password replaced, so it can be used
+// in logs and metric labels.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.Redacted()
+}
+
+// serverIdentity returns a string that uniquely identifies a server,
+// it's the URI with any password removed followed by all headers
+// that might change the response.
+func serverIdentity(uri string, headers http.Header) string {
+	var b strings.Builder
+	if u, err := url.Parse(uri); err == nil {
+		if u.User != nil {
+			u.User = url.User(u.User.Username())
+		}
+		b.WriteString(u.String())
+	} else {
+		b.WriteString(uri)
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		if !slices.Contains(sensitiveHeaders, k) {
+			names = append(names, k)
 		}
 	}
+	sort.Strings(names)
+	for _, k := range names {
+		b.WriteString("\n")
+		b.WriteString(k)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(headers.Values(k), ", "))
+	}
+	return b.String()
+}
+
+func (prom *Prometheus) newTransport() http.RoundTripper {
+	if prom.proxy == nil && !prom.noKeepAlive {
+		return http.DefaultTransport
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if prom.proxy != nil {
+		transport.Proxy = http.ProxyURL(prom.proxy)
+	}
+	transport.DisableKeepAlives = prom.noKeepAlive
+	return transport
 }
 
+func (prom *Prometheus) purgeExpiredCache() {
+	prom.cache.purgeExpired(prom.clock())
+}
+
+// CacheEntries returns details of all query results currently stored in the cache.
+func (prom *Prometheus) CacheEntries() []CacheEntryInfo {
+	return prom.cache.info(prom.clock())
+}
+
+// CacheEvictionOrder returns details of all query results currently stored
+// in the cache, in the order they would be evicted because of size pressure.
+// Least recently used results are evicted first.
+func (prom *Prometheus) CacheEvictionOrder() []CacheEntryInfo {
+	return prom.cache.evictionOrder(prom.clock())
+}
+
+// errWorkersStopped is returned for queries sent after Close was called.
+var errWorkersStopped = errors.New("query workers are stopped")
+
 func (prom *Prometheus) Close() {
 	log.Debug().Str("name", prom.name).Str("uri", prom.uri).Msg("Stopping query workers")
+	prom.queueMtx.Lock()
+	prom.stopped = true
 	close(prom.queries)
+	close(prom.priorityQueries)
+	prom.queueMtx.Unlock()
+	prom.limiter.close()
 	prom.wg.Wait()
+	prom.errorLog.flush(prom.uri)
+	prom.exhaustedLog.flush(prom.uri)
 }
 
 func (prom *Prometheus) StartWorkers() {
@@ -106,29 +498,63 @@ func (prom *Prometheus) StartWorkers() {
 		Int("workers", prom.concurrency).
 		Msg("Starting query workers")
 
+	if prom.adaptive {
+		prom.limiter = newConcurrencyLimiter(prom.concurrency)
+	}
 	prom.queries = make(chan queryRequest, prom.concurrency*10)
+	prom.priorityQueries = make(chan queryRequest, prom.concurrency*10)
 
 	for w := 1; w <= prom.concurrency; w++ {
 		prom.wg.Add(1)
 		go func() {
 			defer prom.wg.Done()
-			queryWorker(prom, prom.queries)
+			queryWorker(prom, prom.queries, prom.priorityQueries)
 		}()
 	}
 }
 
-func (prom *Prometheus) doRequest(ctx context.Context, method, path string, args url.Values) (*http.Response, error) {
-	u, _ := url.Parse(prom.uri)
+// endpointURI returns the full URL for given API path. Any path set on the
+// server URI is kept as a prefix, so servers behind a reverse proxy that
+// serves them under a sub-path work for all endpoints. Every request must
+// use it to build its URL.
+func (prom *Prometheus) endpointURI(path string) (*url.URL, error) {
+	u, err := url.Parse(prom.uri)
+	if err != nil {
+		return nil, err
+	}
 	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u.JoinPath(path), nil
+}
 
-	uri, err := url.JoinPath(u.String(), path)
+func (prom *Prometheus) describeRequest(method, path string, args url.Values) RequestDetails {
+	rd := RequestDetails{Method: method}
+	u, err := prom.endpointURI(path)
+	if err != nil {
+		return rd
+	}
+	switch {
+	case method != http.MethodPost:
+		u.RawQuery = args.Encode()
+	case prom.streamBody:
+		// Streamed bodies are never encoded in memory, don't do it here.
+	default:
+		rd.Body, _ = prom.encodeBody(args)
+	}
+	rd.URI = u.Redacted()
+	return rd
+}
+
+func (prom *Prometheus) doRequest(ctx context.Context, method, path string, args url.Values, headers http.Header) (*http.Response, error) {
+	u, err := prom.endpointURI(path)
 	if err != nil {
 		return nil, err
 	}
+	uri := u.String()
 
 	var body io.Reader
+	var contentType string
 	if method == http.MethodPost {
-		body = strings.NewReader(args.Encode())
+		body, contentType = prom.requestBody(args)
 	} else if eargs := args.Encode(); eargs != "" {
 		uri += "?" + eargs
 	}
@@ -137,30 +563,152 @@ func (prom *Prometheus) doRequest(ctx context.Context, method, path string, args
 	if err != nil {
 		return nil, err
 	}
-	if method == http.MethodPost {
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	prom.setHeaders(req, headers)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
+	return prom.sendRequest(req)
+}
 
-	return prom.client.Do(req)
+// sendRequest sends a request to Prometheus, headers must be already set.
+// All requests are sent using it, so every response is seen by the
+// concurrency limiter and API version tracking.
+func (prom *Prometheus) sendRequest(req *http.Request) (*http.Response, error) {
+	sent := time.Now()
+	resp, err := prom.client.Do(req)
+	if err == nil {
+		prom.limiter.observe(resp.StatusCode, sent)
+		prom.apiVersion.observe(prom.uri, resp.Header)
+	}
+	return resp, err
 }
 
-func queryWorker(prom *Prometheus, queries chan queryRequest) {
-	for job := range queries {
-		job := job
+// requestBody returns the POST request body for given parameters together
+// with its content type. The body is fully buffered, which allows the HTTP
+// client to send it again when needed, unless WithStreamingBody was used.
+func (prom *Prometheus) requestBody(args url.Values) (io.Reader, string) {
+	if !prom.streamBody {
+		body, contentType := prom.encodeBody(args)
+		return strings.NewReader(body), contentType
+	}
 
-		cacheKey := job.query.CacheKey()
-		if cacheKey != "" {
-			if cached, ok := prom.cache.Get(cacheKey); ok {
-				job.result <- cached.(queryResult)
-				prometheusCacheHitsTotal.WithLabelValues(prom.name, job.query.Endpoint()).Inc()
-				log.Debug().
-					Str("uri", prom.uri).
-					Str("query", job.query.String()).
-					Str("key", cacheKey).
-					Msg("Cache hit")
-				continue
+	pr, pw := io.Pipe()
+	go func() {
+		// The client always closes the request body, which unblocks
+		// any pending write if the request fails before it's sent.
+		pw.CloseWithError(prom.writeBody(pw, args))
+	}()
+	return pr, prom.bodyContentType()
+}
+
+// encodeBody returns the POST request body for given parameters together
+// with its content type.
+func (prom *Prometheus) encodeBody(args url.Values) (body, contentType string) {
+	var b strings.Builder
+	// Writing to a strings.Builder can't fail.
+	_ = prom.writeBody(&b, args)
+	return b.String(), prom.bodyContentType()
+}
+
+// writeBody writes the POST request body for given parameters to w.
+// Parameters are sent as a form unless WithJSONBody was used, in which case
+// they are sent as a JSON object with string values.
+func (prom *Prometheus) writeBody(w io.Writer, args url.Values) error {
+	if !prom.jsonBody {
+		_, err := io.WriteString(w, args.Encode())
+		return err
+	}
+	obj := make(map[string]string, len(args))
+	for k := range args {
+		obj[k] = args.Get(k)
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (prom *Prometheus) bodyContentType() string {
+	if prom.jsonBody {
+		return "application/json"
+	}
+	return "application/x-www-form-urlencoded"
+}
+
+// setHeaders adds all headers configured via WithHeaders and any extra
+// headers passed to it to the request.
+func (prom *Prometheus) setHeaders(req *http.Request, headers http.Header) {
+	for _, hdrs := range []http.Header{prom.headers, headers} {
+		for k, vals := range hdrs {
+			for _, v := range vals {
+				req.Header.Add(k, v)
+			}
+		}
+	}
+}
+
+// cacheExpires returns the time when the response should be removed from
+// the cache, using Cache-Control or Expires response headers if present,
+// or def otherwise.
+// Responses marked as no-cache or no-store expire immediately.
+func (prom *Prometheus) cacheExpires(resp *http.Response, def time.Time) time.Time {
+	now := prom.clock()
+	if cc := resp.Header.Get("Cache-Control"); cc != "" {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-cache", directive == "no-store":
+				return now
+			case strings.HasPrefix(directive, "max-age="):
+				if sec, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && sec >= 0 {
+					return now.Add(time.Duration(sec) * time.Second)
+				}
 			}
 		}
+	}
+	if exp := resp.Header.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			return t
+		}
+	}
+	return def
+}
+
+// cached returns the result for given query if it's present in the cache.
+func (prom *Prometheus) cached(q querier, cacheKey string) (queryResult, bool) {
+	if cacheKey == "" {
+		return queryResult{}, false
+	}
+	cached, ok := prom.cache.get(cacheKey, prom.clock())
+	if ok {
+		cached.transfer = TransferStats{Cached: true}
+		prometheusCacheHitsTotal.WithLabelValues(prom.name, q.Endpoint()).Inc()
+		log.Debug().
+			Str("uri", prom.uri).
+			Str("query", q.String()).
+			Str("key", cacheKey).
+			Msg("Cache hit")
+	}
+	return cached, ok
+}
+
+func queryWorker(prom *Prometheus, queries, priority chan queryRequest) {
+	for {
+		job, ok := nextQuery(queries, priority)
+		if !ok {
+			return
+		}
+		if job.started != nil {
+			close(job.started)
+		}
+
+		cacheKey := job.query.CacheKey()
+		if cached, ok := prom.cached(job.query, cacheKey); ok {
+			job.result <- cached
+			continue
+		}
 		prometheusCacheMissTotal.WithLabelValues(prom.name, job.query.Endpoint()).Inc()
 		log.Debug().
 			Str("uri", prom.uri).
@@ -170,10 +718,30 @@ func queryWorker(prom *Prometheus, queries chan queryRequest) {
 
 		prometheusQueriesTotal.WithLabelValues(prom.name, job.query.Endpoint()).Inc()
 		prometheusQueriesRunning.WithLabelValues(prom.name, job.query.Endpoint()).Inc()
-		prom.rateLimiter.Take()
 		start := time.Now()
-		result := job.query.Run()
+		var result queryResult
+		if prom.replayDir != "" {
+			result = prom.replay(job.query, cacheKey)
+		} else {
+			result = prom.run(job.ctx, job.query)
+			for attempt := 1; attempt <= prom.retries && isRetryable(result.err); attempt++ {
+				delay := retryDelay(attempt)
+				log.Debug().
+					Err(result.err).
+					Str("uri", prom.uri).
+					Str("query", job.query.String()).
+					Int("attempt", attempt).
+					Str("delay", output.HumanizeDuration(delay)).
+					Msg("Retrying failed query")
+				if !waitForRetry(job.ctx, delay) {
+					break
+				}
+				result = prom.run(job.ctx, job.query)
+			}
+			prom.record(job.query, cacheKey, result)
+		}
 		dur := time.Since(start)
+		prom.slowLog.record(prom.uri, job.query, dur)
 		log.Debug().
 			Str("uri", prom.uri).
 			Str("query", job.query.String()).
@@ -181,26 +749,121 @@ func queryWorker(prom *Prometheus, queries chan queryRequest) {
 			Str("duration", output.HumanizeDuration(dur)).
 			Msg("Query completed")
 		prometheusQueriesRunning.WithLabelValues(prom.name, job.query.Endpoint()).Dec()
-		if result.err != nil {
-			prometheusQueryErrorsTotal.WithLabelValues(prom.name, job.query.Endpoint(), errReason(result.err)).Inc()
-			log.Error().
-				Err(result.err).
+		if errors.Is(result.err, context.Canceled) {
+			// Queries are cancelled when their result is no longer needed,
+			// for example once HasData found a value, this isn't an error.
+			log.Debug().
 				Str("uri", prom.uri).
 				Str("query", job.query.String()).
-				Msg("Query returned an error")
+				Msg("Query was cancelled")
+			job.result <- result
+			continue
+		}
+		if result.err != nil {
+			prometheusQueryErrorsTotal.WithLabelValues(prom.name, job.query.Endpoint(), errReason(result.err)).Inc()
+			exhausted := prom.retries > 0 && isRetryable(result.err)
+			if exhausted {
+				prometheusQueryRetriesExhaustedTotal.WithLabelValues(prom.name, prom.safeURI, errReason(result.err)).Inc()
+			}
+			errLog := prom.errorLog
+			if exhausted {
+				errLog = prom.exhaustedLog
+			}
+			if ok, suppressed := errLog.check(prom.uri, result.err); ok {
+				l := log.Error().
+					Err(result.err).
+					Str("uri", prom.uri).
+					Str("query", job.query.String())
+				if exhausted {
+					l = l.Int("retries", prom.retries)
+				}
+				if suppressed > 0 {
+					l = l.Int("suppressed", suppressed)
+				}
+				l.Msg("Query returned an error")
+			}
 			job.result <- result
 			continue
 		}
 
-		if cacheKey != "" {
-			prom.cache.Add(cacheKey, result)
+		if now := prom.clock(); cacheKey != "" && (result.expires.IsZero() || result.expires.After(now)) {
+			prom.cache.add(cacheKey, job.query.Endpoint(), result, now)
 		}
-		prometheusCacheSize.WithLabelValues(prom.name).Set(float64(prom.cache.Len()))
+		prometheusCacheSize.WithLabelValues(prom.name).Set(float64(prom.cache.len()))
 
 		job.result <- result
 	}
 }
 
+// run sends a query to Prometheus once it's allowed by both the rate limiter
+// and the adaptive concurrency limit.
+func (prom *Prometheus) run(ctx context.Context, q querier) queryResult {
+	if err := prom.limiter.acquire(ctx); err != nil {
+		return queryResult{err: err}
+	}
+	defer prom.limiter.release()
+	prom.rateLimiter.Take()
+	return q.Run()
+}
+
+// ConcurrencyLimit returns the number of queries that can currently run
+// at the same time. It only changes if WithAdaptiveConcurrency was used.
+func (prom *Prometheus) ConcurrencyLimit() int {
+	if prom.limiter == nil {
+		return prom.concurrency
+	}
+	return prom.limiter.current()
+}
+
+// SlowestQueries returns the slowest queries sent to Prometheus, slowest
+// first. It's only populated if WithSlowQueryLog was used.
+func (prom *Prometheus) SlowestQueries() []SlowQuery {
+	return prom.slowLog.list()
+}
+
+const (
+	retryBaseDelay = time.Millisecond * 100
+	retryMaxDelay  = time.Second * 10
+)
+
+// retryDelay returns how long to wait before given retry attempt. It doubles
+// with every attempt, up to retryMaxDelay, and it's randomised, so queries
+// that failed at the same time are not all retried at the same time.
+func retryDelay(attempt int) time.Duration {
+	d := retryBaseDelay
+	for i := 1; i < attempt && d < retryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// waitForRetry waits for given delay, it returns false if the query context
+// was cancelled first, in which case there's no point in retrying.
+func waitForRetry(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errWorkersStopped) {
+		return false
+	}
+	return IsUnavailableError(err)
+}
+
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
 func formatTime(t time.Time) string {
 	return strconv.FormatFloat(float64(t.Unix())+float64(t.Nanosecond())/1e9, 'f', -1, 64)
 }
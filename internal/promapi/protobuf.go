@@ -0,0 +1,61 @@
+package promapi
+
+import (
+	"fmt"
+	"io"
+	"mime"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// protobufContentType is the media type of range query responses encoded
+// as a single prompb.QueryResult message.
+const protobufContentType = "application/vnd.google.protobuf"
+
+// protobufAccept is sent when protobuf responses are enabled, JSON is still
+// accepted so servers that don't support protobuf keep working.
+const protobufAccept = protobufContentType + ";proto=prometheus.QueryResult, application/json;q=0.5"
+
+// maxProtobufBytes is the maximum size of a protobuf response, both remote
+// read and range query, it's also applied to remote read responses after
+// decompression. MaxTotalBytes can set a lower limit.
+const maxProtobufBytes = 512 * 1024 * 1024
+
+func isProtobufResponse(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == protobufContentType
+}
+
+func decodeProtobufMatrix(r io.Reader) (samples []model.SampleStream, err error) {
+	defer dummyReadAll(r)
+
+	data, err := readAllLimited(r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var qr prompb.QueryResult
+	if err = qr.Unmarshal(data); err != nil {
+		return nil, APIError{Status: "error", ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("protobuf decode error: %s", err)}
+	}
+	return appendTimeSeries([]model.SampleStream{}, qr.Timeseries), nil
+}
+
+// readAllLimited reads everything from r, unless it's more than limit
+// or maxProtobufBytes, in which case it returns ErrResultTooLarge.
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 || limit > maxProtobufBytes {
+		limit = maxProtobufBytes
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w, response is bigger than %d bytes", ErrResultTooLarge, limit)
+	}
+	return data, nil
+}
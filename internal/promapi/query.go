@@ -2,7 +2,6 @@ package promapi
 
 import (
 	"context"
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,6 +13,8 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prymitive/current"
 	"github.com/rs/zerolog/log"
+
+	"github.com/cloudflare/pint/internal/output"
 )
 
 type QueryResult struct {
@@ -26,6 +27,9 @@ type instantQuery struct {
 	ctx       context.Context
 	expr      string
 	timestamp time.Time
+	// evalTime is the evaluation time sent to Prometheus, if it's not set
+	// the query is evaluated at current server time.
+	evalTime time.Time
 }
 
 func (q instantQuery) Run() queryResult {
@@ -41,13 +45,25 @@ func (q instantQuery) Run() queryResult {
 
 	args := url.Values{}
 	args.Set("query", q.expr)
-	args.Set("timeout", q.prom.timeout.String())
-	resp, err := q.prom.doRequest(ctx, http.MethodPost, q.Endpoint(), args)
+	if !q.evalTime.IsZero() {
+		args.Set("time", formatTime(q.evalTime))
+	}
+	if !q.prom.noTimeout {
+		args.Set("timeout", q.prom.timeout.String())
+	}
+	if q.prom.lookback > 0 {
+		args.Set("lookback_delta", formatDuration(q.prom.lookback))
+	}
+	qr.request = q.prom.describeRequest(http.MethodPost, q.Endpoint(), args)
+	resp, err := q.prom.doRequest(ctx, http.MethodPost, q.Endpoint(), args, nil)
 	if err != nil {
 		qr.err = err
 		return qr
 	}
 	defer resp.Body.Close()
+	stop := q.prom.watchCancel(ctx, resp)
+	defer func() { stop(qr.err == nil || resp.StatusCode/100 != 2) }()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
 
 	if resp.StatusCode/100 != 2 {
 		qr.err = tryDecodingAPIError(resp)
@@ -67,16 +83,32 @@ func (q instantQuery) String() string {
 }
 
 func (q instantQuery) CacheKey() string {
-	h := sha1.New()
+	h := q.prom.newCacheKeyHash()
 	_, _ = io.WriteString(h, q.Endpoint())
 	_, _ = io.WriteString(h, "\n")
 	_, _ = io.WriteString(h, q.expr)
 	_, _ = io.WriteString(h, "\n")
 	_, _ = io.WriteString(h, q.timestamp.Round(cacheExpiry).Format(time.RFC3339))
+	if q.prom.lookback > 0 {
+		_, _ = io.WriteString(h, "\n")
+		_, _ = io.WriteString(h, output.HumanizeDuration(q.prom.lookback))
+	}
+	if !q.evalTime.IsZero() {
+		_, _ = io.WriteString(h, "\n")
+		_, _ = io.WriteString(h, q.evalTime.UTC().Format(time.RFC3339Nano))
+	}
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
 func (p *Prometheus) Query(ctx context.Context, expr string) (*QueryResult, error) {
+	expr, err := p.rewriteQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.checkMetrics(expr); err != nil {
+		return nil, err
+	}
+
 	log.Debug().Str("uri", p.uri).Str("query", expr).Msg("Scheduling prometheus query")
 
 	key := fmt.Sprintf("/api/v1/query/%s", expr)
@@ -84,14 +116,14 @@ func (p *Prometheus) Query(ctx context.Context, expr string) (*QueryResult, erro
 	defer p.locker.unlock(key)
 
 	resultChan := make(chan queryResult)
-	p.queries <- queryRequest{
-		query:  instantQuery{prom: p, ctx: ctx, expr: expr, timestamp: time.Now()},
+	p.enqueue(ctx, queryRequest{
+		query:  instantQuery{prom: p, ctx: ctx, expr: expr, timestamp: p.clock()},
 		result: resultChan,
-	}
+	})
 
 	result := <-resultChan
 	if result.err != nil {
-		return nil, QueryError{err: result.err, msg: decodeError(result.err)}
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
 	}
 
 	qr := QueryResult{
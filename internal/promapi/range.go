@@ -2,7 +2,8 @@ package promapi
 
 import (
 	"context"
-	"crypto/sha1"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,31 +23,294 @@ import (
 	"github.com/cloudflare/pint/internal/output"
 )
 
+// defaultSliceSize is the size of range query slices used when the query
+// doesn't have a custom timeout.
+const defaultSliceSize = time.Hour * 2
+
+// SliceOrder controls the order in which range query slices are scheduled.
+type SliceOrder int
+
+const (
+	// Chronological schedules the oldest slice first.
+	Chronological SliceOrder = iota
+	// RecentFirst schedules the most recent slice first.
+	RecentFirst
+)
+
+// SliceAlignment controls how range query slice boundaries are calculated.
+type SliceAlignment int
+
+const (
+	// EpochAligned aligns slices to multiples of the slice size since
+	// the Unix epoch, so queries with different start times share slices
+	// and cache entries.
+	EpochAligned SliceAlignment = iota
+	// StartAligned starts the first slice at the query start time.
+	StartAligned
+)
+
+// DuplicatePolicy controls what happens when a single series in a slice
+// response has more than one value with the same timestamp.
+type DuplicatePolicy int
+
+const (
+	// KeepDuplicates keeps all values.
+	KeepDuplicates DuplicatePolicy = iota
+	// DropDuplicates keeps only the first value for each timestamp.
+	DropDuplicates
+	// RejectDuplicates fails the query with ErrDuplicateTimestamp.
+	RejectDuplicates
+)
+
+// RangeQueryOptions allows to customise how range queries are executed
+// and how their results are processed.
+type RangeQueryOptions struct {
+	// TrimNaN will remove all leading and trailing NaN values from each series.
+	TrimNaN bool
+	// Order controls the order in which slices are sent to Prometheus.
+	Order SliceOrder
+	// Alignment controls how slice boundaries are calculated.
+	Alignment SliceAlignment
+	// Decimate will keep only every Nth value of each series, reducing
+	// memory usage when fine grained results are not needed.
+	// First and last value returned for each slice is always kept.
+	// Values lower than 2 disable decimation.
+	Decimate int
+	// StepTolerance enables validation of returned sample timestamps.
+	// Every sample must be within given tolerance of start + N * step,
+	// a warning is added to the result for each series that isn't.
+	StepTolerance time.Duration
+	// StrictStepAlignment will return ErrStepMisaligned instead of
+	// a warning when a misaligned sample is found.
+	StrictStepAlignment bool
+	// MaxValuesPerSeries limits how many values a single series can have,
+	// ErrSeriesTooLarge is returned if any series goes over it.
+	// Zero means no limit.
+	MaxValuesPerSeries int
+	// Stats will request query statistics from the server (stats=all).
+	Stats bool
+	// Analyze will request the query analysis from servers that support it
+	// (analyze=true), like Thanos.
+	Analyze bool
+	// InstantFallback will run an instant query at the end of the range if
+	// range query returned no data, result will include a single value for
+	// each series returned by the instant query.
+	InstantFallback bool
+	// SpillThreshold is the maximum number of values kept in memory while
+	// merging slices, once it's crossed all values are written to a temporary
+	// file and read back after all slices are merged.
+	// This is slow but allows to run queries that wouldn't fit in memory.
+	// Zero disables spilling.
+	SpillThreshold int
+	// CacheStepBucket rounds the query step up to a multiple of given
+	// duration when calculating cache keys, so queries with similar steps
+	// can share cached results. Callers using it must be fine with getting
+	// results with a different step than requested. Results cached using
+	// a bucket are only shared with queries using the same bucket.
+	// Zero means that the step must match exactly.
+	CacheStepBucket time.Duration
+	// MaxLabelValues limits how many distinct values of each label are
+	// retained in the result, any series with a label value over the limit
+	// is dropped. Series are processed in fingerprint order, so the same
+	// series are kept across runs. Zero means no limit.
+	MaxLabelValues int
+	// Tee is called for every slice request with the time range of that
+	// slice, the returned writer receives a copy of the raw response body
+	// as it's being decoded, without buffering it. Slices can run at the
+	// same time, so each one should get its own writer. Write errors are
+	// ignored, nothing more is written to that writer after the first one.
+	// Slices served from the cache are not written, nil writer skips a slice.
+	Tee func(start, end time.Time) io.Writer
+	// Engine sets the engine form parameter, used by some query gateways
+	// to select which query engine should run the query.
+	// Empty value means that the parameter is not sent.
+	Engine string
+	// MaxSlices limits how many slices a single range query is split into.
+	// If the range would need more slices then the slice size is increased
+	// until it fits. EpochAligned slices can cross a slice boundary even when
+	// the range is shorter than a single slice, so with that alignment
+	// values lower than 2 are treated as 2. Zero means no limit.
+	MaxSlices int
+	// DropEmptySeries will skip series returned with an empty list of values,
+	// which some backends return for series without any samples in the range.
+	// Dropped series are counted in EmptySeries instead of MatchedSeries.
+	DropEmptySeries bool
+	// AnchorToRange will replace `@ start()` and `@ end()` modifiers with
+	// the timestamp of the start and end of the whole range before it's
+	// split into slices, so every slice is anchored to the same time.
+	// Otherwise each slice would be anchored to its own start or end.
+	AnchorToRange bool
+	// Duplicates controls how values with the same timestamp returned for
+	// a single series in one slice response are handled. Prometheus never
+	// returns those, but some buggy backends might.
+	Duplicates DuplicatePolicy
+	// SignificantFigures rounds every value to given number of significant
+	// figures, so results don't depend on floating point noise that can
+	// differ between Prometheus replicas. Zero disables rounding.
+	SignificantFigures int
+	// VerifyCompleteness checks that every series has a value for every
+	// step between start and end after all slices are merged, and adds
+	// a warning for each gap found. This is a debugging aid for finding
+	// slices that were silently dropped, series that don't exist for the
+	// whole range will also be reported. It's ignored when Decimate is used.
+	VerifyCompleteness bool
+	// Timeout overrides the server timeout for every slice of this query.
+	// If it's shorter than the server timeout then slices are made smaller
+	// by the same ratio, so each one is more likely to finish in time.
+	// Zero means that the server timeout is used.
+	Timeout time.Duration
+	// StopWhen is called every time a slice is merged into the result and
+	// all remaining slices are cancelled once it returns true, the result
+	// will only include slices merged so far. It's passed the result being
+	// merged, values of each series might not be sorted yet and values
+	// spilled to disk because of SpillThreshold are not included. It must
+	// not modify or retain the result.
+	// Errors returned by other slices are ignored once it returned true.
+	StopWhen func(partial *RangeQueryResult) bool
+	// MaxTotalBytes limits the total size of response bodies read by all
+	// slices of the query, after decompression. Once it's crossed all
+	// remaining slices are cancelled and ErrResultTooLarge is returned.
+	// Slices served from the cache are not counted. Zero means no limit.
+	MaxTotalBytes int64
+	// MaxStepIncreases is the number of times the whole query is retried
+	// with the step doubled if Prometheus rejects it because it would
+	// return too many points per series. A warning with the step that was
+	// used is added to the result. Zero disables retries.
+	MaxStepIncreases int
+	// DropStaleMarkers removes all staleness markers from the result.
+	// Prometheus uses a special NaN value to mark series that went away,
+	// those are only preserved by remote read and protobuf responses,
+	// JSON responses return them as regular NaN values.
+	// Markers are counted in StaleMarkers even if they're not dropped.
+	DropStaleMarkers bool
+	// HedgeDelay enables request hedging for slices, if a slice doesn't
+	// return within given delay then a duplicate request is sent and
+	// whichever responds first is used, the other one is cancelled.
+	// The delay is counted from the moment a worker starts running the slice,
+	// so time spent waiting in the queue doesn't trigger hedging. It's a fixed
+	// value, pint doesn't measure latencies itself, so it should be set from
+	// the observed p95 latency of slice queries, lower values will send a lot
+	// of extra queries. Hedged requests use the same worker pool, so it only
+	// helps with concurrency higher than one, and no hedged request is sent
+	// while there are other queries waiting for a free worker.
+	// Zero disables hedging.
+	HedgeDelay time.Duration
+	// DropInf removes all +Inf and -Inf values from the result, treating
+	// them like missing values. Those are usually returned by expressions
+	// dividing by zero and can skew any calculations done on the result.
+	// By default they are kept.
+	DropInf bool
+}
+
 type RangeQueryResult struct {
 	URI     string
 	Samples []*model.SampleStream
 	Start   time.Time
 	End     time.Time
+	// Requests holds details of the HTTP request sent for each slice,
+	// in the same order as slices, followed by the instant query request
+	// if InstantFallback was used.
+	Requests []RequestDetails
+	// Warnings contains any problems found while processing results.
+	Warnings []string
+	// Stats holds query statistics for each slice, in the same order as
+	// slices, if they were requested and returned by the server.
+	Stats []*QueryStats
+	// Transfers holds the size of each slice response and the time it took
+	// to fetch and decode it, in the same order as slices.
+	Transfers []TransferStats
+	// MatchedSeries is the number of series returned by Prometheus.
+	// Zero means that the query didn't match anything.
+	MatchedSeries int
+	// RetainedSeries is the number of series with at least one value
+	// left after all values outside of the query range were removed.
+	// It's lower than MatchedSeries if some series had no values
+	// within the range.
+	RetainedSeries int
+	// Status is the status field returned by Prometheus in the response.
+	// If slices returned different values then the first one that's not
+	// "success" is used.
+	Status string
+	// DroppedSeries is the number of series removed because of MaxLabelValues.
+	DroppedSeries int
+	// DroppedLabelValues is the number of distinct label values that were
+	// dropped for each label name because of MaxLabelValues.
+	DroppedLabelValues map[string]int
+	// EmptySeries is the number of series returned with no values by every
+	// slice, they are only counted and removed if DropEmptySeries was used.
+	EmptySeries int
+	// Coverage holds the timestamps of the first and last value of each
+	// series, in the same order as Samples.
+	Coverage []SeriesCoverage
+	// StaleMarkers is the number of staleness markers found in the result,
+	// they are removed from Samples if DropStaleMarkers was used.
+	StaleMarkers int
+
+	// labelNames caches LabelNames, it must be reset when Samples change.
+	labelNames []string
+}
+
+// SeriesCoverage describes the time range covered by a single series.
+// First and Last are zero if the series has no values.
+type SeriesCoverage struct {
+	First  time.Time
+	Last   time.Time
+	Points int
+}
+
+type sliceResult struct {
+	index int
+	// split is true if this slice was split into smaller queries.
+	split bool
+	queryResult
 }
 
 type rangeQuery struct {
-	prom *Prometheus
-	ctx  context.Context
-	expr string
-	r    v1.Range
+	prom    *Prometheus
+	ctx     context.Context
+	expr    string
+	r       v1.Range
+	stats   bool
+	analyze bool
+	sticky  string
+	// stepBucket is only used to calculate the cache key.
+	stepBucket time.Duration
+	tee        func(start, end time.Time) io.Writer
+	engine     string
+	budget     *byteBudget
+	// timeout overrides the server timeout if it's not zero.
+	timeout time.Duration
+}
+
+// teeWriter ignores write errors, so a broken tee doesn't fail the query.
+// Nothing is written after the first error.
+type teeWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (tw *teeWriter) Write(p []byte) (int, error) {
+	if tw.err == nil {
+		_, tw.err = tw.w.Write(p)
+	}
+	return len(p), nil
 }
 
 func (q rangeQuery) Run() queryResult {
 	log.Debug().
 		Str("uri", q.prom.uri).
 		Str("query", q.expr).
-		Str("start", q.r.Start.Format(time.RFC3339)).
-		Str("end", q.r.End.Format(time.RFC3339)).
+		Str("start", q.r.Start.UTC().Format(time.RFC3339)).
+		Str("end", q.r.End.UTC().Format(time.RFC3339)).
 		Str("range", output.HumanizeDuration(q.r.End.Sub(q.r.Start))).
 		Str("step", output.HumanizeDuration(q.r.Step)).
 		Msg("Running prometheus range query slice")
 
-	ctx, cancel := context.WithTimeout(q.ctx, q.prom.timeout)
+	timeout := q.prom.timeout
+	if q.timeout > 0 {
+		timeout = q.timeout
+	}
+	ctx, cancel := context.WithTimeout(q.ctx, timeout)
 	defer cancel()
 
 	qr := queryResult{}
@@ -55,21 +319,86 @@ func (q rangeQuery) Run() queryResult {
 	args.Set("query", q.expr)
 	args.Set("start", formatTime(q.r.Start))
 	args.Set("end", formatTime(q.r.End))
-	args.Set("step", strconv.FormatFloat(q.r.Step.Seconds(), 'f', -1, 64))
-	args.Set("timeout", q.prom.timeout.String())
-	resp, err := q.prom.doRequest(ctx, http.MethodPost, q.Endpoint(), args)
+	args.Set("step", formatDuration(q.r.Step))
+	if !q.prom.noTimeout {
+		args.Set("timeout", timeout.String())
+	}
+	if q.prom.lookback > 0 {
+		args.Set("lookback_delta", formatDuration(q.prom.lookback))
+	}
+	if q.stats {
+		args.Set("stats", "all")
+	}
+	if q.analyze {
+		args.Set("analyze", "true")
+	}
+	if q.engine != "" {
+		args.Set("engine", q.engine)
+	}
+	qr.request = q.prom.describeRequest(http.MethodPost, q.Endpoint(), args)
+	headers := http.Header{}
+	if q.prom.sticky != "" {
+		headers.Set(q.prom.sticky, q.sticky)
+	}
+	if q.prom.protobuf {
+		headers.Set("Accept", protobufAccept)
+	}
+	reqStart := time.Now()
+	resp, err := q.prom.doRequest(ctx, http.MethodPost, q.Endpoint(), args, headers)
 	if err != nil {
 		qr.err = err
 		return qr
 	}
 	defer resp.Body.Close()
+	stop := q.prom.watchCancel(ctx, resp)
+	defer func() { stop(qr.err == nil || resp.StatusCode/100 != 2) }()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
+	qr.transfer.NetworkDuration = time.Since(reqStart)
 
 	if resp.StatusCode/100 != 2 {
 		qr.err = tryDecodingAPIError(resp)
 		return qr
 	}
 
-	qr.value, qr.err = streamSampleStream(resp.Body)
+	counter := &countingReader{r: resp.Body, budget: q.budget}
+	var body io.Reader = counter
+	if q.tee != nil {
+		if w := q.tee(q.r.Start, q.r.End); w != nil {
+			body = io.TeeReader(counter, &teeWriter{w: w})
+		}
+	}
+
+	decodeStart := time.Now()
+	if isProtobufResponse(resp.Header.Get("Content-Type")) {
+		qr.value, qr.err = decodeProtobufMatrix(body)
+		if qr.err == nil {
+			qr.status = "success"
+		}
+	} else {
+		qr.value, qr.stats, qr.status, qr.err = streamSampleStream(body)
+	}
+	if counter.exceeded {
+		qr.err = fmt.Errorf("%w, query read more than %d bytes", ErrResultTooLarge, q.budget.limit)
+	}
+	qr.transfer.BytesRead = counter.n
+	qr.transfer.NetworkDuration += counter.wait
+	qr.transfer.DecodeDuration = time.Since(decodeStart) - counter.wait
+	if qr.err == nil {
+		samples := qr.value.([]model.SampleStream)
+		var values int
+		for _, s := range samples {
+			values += len(s.Values)
+		}
+		log.Debug().
+			Str("uri", q.prom.uri).
+			Str("query", q.expr).
+			Str("start", q.r.Start.UTC().Format(time.RFC3339)).
+			Str("end", q.r.End.UTC().Format(time.RFC3339)).
+			Int("series", len(samples)).
+			Int("values", values).
+			Str("decode", output.HumanizeDuration(time.Since(decodeStart))).
+			Msg("Decoded prometheus range query slice")
+	}
 	return qr
 }
 
@@ -81,18 +410,49 @@ func (q rangeQuery) String() string {
 	return q.expr
 }
 
+func (q rangeQuery) window() (time.Time, time.Time) {
+	return q.r.Start, q.r.End
+}
+
 func (q rangeQuery) CacheKey() string {
-	h := sha1.New()
-	_, _ = io.WriteString(h, q.Endpoint())
-	_, _ = io.WriteString(h, "\n")
-	_, _ = io.WriteString(h, q.expr)
-	_, _ = io.WriteString(h, "\n")
-	_, _ = io.WriteString(h, q.r.Start.Format(time.RFC3339))
-	_, _ = io.WriteString(h, "\n")
-	_, _ = io.WriteString(h, q.r.End.Round(q.r.Step).Format(time.RFC3339))
-	_, _ = io.WriteString(h, "\n")
-	_, _ = io.WriteString(h, output.HumanizeDuration(q.r.Step))
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return hashCacheKeyParts(q.cacheKeyParts())
+}
+
+// cacheKeyParts returns all values used to calculate the cache key.
+func (q rangeQuery) cacheKeyParts() []CacheKeyPart {
+	parts := append(q.prom.cacheKeyParts(),
+		CacheKeyPart{Name: "endpoint", Value: q.Endpoint()},
+		CacheKeyPart{Name: "expr", Value: q.expr},
+		CacheKeyPart{Name: "start", Value: q.r.Start.UTC().Format(time.RFC3339)},
+		CacheKeyPart{Name: "end", Value: q.r.End.Round(q.keyStep()).UTC().Format(time.RFC3339)},
+		CacheKeyPart{Name: "step", Value: output.HumanizeDuration(q.keyStep())},
+	)
+	if q.stepBucket > 0 {
+		// Bucketed results might have a different step than requested, so
+		// they must never be returned for queries asking for an exact step.
+		parts = append(parts, CacheKeyPart{Name: "stepBucket", Value: "bucket=" + output.HumanizeDuration(q.stepBucket)})
+	}
+	if q.prom.lookback > 0 {
+		parts = append(parts, CacheKeyPart{Name: "lookback", Value: output.HumanizeDuration(q.prom.lookback)})
+	}
+	if q.stats {
+		parts = append(parts, CacheKeyPart{Name: "stats", Value: "stats"})
+	}
+	if q.analyze {
+		parts = append(parts, CacheKeyPart{Name: "analyze", Value: "analyze"})
+	}
+	if q.engine != "" {
+		parts = append(parts, CacheKeyPart{Name: "engine", Value: "engine=" + q.engine})
+	}
+	return parts
+}
+
+// keyStep returns the step used for the cache key.
+func (q rangeQuery) keyStep() time.Duration {
+	if q.stepBucket <= 0 || q.r.Step%q.stepBucket == 0 {
+		return q.r.Step
+	}
+	return (q.r.Step/q.stepBucket + 1) * q.stepBucket
 }
 
 type RangeQueryTimes interface {
@@ -103,121 +463,425 @@ type RangeQueryTimes interface {
 	String() string
 }
 
-func (p *Prometheus) RangeQuery(ctx context.Context, expr string, params RangeQueryTimes) (*RangeQueryResult, error) {
-	start := params.Start()
-	end := params.End()
-	lookback := params.Dur()
-	step := params.Step()
+// rangePlan holds everything needed to schedule all slices of a range query.
+// It doesn't depend on the query expression, so it can be shared between
+// multiple queries using the same time range.
+type rangePlan struct {
+	params    RangeQueryTimes
+	opts      RangeQueryOptions
+	start     time.Time
+	end       time.Time
+	lookback  time.Duration
+	step      time.Duration
+	sliceSize time.Duration
+	slices    []timeRange
+	warnings  []string
+	// budget is shared by all queries using this plan.
+	budget *byteBudget
+	// anyData will cancel all remaining slices once any slice returns
+	// a value within the query range.
+	anyData bool
+	// stream will receive all series one at a time instead of returning
+	// them in the result.
+	stream func(*model.SampleStream) error
+}
+
+func newRangePlan(params RangeQueryTimes, opts RangeQueryOptions) rangePlan {
+	return newSizedRangePlan(params, opts, defaultSliceSize)
+}
+
+// newSizedRangePlan creates a range plan with slices of given size,
+// rounded to a multiple of step.
+func newSizedRangePlan(params RangeQueryTimes, opts RangeQueryOptions, sliceSize time.Duration) rangePlan {
+	plan := rangePlan{
+		params:   params,
+		opts:     opts,
+		start:    params.Start().UTC(),
+		end:      params.End().UTC(),
+		lookback: params.Dur(),
+		step:     roundStep(params.Step()),
+	}
+
+	plan.sliceSize = sliceSize.Round(plan.step)
+	if plan.sliceSize < plan.step {
+		// Steps longer than twice the slice size would round it down to zero.
+		plan.sliceSize = plan.step
+	}
+	if plan.sliceSize > plan.lookback {
+		plan.sliceSize = plan.lookback
+	}
+
+	plan.slices = sliceRange(plan.start, plan.end, plan.step, plan.sliceSize, opts.Alignment)
+	if opts.MaxSlices > 0 && len(plan.slices) > opts.MaxSlices {
+		plan.growSlices(opts.MaxSlices)
+	}
+	if opts.MaxTotalBytes > 0 {
+		plan.budget = &byteBudget{limit: opts.MaxTotalBytes}
+	}
+	return plan
+}
+
+// stepPrecision is the precision of range query steps, Prometheus stores
+// timestamps with millisecond precision so there's no point in sending
+// steps with more decimal places than that, and some backends reject them.
+const stepPrecision = time.Millisecond
+
+// roundStep rounds step to stepPrecision, so the step sent to Prometheus
+// is always the same as the one used for the cache key.
+func roundStep(step time.Duration) time.Duration {
+	if step <= 0 {
+		return step
+	}
+	if rounded := step.Round(stepPrecision); rounded > 0 {
+		return rounded
+	}
+	return stepPrecision
+}
+
+// growSlices increases the slice size, always by a multiple of step,
+// until the range fits in maxSlices slices.
+func (plan *rangePlan) growSlices(maxSlices int) {
+	if plan.opts.Alignment == EpochAligned && maxSlices < 2 {
+		maxSlices = 2
+	}
+	for n := maxSlices; n > 0 && len(plan.slices) > maxSlices; n-- {
+		size := plan.lookback / time.Duration(n)
+		if plan.step > 0 {
+			if rem := size % plan.step; rem > 0 || size == 0 {
+				size += plan.step - rem
+			}
+		}
+		if size <= plan.sliceSize {
+			continue
+		}
+		plan.sliceSize = size
+		plan.slices = sliceRange(plan.start, plan.end, plan.step, plan.sliceSize, plan.opts.Alignment)
+	}
+}
+
+// query returns the query for the slice with given index.
+func (plan rangePlan) query(p *Prometheus, ctx context.Context, expr, sticky string, i int) rangeQuery {
+	return rangeQuery{
+		prom: p,
+		ctx:  ctx,
+		expr: expr,
+		r: v1.Range{
+			Start: plan.slices[i].start,
+			End:   plan.slices[i].end,
+			Step:  plan.step,
+		},
+		stats:      plan.opts.Stats,
+		analyze:    plan.opts.Analyze,
+		sticky:     sticky,
+		stepBucket: plan.opts.CacheStepBucket,
+		tee:        plan.opts.Tee,
+		budget:     plan.budget,
+		engine:     plan.opts.Engine,
+		timeout:    plan.opts.Timeout,
+	}
+}
 
-	queryStep := (time.Hour * 2).Round(step)
-	if queryStep > lookback {
-		queryStep = lookback
+// order returns indexes of all slices in the order they should be scheduled.
+func (plan rangePlan) order() []int {
+	order := make([]int, len(plan.slices))
+	for i := range order {
+		if plan.opts.Order == RecentFirst {
+			order[i] = len(order) - 1 - i
+		} else {
+			order[i] = i
+		}
 	}
+	return order
+}
+
+func (p *Prometheus) RangeQuery(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions) (*RangeQueryResult, error) {
+	return p.rangeQuery(ctx, expr, p.newRangePlan(ctx, params, opts))
+}
+
+// newRangePlan creates a range plan, adjusting time range for clock skew
+// if that's enabled.
+func (p *Prometheus) newRangePlan(ctx context.Context, params RangeQueryTimes, opts RangeQueryOptions) rangePlan {
+	params = p.resolveRange(params)
+	params, skewWarning := p.clampRange(ctx, params)
+	params, lagWarning := p.clampStale(ctx, params)
+	plan := newSizedRangePlan(params, opts, p.sliceSize(opts.Timeout))
+	for _, warning := range []string{skewWarning, lagWarning} {
+		if warning != "" {
+			plan.warnings = append(plan.warnings, warning)
+		}
+	}
+	return plan
+}
+
+// resolveRange turns ranges ending at the current time into absolute ranges
+// using the client clock.
+func (p *Prometheus) resolveRange(params RangeQueryTimes) RangeQueryTimes {
+	if rt, ok := params.(relativeTimes); ok {
+		return rt.at(p.clock())
+	}
+	return params
+}
+
+// sliceSize returns the size of range query slices for given query timeout.
+// Shorter timeouts get proportionally smaller slices, longer timeouts never
+// make slices bigger than the default.
+func (p *Prometheus) sliceSize(timeout time.Duration) time.Duration {
+	if timeout <= 0 || timeout >= p.timeout {
+		return defaultSliceSize
+	}
+	return time.Duration(float64(defaultSliceSize) * float64(timeout) / float64(p.timeout))
+}
+
+// RangeQueryBatch runs multiple range queries using the same time range.
+// All slices of all queries are scheduled at once using the same worker pool.
+// Results and errors are returned per expression.
+func (p *Prometheus) RangeQueryBatch(ctx context.Context, exprs []string, params RangeQueryTimes, opts RangeQueryOptions) (map[string]*RangeQueryResult, map[string]error) {
+	plan := p.newRangePlan(ctx, params, opts)
+
+	unique := map[string]struct{}{}
+	for _, expr := range exprs {
+		unique[expr] = struct{}{}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]*RangeQueryResult, len(unique))
+	errs := map[string]error{}
+	for expr := range unique {
+		wg.Add(1)
+		go func(expr string) {
+			defer wg.Done()
+			qr, err := p.rangeQuery(ctx, expr, plan)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[expr] = err
+				return
+			}
+			results[expr] = qr
+		}(expr)
+	}
+	wg.Wait()
+
+	return results, errs
+}
+
+func (p *Prometheus) rangeQuery(ctx context.Context, expr string, plan rangePlan) (*RangeQueryResult, error) {
+	for attempt := 1; ; attempt++ {
+		rqr, err := p.runRangePlan(ctx, expr, plan)
+		if err == nil || attempt > plan.opts.MaxStepIncreases || !isTooManyPoints(err) {
+			return rqr, err
+		}
+
+		step := plan.step * 2
+		log.Debug().
+			Str("uri", p.uri).
+			Str("query", expr).
+			Str("step", output.HumanizeDuration(plan.step)).
+			Str("retry", output.HumanizeDuration(step)).
+			Msg("Range query would return too many points per series, retrying with a longer step")
+		plan = p.coarserPlan(plan, step)
+	}
+}
+
+// coarserPlan returns a copy of the plan using given step.
+func (p *Prometheus) coarserPlan(plan rangePlan, step time.Duration) rangePlan {
+	coarse := newSizedRangePlan(NewAbsoluteRange(plan.start, plan.end, step), plan.opts, p.sliceSize(plan.opts.Timeout))
+	// Bytes read by previous attempts count against the same limit.
+	coarse.budget = plan.budget
+	coarse.anyData = plan.anyData
+	coarse.stream = plan.stream
+	coarse.warnings = append(append([]string(nil), plan.warnings...), fmt.Sprintf(
+		"query would return too many points per series with %s step, it was retried with %s step",
+		output.HumanizeDuration(plan.step), output.HumanizeDuration(coarse.step)))
+	return coarse
+}
+
+// rangeExpr returns the expression that will be sent for every slice
+// of the plan.
+func (p *Prometheus) rangeExpr(expr string, plan rangePlan) (string, error) {
+	expr, err := p.rewriteQuery(expr)
+	if err != nil {
+		return "", err
+	}
+	if plan.opts.AnchorToRange {
+		return anchorQuery(expr, plan.start, plan.end)
+	}
+	return expr, nil
+}
+
+func (p *Prometheus) runRangePlan(ctx context.Context, expr string, plan rangePlan) (*RangeQueryResult, error) {
+	expr, err := p.rangeExpr(expr, plan)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.checkMetrics(expr); err != nil {
+		return nil, err
+	}
+
+	start := plan.start
+	end := plan.end
+	step := plan.step
 
 	log.Debug().
 		Str("uri", p.uri).
 		Str("query", expr).
-		Str("lookback", output.HumanizeDuration(lookback)).
+		Str("lookback", output.HumanizeDuration(plan.lookback)).
 		Str("step", output.HumanizeDuration(step)).
-		Str("slice", output.HumanizeDuration(queryStep)).
+		Str("slice", output.HumanizeDuration(plan.sliceSize)).
 		Msg("Scheduling prometheus range query")
 
-	key := fmt.Sprintf("/api/v1/query_range/%s/%s", expr, params.String())
+	key := fmt.Sprintf("/api/v1/query_range/%s/%s", expr, plan.params.String())
 	p.locker.lock(key)
 	defer p.locker.unlock(key)
 
 	var wg sync.WaitGroup
 	var lastErr error
+	var lastReq, mergeReq *RequestDetails
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	slices := sliceRange(start, end, step, queryStep)
-	results := make(chan queryResult, len(slices))
-	for _, s := range slices {
-		query := queryRequest{
-			query: rangeQuery{
-				prom: p,
-				ctx:  ctx,
-				expr: expr,
-				r: v1.Range{
-					Start: s.start,
-					End:   s.end,
-					Step:  step,
-				},
-			},
-		}
+	var sticky string
+	if p.sticky != "" {
+		sticky = newStickyValue()
+	}
 
-		wg.Add(1)
-		go func() {
-			var result queryResult
-			query.result = make(chan queryResult)
-			p.queries <- query
-			result = <-query.result
+	slices := plan.slices
+	results := make(chan sliceResult, len(slices))
+	wg.Add(len(slices))
+	go func() {
+		for _, i := range plan.order() {
+			i := i
+			if err := ctx.Err(); err != nil {
+				// Query was already cancelled, don't send any more slices.
+				results <- sliceResult{index: i, queryResult: queryResult{err: err}}
+				continue
+			}
+			query := queryRequest{
+				query:  plan.query(p, ctx, expr, sticky, i),
+				result: make(chan queryResult),
+			}
 
-			if result.err != nil {
-				cancel()
+			// Other queries might have populated the cache since we started
+			// scheduling, don't send any slice we already have results for.
+			if cached, ok := p.cached(query.query, query.query.CacheKey()); ok {
+				results <- sliceResult{index: i, queryResult: cached}
+				continue
+			}
+			wait := func() queryResult { return <-query.result }
+			if plan.opts.HedgeDelay > 0 {
+				wait = p.enqueueHedged(query.query.(rangeQuery), plan.opts.HedgeDelay)
+			} else {
+				p.enqueue(ctx, query)
 			}
 
-			results <- result
-		}()
-	}
+			go func() {
+				result := wait()
+				var split bool
+				if isTooManySamples(result.err) {
+					split = true
+					result = p.splitRangeSlice(query.query.(rangeQuery), result, 0)
+				}
+				if result.err != nil {
+					cancel()
+				}
+				results <- sliceResult{index: i, queryResult: result, split: split}
+			}()
+		}
+	}()
 
 	go func() {
 		wg.Wait()
 		close(results)
 	}()
 
-	merged := RangeQueryResult{URI: p.uri, Start: start, End: end}
+	merged := RangeQueryResult{
+		URI:       p.uri,
+		Start:     start,
+		End:       end,
+		Requests:  make([]RequestDetails, len(slices)),
+		Transfers: make([]TransferStats, len(slices)),
+		Warnings:  append([]string(nil), plan.warnings...),
+	}
+	if plan.opts.Stats || plan.opts.Analyze {
+		merged.Stats = make([]*QueryStats, len(slices))
+	}
+	merger := newRangeMerger(&merged, plan.opts, step)
+	defer merger.close()
+	var found bool
 	for result := range results {
+		merged.Requests[result.index] = result.request
+		merged.Transfers[result.index] = result.transfer
+		if merged.Stats != nil {
+			merged.Stats[result.index] = result.stats
+		}
 		if result.err != nil {
 			if !errors.Is(result.err, context.Canceled) {
 				lastErr = result.err
+				lastReq = &merged.Requests[result.index]
 			}
 			wg.Done()
 			continue
 		}
 
-		for _, sample := range result.value.([]model.SampleStream) {
-			var found bool
-			var ts time.Time
-			for i, rs := range merged.Samples {
-				if sample.Metric.Equal(rs.Metric) {
-					found = true
-					for _, v := range sample.Values {
-						ts = v.Timestamp.Time()
-						if !ts.Before(start) && !ts.After(end) {
-							merged.Samples[i].Values = append(merged.Samples[i].Values, v)
-						}
-					}
-					break
-				}
-			}
-			if !found {
-				s := model.SampleStream{
-					Metric: sample.Metric.Clone(),
-					Values: make([]model.SamplePair, 0, len(sample.Values)),
-				}
-				for _, v := range sample.Values {
-					ts = v.Timestamp.Time()
-					if !ts.Before(start) && !ts.After(end) {
-						s.Values = append(s.Values, v)
-					}
-				}
-				merged.Samples = append(merged.Samples, &s)
+		if merged.Status == "" || (merged.Status == "success" && result.status != "") {
+			merged.Status = result.status
+		}
+
+		if result.split {
+			merged.Warnings = append(merged.Warnings, fmt.Sprintf(
+				"query for %s - %s would load too many samples, it was split into smaller queries",
+				slices[result.index].start.Format(time.RFC3339), slices[result.index].end.Format(time.RFC3339)))
+		}
+
+		if merger.err == nil && !found {
+			samples := result.value.([]model.SampleStream)
+			merger.add(samples)
+			if merger.err != nil {
+				mergeReq = &merged.Requests[result.index]
+				// No need to wait for remaining slices, this query will fail anyway.
+				cancel()
+			} else if plan.anyData && hasValuesInRange(samples, start, end) {
+				found = true
+				cancel()
+			} else if plan.opts.StopWhen != nil && plan.opts.StopWhen(&merged) {
+				found = true
+				cancel()
 			}
 		}
 		wg.Done()
 	}
 
-	if lastErr != nil {
-		return nil, QueryError{err: lastErr, msg: decodeError(lastErr)}
+	if lastErr != nil && !found {
+		return nil, QueryError{err: lastErr, msg: decodeError(lastErr), request: lastReq}
 	}
 
-	for k := range merged.Samples {
-		sort.SliceStable(merged.Samples[k].Values, func(i, j int) bool {
-			return merged.Samples[k].Values[i].Timestamp.Before(merged.Samples[k].Values[j].Timestamp)
-		})
+	if merger.err != nil {
+		return nil, QueryError{err: merger.err, msg: decodeError(merger.err), request: mergeReq}
+	}
+
+	if plan.stream != nil {
+		err = merger.finishStream(plan.stream)
+	} else {
+		err = merger.finish()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if plan.opts.InstantFallback && len(merged.Coverage) == 0 {
+		if err := p.instantFallback(ctx, expr, &merged, plan.opts.SignificantFigures); err != nil {
+			return nil, err
+		}
+		if plan.stream != nil {
+			for _, s := range merged.Samples {
+				if err := plan.stream(s); err != nil {
+					return nil, err
+				}
+			}
+			merged.Samples = nil
+		}
 	}
 
 	log.Debug().Str("uri", p.uri).Str("query", expr).Int("samples", len(merged.Samples)).Msg("Parsed range response")
@@ -225,17 +889,196 @@ func (p *Prometheus) RangeQuery(ctx context.Context, expr string, params RangeQu
 	return &merged, nil
 }
 
+// RangeQueryStream runs a range query just like RangeQuery, but instead
+// of returning all series in the result it passes them to fn one at a time,
+// in fingerprint order. With SpillThreshold set only values of the series
+// currently passed to fn are kept in memory, so it can be used to export
+// results that wouldn't fit in memory. fn must not retain the series after
+// it returns, any error returned by fn stops the stream and is returned.
+// Samples are not set on the returned result, Coverage is in the same order
+// series were passed to fn.
+func (p *Prometheus) RangeQueryStream(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions, fn func(*model.SampleStream) error) (*RangeQueryResult, error) {
+	plan := p.newRangePlan(ctx, params, opts)
+	plan.stream = fn
+	return p.rangeQuery(ctx, expr, plan)
+}
+
+// HasData returns true if expr returns any value within given range.
+// Slices are sent in the order set in options and all remaining slices are
+// cancelled as soon as one of them returns a value, so it's much faster than
+// RangeQuery if there's data early in the range.
+// Errors returned by other slices are ignored once a value was found.
+func (p *Prometheus) HasData(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions) (bool, error) {
+	plan := p.newRangePlan(ctx, params, opts)
+	plan.anyData = true
+	qr, err := p.rangeQuery(ctx, expr, plan)
+	if err != nil {
+		return false, err
+	}
+	return qr.RetainedSeries > 0, nil
+}
+
+func hasValuesInRange(samples []model.SampleStream, start, end time.Time) bool {
+	for _, s := range samples {
+		for _, v := range s.Values {
+			if ts := v.Timestamp.Time(); !ts.Before(start) && !ts.After(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// instantFallback runs an instant query at the end of the range and
+// adds all returned samples to the range query result.
+func (p *Prometheus) instantFallback(ctx context.Context, expr string, merged *RangeQueryResult, figures int) error {
+	log.Debug().
+		Str("uri", p.uri).
+		Str("query", expr).
+		Msg("Range query returned no data, falling back to an instant query")
+
+	resultChan := make(chan queryResult)
+	p.enqueue(ctx, queryRequest{
+		query:  instantQuery{prom: p, ctx: ctx, expr: expr, timestamp: p.clock(), evalTime: merged.End},
+		result: resultChan,
+	})
+
+	result := <-resultChan
+	if result.err != nil {
+		return QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
+	}
+
+	merged.Requests = append(merged.Requests, result.request)
+	for _, s := range result.value.([]model.Sample) {
+		merged.Samples = append(merged.Samples, &model.SampleStream{
+			Metric: s.Metric,
+			Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: roundSignificant(s.Value, figures)}},
+		})
+		merged.Coverage = append(merged.Coverage, SeriesCoverage{
+			First:  s.Timestamp.Time().UTC(),
+			Last:   s.Timestamp.Time().UTC(),
+			Points: 1,
+		})
+		merged.MatchedSeries++
+		merged.RetainedSeries++
+	}
+	merged.labelNames = nil
+	if len(merged.Samples) > 0 {
+		merged.Warnings = append(merged.Warnings, "range query returned no data, results are from an instant query")
+	}
+	return nil
+}
+
+// isTooManySamples returns true if Prometheus refused to run the query
+// because it would load more than query.max-samples.
+func isTooManySamples(err error) bool {
+	var apiErr APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorType == v1.ErrExec && strings.Contains(apiErr.Err, "too many samples")
+}
+
+// isTooManyPoints returns true if Prometheus refused to run the query
+// because it would return more than 11,000 points per series.
+func isTooManyPoints(err error) bool {
+	var apiErr APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorType == v1.ErrBadData && strings.Contains(apiErr.Err, "exceeded maximum resolution")
+}
+
+// maxSplitDepth is how many times a range slice can be split in half
+// because it would load too many samples.
+const maxSplitDepth = 8
+
+// runRangeSlice sends a single range slice query and waits for the result.
+// If the query would load too many samples it's split into smaller queries.
+func (p *Prometheus) runRangeSlice(q rangeQuery, depth int) queryResult {
+	result := make(chan queryResult)
+	p.enqueue(q.ctx, queryRequest{query: q, result: result})
+	qr := <-result
+	if isTooManySamples(qr.err) {
+		return p.splitRangeSlice(q, qr, depth)
+	}
+	return qr
+}
+
+// splitRangeSlice splits a range slice that failed to load because of too
+// many samples into two halves, runs both at the same time and merges
+// their results.
+// Slice that only has a single step, or was already split maxSplitDepth
+// times, cannot be split and the original error is returned.
+func (p *Prometheus) splitRangeSlice(q rangeQuery, failed queryResult, depth int) queryResult {
+	steps := int64(q.r.End.Sub(q.r.Start) / q.r.Step)
+	if steps < 1 || depth >= maxSplitDepth {
+		return failed
+	}
+
+	mid := q.r.Start.Add(time.Duration((steps+1)/2) * q.r.Step)
+	log.Debug().
+		Str("uri", p.uri).
+		Str("query", q.expr).
+		Str("start", q.r.Start.UTC().Format(time.RFC3339)).
+		Str("end", q.r.End.UTC().Format(time.RFC3339)).
+		Str("split", mid.UTC().Format(time.RFC3339)).
+		Msg("Range query slice would load too many samples, splitting it")
+
+	halves := []v1.Range{
+		{Start: q.r.Start, End: mid.Add(-q.r.Step), Step: q.r.Step},
+		{Start: mid, End: q.r.End, Step: q.r.Step},
+	}
+	results := make([]queryResult, len(halves))
+	var wg sync.WaitGroup
+	for i, r := range halves {
+		wg.Add(1)
+		go func(i int, r v1.Range) {
+			defer wg.Done()
+			sq := q
+			sq.r = r
+			results[i] = p.runRangeSlice(sq, depth+1)
+		}(i, r)
+	}
+	wg.Wait()
+
+	merged := queryResult{request: failed.request}
+	samples := []model.SampleStream{}
+	for _, qr := range results {
+		if qr.err != nil {
+			return qr
+		}
+		samples = append(samples, qr.value.([]model.SampleStream)...)
+		merged.transfer.add(qr.transfer)
+		if merged.status == "" || merged.status == "success" {
+			merged.status = qr.status
+		}
+	}
+	merged.value = samples
+	return merged
+}
+
+// newStickyValue returns a random value for the sticky header.
+func newStickyValue() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 type timeRange struct {
 	start time.Time
 	end   time.Time
 }
 
-func sliceRange(start, end time.Time, resolution, sliceSize time.Duration) (slices []timeRange) {
+// sliceRange splits given time range into slices of sliceSize.
+// All calculations are done in UTC so that DST changes in the local
+// timezone don't create overlapping or missing slices.
+func sliceRange(start, end time.Time, resolution, sliceSize time.Duration, alignment SliceAlignment) (slices []timeRange) {
+	start = start.UTC()
+	end = end.UTC()
+
 	if end.Sub(start) <= resolution {
 		return []timeRange{{start: start, end: end}}
 	}
 
-	rstart := start.Round(sliceSize)
+	rstart := start
+	if alignment == EpochAligned {
+		rstart = start.Round(sliceSize)
+	}
 
 	if rstart.After(start) {
 		s := timeRange{start: rstart.Add(sliceSize * -1), end: rstart}
@@ -268,6 +1111,12 @@ func sliceRange(start, end time.Time, resolution, sliceSize time.Duration) (slic
 	return slices
 }
 
+// relativeTimes is implemented by ranges that end at the current time,
+// so they can be resolved using the clock of the client running them.
+type relativeTimes interface {
+	at(now time.Time) RangeQueryTimes
+}
+
 func NewRelativeRange(lookback, step time.Duration) RelativeRange {
 	return RelativeRange{lookback: lookback, step: step}
 }
@@ -275,14 +1124,28 @@ func NewRelativeRange(lookback, step time.Duration) RelativeRange {
 type RelativeRange struct {
 	lookback time.Duration
 	step     time.Duration
+	delay    time.Duration
+}
+
+// WithIngestionDelay returns a copy of the range that ends given duration
+// before the current time, so it doesn't include the most recent window
+// that Prometheus might not have ingested yet.
+func (rr RelativeRange) WithIngestionDelay(delay time.Duration) RelativeRange {
+	rr.delay = delay
+	return rr
 }
 
 func (rr RelativeRange) Start() time.Time {
-	return time.Now().Add(rr.lookback * -1)
+	return rr.End().Add(rr.lookback * -1)
 }
 
 func (rr RelativeRange) End() time.Time {
-	return time.Now()
+	return time.Now().Add(rr.delay * -1)
+}
+
+func (rr RelativeRange) at(now time.Time) RangeQueryTimes {
+	end := now.Add(rr.delay * -1)
+	return NewAbsoluteRange(end.Add(rr.lookback*-1), end, rr.step)
 }
 
 func (rr RelativeRange) Dur() time.Duration {
@@ -294,13 +1157,121 @@ func (rr RelativeRange) Step() time.Duration {
 }
 
 func (rr RelativeRange) String() string {
+	if rr.delay > 0 {
+		return fmt.Sprintf("%s/%s/-%s", output.HumanizeDuration(rr.lookback), output.HumanizeDuration(rr.step), output.HumanizeDuration(rr.delay))
+	}
 	return fmt.Sprintf("%s/%s", output.HumanizeDuration(rr.lookback), output.HumanizeDuration(rr.step))
 }
 
+// NewEvalAlignedRange returns a range that's aligned to evaluation times
+// of a rule group with given evaluation interval and offset, so a range
+// query will return the same timestamps the rule would be evaluated at.
+// Prometheus evaluates a group at every Unix time that's equal to offset
+// plus a multiple of interval.
+// It returns an error if interval is not positive.
+func NewEvalAlignedRange(lookback, interval, offset time.Duration) (EvalAlignedRange, error) {
+	if interval <= 0 {
+		return EvalAlignedRange{}, fmt.Errorf("invalid evaluation interval %s, it must be greater than zero", interval)
+	}
+	offset %= interval
+	if offset < 0 {
+		offset += interval
+	}
+	if rem := lookback % interval; rem > 0 {
+		lookback += interval - rem
+	}
+	return EvalAlignedRange{lookback: lookback, interval: interval, offset: offset}, nil
+}
+
+type EvalAlignedRange struct {
+	lookback time.Duration
+	interval time.Duration
+	offset   time.Duration
+}
+
+func (er EvalAlignedRange) Start() time.Time {
+	return er.End().Add(er.lookback * -1)
+}
+
+// End returns the most recent evaluation time.
+func (er EvalAlignedRange) End() time.Time {
+	return er.lastEval(time.Now())
+}
+
+func (er EvalAlignedRange) lastEval(now time.Time) time.Time {
+	ns := now.UnixNano() - int64(er.offset)
+	ns -= ns % int64(er.interval)
+	return time.Unix(0, ns+int64(er.offset)).UTC()
+}
+
+func (er EvalAlignedRange) at(now time.Time) RangeQueryTimes {
+	end := er.lastEval(now)
+	return NewAbsoluteRange(end.Add(er.lookback*-1), end, er.interval)
+}
+
+// Dur returns the lookback rounded up to a multiple of interval.
+func (er EvalAlignedRange) Dur() time.Duration {
+	return er.lookback
+}
+
+func (er EvalAlignedRange) Step() time.Duration {
+	return er.interval
+}
+
+func (er EvalAlignedRange) String() string {
+	if er.offset == 0 {
+		return fmt.Sprintf("%s/%s", output.HumanizeDuration(er.lookback), output.HumanizeDuration(er.interval))
+	}
+	return fmt.Sprintf("%s/%s+%s", output.HumanizeDuration(er.lookback), output.HumanizeDuration(er.interval), output.HumanizeDuration(er.offset))
+}
+
 func NewAbsoluteRange(start, end time.Time, step time.Duration) AbsoluteRange {
 	return AbsoluteRange{start: start, end: end, step: step}
 }
 
+// ErrRangesNotContiguous is returned by NewAbsoluteRanges when there's
+// a gap between time ranges.
+var ErrRangesNotContiguous = errors.New("time ranges are not contiguous")
+
+// TimeRange is a single window of time used with NewAbsoluteRanges.
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// NewAbsoluteRanges returns a single range covering all given time ranges,
+// so they can be queried with one RangeQuery call instead of a call per
+// range. Ranges can be passed in any order and they can overlap, but there
+// can't be any gap between them longer than step, otherwise an error
+// wrapping ErrRangesNotContiguous is returned.
+func NewAbsoluteRanges(ranges []TimeRange, step time.Duration) (AbsoluteRange, error) {
+	if len(ranges) == 0 {
+		return AbsoluteRange{}, errors.New("at least one time range is required")
+	}
+
+	sorted := make([]TimeRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	ar := AbsoluteRange{start: sorted[0].Start, end: sorted[0].End, step: step}
+	for _, tr := range sorted {
+		if tr.End.Before(tr.Start) {
+			return AbsoluteRange{}, fmt.Errorf("time range %s-%s ends before it starts",
+				tr.Start.UTC().Format(time.RFC3339), tr.End.UTC().Format(time.RFC3339))
+		}
+		if tr.Start.After(ar.end.Add(step)) {
+			return AbsoluteRange{}, fmt.Errorf("%w, nothing between %s and %s", ErrRangesNotContiguous,
+				ar.end.UTC().Format(time.RFC3339), tr.Start.UTC().Format(time.RFC3339))
+		}
+		if tr.End.After(ar.end) {
+			ar.end = tr.End
+		}
+	}
+	return ar, nil
+}
+
 type AbsoluteRange struct {
 	start time.Time
 	end   time.Time
@@ -326,18 +1297,21 @@ func (ar AbsoluteRange) Step() time.Duration {
 func (ar AbsoluteRange) String() string {
 	return fmt.Sprintf(
 		"%s-%s/%s",
-		ar.start.Format(time.RFC3339),
-		ar.end.Format(time.RFC3339),
+		ar.start.UTC().Format(time.RFC3339),
+		ar.end.UTC().Format(time.RFC3339),
 		output.HumanizeDuration(ar.step))
 }
 
-func streamSampleStream(r io.Reader) (samples []model.SampleStream, err error) {
+func streamSampleStream(r io.Reader) (samples []model.SampleStream, stats *QueryStats, status string, err error) {
 	defer dummyReadAll(r)
 
-	var status, errType, errText, resultType string
+	var errType, errText, resultType string
+	var hasData bool
 	var sample model.SampleStream
+	var qs QueryStats
+	var analysis QueryAnalysis
 	samples = []model.SampleStream{}
-	decoder := current.Object(
+	decoder := jsonObject(
 		current.Key("status", current.Value(func(s string, isNil bool) {
 			status = s
 		})),
@@ -347,7 +1321,7 @@ func streamSampleStream(r io.Reader) (samples []model.SampleStream, err error) {
 		current.Key("errorType", current.Value(func(s string, isNil bool) {
 			errType = s
 		})),
-		current.Key("data", current.Object(
+		current.Key("data", &presence{found: &hasData, str: jsonObject(
 			current.Key("resultType", current.Value(func(s string, isNil bool) {
 				resultType = s
 			})),
@@ -359,21 +1333,36 @@ func streamSampleStream(r io.Reader) (samples []model.SampleStream, err error) {
 					sample.Values = make([]model.SamplePair, 0, len(sample.Values))
 				},
 			)),
-		)),
+			current.Key("stats", &jsonValue[QueryStats]{dst: &qs}),
+			current.Key("analysis", &jsonValue[QueryAnalysis]{dst: &analysis}),
+		)}),
 	)
 
 	dec := json.NewDecoder(r)
 	if err = decoder.Stream(dec); err != nil {
-		return nil, APIError{Status: status, ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("JSON parse error: %s", err)}
+		return nil, nil, status, APIError{Status: status, ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("JSON parse error: %s", err)}
 	}
 
 	if status != "success" {
-		return nil, APIError{Status: status, ErrorType: decodeErrorType(errType), Err: errText}
+		return nil, nil, status, APIError{Status: status, ErrorType: decodeErrorType(errType), Err: errText}
+	}
+
+	// Some backends return a successful response without any data
+	// when nothing matched the query.
+	if !hasData {
+		return samples, nil, status, nil
 	}
 
 	if resultType != "matrix" {
-		return nil, APIError{Status: status, ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("invalid result type, expected matrix, got %s", resultType)}
+		return nil, nil, status, APIError{Status: status, ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("invalid result type, expected matrix, got %s", resultType)}
+	}
+
+	if analysis.Name != "" {
+		qs.Analysis = &analysis
+	}
+	if qs != (QueryStats{}) {
+		stats = &qs
 	}
 
-	return samples, nil
+	return samples, stats, status, nil
 }
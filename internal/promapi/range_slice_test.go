@@ -1,12 +1,19 @@
 package promapi
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+	_ "time/tzdata"
 
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 )
 
@@ -204,8 +211,271 @@ func TestSliceRange(t *testing.T) {
 
 	for i, tc := range testCases {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			output := sliceRange(tc.start, tc.end, tc.resolution, tc.sliceSize)
+			output := sliceRange(tc.start, tc.end, tc.resolution, tc.sliceSize, EpochAligned)
 			require.Equal(t, printRange(tc.output), printRange(output))
 		})
 	}
 }
+
+func TestSliceRangeDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+
+	// Clocks go forward from 01:00 GMT to 02:00 BST on 2022-03-27.
+	start := time.Date(2022, 3, 27, 0, 30, 0, 0, loc)
+	end := time.Date(2022, 3, 27, 3, 30, 0, 0, loc)
+	require.Equal(t, time.Hour*2, end.Sub(start))
+
+	slices := sliceRange(start, end, time.Minute*5, time.Hour, EpochAligned)
+	require.Equal(t, []timeRange{
+		{
+			start: time.Date(2022, 3, 27, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2022, 3, 27, 0, 59, 59, 0, time.UTC),
+		},
+		{
+			start: time.Date(2022, 3, 27, 1, 0, 0, 0, time.UTC),
+			end:   time.Date(2022, 3, 27, 1, 59, 59, 0, time.UTC),
+		},
+		{
+			start: time.Date(2022, 3, 27, 2, 0, 0, 0, time.UTC),
+			end:   time.Date(2022, 3, 27, 2, 30, 0, 0, time.UTC),
+		},
+	}, slices)
+
+	for i := 1; i < len(slices); i++ {
+		require.Equal(t, slices[i-1].end.Add(time.Second), slices[i].start, "gap or overlap between slices %d and %d", i-1, i)
+	}
+}
+
+func TestSliceRangeAlignment(t *testing.T) {
+	start := time.Date(2022, 1, 1, 11, 11, 11, 0, time.UTC)
+	end := start.Add(time.Hour * 5)
+
+	require.Equal(t, []timeRange{
+		{
+			start: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC),
+			end:   time.Date(2022, 1, 1, 11, 59, 59, 0, time.UTC),
+		},
+		{
+			start: time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC),
+			end:   time.Date(2022, 1, 1, 13, 59, 59, 0, time.UTC),
+		},
+		{
+			start: time.Date(2022, 1, 1, 14, 0, 0, 0, time.UTC),
+			end:   time.Date(2022, 1, 1, 15, 59, 59, 0, time.UTC),
+		},
+		{
+			start: time.Date(2022, 1, 1, 16, 0, 0, 0, time.UTC),
+			end:   time.Date(2022, 1, 1, 16, 11, 11, 0, time.UTC),
+		},
+	}, sliceRange(start, end, time.Minute, time.Hour*2, EpochAligned))
+
+	require.Equal(t, []timeRange{
+		{
+			start: time.Date(2022, 1, 1, 11, 11, 11, 0, time.UTC),
+			end:   time.Date(2022, 1, 1, 13, 11, 10, 0, time.UTC),
+		},
+		{
+			start: time.Date(2022, 1, 1, 13, 11, 11, 0, time.UTC),
+			end:   time.Date(2022, 1, 1, 15, 11, 10, 0, time.UTC),
+		},
+		{
+			start: time.Date(2022, 1, 1, 15, 11, 11, 0, time.UTC),
+			end:   time.Date(2022, 1, 1, 16, 11, 11, 0, time.UTC),
+		},
+	}, sliceRange(start, end, time.Minute, time.Hour*2, StartAligned))
+}
+
+func TestRangeQueryCacheKeyTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	start := time.Date(2022, 11, 6, 5, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour * 2)
+
+	prom := NewPrometheus("test", "http://localhost", time.Second, 1, 100, 100)
+	utc := rangeQuery{prom: prom, expr: "up", r: v1.Range{Start: start, End: end, Step: time.Minute}}
+	local := rangeQuery{prom: prom, expr: "up", r: v1.Range{Start: start.In(loc), End: end.In(loc), Step: time.Minute}}
+	require.Equal(t, utc.CacheKey(), local.CacheKey())
+}
+
+func TestRangeQueryCacheKeyLookbackDelta(t *testing.T) {
+	start := time.Date(2022, 11, 6, 5, 0, 0, 0, time.UTC)
+	r := v1.Range{Start: start, End: start.Add(time.Hour), Step: time.Minute}
+
+	def := rangeQuery{prom: NewPrometheus("test", "http://localhost", time.Second, 1, 100, 100), expr: "up", r: r}
+	lb5m := rangeQuery{prom: NewPrometheus("test", "http://localhost", time.Second, 1, 100, 100, WithLookbackDelta(time.Minute*5)), expr: "up", r: r}
+	lb1m := rangeQuery{prom: NewPrometheus("test", "http://localhost", time.Second, 1, 100, 100, WithLookbackDelta(time.Minute)), expr: "up", r: r}
+	require.NotEqual(t, def.CacheKey(), lb5m.CacheKey())
+	require.NotEqual(t, def.CacheKey(), lb1m.CacheKey())
+	require.NotEqual(t, lb5m.CacheKey(), lb1m.CacheKey())
+}
+
+func TestRangeQuerySliceDebugLog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{
+			"status":"success",
+			"data":{
+				"resultType":"matrix",
+				"result":[
+					{"metric":{"instance":"1"},"values":[[1654077600,"1"],[1654077660,"1"],[1654077720,"1"]]},
+					{"metric":{"instance":"2"},"values":[[1654077600,"1"]]}
+				]
+			}
+		}`))
+	}))
+	defer srv.Close()
+
+	logs := captureLogs(t, zerolog.DebugLevel)
+
+	prom := NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	params := NewAbsoluteRange(start, start.Add(time.Hour*3), time.Minute)
+	_, err := prom.RangeQuery(context.Background(), "up", params, RangeQueryOptions{})
+	require.NoError(t, err)
+
+	lines := logs.lines("Decoded prometheus range query slice")
+	require.Len(t, lines, 2, "one line per slice")
+	for _, line := range lines {
+		require.Equal(t, "debug", line["level"])
+		require.Equal(t, srv.URL, line["uri"])
+		require.Equal(t, "up", line["query"])
+		require.Equal(t, float64(2), line["series"])
+		require.Equal(t, float64(4), line["values"])
+		require.Contains(t, line, "decode")
+		require.Contains(t, line, "start")
+		require.Contains(t, line, "end")
+	}
+}
+
+func TestRangeQuerySkipsCachedSlices(t *testing.T) {
+	prom := NewPrometheus("test", "http://localhost", time.Second, 1, 100, 100)
+	prom.queries = make(chan queryRequest)
+
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	params := NewAbsoluteRange(start, start.Add(time.Hour*8), time.Minute)
+	plan := newRangePlan(params, RangeQueryOptions{})
+	require.Len(t, plan.slices, 4)
+
+	sliceQuery := func(i int) rangeQuery {
+		return rangeQuery{
+			prom: prom,
+			expr: "up",
+			r:    v1.Range{Start: plan.slices[i].start, End: plan.slices[i].end, Step: plan.step},
+		}
+	}
+	sliceResult := func(i int) queryResult {
+		return queryResult{value: []model.SampleStream{
+			{
+				Metric: model.Metric{"instance": "1"},
+				Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(plan.slices[i].start.Unix()), Value: model.SampleValue(i)}},
+			},
+		}}
+	}
+
+	var received []int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for job := range prom.queries {
+			q := job.query.(rangeQuery)
+			for i := range plan.slices {
+				if q.r.Start.Equal(plan.slices[i].start) {
+					received = append(received, i)
+					if i == 0 {
+						// Simulate another query populating the cache while
+						// this one is still running. Scheduler is either
+						// checking the cache for slice 1 or waiting to send it.
+						for _, j := range []int{2, 3} {
+							prom.cache.add(sliceQuery(j).CacheKey(), q.Endpoint(), sliceResult(j), time.Now())
+						}
+					}
+					job.result <- sliceResult(i)
+				}
+			}
+		}
+	}()
+
+	qr, err := prom.rangeQuery(context.Background(), "up", plan)
+	close(prom.queries)
+	<-done
+
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, received, "cached slices shouldn't be sent to workers")
+	require.Len(t, qr.Samples, 1)
+	require.Len(t, qr.Samples[0].Values, 4)
+	for i, v := range qr.Samples[0].Values {
+		require.Equal(t, model.SampleValue(i), v.Value)
+	}
+}
+
+func TestRangePlanMaxSlices(t *testing.T) {
+	type testCaseT struct {
+		lookback  time.Duration
+		step      time.Duration
+		maxSlices int
+		alignment SliceAlignment
+		slices    int
+	}
+
+	testCases := []testCaseT{
+		{lookback: time.Hour * 24 * 30, step: time.Minute, maxSlices: 0, slices: 361},
+		{lookback: time.Hour * 24 * 30, step: time.Minute, maxSlices: 400, slices: 361},
+		{lookback: time.Hour * 24 * 30, step: time.Minute, maxSlices: 100, slices: 100},
+		{lookback: time.Hour * 24 * 30, step: time.Minute, maxSlices: 10, slices: 10},
+		{lookback: time.Hour * 24 * 30, step: time.Minute, maxSlices: 1, slices: 2},
+		{lookback: time.Hour * 24 * 30, step: time.Minute, maxSlices: 1, alignment: StartAligned, slices: 1},
+		{lookback: time.Hour * 24 * 7, step: time.Minute * 7, maxSlices: 5, slices: 5},
+		{lookback: time.Hour * 24 * 7, step: time.Minute * 7, maxSlices: 5, alignment: StartAligned, slices: 5},
+	}
+
+	end := time.Date(2022, 6, 14, 10, 13, 27, 0, time.UTC)
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s/%s/%d/%d", tc.lookback, tc.step, tc.maxSlices, tc.alignment), func(t *testing.T) {
+			params := AbsoluteRange{start: end.Add(-tc.lookback), end: end, step: tc.step}
+			plan := newRangePlan(params, RangeQueryOptions{MaxSlices: tc.maxSlices, Alignment: tc.alignment})
+			require.Len(t, plan.slices, tc.slices)
+			require.Zero(t, plan.sliceSize%tc.step, "slice size must be a multiple of step")
+			require.False(t, plan.slices[0].start.After(plan.start), "first slice must cover the start of the range")
+			require.Equal(t, plan.end, plan.slices[len(plan.slices)-1].end)
+		})
+	}
+}
+
+func TestRangePlanLongStep(t *testing.T) {
+	end := time.Date(2022, 6, 14, 10, 0, 0, 0, time.UTC)
+	params := AbsoluteRange{start: end.Add(-time.Hour * 24 * 7), end: end, step: time.Hour * 6}
+	plan := newRangePlan(params, RangeQueryOptions{Alignment: StartAligned})
+	require.Equal(t, time.Hour*6, plan.sliceSize, "slice can't be shorter than step")
+	require.Len(t, plan.slices, 28)
+}
+
+func TestRangePlanTimeout(t *testing.T) {
+	prom := NewPrometheus("test", "http://localhost", time.Minute*2, 1, 100, 100)
+	end := time.Date(2022, 6, 14, 10, 0, 0, 0, time.UTC)
+	params := AbsoluteRange{start: end.Add(-time.Hour * 24), end: end, step: time.Minute}
+
+	for _, tc := range []struct {
+		timeout   time.Duration
+		sliceSize time.Duration
+		slices    int
+	}{
+		{timeout: 0, sliceSize: time.Hour * 2, slices: 12},
+		{timeout: time.Minute * 2, sliceSize: time.Hour * 2, slices: 12},
+		{timeout: time.Minute * 10, sliceSize: time.Hour * 2, slices: 12},
+		{timeout: time.Minute, sliceSize: time.Hour, slices: 24},
+		{timeout: time.Second * 30, sliceSize: time.Minute * 30, slices: 48},
+		{timeout: time.Millisecond, sliceSize: time.Minute, slices: 1440},
+	} {
+		t.Run(tc.timeout.String(), func(t *testing.T) {
+			plan := prom.newRangePlan(context.Background(), params, RangeQueryOptions{Alignment: StartAligned, Timeout: tc.timeout})
+			require.Equal(t, tc.sliceSize, plan.sliceSize)
+			require.Len(t, plan.slices, tc.slices)
+		})
+	}
+}
@@ -2,15 +2,27 @@ package promapi_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/require"
 
 	"github.com/cloudflare/pint/internal/promapi"
@@ -302,6 +314,72 @@ func TestRange(t *testing.T) {
 				}`))
 			},
 		},
+		{
+			query:   "nodata",
+			start:   timeParse("2022-06-14T00:00:00Z"),
+			end:     timeParse("2022-06-14T00:05:00Z"),
+			step:    time.Minute,
+			timeout: time.Second,
+			samples: nil,
+			handler: func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"status":"success"}`))
+			},
+		},
+		{
+			query:   "emptydata",
+			start:   timeParse("2022-06-14T00:00:00Z"),
+			end:     timeParse("2022-06-14T00:05:00Z"),
+			step:    time.Minute,
+			timeout: time.Second,
+			err:     "bad_response: invalid result type, expected matrix, got ",
+			handler: func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"status":"success","data":{}}`))
+			},
+		},
+		{
+			query:   "unknownkeys",
+			start:   timeParse("2022-06-14T00:00:00Z"),
+			end:     timeParse("2022-06-14T00:05:00Z"),
+			step:    time.Minute,
+			timeout: time.Second,
+			samples: []*model.SampleStream{
+				{
+					Metric: model.Metric{"instance": "1"},
+					Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(timeParse("2022-06-14T00:00:00Z").Unix()), Value: 1}},
+				},
+			},
+			handler: func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{
+					"status":"success",
+					"meta":{"status":"error","data":{"foo":"bar"}},
+					"warnings":["data", {"status":"error"}],
+					"data":{
+						"extra":{"resultType":"vector"},
+						"resultType":"matrix",
+						"result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"]]}]
+					}
+				}`))
+			},
+		},
+		{
+			query:   "nodataerror",
+			start:   timeParse("2022-06-14T00:00:00Z"),
+			end:     timeParse("2022-06-14T00:05:00Z"),
+			step:    time.Minute,
+			timeout: time.Second,
+			err:     "bad_data: bad input data",
+			handler: func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"bad input data"}`))
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -315,7 +393,7 @@ func TestRange(t *testing.T) {
 			prom.StartWorkers()
 			defer prom.Close()
 
-			qr, err := prom.RangeQuery(context.Background(), tc.query, promapi.NewAbsoluteRange(tc.start, tc.end, tc.step))
+			qr, err := prom.RangeQuery(context.Background(), tc.query, promapi.NewAbsoluteRange(tc.start, tc.end, tc.step), promapi.RangeQueryOptions{})
 			if tc.err != "" {
 				require.EqualError(t, err, tc.err, tc)
 			} else {
@@ -336,3 +414,2539 @@ func generateSamples(start, end time.Time, step time.Duration) (samples []model.
 	}
 	return samples
 }
+
+func TestRangeRequestDetails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch r.Form.Get("query") {
+		case "error":
+			w.WriteHeader(400)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"unknown function"}`))
+		default:
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	uri := strings.Replace(srv.URL, "http://", "http://bob:secret@", 1)
+	redacted := strings.Replace(srv.URL, "http://", "http://bob:xxxxx@", 1)
+
+	prom := promapi.NewPrometheus("test", uri, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	end := start.Add(time.Hour * 3)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(start, end, time.Minute*5), promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []promapi.RequestDetails{
+		{
+			Method: http.MethodPost,
+			URI:    redacted + "/api/v1/query_range",
+			Body:   "end=1655171999&query=up&start=1655164800&step=300&timeout=1s",
+		},
+		{
+			Method: http.MethodPost,
+			URI:    redacted + "/api/v1/query_range",
+			Body:   "end=1655175600&query=up&start=1655172000&step=300&timeout=1s",
+		},
+	}, qr.Requests)
+
+	_, err = prom.RangeQuery(context.Background(), "error", promapi.NewAbsoluteRange(start, start.Add(time.Minute), time.Minute), promapi.RangeQueryOptions{})
+	require.EqualError(t, err, "bad_data: unknown function")
+	var qe promapi.QueryError
+	require.ErrorAs(t, err, &qe)
+	require.Equal(t, &promapi.RequestDetails{
+		Method: http.MethodPost,
+		URI:    redacted + "/api/v1/query_range",
+		Body:   "end=1655164860&query=error&start=1655164800&step=60&timeout=1s",
+	}, qe.Request())
+}
+
+func TestRangeQueryBatch(t *testing.T) {
+	var lock sync.Mutex
+	requests := map[string]int{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := r.Form.Get("query")
+
+		lock.Lock()
+		requests[query]++
+		lock.Unlock()
+
+		if query == "error" {
+			w.WriteHeader(400)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"unknown function"}`))
+			return
+		}
+
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(
+			`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"query":"%s"}, "values":[[%3f,"1"]]}]}}`,
+			query, start)))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 4, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	end := start.Add(time.Hour * 6)
+	params := promapi.NewAbsoluteRange(start, end, time.Minute)
+
+	results, errs := prom.RangeQueryBatch(context.Background(), []string{"foo", "bar", "error", "foo"}, params, promapi.RangeQueryOptions{})
+	require.Len(t, results, 2)
+	require.Len(t, errs, 1)
+	require.EqualError(t, errs["error"], "bad_data: unknown function")
+
+	for _, expr := range []string{"foo", "bar"} {
+		require.Contains(t, results, expr)
+		require.Len(t, results[expr].Samples, 1)
+		require.Equal(t, model.Metric{"query": model.LabelValue(expr)}, results[expr].Samples[0].Metric)
+		require.Len(t, results[expr].Samples[0].Values, 3)
+		require.Equal(t, 3, requests[expr], "each slice should be requested once")
+	}
+
+	// second run should be served from cache
+	results, errs = prom.RangeQueryBatch(context.Background(), []string{"foo", "bar"}, params, promapi.RangeQueryOptions{})
+	require.Len(t, results, 2)
+	require.Len(t, errs, 0)
+	require.Equal(t, 3, requests["foo"])
+	require.Equal(t, 3, requests["bar"])
+}
+
+func TestRangeLookbackDelta(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch r.Form.Get("query") {
+		case "default":
+			require.False(t, r.Form.Has("lookback_delta"), "lookback_delta shouldn't be set")
+		case "custom":
+			require.Equal(t, "120", r.Form.Get("lookback_delta"))
+		default:
+			t.Fatalf("unknown query: %s", r.Form.Get("query"))
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+	_, err := prom.RangeQuery(context.Background(), "default", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+
+	custom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithLookbackDelta(time.Minute*2))
+	custom.StartWorkers()
+	defer custom.Close()
+	_, err = custom.RangeQuery(context.Background(), "custom", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+}
+
+func TestRangeWithoutTimeoutParam(t *testing.T) {
+	var mtx sync.Mutex
+	timeouts := map[string][]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		timeouts[r.Form.Get("query")] = r.Form["timeout"]
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+	_, err := prom.RangeQuery(context.Background(), "default", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+
+	omit := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithoutTimeoutParam())
+	omit.StartWorkers()
+	defer omit.Close()
+	_, err = omit.RangeQuery(context.Background(), "omitted", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	_, err = omit.Query(context.Background(), "instant")
+	require.NoError(t, err)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Len(t, timeouts, 3)
+	require.Equal(t, []string{"1s"}, timeouts["default"])
+	require.Nil(t, timeouts["omitted"], "timeout shouldn't be set")
+	require.Nil(t, timeouts["instant"], "timeout shouldn't be set")
+}
+
+func TestRangeWithoutKeepAlives(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*8), time.Minute)
+
+	query := func(opts ...promapi.PrometheusOption) (conns, reused int) {
+		var mtx sync.Mutex
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				conns++
+				if info.Reused {
+					reused++
+				}
+			},
+		})
+
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, opts...)
+		prom.StartWorkers()
+		defer prom.Close()
+		qr, err := prom.RangeQuery(ctx, "up", params, promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		require.Greater(t, len(qr.Requests), 1)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		require.Equal(t, len(qr.Requests), conns)
+		return conns, reused
+	}
+
+	_, reused := query()
+	require.Positive(t, reused, "connections should be reused by default")
+
+	_, reused = query(promapi.WithoutKeepAlives())
+	require.Zero(t, reused, "connections shouldn't be reused")
+}
+
+func TestRangeMatchedSeries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Form.Get("query") {
+		case "empty":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		case "outside":
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"1"}, "values":[[%3f,"1"]]},
+				{"metric":{"instance":"2"}, "values":[[%3f,"1"]]}
+			]}}`, start-3600, start+1)))
+		}
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "empty", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 0)
+	require.Equal(t, 0, qr.MatchedSeries)
+	require.Equal(t, 0, qr.RetainedSeries)
+
+	qr, err = prom.RangeQuery(context.Background(), "outside", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 2)
+	require.Equal(t, 2, qr.MatchedSeries)
+	require.Equal(t, 1, qr.RetainedSeries)
+	require.Len(t, qr.Samples[0].Values, 0)
+	require.Len(t, qr.Samples[1].Values, 1)
+}
+
+func TestRangeDropEmptySeries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[[%3f,"1"]]},
+			{"metric":{"instance":"2"}, "values":[]},
+			{"metric":{"instance":"3"}, "values":[]},
+			{"metric":{"instance":"4"}, "values":[[%3f,"1"]]}
+		]}}`, start, start-3600)))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "keep", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 4)
+	require.Equal(t, 4, qr.MatchedSeries)
+	require.Equal(t, 1, qr.RetainedSeries)
+	require.Equal(t, 0, qr.EmptySeries)
+
+	qr, err = prom.RangeQuery(context.Background(), "drop", params, promapi.RangeQueryOptions{DropEmptySeries: true})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 2)
+	require.Equal(t, model.Metric{"instance": "1"}, qr.Samples[0].Metric)
+	require.Equal(t, model.Metric{"instance": "4"}, qr.Samples[1].Metric)
+	require.Equal(t, 2, qr.MatchedSeries)
+	require.Equal(t, 1, qr.RetainedSeries)
+	require.Equal(t, 2, qr.EmptySeries)
+}
+
+func TestRangeDropEmptySeriesAcrossSlices(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		// Only the slice covering the start of the query returns values
+		// for instance 1, other slices return it with an empty list.
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		if start <= 1655164800 {
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"1"}, "values":[[%3f,"1"]]},
+				{"metric":{"instance":"2"}, "values":[]}
+			]}}`, start+60)))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[]},
+			{"metric":{"instance":"2"}, "values":[]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*6), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{DropEmptySeries: true})
+	require.NoError(t, err)
+	require.Greater(t, len(qr.Requests), 1, "query should be split into multiple slices")
+	require.Len(t, qr.Samples, 1)
+	require.Equal(t, model.Metric{"instance": "1"}, qr.Samples[0].Metric)
+	require.Len(t, qr.Samples[0].Values, 1)
+	require.Equal(t, 1, qr.MatchedSeries)
+	require.Equal(t, 1, qr.EmptySeries)
+}
+
+func TestRangeAnchorToRange(t *testing.T) {
+	anchorRe := regexp.MustCompile(`@ ([0-9.]+)`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		// Emulate Prometheus resolving start() using the range of each request,
+		// the value is the timestamp the selector was anchored to.
+		anchor := start
+		if m := anchorRe.FindStringSubmatch(r.Form.Get("query")); m != nil {
+			anchor, _ = strconv.ParseFloat(m[1], 64)
+		} else if !strings.Contains(r.Form.Get("query"), "@ start()") {
+			t.Fatalf("unexpected query: %s", r.Form.Get("query"))
+		}
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[[%3f,"%f"]]}
+		]}}`, start+60, anchor)))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*6), time.Minute)
+	anchors := func(qr *promapi.RangeQueryResult) map[float64]struct{} {
+		vals := map[float64]struct{}{}
+		for _, v := range qr.Samples[0].Values {
+			vals[float64(v.Value)] = struct{}{}
+		}
+		return vals
+	}
+
+	qr, err := prom.RangeQuery(context.Background(), "up @ start()", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Len(t, qr.Samples[0].Values, 3)
+	require.Len(t, anchors(qr), 3, "each slice should be anchored to its own start")
+
+	qr, err = prom.RangeQuery(context.Background(), "up @ start()", params, promapi.RangeQueryOptions{AnchorToRange: true})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Len(t, qr.Samples[0].Values, 3)
+	require.Equal(t, map[float64]struct{}{float64(start.Unix()): {}}, anchors(qr), "all slices should be anchored to the start of the range")
+	for _, req := range qr.Requests {
+		require.Contains(t, req.Body+req.URI, "1655164800.000")
+	}
+}
+
+func TestRangeJSONBody(t *testing.T) {
+	var mtx sync.Mutex
+	contentTypes := []string{}
+	params := []map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]string{}
+		switch r.Header.Get("Content-Type") {
+		case "application/json":
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			for k := range r.PostForm {
+				req[k] = r.PostForm.Get(k)
+			}
+		}
+		mtx.Lock()
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		params = append(params, req)
+		mtx.Unlock()
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[[%s,"1"]]}
+		]}}`, req["start"])))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	rr := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	form := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	form.StartWorkers()
+	defer form.Close()
+
+	js := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithJSONBody())
+	js.StartWorkers()
+	defer js.Close()
+
+	fqr, err := form.RangeQuery(context.Background(), `sum(up{job="foo"})`, rr, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	jqr, err := js.RangeQuery(context.Background(), `sum(up{job="foo"})`, rr, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, fqr.Samples, jqr.Samples)
+
+	// Second query should be served from the cache.
+	_, err = js.RangeQuery(context.Background(), `sum(up{job="foo"})`, rr, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, []string{"application/x-www-form-urlencoded", "application/json"}, contentTypes)
+	require.Len(t, params, 2)
+	require.Equal(t, `sum(up{job="foo"})`, params[1]["query"])
+	require.Equal(t, params[0], params[1], "JSON body should have the same parameters as the form")
+
+	require.Len(t, jqr.Requests, 1)
+	require.JSONEq(t, `{"query":"sum(up{job=\"foo\"})","start":"1655164800","end":"1655165100","step":"60","timeout":"1s"}`, jqr.Requests[0].Body)
+}
+
+func TestRangeStreamingBody(t *testing.T) {
+	type request struct {
+		body          string
+		contentLength int64
+	}
+
+	var mtx sync.Mutex
+	var requests []request
+	var failures int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtx.Lock()
+		requests = append(requests, request{body: string(body), contentLength: r.ContentLength})
+		fail := failures > 0
+		if fail {
+			failures--
+		}
+		mtx.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[[1655164800,"1"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	rr := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+	form := `end=1655165100&query=sum%28up%7Bjob%3D%22foo%22%7D%29&start=1655164800&step=60&timeout=1s`
+
+	type testCaseT struct {
+		name     string
+		opts     []promapi.PrometheusOption
+		failures int
+		body     string
+		buffered bool
+	}
+
+	testCases := []testCaseT{
+		{
+			name:     "buffered",
+			body:     form,
+			buffered: true,
+		},
+		{
+			name: "streamed",
+			opts: []promapi.PrometheusOption{promapi.WithStreamingBody()},
+			body: form,
+		},
+		{
+			name: "streamed JSON",
+			opts: []promapi.PrometheusOption{promapi.WithStreamingBody(), promapi.WithJSONBody()},
+			body: `{"end":"1655165100","query":"sum(up{job=\"foo\"})","start":"1655164800","step":"60","timeout":"1s"}`,
+		},
+		{
+			name:     "streamed with retries",
+			opts:     []promapi.PrometheusOption{promapi.WithStreamingBody(), promapi.WithRetries(2)},
+			failures: 2,
+			body:     form,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mtx.Lock()
+			requests = nil
+			failures = tc.failures
+			mtx.Unlock()
+
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, tc.opts...)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			qr, err := prom.RangeQuery(context.Background(), `sum(up{job="foo"})`, rr, promapi.RangeQueryOptions{})
+			require.NoError(t, err)
+			require.Len(t, qr.Samples, 1)
+			require.Len(t, qr.Requests, 1)
+			if tc.buffered {
+				require.Equal(t, tc.body, qr.Requests[0].Body)
+			} else {
+				require.Empty(t, qr.Requests[0].Body, "streamed body shouldn't be encoded in memory")
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			require.Len(t, requests, tc.failures+1)
+			for _, req := range requests {
+				require.Equal(t, tc.body, req.body)
+				if tc.buffered {
+					require.Equal(t, int64(len(tc.body)), req.contentLength)
+				} else {
+					require.Equal(t, int64(-1), req.contentLength, "streamed body shouldn't have a known length")
+				}
+			}
+		})
+	}
+}
+
+func TestHasData(t *testing.T) {
+	var mtx sync.Mutex
+	var requests, cancelled int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+
+		query := r.Form.Get("query")
+		if query == "early" && start <= 1655164800 {
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"1"}, "values":[[%3f,"1"]]}
+			]}}`, start+60)))
+			return
+		}
+		if query == "early" {
+			// Block all other slices until the request is cancelled.
+			select {
+			case <-r.Context().Done():
+				mtx.Lock()
+				cancelled++
+				mtx.Unlock()
+				return
+			case <-time.After(time.Second * 10):
+			}
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*30, 3, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*6), time.Minute)
+
+	began := time.Now()
+	ok, err := prom.HasData(context.Background(), "early", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Less(t, time.Since(began), time.Second*5, "remaining slices should be cancelled")
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return cancelled == requests-1
+	}, time.Second*5, time.Millisecond*10, "all other running slices should be cancelled")
+
+	mtx.Lock()
+	requests = 0
+	mtx.Unlock()
+	ok, err = prom.HasData(context.Background(), "empty", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.False(t, ok)
+	mtx.Lock()
+	require.Equal(t, 3, requests, "all slices should be sent if there's no data")
+	mtx.Unlock()
+}
+
+func TestRangeTransfers(t *testing.T) {
+	var mtx sync.Mutex
+	sizes := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		var series []string
+		for i := 0; i < int(start)%7+1; i++ {
+			series = append(series, fmt.Sprintf(`{"metric":{"instance":"%d"}, "values":[[%3f,"1"]]}`, i, start+60))
+		}
+		body := fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, strings.Join(series, ","))
+		mtx.Lock()
+		sizes[r.Form.Get("start")] = len(body)
+		mtx.Unlock()
+
+		time.Sleep(time.Millisecond * 50)
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*6), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Transfers, 3)
+	mtx.Lock()
+	for i, tr := range qr.Transfers {
+		u, err := url.ParseQuery(qr.Requests[i].Body)
+		require.NoError(t, err)
+		require.Equal(t, int64(sizes[u.Get("start")]), tr.BytesRead, "slice %d", i)
+		require.False(t, tr.Cached)
+		require.GreaterOrEqual(t, tr.NetworkDuration, time.Millisecond*50)
+		require.GreaterOrEqual(t, tr.DecodeDuration, time.Duration(0))
+	}
+	mtx.Unlock()
+
+	qr, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []promapi.TransferStats{{Cached: true}, {Cached: true}, {Cached: true}}, qr.Transfers)
+}
+
+func TestRangeDuplicates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[[1655164800,"1"],[1655164860,"2"],[1655164860,"3"],[1655164920,"4"]]},
+			{"metric":{"instance":"2"}, "values":[[1655164920,"3"],[1655164800,"1"],[1655164920,"4"],[1655164860,"2"]]},
+			{"metric":{"instance":"3"}, "values":[[1655164800,"1"],[1655164860,"2"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+	values := func(vals ...float64) []model.SamplePair {
+		pairs := make([]model.SamplePair, 0, len(vals))
+		for i, v := range vals {
+			pairs = append(pairs, model.SamplePair{Timestamp: model.TimeFromUnix(start.Unix() + int64(i)*60), Value: model.SampleValue(v)})
+		}
+		return pairs
+	}
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 3)
+	require.Len(t, qr.Samples[0].Values, 4, "duplicates should be kept by default")
+	require.Len(t, qr.Samples[1].Values, 4, "duplicates should be kept by default")
+
+	qr, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{Duplicates: promapi.DropDuplicates})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 3)
+	require.Equal(t, values(1, 2, 4), qr.Samples[0].Values)
+	require.Equal(t, values(1, 2, 3), qr.Samples[1].Values)
+	require.Equal(t, values(1, 2), qr.Samples[2].Values)
+
+	_, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{Duplicates: promapi.RejectDuplicates})
+	require.ErrorIs(t, err, promapi.ErrDuplicateTimestamp)
+	require.EqualError(t, err, `series has multiple values with the same timestamp: {instance="1"} has multiple values at 2022-06-14T00:01:00Z`)
+	var qe promapi.QueryError
+	require.ErrorAs(t, err, &qe)
+	require.NotNil(t, qe.Request())
+}
+
+func TestRangeDropInf(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[[1655164800,"1"],[1655164860,"+Inf"],[1655164920,"-Inf"],[1655164980,"NaN"]]},
+			{"metric":{"instance":"2"}, "values":[[1655164800,"+Inf"],[1655164860,"-Inf"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 2)
+	require.Len(t, qr.Samples[0].Values, 4, "infinite values should be kept by default")
+	require.True(t, math.IsInf(float64(qr.Samples[0].Values[1].Value), 1))
+	require.True(t, math.IsInf(float64(qr.Samples[0].Values[2].Value), -1))
+	require.Len(t, qr.Samples[1].Values, 2, "infinite values should be kept by default")
+
+	qr, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{DropInf: true})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 2)
+	require.Len(t, qr.Samples[0].Values, 2)
+	require.Equal(t, model.SampleValue(1), qr.Samples[0].Values[0].Value)
+	require.Equal(t, model.TimeFromUnix(start.Unix()), qr.Samples[0].Values[0].Timestamp)
+	require.True(t, math.IsNaN(float64(qr.Samples[0].Values[1].Value)), "NaN values should be kept")
+	require.Empty(t, qr.Samples[1].Values)
+	require.Equal(t, 1, qr.RetainedSeries)
+}
+
+func TestRangeCoverage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/v1/query" {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+				{"metric":{"instance":"4"}, "value":[1655186400,"1"]}
+			]}}`))
+			return
+		}
+		if r.Form.Get("query") == "empty" {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+			return
+		}
+		// instance 1 is present in every slice, instance 2 only in the first
+		// slice and instance 3 has no values within the range.
+		series := []string{
+			fmt.Sprintf(`{"metric":{"instance":"1"}, "values":[[%3f,"1"],[%3f,"1"]]}`, start+60, start+120),
+			fmt.Sprintf(`{"metric":{"instance":"3"}, "values":[[%3f,"1"]]}`, start-3600*24),
+		}
+		if start <= 1655164800 {
+			series = append(series, fmt.Sprintf(`{"metric":{"instance":"2"}, "values":[[%3f,"1"],[%3f,"1"],[%3f,"1"]]}`, start+300, start, start+600))
+		}
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, strings.Join(series, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0).UTC()
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*6), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 3)
+	require.Len(t, qr.Coverage, 3)
+	for i, s := range qr.Samples {
+		switch s.Metric["instance"] {
+		case "1":
+			require.Equal(t, promapi.SeriesCoverage{
+				First:  start.Add(time.Minute),
+				Last:   start.Add(time.Hour*4 + time.Minute*2),
+				Points: 6,
+			}, qr.Coverage[i])
+		case "2":
+			require.Equal(t, promapi.SeriesCoverage{
+				First:  start,
+				Last:   start.Add(time.Minute * 10),
+				Points: 3,
+			}, qr.Coverage[i])
+		case "3":
+			require.Equal(t, promapi.SeriesCoverage{}, qr.Coverage[i])
+		}
+		require.Equal(t, len(s.Values), qr.Coverage[i].Points)
+	}
+
+	qr, err = prom.RangeQuery(context.Background(), "empty", params, promapi.RangeQueryOptions{InstantFallback: true})
+	require.NoError(t, err)
+	require.Equal(t, []promapi.SeriesCoverage{
+		{First: start.Add(time.Hour * 6), Last: start.Add(time.Hour * 6), Points: 1},
+	}, qr.Coverage)
+}
+
+func TestRangeProtobuf(t *testing.T) {
+	var mtx sync.Mutex
+	contentTypes := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		query := r.Form.Get("query")
+		accept := r.Header.Get("Accept")
+
+		if strings.HasPrefix(accept, "application/vnd.google.protobuf") && query != "json" {
+			qr := prompb.QueryResult{Timeseries: []*prompb.TimeSeries{
+				{
+					Labels:  []prompb.Label{{Name: "instance", Value: "1"}, {Name: "job", Value: "foo"}},
+					Samples: []prompb.Sample{{Timestamp: int64(start) * 1000, Value: 1}, {Timestamp: int64(start+60) * 1000, Value: 2}},
+				},
+				{
+					Labels:  []prompb.Label{{Name: "instance", Value: "2"}, {Name: "job", Value: "foo"}},
+					Samples: []prompb.Sample{{Timestamp: int64(start) * 1000, Value: 3}},
+				},
+			}}
+			data, err := qr.Marshal()
+			require.NoError(t, err)
+			if query == "corrupted" {
+				data = []byte("not a protobuf message")
+			}
+			mtx.Lock()
+			contentTypes[query] = "protobuf"
+			mtx.Unlock()
+			w.Header().Set("Content-Type", "application/vnd.google.protobuf; proto=prometheus.QueryResult")
+			w.WriteHeader(200)
+			_, _ = w.Write(data)
+			return
+		}
+
+		mtx.Lock()
+		contentTypes[query] = "json"
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1","job":"foo"}, "values":[[%3f,"1"],[%3f,"2"]]},
+			{"metric":{"instance":"2","job":"foo"}, "values":[[%3f,"3"]]}
+		]}}`, start, start+60, start)))
+	}))
+	defer srv.Close()
+
+	contentType := func(query string) string {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return contentTypes[query]
+	}
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	jsonProm := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	jsonProm.StartWorkers()
+	defer jsonProm.Close()
+
+	pbProm := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithProtobufResponses())
+	pbProm.StartWorkers()
+	defer pbProm.Close()
+
+	expected, err := jsonProm.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, expected.Samples, 2)
+	require.Equal(t, "json", contentType("up"))
+
+	qr, err := pbProm.RangeQuery(context.Background(), "pb", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "protobuf", contentType("pb"))
+	require.Equal(t, expected.Samples, qr.Samples)
+	require.Equal(t, "success", qr.Status)
+
+	qr, err = pbProm.RangeQuery(context.Background(), "json", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "json", contentType("json"), "server should be able to respond with JSON")
+	require.Equal(t, expected.Samples, qr.Samples)
+
+	_, err = pbProm.RangeQuery(context.Background(), "corrupted", params, promapi.RangeQueryOptions{})
+	require.ErrorContains(t, err, "bad_response: protobuf decode error: ")
+}
+
+func TestRangeMaxLabelValues(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		var series []string
+		for i := 0; i < 10; i++ {
+			series = append(series, fmt.Sprintf(`{"metric":{"job":"foo","instance":"%d","cluster":"%d"}, "values":[[%3f,"1"]]}`, i, i%2, start))
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, strings.Join(series, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 10)
+	require.Equal(t, 0, qr.DroppedSeries)
+	require.Nil(t, qr.DroppedLabelValues)
+
+	var fps []model.Fingerprint
+	for _, s := range qr.Samples {
+		fps = append(fps, s.Metric.Fingerprint())
+	}
+	sort.Slice(fps, func(i, j int) bool { return fps[i] < fps[j] })
+
+	qr, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxLabelValues: 3})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 3)
+	require.Equal(t, 10, qr.MatchedSeries)
+	require.Equal(t, 3, qr.RetainedSeries)
+	require.Equal(t, 7, qr.DroppedSeries)
+	require.Equal(t, map[string]int{"instance": 7}, qr.DroppedLabelValues)
+	for _, s := range qr.Samples {
+		require.Contains(t, fps[:3], s.Metric.Fingerprint(), "series with lowest fingerprints should be kept")
+	}
+
+	qr, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxLabelValues: 1})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Equal(t, 9, qr.DroppedSeries)
+	require.Equal(t, fps[0], qr.Samples[0].Metric.Fingerprint())
+	require.Equal(t, 9, qr.DroppedLabelValues["instance"])
+	require.Equal(t, 1, qr.DroppedLabelValues["cluster"])
+	require.NotContains(t, qr.DroppedLabelValues, "job")
+}
+
+func TestRangeTrimNaN(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[[1655164800,"NaN"],[1655164860,"NaN"],[1655164920,"1"],[1655164980,"NaN"],[1655165040,"2"],[1655165100,"NaN"]]},
+			{"metric":{"instance":"2"}, "values":[[1655164800,"NaN"],[1655164860,"NaN"]]},
+			{"metric":{"instance":"3"}, "values":[[1655164800,"1"],[1655164860,"2"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "trim", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 3)
+	require.Len(t, qr.Samples[0].Values, 6)
+	require.Len(t, qr.Samples[1].Values, 2)
+	require.Len(t, qr.Samples[2].Values, 2)
+
+	qr, err = prom.RangeQuery(context.Background(), "trim", params, promapi.RangeQueryOptions{TrimNaN: true})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 3)
+	require.Len(t, qr.Samples[0].Values, 3)
+	require.Equal(t, model.TimeFromUnix(1655164920), qr.Samples[0].Values[0].Timestamp)
+	require.Equal(t, model.SampleValue(1), qr.Samples[0].Values[0].Value)
+	require.True(t, math.IsNaN(float64(qr.Samples[0].Values[1].Value)), "interior NaN should be kept")
+	require.Equal(t, model.TimeFromUnix(1655165040), qr.Samples[0].Values[2].Timestamp)
+	require.Len(t, qr.Samples[1].Values, 0)
+	require.Equal(t, []model.SamplePair{
+		{Timestamp: model.TimeFromUnix(1655164800), Value: 1},
+		{Timestamp: model.TimeFromUnix(1655164860), Value: 2},
+	}, qr.Samples[2].Values)
+}
+
+func TestRangeSliceOrder(t *testing.T) {
+	var lock sync.Mutex
+	starts := map[string][]float64{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+
+		lock.Lock()
+		starts[r.Form.Get("query")] = append(starts[r.Form.Get("query")], start)
+		lock.Unlock()
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*8), time.Minute)
+
+	_, err := prom.RangeQuery(context.Background(), "chronological", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	_, err = prom.RangeQuery(context.Background(), "recent", params, promapi.RangeQueryOptions{Order: promapi.RecentFirst})
+	require.NoError(t, err)
+
+	require.Equal(t, []float64{1655164800, 1655172000, 1655179200, 1655186400}, starts["chronological"])
+	require.Equal(t, []float64{1655186400, 1655179200, 1655172000, 1655164800}, starts["recent"])
+}
+
+func TestRangeLongStep(t *testing.T) {
+	var lock sync.Mutex
+	var slices [][2]float64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+
+		lock.Lock()
+		slices = append(slices, [2]float64{start, end})
+		lock.Unlock()
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	// Steps longer than 4h used to round the slice size down to zero.
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*24), time.Hour*6)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err := prom.RangeQuery(ctx, "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, [][2]float64{
+		{1655164800, 1655186399},
+		{1655186400, 1655207999},
+		{1655208000, 1655229599},
+		{1655229600, 1655251200},
+	}, slices, "every slice should cover a single step")
+}
+
+func TestRangeDecimate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"}, "values":[
+				[1655164800,"0"],[1655164860,"1"],[1655164920,"2"],[1655164980,"3"],[1655165040,"4"],
+				[1655165100,"5"],[1655165160,"6"],[1655165220,"7"],[1655165280,"8"],[1655165340,"9"]
+			]},
+			{"metric":{"instance":"2"}, "values":[[1655164800,"0"],[1655164860,"1"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*9), time.Minute)
+
+	values := func(samples []model.SamplePair) (vals []float64) {
+		for _, s := range samples {
+			vals = append(vals, float64(s.Value))
+		}
+		return vals
+	}
+
+	type testCaseT struct {
+		decimate int
+		first    []float64
+		second   []float64
+	}
+
+	testCases := []testCaseT{
+		{decimate: 0, first: []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, second: []float64{0, 1}},
+		{decimate: 1, first: []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, second: []float64{0, 1}},
+		{decimate: 2, first: []float64{0, 2, 4, 6, 8, 9}, second: []float64{0, 1}},
+		{decimate: 3, first: []float64{0, 3, 6, 9}, second: []float64{0, 1}},
+		{decimate: 4, first: []float64{0, 4, 8, 9}, second: []float64{0, 1}},
+		{decimate: 100, first: []float64{0, 9}, second: []float64{0, 1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strconv.Itoa(tc.decimate), func(t *testing.T) {
+			qr, err := prom.RangeQuery(context.Background(), "decimate", params, promapi.RangeQueryOptions{Decimate: tc.decimate})
+			require.NoError(t, err)
+			require.Len(t, qr.Samples, 2)
+			require.Equal(t, tc.first, values(qr.Samples[0].Values))
+			require.Equal(t, tc.second, values(qr.Samples[1].Values))
+		})
+	}
+}
+
+func TestRangeStepAlignment(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+
+		var drift float64
+		if r.Form.Get("query") == "misaligned" {
+			drift = 7
+		}
+
+		var values []string
+		for i := start; i <= end; i += 60 {
+			values = append(values, fmt.Sprintf(`[%3f,"1"]`, i))
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(
+			`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"}, "values":[%s]},{"metric":{"instance":"2"}, "values":[[%3f,"1"],[%3f,"2"]]}]}}`,
+			strings.Join(values, ","), start+drift, start+60+drift)))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "aligned", params, promapi.RangeQueryOptions{StepTolerance: time.Second})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 2)
+	require.Empty(t, qr.Warnings)
+
+	qr, err = prom.RangeQuery(context.Background(), "misaligned", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Empty(t, qr.Warnings, "alignment shouldn't be checked by default")
+
+	qr, err = prom.RangeQuery(context.Background(), "misaligned", params, promapi.RangeQueryOptions{StepTolerance: time.Second * 10})
+	require.NoError(t, err)
+	require.Empty(t, qr.Warnings, "drift is within tolerance")
+
+	qr, err = prom.RangeQuery(context.Background(), "misaligned", params, promapi.RangeQueryOptions{StepTolerance: time.Second})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 2)
+	require.Len(t, qr.Warnings, 3, "one warning per slice for the misaligned series")
+	require.Equal(t, `sample for {instance="2"} at 2022-06-14T00:00:07Z is 7s away from the nearest step`, qr.Warnings[0])
+
+	_, err = prom.RangeQuery(context.Background(), "misaligned", params, promapi.RangeQueryOptions{StepTolerance: time.Second, StrictStepAlignment: true})
+	require.ErrorIs(t, err, promapi.ErrStepMisaligned)
+	require.EqualError(t, err, `sample timestamp is not aligned to query step: sample for {instance="2"} at 2022-06-14T00:00:07Z is 7s away from the nearest step`)
+}
+
+func TestRangeMaxValuesPerSeries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+
+		var values []string
+		for i := start; i <= end; i += 60 {
+			values = append(values, fmt.Sprintf(`[%3f,"1"]`, i))
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(
+			`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"1"}, "values":[[%3f,"1"]]},
+				{"metric":{"instance":"2"}, "values":[%s]},
+				{"metric":{"instance":"3"}, "values":[[%3f,"1"]]}
+			]}}`,
+			start, strings.Join(values, ","), start)))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxValuesPerSeries: 301})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 3)
+	require.Len(t, qr.Samples[1].Values, 301)
+
+	_, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxValuesPerSeries: 200})
+	require.ErrorIs(t, err, promapi.ErrSeriesTooLarge)
+	require.EqualError(t, err, `series has too many values: {instance="2"} has at least 240 values, limit is 200`)
+}
+
+func TestRangeSplitTooManySamples(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+
+		maxSteps := 30.0
+		if r.Form.Get("query") == "never" {
+			maxSteps = -1
+		}
+		if (end-start)/60 > maxSteps {
+			w.WriteHeader(422)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"execution","error":"query processing would load too many samples into memory in query execution"}`))
+			return
+		}
+
+		var values []string
+		for i := start; i <= end; i += 60 {
+			values = append(values, fmt.Sprintf(`[%3f,"1"]`, i))
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"}, "values":[%s]}]}}`, strings.Join(values, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 2, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*2), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Len(t, qr.Samples[0].Values, 121)
+	for i, v := range qr.Samples[0].Values {
+		require.Equal(t, model.TimeFromUnix(start.Add(time.Minute*time.Duration(i)).Unix()), v.Timestamp)
+	}
+	require.Equal(t, []string{
+		"query for 2022-06-14T00:00:00Z - 2022-06-14T02:00:00Z would load too many samples, it was split into smaller queries",
+	}, qr.Warnings)
+
+	_, err = prom.RangeQuery(context.Background(), "never", promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute), promapi.RangeQueryOptions{})
+	require.EqualError(t, err, "execution: query processing would load too many samples into memory in query execution")
+}
+
+func TestRangeSplitTooManySamplesDepth(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(422)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"error","errorType":"execution","error":"query processing would load too many samples into memory in query execution"}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 4, 100, 1000)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Second)
+	_, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxSlices: 1})
+	require.EqualError(t, err, "execution: query processing would load too many samples into memory in query execution")
+	require.Less(t, requests.Load(), int64(1100), "slices shouldn't be split down to a single step")
+}
+
+func TestRangeStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"}, "values":[[1655164800,"1"]]}]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	qr, err := prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(start, start.Add(time.Hour*3), time.Minute), promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Requests, 2)
+	require.Equal(t, "success", qr.Status)
+
+	// Cached slices should keep the status.
+	qr, err = prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(start, start.Add(time.Hour*3), time.Minute), promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "success", qr.Status)
+}
+
+func TestRangeEngine(t *testing.T) {
+	var mtx sync.Mutex
+	engines := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := r.Form["engine"]
+		require.Equal(t, r.Form.Get("engine") != "", ok, "empty engine param shouldn't be sent")
+		mtx.Lock()
+		engines[r.Form.Get("engine")]++
+		mtx.Unlock()
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	for _, engine := range []string{"", "thanos", "prometheus", "thanos", ""} {
+		_, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{Engine: engine})
+		require.NoError(t, err)
+	}
+	require.Equal(t, map[string]int{"": 1, "thanos": 1, "prometheus": 1}, engines, "each engine should have a separate cache entry")
+}
+
+func TestRangeTee(t *testing.T) {
+	var mtx sync.Mutex
+	bodies := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"}, "values":[[%s,"1"]]}]}}`+"\n\n", r.Form.Get("start"))
+		mtx.Lock()
+		bodies[r.Form.Get("start")] = body
+		mtx.Unlock()
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 4, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*7), time.Minute)
+
+	tees := map[string]*strings.Builder{}
+	tee := func(start, _ time.Time) io.Writer {
+		mtx.Lock()
+		defer mtx.Unlock()
+		buf := &strings.Builder{}
+		tees[strconv.FormatInt(start.Unix(), 10)] = buf
+		return buf
+	}
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{Tee: tee})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Len(t, qr.Samples[0].Values, 4)
+
+	require.Len(t, bodies, 4)
+	require.Len(t, tees, 4)
+	for start, body := range bodies {
+		require.Equal(t, body, tees[start].String(), "tee should receive full response body")
+	}
+
+	// Cached slices are not written.
+	tees = map[string]*strings.Builder{}
+	_, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{Tee: tee})
+	require.NoError(t, err)
+	require.Empty(t, tees)
+}
+
+func TestRangeTeeStreams(t *testing.T) {
+	received := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[`))
+		w.(http.Flusher).Flush()
+		// Rest of the body is only sent once the tee got the first part,
+		// which wouldn't happen if the body was buffered.
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Error("tee didn't receive the first part of the body")
+		}
+		_, _ = w.Write([]byte(`{"metric":{"instance":"1"}, "values":[[1655164800,"1"]]}]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*10, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+
+	var once sync.Once
+	pw := writerFunc(func(p []byte) (int, error) {
+		once.Do(func() { close(received) })
+		return len(p), nil
+	})
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{
+		Tee: func(_, _ time.Time) io.Writer { return pw },
+	})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+
+	var writes int
+	fw := writerFunc(func(p []byte) (int, error) {
+		writes++
+		return 0, errors.New("write failed")
+	})
+	qr, err = prom.RangeQuery(context.Background(), "down", params, promapi.RangeQueryOptions{
+		Tee: func(_, _ time.Time) io.Writer { return fw },
+	})
+	require.NoError(t, err, "tee errors shouldn't fail the query")
+	require.Len(t, qr.Samples, 1)
+	require.Equal(t, 1, writes, "nothing should be written after the first error")
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestRangeSpill(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+
+		var values []string
+		for i := end; i >= start; i -= 60 {
+			values = append(values, fmt.Sprintf(`[%3f,"%3f"]`, i, i/60))
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(
+			`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"instance":"1"}, "values":[%s]},
+				{"metric":{"instance":"2"}, "values":[[%3f,"-1"],%s]}
+			]}}`,
+			strings.Join(values, ","), start, strings.Join(values, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*5), time.Minute)
+
+	expected, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, expected.Samples, 2)
+	require.Len(t, expected.Samples[0].Values, 301)
+
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	spilled, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{SpillThreshold: 10})
+	require.NoError(t, err)
+	require.Equal(t, expected.Samples, spilled.Samples)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files, "spill file should be removed")
+}
+
+func TestRangeQueryStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+
+		series := make([]string, 0, 20)
+		for i := 0; i < 20; i++ {
+			var values []string
+			for ts := end; ts >= start; ts -= 60 {
+				values = append(values, fmt.Sprintf(`[%3f,"%d"]`, ts, i))
+			}
+			series = append(series, fmt.Sprintf(`{"metric":{"instance":"%d"}, "values":[%s]}`, i, strings.Join(values, ",")))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, strings.Join(series, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 2, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*5), time.Minute)
+
+	buffered, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, buffered.Samples, 20)
+	expected := make([]*model.SampleStream, len(buffered.Samples))
+	copy(expected, buffered.Samples)
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].Metric.Fingerprint() < expected[j].Metric.Fingerprint()
+	})
+
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	for _, threshold := range []int{0, 10, 1000} {
+		t.Run(strconv.Itoa(threshold), func(t *testing.T) {
+			streamed := []*model.SampleStream{}
+			qr, err := prom.RangeQueryStream(context.Background(), "up", params, promapi.RangeQueryOptions{SpillThreshold: threshold}, func(s *model.SampleStream) error {
+				streamed = append(streamed, &model.SampleStream{Metric: s.Metric, Values: append([]model.SamplePair(nil), s.Values...)})
+				return nil
+			})
+			require.NoError(t, err)
+			require.Empty(t, qr.Samples, "series shouldn't be kept in the result")
+			require.Equal(t, expected, streamed)
+			require.Equal(t, buffered.MatchedSeries, qr.MatchedSeries)
+			require.Equal(t, buffered.RetainedSeries, qr.RetainedSeries)
+			require.Len(t, qr.Coverage, 20)
+			for i, s := range streamed {
+				require.Equal(t, len(s.Values), qr.Coverage[i].Points)
+			}
+
+			files, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, files, "spill file should be removed")
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		var calls int
+		_, err := prom.RangeQueryStream(context.Background(), "up", params, promapi.RangeQueryOptions{SpillThreshold: 10}, func(s *model.SampleStream) error {
+			calls++
+			return errors.New("export failed")
+		})
+		require.EqualError(t, err, "export failed")
+		require.Equal(t, 1, calls)
+
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, files, "spill file should be removed")
+	})
+}
+
+func TestRangeQueryStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Form.Get("query") {
+		case "prometheus":
+			require.Equal(t, "all", r.Form.Get("stats"))
+			require.Equal(t, "", r.Form.Get("analyze"))
+			_, _ = w.Write([]byte(`{"status":"success","data":{
+				"resultType":"matrix",
+				"result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"]]}],
+				"stats":{
+					"timings":{
+						"evalTotalTime":0.0029,
+						"resultSortTime":0,
+						"queryPreparationTime":0.0012,
+						"innerEvalTime":0.0016,
+						"execQueueTime":0.00001,
+						"execTotalTime":0.003
+					},
+					"samples":{
+						"totalQueryableSamplesPerStep":[[1655164800,15]],
+						"totalQueryableSamples":15,
+						"peakSamples":12
+					}
+				}
+			}}`))
+		case "thanos":
+			require.Equal(t, "", r.Form.Get("stats"))
+			require.Equal(t, "true", r.Form.Get("analyze"))
+			_, _ = w.Write([]byte(`{"status":"success","data":{
+				"resultType":"matrix",
+				"result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"]]}],
+				"analysis":{
+					"name":"[*concurrencyOperator(buff=2)]: 1",
+					"executionTime":"77.916µs",
+					"children":[
+						{"name":"[*matrixSelector] rate({[__name__=\"up\"]}[5m0s] 0 mod 2)","executionTime":"60.166µs","children":null}
+					]
+				}
+			}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"]]}]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "none", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Nil(t, qr.Stats)
+
+	qr, err = prom.RangeQuery(context.Background(), "none", params, promapi.RangeQueryOptions{Stats: true})
+	require.NoError(t, err)
+	require.Equal(t, []*promapi.QueryStats{nil}, qr.Stats, "server didn't return any stats")
+
+	qr, err = prom.RangeQuery(context.Background(), "prometheus", params, promapi.RangeQueryOptions{Stats: true})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Equal(t, []*promapi.QueryStats{
+		{
+			Timings: promapi.QueryTimings{
+				EvalTotalTime:        0.0029,
+				QueryPreparationTime: 0.0012,
+				InnerEvalTime:        0.0016,
+				ExecQueueTime:        0.00001,
+				ExecTotalTime:        0.003,
+			},
+			Samples: promapi.QuerySamples{
+				TotalQueryableSamples: 15,
+				PeakSamples:           12,
+			},
+		},
+	}, qr.Stats)
+
+	qr, err = prom.RangeQuery(context.Background(), "thanos", params, promapi.RangeQueryOptions{Analyze: true})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Equal(t, []*promapi.QueryStats{
+		{
+			Analysis: &promapi.QueryAnalysis{
+				Name:          "[*concurrencyOperator(buff=2)]: 1",
+				ExecutionTime: "77.916µs",
+				Children: []promapi.QueryAnalysis{
+					{Name: `[*matrixSelector] rate({[__name__="up"]}[5m0s] 0 mod 2)`, ExecutionTime: "60.166µs"},
+				},
+			},
+		},
+	}, qr.Stats)
+}
+
+func TestRangeStickyHeader(t *testing.T) {
+	var lock sync.Mutex
+	sticky := map[string][]string{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lock.Lock()
+		sticky[r.Form.Get("query")] = append(sticky[r.Form.Get("query")], r.Header.Get("X-Sticky"))
+		lock.Unlock()
+
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*8), time.Minute)
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 4, 100, 100, promapi.WithStickyHeader("X-Sticky"))
+	prom.StartWorkers()
+	defer prom.Close()
+
+	_, err := prom.RangeQuery(context.Background(), "first", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	_, err = prom.RangeQuery(context.Background(), "second", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+
+	require.Len(t, sticky["first"], 4)
+	require.Len(t, sticky["second"], 4)
+	for _, query := range []string{"first", "second"} {
+		require.NotEmpty(t, sticky[query][0])
+		for _, v := range sticky[query] {
+			require.Equal(t, sticky[query][0], v, "all slices should share the same sticky value")
+		}
+	}
+	require.NotEqual(t, sticky["first"][0], sticky["second"][0], "each range query should use a new sticky value")
+
+	noSticky := promapi.NewPrometheus("test", srv.URL, time.Second, 4, 100, 100)
+	noSticky.StartWorkers()
+	defer noSticky.Close()
+
+	_, err = noSticky.RangeQuery(context.Background(), "none", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"", "", "", ""}, sticky["none"])
+}
+
+func TestRangeInstantFallback(t *testing.T) {
+	var lock sync.Mutex
+	var instantTimes []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		case "/api/v1/query":
+			lock.Lock()
+			instantTimes = append(instantTimes, r.Form.Get("time"))
+			lock.Unlock()
+			switch r.Form.Get("query") {
+			case "empty":
+				w.WriteHeader(200)
+				_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			case "error":
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"instant query failed"}`))
+			default:
+				w.WriteHeader(200)
+				_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+					{"metric":{"instance":"1"},"value":[1655165100,"5"]},
+					{"metric":{"instance":"2"},"value":[1655165100,"7"]}
+				]}}`))
+			}
+		}
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Empty(t, qr.Samples)
+	require.Empty(t, instantTimes, "fallback should be disabled by default")
+
+	qr, err = prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{InstantFallback: true})
+	require.NoError(t, err)
+	require.Equal(t, []*model.SampleStream{
+		{
+			Metric: model.Metric{"instance": "1"},
+			Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(1655165100), Value: 5}},
+		},
+		{
+			Metric: model.Metric{"instance": "2"},
+			Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(1655165100), Value: 7}},
+		},
+	}, qr.Samples)
+	require.Equal(t, []string{"range query returned no data, results are from an instant query"}, qr.Warnings)
+	require.Len(t, qr.Requests, 2)
+	require.Equal(t, srv.URL+"/api/v1/query", qr.Requests[1].URI)
+	require.Equal(t, []string{"1655165100"}, instantTimes, "instant query should be evaluated at the end of the range")
+
+	qr, err = prom.RangeQuery(context.Background(), "empty", params, promapi.RangeQueryOptions{InstantFallback: true})
+	require.NoError(t, err)
+	require.Empty(t, qr.Samples)
+	require.Empty(t, qr.Warnings)
+
+	_, err = prom.RangeQuery(context.Background(), "error", params, promapi.RangeQueryOptions{InstantFallback: true})
+	require.EqualError(t, err, "bad_data: instant query failed")
+}
+
+func TestRelativeRangeIngestionDelay(t *testing.T) {
+	rr := promapi.NewRelativeRange(time.Hour, time.Minute)
+	delayed := rr.WithIngestionDelay(time.Second * 30)
+
+	before := time.Now()
+	end := delayed.End()
+	start := delayed.Start()
+	after := time.Now()
+
+	require.False(t, end.Before(before.Add(time.Second*-30)))
+	require.False(t, end.After(after.Add(time.Second*-30)))
+	require.False(t, start.Before(before.Add(-time.Hour-time.Second*30)))
+	require.False(t, start.After(after.Add(-time.Hour-time.Second*30)))
+	require.Equal(t, time.Hour, delayed.Dur())
+	require.Equal(t, time.Minute, delayed.Step())
+	require.Equal(t, "1h/1m/-30s", delayed.String())
+
+	require.Equal(t, "1h/1m", rr.String(), "original range shouldn't be modified")
+	require.False(t, rr.End().Before(after))
+}
+
+func TestEvalAlignedRange(t *testing.T) {
+	type testCaseT struct {
+		lookback time.Duration
+		interval time.Duration
+		offset   time.Duration
+		dur      time.Duration
+		str      string
+	}
+
+	testCases := []testCaseT{
+		{lookback: time.Hour, interval: time.Minute, dur: time.Hour, str: "1h/1m"},
+		{lookback: time.Hour, interval: time.Minute, offset: time.Second * 15, dur: time.Hour, str: "1h/1m+15s"},
+		{lookback: time.Hour, interval: time.Minute * 7, offset: time.Second * 90, dur: time.Minute * 63, str: "1h3m/7m+1m30s"},
+		{lookback: time.Hour, interval: time.Minute, offset: time.Second * 75, dur: time.Hour, str: "1h/1m+15s"},
+		{lookback: time.Hour, interval: time.Minute, offset: time.Second * -15, dur: time.Hour, str: "1h/1m+45s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.str, func(t *testing.T) {
+			er, err := promapi.NewEvalAlignedRange(tc.lookback, tc.interval, tc.offset)
+			require.NoError(t, err)
+
+			before := time.Now()
+			end := er.End()
+			start := er.Start()
+			after := time.Now()
+
+			require.Equal(t, tc.dur, er.Dur())
+			require.Equal(t, tc.interval, er.Step())
+			require.Equal(t, tc.str, er.String())
+
+			offset := ((tc.offset % tc.interval) + tc.interval) % tc.interval
+			require.Zero(t, (end.UnixNano()-int64(offset))%int64(tc.interval), "end must be aligned to rule evaluation")
+			require.Zero(t, (start.UnixNano()-int64(offset))%int64(tc.interval), "start must be aligned to rule evaluation")
+			require.Equal(t, tc.dur, end.Sub(start))
+			require.False(t, end.After(after), "end can't be in the future")
+			require.True(t, end.After(before.Add(-tc.interval)), "end must be the most recent evaluation")
+		})
+	}
+}
+
+func TestEvalAlignedRangeInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		_, err := promapi.NewEvalAlignedRange(time.Hour, interval, time.Second*15)
+		require.EqualError(t, err, fmt.Sprintf("invalid evaluation interval %s, it must be greater than zero", interval))
+	}
+}
+
+func TestRangeTimeout(t *testing.T) {
+	var mtx sync.Mutex
+	timeouts := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		timeouts[r.Form.Get("timeout")]++
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Minute, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	rr := promapi.NewAbsoluteRange(start, start.Add(time.Hour*4), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{Alignment: promapi.StartAligned})
+	require.NoError(t, err)
+	require.Len(t, qr.Requests, 2)
+
+	qr, err = prom.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{Alignment: promapi.StartAligned, Timeout: time.Second * 15})
+	require.NoError(t, err)
+	require.Len(t, qr.Requests, 8, "slices should be 4x smaller with 4x shorter timeout")
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, map[string]int{"1m0s": 2, "15s": 8}, timeouts)
+}
+
+func TestNewAbsoluteRanges(t *testing.T) {
+	day := time.Date(2022, 6, 14, 0, 0, 0, 0, time.UTC)
+	days := func(from, to int) promapi.TimeRange {
+		return promapi.TimeRange{Start: day.Add(time.Hour * 24 * time.Duration(from)), End: day.Add(time.Hour * 24 * time.Duration(to))}
+	}
+
+	type testCaseT struct {
+		name   string
+		ranges []promapi.TimeRange
+		step   time.Duration
+		str    string
+		err    string
+	}
+
+	testCases := []testCaseT{
+		{
+			name:   "single",
+			ranges: []promapi.TimeRange{days(0, 1)},
+			step:   time.Minute,
+			str:    "2022-06-14T00:00:00Z-2022-06-15T00:00:00Z/1m",
+		},
+		{
+			name:   "adjacent days",
+			ranges: []promapi.TimeRange{days(0, 1), days(1, 2), days(2, 3)},
+			step:   time.Minute,
+			str:    "2022-06-14T00:00:00Z-2022-06-17T00:00:00Z/1m",
+		},
+		{
+			name:   "unsorted and overlapping",
+			ranges: []promapi.TimeRange{days(2, 3), days(0, 2), days(1, 2)},
+			step:   time.Minute,
+			str:    "2022-06-14T00:00:00Z-2022-06-17T00:00:00Z/1m",
+		},
+		{
+			name: "inclusive ends",
+			ranges: []promapi.TimeRange{
+				{Start: day, End: day.Add(time.Hour*24 - time.Minute)},
+				{Start: day.Add(time.Hour * 24), End: day.Add(time.Hour*48 - time.Minute)},
+			},
+			step: time.Minute,
+			str:  "2022-06-14T00:00:00Z-2022-06-15T23:59:00Z/1m",
+		},
+		{
+			name:   "gap",
+			ranges: []promapi.TimeRange{days(0, 1), days(2, 3)},
+			step:   time.Minute,
+			err:    "time ranges are not contiguous, nothing between 2022-06-15T00:00:00Z and 2022-06-16T00:00:00Z",
+		},
+		{
+			name:   "reversed",
+			ranges: []promapi.TimeRange{days(1, 0)},
+			step:   time.Minute,
+			err:    "time range 2022-06-15T00:00:00Z-2022-06-14T00:00:00Z ends before it starts",
+		},
+		{
+			name: "empty",
+			step: time.Minute,
+			err:  "at least one time range is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ar, err := promapi.NewAbsoluteRanges(tc.ranges, tc.step)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.str, ar.String())
+			require.Equal(t, tc.step, ar.Step())
+		})
+	}
+}
+
+func TestRangeAbsoluteRanges(t *testing.T) {
+	var mtx sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+
+		values := []string{}
+		for ts := start; ts <= end; ts += step {
+			values = append(values, fmt.Sprintf(`[%.0f,"1"]`, ts))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[%s]}]}}`, strings.Join(values, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 4, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	day := time.Date(2022, 6, 14, 0, 0, 0, 0, time.UTC)
+	ranges := []promapi.TimeRange{}
+	for i := 0; i < 3; i++ {
+		ranges = append(ranges, promapi.TimeRange{Start: day.Add(time.Hour * 24 * time.Duration(i)), End: day.Add(time.Hour * 24 * time.Duration(i+1))})
+	}
+	ar, err := promapi.NewAbsoluteRanges(ranges, time.Hour)
+	require.NoError(t, err)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", ar, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Len(t, qr.Samples[0].Values, 3*24+1, "boundaries between days shouldn't be duplicated")
+	require.Equal(t, model.TimeFromUnix(day.Unix()), qr.Samples[0].Values[0].Timestamp)
+	require.Equal(t, model.TimeFromUnix(day.Add(time.Hour*72).Unix()), qr.Samples[0].Values[3*24].Timestamp)
+	for i := 1; i < len(qr.Samples[0].Values); i++ {
+		require.Equal(t, model.Time(time.Hour.Milliseconds()), qr.Samples[0].Values[i].Timestamp-qr.Samples[0].Values[i-1].Timestamp)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, len(qr.Requests), requests, "all days should be scheduled as slices of a single query")
+	require.Equal(t, 36, requests)
+}
+
+func TestRangeVerifyCompleteness(t *testing.T) {
+	start := time.Unix(1655164800, 0).UTC()
+	dropped := start.Add(time.Hour * 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		from, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		to, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+
+		values := []string{}
+		// Deliberately drop all values from the slice with the second hour.
+		if !(from <= float64(dropped.Unix()) && float64(dropped.Unix()) <= to) {
+			for ts := from; ts <= to; ts += step {
+				values = append(values, fmt.Sprintf(`[%.0f,"1"]`, ts))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"},"values":[%s]}]}}`, strings.Join(values, ","))))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	rr := promapi.NewAbsoluteRange(start, start.Add(time.Hour*6), time.Minute)
+
+	qr, err := prom.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{Alignment: promapi.StartAligned})
+	require.NoError(t, err)
+	require.Empty(t, qr.Warnings, "completeness isn't verified by default")
+
+	qr, err = prom.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{Alignment: promapi.StartAligned, VerifyCompleteness: true})
+	require.NoError(t, err)
+	require.Len(t, qr.Samples, 1)
+	require.Len(t, qr.Requests, 3)
+	require.Len(t, qr.Samples[0].Values, 6*60+1-120)
+	require.Equal(t, []string{
+		`{instance="1"} has no values between 2022-06-14T02:00:00Z and 2022-06-14T03:59:00Z (120 steps)`,
+	}, qr.Warnings)
+
+	complete := promapi.NewAbsoluteRange(start.Add(time.Hour*4), start.Add(time.Hour*6), time.Minute)
+	qr, err = prom.RangeQuery(context.Background(), "up", complete, promapi.RangeQueryOptions{Alignment: promapi.StartAligned, VerifyCompleteness: true})
+	require.NoError(t, err)
+	require.Empty(t, qr.Warnings)
+}
+
+func TestRangeStepPrecision(t *testing.T) {
+	var mtx sync.Mutex
+	steps := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		steps = append(steps, r.Form.Get("step"))
+		mtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+
+	type testCaseT struct {
+		step     time.Duration
+		expected string
+	}
+
+	for _, tc := range []testCaseT{
+		{step: time.Minute, expected: "60"},
+		{step: time.Second, expected: "1"},
+		{step: time.Millisecond * 1500, expected: "1.5"},
+		{step: time.Second * 4 / 3, expected: "1.333"},
+		{step: time.Millisecond*1333 + time.Microsecond*600, expected: "1.334"},
+		{step: time.Microsecond * 10, expected: "0.001"},
+	} {
+		t.Run(tc.step.String(), func(t *testing.T) {
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			mtx.Lock()
+			steps = steps[:0]
+			mtx.Unlock()
+
+			_, err := prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(start, start.Add(time.Second*10), tc.step), promapi.RangeQueryOptions{})
+			require.NoError(t, err)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			require.NotEmpty(t, steps)
+			for _, step := range steps {
+				require.Equal(t, tc.expected, step)
+			}
+		})
+	}
+
+	t.Run("cache", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		mtx.Lock()
+		steps = steps[:0]
+		mtx.Unlock()
+
+		for _, step := range []time.Duration{time.Second * 4 / 3, time.Millisecond*1333 + time.Microsecond*100} {
+			_, err := prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(start, start.Add(time.Second*10), step), promapi.RangeQueryOptions{})
+			require.NoError(t, err)
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		require.Equal(t, []string{"1.333"}, steps, "steps rounded to the same value should share cache")
+	})
+}
+
+func TestRangeStopWhen(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+
+	var mtx sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+
+		// Every slice returns a different series with the number of hours
+		// since the start of the range as the value.
+		ts, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		hours := (int64(ts) - start.Unix()) / 3600
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"%d"},"values":[[%d,"%d"]]}
+		]}}`, hours, int64(ts)+60, hours)))
+	}))
+	defer srv.Close()
+
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*12), time.Minute)
+
+	type testCaseT struct {
+		name     string
+		stopWhen func(*promapi.RangeQueryResult) bool
+		series   int
+		stopped  bool
+	}
+
+	testCases := []testCaseT{
+		{
+			name:   "never",
+			series: 6,
+		},
+		{
+			name: "series",
+			stopWhen: func(partial *promapi.RangeQueryResult) bool {
+				return len(partial.Samples) >= 3
+			},
+			series:  3,
+			stopped: true,
+		},
+		{
+			name: "threshold",
+			stopWhen: func(partial *promapi.RangeQueryResult) bool {
+				for _, s := range partial.Samples {
+					for _, v := range s.Values {
+						if v.Value > 5 {
+							return true
+						}
+					}
+				}
+				return false
+			},
+			series:  4,
+			stopped: true,
+		},
+		{
+			name: "false",
+			stopWhen: func(partial *promapi.RangeQueryResult) bool {
+				return false
+			},
+			series: 6,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			mtx.Lock()
+			requests = 0
+			mtx.Unlock()
+
+			qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{StopWhen: tc.stopWhen})
+			require.NoError(t, err)
+			require.Len(t, qr.Samples, tc.series)
+			require.Len(t, qr.Coverage, tc.series)
+			for i, s := range qr.Samples {
+				require.Equal(t, model.LabelValue(strconv.Itoa(i*2)), s.Metric["instance"], "slices should be merged in order")
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if tc.stopped {
+				require.Less(t, requests, 6, "remaining slices should be cancelled")
+			} else {
+				require.Equal(t, 6, requests)
+			}
+		})
+	}
+}
+
+func TestRangeMaxTotalBytes(t *testing.T) {
+	var mtx sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		values := make([]string, 0, 50)
+		for i := 0; i < 50; i++ {
+			values = append(values, fmt.Sprintf(`[%d,"1"]`, int64(start)+int64(i)*60))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"},"values":[%s]}
+		]}}`, strings.Join(values, ","))))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*12), time.Minute)
+
+	query := func(limit int64) (*promapi.RangeQueryResult, int, error) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		mtx.Lock()
+		requests = 0
+		mtx.Unlock()
+
+		qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxTotalBytes: limit})
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		return qr, requests, err
+	}
+
+	// Find out how many bytes the whole query reads.
+	qr, requests, err := query(0)
+	require.NoError(t, err)
+	require.Len(t, qr.Transfers, 6)
+	require.Equal(t, 6, requests)
+	var total, slice int64
+	for _, tr := range qr.Transfers {
+		total += tr.BytesRead
+		if tr.BytesRead > slice {
+			slice = tr.BytesRead
+		}
+	}
+
+	t.Run("under", func(t *testing.T) {
+		qr, requests, err := query(total)
+		require.NoError(t, err)
+		require.Len(t, qr.Samples, 1)
+		require.Equal(t, 6, requests)
+	})
+
+	t.Run("over", func(t *testing.T) {
+		// Every slice is under the limit, but all of them together are not.
+		_, requests, err := query(slice * 2)
+		require.Error(t, err)
+		require.ErrorIs(t, err, promapi.ErrResultTooLarge)
+		require.EqualError(t, err, fmt.Sprintf("query result is too large, query read more than %d bytes", slice*2))
+		require.False(t, promapi.IsUnavailableError(err))
+		require.Less(t, requests, 6, "remaining slices should be cancelled")
+	})
+}
+
+func TestRangeMaxStepIncreasesBudget(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// Only the second slice fails with the initial step, so the first
+		// one is read before the query is retried.
+		if r.Form.Get("step") == "15" && r.Form.Get("start") != strconv.FormatInt(start.Unix(), 10) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)"}`))
+			return
+		}
+		// Every successful response has the same size.
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"},"values":[[1655164800,"1"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*3), time.Second*15)
+
+	query := func(limit int64) (*promapi.RangeQueryResult, error) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+		return prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxStepIncreases: 1, MaxTotalBytes: limit})
+	}
+
+	qr, err := query(0)
+	require.NoError(t, err)
+	require.Len(t, qr.Transfers, 2)
+	var total int64
+	for _, tr := range qr.Transfers {
+		total += tr.BytesRead
+	}
+
+	// The retry alone reads exactly the limit, the first slice read by
+	// the first attempt puts it over.
+	_, err = query(total)
+	require.ErrorIs(t, err, promapi.ErrResultTooLarge)
+}
+
+func TestRangeMaxStepIncreases(t *testing.T) {
+	var mtx sync.Mutex
+	steps := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		mtx.Lock()
+		steps = append(steps, r.Form.Get("step"))
+		mtx.Unlock()
+
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+		w.Header().Set("Content-Type", "application/json")
+		// Reject any query that would return more than 100 points.
+		if (end-start)/step > 100 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)"}`))
+			return
+		}
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"instance":"1"},"values":[[%d,"1"]]}
+		]}}`, int64(start))))
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	// Slices are 2h long, so a 15s step gives 480 points per slice.
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour*2), time.Second*15)
+
+	type testCaseT struct {
+		increases int
+		steps     []string
+		warnings  []string
+		err       string
+	}
+
+	testCases := []testCaseT{
+		{
+			steps: []string{"15"},
+			err:   "bad_data: exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)",
+		},
+		{
+			increases: 2,
+			steps:     []string{"15", "30", "60"},
+			err:       "bad_data: exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)",
+		},
+		{
+			increases: 3,
+			steps:     []string{"15", "30", "60", "120"},
+			warnings: []string{
+				"query would return too many points per series with 15s step, it was retried with 30s step",
+				"query would return too many points per series with 30s step, it was retried with 1m step",
+				"query would return too many points per series with 1m step, it was retried with 2m step",
+			},
+		},
+		{
+			increases: 10,
+			steps:     []string{"15", "30", "60", "120"},
+			warnings: []string{
+				"query would return too many points per series with 15s step, it was retried with 30s step",
+				"query would return too many points per series with 30s step, it was retried with 1m step",
+				"query would return too many points per series with 1m step, it was retried with 2m step",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strconv.Itoa(tc.increases), func(t *testing.T) {
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			mtx.Lock()
+			steps = steps[:0]
+			mtx.Unlock()
+
+			qr, err := prom.RangeQuery(context.Background(), "up", params, promapi.RangeQueryOptions{MaxStepIncreases: tc.increases})
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			require.Equal(t, tc.steps, steps)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.warnings, qr.Warnings)
+			require.Len(t, qr.Samples, 1)
+		})
+	}
+}
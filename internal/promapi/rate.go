@@ -0,0 +1,123 @@
+package promapi
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+)
+
+// RateOverRange calculates rate() of every counter series in the result,
+// the same way Prometheus does it, so it can be compared with the value
+// computed by the server. Rate is evaluated at every timestamp a series has
+// a value for, using all values within window before it, including values
+// at the start of the window. Counter resets are accounted for and the
+// result is extrapolated to the edges of the window following Prometheus
+// rules. Steps with less than two values in the window, or with all values
+// at the same timestamp, are skipped and so are series with no steps left. Metric names are removed from returned
+// series, just like Prometheus does.
+// Values of each series must be sorted by timestamp, staleness markers
+// are ignored.
+func RateOverRange(result *RangeQueryResult, window time.Duration) []*model.SampleStream {
+	return deltaOverRange(result, window, true)
+}
+
+// IncreaseOverRange calculates increase() of every counter series in the
+// result, it works the same way as RateOverRange.
+func IncreaseOverRange(result *RangeQueryResult, window time.Duration) []*model.SampleStream {
+	return deltaOverRange(result, window, false)
+}
+
+func deltaOverRange(result *RangeQueryResult, window time.Duration, isRate bool) []*model.SampleStream {
+	var out []*model.SampleStream
+	for _, s := range result.Samples {
+		values := make([]model.SamplePair, 0, len(s.Values))
+		for _, v := range s.Values {
+			if !value.IsStaleNaN(float64(v.Value)) {
+				values = append(values, v)
+			}
+		}
+
+		var points []model.SamplePair
+		var first int
+		for last, v := range values {
+			for values[first].Timestamp.Before(v.Timestamp.Add(-window)) {
+				first++
+			}
+			if last == first {
+				continue
+			}
+			delta, ok := extrapolatedDelta(values[first:last+1], v.Timestamp.Add(-window), v.Timestamp, window, isRate)
+			if !ok {
+				continue
+			}
+			points = append(points, model.SamplePair{Timestamp: v.Timestamp, Value: delta})
+		}
+		if len(points) == 0 {
+			continue
+		}
+
+		metric := s.Metric.Clone()
+		delete(metric, model.MetricNameLabel)
+		out = append(out, &model.SampleStream{Metric: metric, Values: points})
+	}
+	return out
+}
+
+// extrapolatedDelta is a port of extrapolatedRate from Prometheus for
+// counters. values must have at least two elements. It returns false if
+// all values have the same timestamp, Prometheus returns no value then.
+func extrapolatedDelta(values []model.SamplePair, rangeStart, rangeEnd model.Time, window time.Duration, isRate bool) (model.SampleValue, bool) {
+	first := values[0]
+	last := values[len(values)-1]
+	if first.Timestamp == last.Timestamp {
+		return 0, false
+	}
+
+	delta := last.Value - first.Value
+	prev := first.Value
+	for _, v := range values[1:] {
+		if v.Value < prev {
+			// Counter was reset, add the value from before the reset.
+			delta += prev
+		}
+		prev = v.Value
+	}
+
+	durationToStart := first.Timestamp.Sub(rangeStart).Seconds()
+	durationToEnd := rangeEnd.Sub(last.Timestamp).Seconds()
+	sampledInterval := last.Timestamp.Sub(first.Timestamp).Seconds()
+	averageDurationBetweenSamples := sampledInterval / float64(len(values)-1)
+
+	// Counters can't go below zero, so don't extrapolate past the point
+	// where the counter would have been zero.
+	if delta > 0 && first.Value >= 0 {
+		durationToZero := sampledInterval * float64(first.Value/delta)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	// If the first or last value is close enough to the edge of the window
+	// then extrapolate all the way to it, otherwise only extrapolate by half
+	// of the average interval between values, since the series likely
+	// started or ended within the window.
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	extrapolateToInterval := sampledInterval
+	if durationToStart < extrapolationThreshold {
+		extrapolateToInterval += durationToStart
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	if durationToEnd < extrapolationThreshold {
+		extrapolateToInterval += durationToEnd
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+
+	factor := extrapolateToInterval / sampledInterval
+	if isRate {
+		factor /= window.Seconds()
+	}
+	return delta * model.SampleValue(factor), true
+}
@@ -0,0 +1,150 @@
+package promapi_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestRateOverRange(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+
+	// counter returns a series with one value every 15s starting at offset.
+	counter := func(offset time.Duration, values ...float64) []model.SamplePair {
+		pairs := make([]model.SamplePair, 0, len(values))
+		for i, v := range values {
+			pairs = append(pairs, model.SamplePair{
+				Timestamp: model.TimeFromUnixNano(start.Add(offset + time.Second*15*time.Duration(i)).UnixNano()),
+				Value:     model.SampleValue(v),
+			})
+		}
+		return pairs
+	}
+	// points returns expected values one every 15s starting at offset.
+	points := counter
+
+	type testCaseT struct {
+		name     string
+		samples  []*model.SampleStream
+		window   time.Duration
+		increase []*model.SampleStream
+		rate     []*model.SampleStream
+	}
+
+	testCases := []testCaseT{
+		{
+			name:   "empty",
+			window: time.Minute,
+		},
+		{
+			name: "single value",
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"__name__": "foo"}, Values: counter(0, 1)},
+			},
+			window: time.Minute,
+		},
+		{
+			name: "steady",
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"__name__": "foo", "instance": "1"}, Values: counter(0, 0, 15, 30, 45, 60, 75)},
+			},
+			window: time.Minute,
+			increase: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*15, 15, 30, 45, 60, 60)},
+			},
+			rate: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*15, 0.25, 0.5, 0.75, 1, 1)},
+			},
+		},
+		{
+			name: "reset",
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: counter(0, 10, 25, 40, 5, 20)},
+			},
+			window: time.Minute,
+			// Values before the reset are added, extrapolation stops where
+			// the counter would be zero.
+			increase: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*15, 25, 40, 45, 50)},
+			},
+			rate: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*15, 25.0/60, 40.0/60, 45.0/60, 50.0/60)},
+			},
+		},
+		{
+			name: "series starts within window",
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: counter(time.Second*30, 100, 115)},
+			},
+			window: time.Minute,
+			// First value is too far from the start of the window, so it's
+			// only extrapolated by half of the interval between values.
+			increase: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*45, 22.5)},
+			},
+			rate: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*45, 22.5/60)},
+			},
+		},
+		{
+			name: "stale markers",
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: counter(0, 0, 15, math.Float64frombits(value.StaleNaN), 45)},
+			},
+			window: time.Minute,
+			increase: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: append(points(time.Second*15, 15), points(time.Second*45, 45)...)},
+			},
+			rate: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: append(points(time.Second*15, 0.25), points(time.Second*45, 0.75)...)},
+			},
+		},
+		{
+			name: "same timestamp",
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"__name__": "foo"}, Values: append(counter(0, 1), counter(0, 2)...)},
+			},
+			window: time.Minute,
+		},
+		{
+			name: "same timestamp followed by more values",
+			samples: []*model.SampleStream{
+				{Metric: model.Metric{"__name__": "foo", "instance": "1"}, Values: append(counter(0, 0), counter(0, 0, 15)...)},
+			},
+			window: time.Minute,
+			increase: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*15, 15)},
+			},
+			rate: []*model.SampleStream{
+				{Metric: model.Metric{"instance": "1"}, Values: points(time.Second*15, 0.25)},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := promapi.RangeQueryResult{Samples: tc.samples}
+			requireSeries(t, tc.increase, promapi.IncreaseOverRange(&result, tc.window))
+			requireSeries(t, tc.rate, promapi.RateOverRange(&result, tc.window))
+		})
+	}
+}
+
+func requireSeries(t *testing.T, expected, got []*model.SampleStream) {
+	t.Helper()
+	require.Len(t, got, len(expected))
+	for i := range expected {
+		require.Equal(t, expected[i].Metric, got[i].Metric)
+		require.Len(t, got[i].Values, len(expected[i].Values))
+		for j := range expected[i].Values {
+			require.Equal(t, expected[i].Values[j].Timestamp, got[i].Values[j].Timestamp)
+			require.InDelta(t, float64(expected[i].Values[j].Value), float64(got[i].Values[j].Value), 1e-9)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package promapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+
+	"github.com/cloudflare/pint/internal/output"
+)
+
+// ErrRemoteReadDisabled is returned by RemoteRead when remote read wasn't
+// enabled using WithRemoteRead option.
+var ErrRemoteReadDisabled = errors.New("remote read is not enabled")
+
+// WithRemoteRead enables RemoteRead method, which fetches raw samples using
+// the remote read protocol instead of running range queries.
+// Not all servers expose /api/v1/read so this is disabled by default.
+func WithRemoteRead() PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.remoteRead = true
+	}
+}
+
+type remoteReadQuery struct {
+	prom     *Prometheus
+	ctx      context.Context
+	selector string
+	matchers []*prompb.LabelMatcher
+	start    time.Time
+	end      time.Time
+	step     time.Duration
+	maxBytes int64
+}
+
+func (q remoteReadQuery) Run() queryResult {
+	log.Debug().
+		Str("uri", q.prom.uri).
+		Str("selector", q.selector).
+		Str("start", q.start.UTC().Format(time.RFC3339)).
+		Str("end", q.end.UTC().Format(time.RFC3339)).
+		Msg("Running prometheus remote read")
+
+	ctx, cancel := context.WithTimeout(q.ctx, q.prom.timeout)
+	defer cancel()
+
+	qr := queryResult{}
+
+	rr := prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				StartTimestampMs: q.start.UnixMilli(),
+				EndTimestampMs:   q.end.UnixMilli(),
+				Matchers:         q.matchers,
+				Hints: &prompb.ReadHints{
+					StepMs:  q.step.Milliseconds(),
+					StartMs: q.start.UnixMilli(),
+					EndMs:   q.end.UnixMilli(),
+				},
+			},
+		},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES},
+	}
+	qr.request = RequestDetails{Method: http.MethodPost, Body: rr.String()}
+
+	u, err := q.prom.endpointURI(q.Endpoint())
+	if err != nil {
+		qr.err = err
+		return qr
+	}
+	qr.request.URI = u.Redacted()
+
+	data, err := rr.Marshal()
+	if err != nil {
+		qr.err = err
+		return qr
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		qr.err = err
+		return qr
+	}
+	q.prom.setHeaders(req, nil)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	resp, err := q.prom.sendRequest(req)
+	if err != nil {
+		qr.err = err
+		return qr
+	}
+	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
+
+	if resp.StatusCode/100 != 2 {
+		qr.err = tryDecodingAPIError(resp)
+		return qr
+	}
+
+	qr.value, qr.err = decodeRemoteRead(resp.Body, q.maxBytes)
+	return qr
+}
+
+func (q remoteReadQuery) Endpoint() string {
+	return "/api/v1/read"
+}
+
+func (q remoteReadQuery) String() string {
+	return q.selector
+}
+
+func (q remoteReadQuery) CacheKey() string {
+	h := q.prom.newCacheKeyHash()
+	_, _ = io.WriteString(h, q.Endpoint())
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.selector)
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.start.UTC().Format(time.RFC3339))
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.end.Round(q.step).UTC().Format(time.RFC3339))
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, output.HumanizeDuration(q.step))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// RemoteRead fetches raw samples of all series matching given selector
+// using the remote read protocol. It returns the same result as a range
+// query for that selector would, but it's much cheaper for Prometheus
+// to serve large amounts of series this way.
+func (p *Prometheus) RemoteRead(ctx context.Context, selector string, params RangeQueryTimes, opts RangeQueryOptions) (*RangeQueryResult, error) {
+	if !p.remoteRead {
+		return nil, fmt.Errorf("%w for %s", ErrRemoteReadDisabled, p.uri)
+	}
+
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.checkMetrics(selector); err != nil {
+		return nil, err
+	}
+
+	start := params.Start().UTC()
+	end := params.End().UTC()
+
+	log.Debug().
+		Str("uri", p.uri).
+		Str("selector", selector).
+		Str("range", params.String()).
+		Msg("Scheduling prometheus remote read")
+
+	key := fmt.Sprintf("/api/v1/read/%s/%s", selector, params.String())
+	p.locker.lock(key)
+	defer p.locker.unlock(key)
+
+	resultChan := make(chan queryResult)
+	p.enqueue(ctx, queryRequest{
+		query: remoteReadQuery{
+			prom:     p,
+			ctx:      ctx,
+			selector: selector,
+			matchers: toLabelMatchers(matchers),
+			start:    start,
+			end:      end,
+			step:     params.Step(),
+			maxBytes: opts.MaxTotalBytes,
+		},
+		result: resultChan,
+	})
+
+	result := <-resultChan
+	if result.err != nil {
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
+	}
+
+	rqr := RangeQueryResult{
+		URI:      p.uri,
+		Start:    start,
+		End:      end,
+		Requests: []RequestDetails{result.request},
+	}
+	merger := newRangeMerger(&rqr, opts, 0)
+	defer merger.close()
+	merger.add(result.value.([]model.SampleStream))
+	if merger.err != nil {
+		return nil, QueryError{err: merger.err, msg: decodeError(merger.err), request: &result.request}
+	}
+	if err = merger.finish(); err != nil {
+		return nil, err
+	}
+
+	log.Debug().
+		Str("uri", p.uri).
+		Str("selector", selector).
+		Int("samples", len(rqr.Samples)).
+		Msg("Parsed remote read response")
+
+	return &rqr, nil
+}
+
+func toLabelMatchers(matchers []*labels.Matcher) []*prompb.LabelMatcher {
+	pbm := make([]*prompb.LabelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		var mt prompb.LabelMatcher_Type
+		switch m.Type {
+		case labels.MatchEqual:
+			mt = prompb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			mt = prompb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			mt = prompb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			mt = prompb.LabelMatcher_NRE
+		}
+		pbm = append(pbm, &prompb.LabelMatcher{Type: mt, Name: m.Name, Value: m.Value})
+	}
+	return pbm
+}
+
+// decodeRemoteRead decodes a remote read response, it fails with
+// ErrResultTooLarge if the response is bigger than maxBytes or
+// maxProtobufBytes, whichever is lower.
+func decodeRemoteRead(r io.Reader, maxBytes int64) (samples []model.SampleStream, err error) {
+	defer dummyReadAll(r)
+
+	compressed, err := readAllLimited(r, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := snappy.DecodedLen(compressed); err == nil && n > maxProtobufBytes {
+		return nil, fmt.Errorf("%w, decompressed response is %d bytes, more than %d bytes allowed", ErrResultTooLarge, n, maxProtobufBytes)
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, APIError{Status: "error", ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("snappy decode error: %s", err)}
+	}
+
+	var resp prompb.ReadResponse
+	if err = resp.Unmarshal(data); err != nil {
+		return nil, APIError{Status: "error", ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("protobuf decode error: %s", err)}
+	}
+
+	samples = []model.SampleStream{}
+	for _, result := range resp.Results {
+		samples = appendTimeSeries(samples, result.Timeseries)
+	}
+	return samples, nil
+}
+
+func appendTimeSeries(samples []model.SampleStream, series []*prompb.TimeSeries) []model.SampleStream {
+	for _, ts := range series {
+		sample := model.SampleStream{
+			Metric: make(model.Metric, len(ts.Labels)),
+			Values: make([]model.SamplePair, 0, len(ts.Samples)),
+		}
+		for _, l := range ts.Labels {
+			sample.Metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		for _, s := range ts.Samples {
+			sample.Values = append(sample.Values, model.SamplePair{
+				Timestamp: model.Time(s.Timestamp),
+				Value:     model.SampleValue(s.Value),
+			})
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
@@ -0,0 +1,337 @@
+package promapi_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func remoteReadFixture(t *testing.T) []byte {
+	resp := prompb.ReadResponse{
+		Results: []*prompb.QueryResult{
+			{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels: []prompb.Label{
+							{Name: "__name__", Value: "up"},
+							{Name: "instance", Value: "1"},
+						},
+						Samples: []prompb.Sample{
+							{Timestamp: 1655164860000, Value: 2},
+							{Timestamp: 1655164800000, Value: 1},
+							{Timestamp: 1655164920000, Value: 3},
+						},
+					},
+					{
+						Labels: []prompb.Label{
+							{Name: "__name__", Value: "up"},
+							{Name: "instance", Value: "2"},
+						},
+						Samples: []prompb.Sample{
+							{Timestamp: 1655164800000, Value: 0},
+							{Timestamp: 1655168400000, Value: 1},
+						},
+					},
+				},
+			},
+		},
+	}
+	data, err := resp.Marshal()
+	require.NoError(t, err)
+	return snappy.Encode(nil, data)
+}
+
+func TestRemoteRead(t *testing.T) {
+	fixture := remoteReadFixture(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/read" {
+			w.WriteHeader(400)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"unhandled path"}`))
+			return
+		}
+
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		require.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+
+		compressed, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		var req prompb.ReadRequest
+		require.NoError(t, req.Unmarshal(data))
+		require.Len(t, req.Queries, 1)
+
+		var name string
+		for _, m := range req.Queries[0].Matchers {
+			if m.Name == "__name__" {
+				name = m.Value
+			}
+		}
+
+		switch name {
+		case "up":
+			require.Equal(t, []*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "foo"},
+				{Type: prompb.LabelMatcher_RE, Name: "instance", Value: ".+"},
+				{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			}, req.Queries[0].Matchers)
+			require.Equal(t, int64(1655164800000), req.Queries[0].StartTimestampMs)
+			require.Equal(t, int64(1655164920000), req.Queries[0].EndTimestampMs)
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Header().Set("Content-Encoding", "snappy")
+			w.WriteHeader(200)
+			_, _ = w.Write(fixture)
+		case "badData":
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Header().Set("Content-Encoding", "snappy")
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte("foo"))
+		default:
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("remote read error\n"))
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*2), time.Minute)
+
+	t.Run("disabled", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		_, err := prom.RemoteRead(context.Background(), `up{job="foo"}`, params, promapi.RangeQueryOptions{})
+		require.True(t, errors.Is(err, promapi.ErrRemoteReadDisabled))
+	})
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithRemoteRead())
+	prom.StartWorkers()
+	defer prom.Close()
+
+	t.Run("samples", func(t *testing.T) {
+		qr, err := prom.RemoteRead(context.Background(), `up{job="foo", instance=~".+"}`, params, promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		require.Equal(t, srv.URL, qr.URI)
+		require.Equal(t, start.UTC(), qr.Start)
+		require.Equal(t, start.Add(time.Minute*2).UTC(), qr.End)
+		require.Len(t, qr.Requests, 1)
+		require.Equal(t, srv.URL+"/api/v1/read", qr.Requests[0].URI)
+		require.Equal(t, []*model.SampleStream{
+			{
+				Metric: model.Metric{"__name__": "up", "instance": "1"},
+				Values: []model.SamplePair{
+					{Timestamp: model.TimeFromUnix(1655164800), Value: 1},
+					{Timestamp: model.TimeFromUnix(1655164860), Value: 2},
+					{Timestamp: model.TimeFromUnix(1655164920), Value: 3},
+				},
+			},
+			{
+				Metric: model.Metric{"__name__": "up", "instance": "2"},
+				Values: []model.SamplePair{
+					{Timestamp: model.TimeFromUnix(1655164800), Value: 0},
+				},
+			},
+		}, qr.Samples)
+	})
+
+	t.Run("invalid selector", func(t *testing.T) {
+		_, err := prom.RemoteRead(context.Background(), `sum(up)`, params, promapi.RangeQueryOptions{})
+		require.Error(t, err)
+	})
+
+	t.Run("bad response", func(t *testing.T) {
+		_, err := prom.RemoteRead(context.Background(), `badData`, params, promapi.RangeQueryOptions{})
+		require.EqualError(t, err, "bad_response: snappy decode error: snappy: corrupt input")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, err := prom.RemoteRead(context.Background(), `error`, params, promapi.RangeQueryOptions{})
+		require.EqualError(t, err, "server_error: server error: 500")
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithRemoteRead())
+		prom.StartWorkers()
+		defer prom.Close()
+
+		_, err := prom.RemoteRead(context.Background(), `up{job="foo", instance=~".+"}`, params, promapi.RangeQueryOptions{MaxTotalBytes: 10})
+		require.ErrorIs(t, err, promapi.ErrResultTooLarge)
+	})
+}
+
+func TestRemoteReadStaleMarkers(t *testing.T) {
+	staleNaN := math.Float64frombits(value.StaleNaN)
+	resp := prompb.ReadResponse{
+		Results: []*prompb.QueryResult{
+			{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels: []prompb.Label{
+							{Name: "__name__", Value: "up"},
+							{Name: "instance", Value: "1"},
+						},
+						Samples: []prompb.Sample{
+							{Timestamp: 1655164800000, Value: 1},
+							{Timestamp: 1655164860000, Value: staleNaN},
+							{Timestamp: 1655164920000, Value: math.NaN()},
+							{Timestamp: 1655164980000, Value: 1},
+						},
+					},
+					{
+						Labels: []prompb.Label{
+							{Name: "__name__", Value: "up"},
+							{Name: "instance", Value: "2"},
+						},
+						Samples: []prompb.Sample{
+							{Timestamp: 1655164800000, Value: 0},
+							{Timestamp: 1655164980000, Value: staleNaN},
+						},
+					},
+				},
+			},
+		},
+	}
+	data, err := resp.Marshal()
+	require.NoError(t, err)
+	fixture := snappy.Encode(nil, data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		_, _ = w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithRemoteRead())
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*3), time.Minute)
+
+	values := func(qr *promapi.RangeQueryResult, instance string) (vals []string) {
+		for _, s := range qr.Samples {
+			if s.Metric["instance"] != model.LabelValue(instance) {
+				continue
+			}
+			for _, v := range s.Values {
+				if value.IsStaleNaN(float64(v.Value)) {
+					vals = append(vals, "stale")
+				} else {
+					vals = append(vals, v.Value.String())
+				}
+			}
+		}
+		return vals
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		qr, err := prom.RemoteRead(context.Background(), "up", params, promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 2, qr.StaleMarkers)
+		require.Equal(t, []string{"1", "stale", "NaN", "1"}, values(qr, "1"))
+		require.Equal(t, []string{"0", "stale"}, values(qr, "2"))
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		qr, err := prom.RemoteRead(context.Background(), "up", params, promapi.RangeQueryOptions{DropStaleMarkers: true})
+		require.NoError(t, err)
+		require.Equal(t, 2, qr.StaleMarkers)
+		require.Equal(t, []string{"1", "NaN", "1"}, values(qr, "1"))
+		require.Equal(t, []string{"0"}, values(qr, "2"))
+	})
+}
+
+func TestRemoteReadStaleMarkersCompressedCache(t *testing.T) {
+	staleNaN := math.Float64frombits(value.StaleNaN)
+	resp := prompb.ReadResponse{
+		Results: []*prompb.QueryResult{
+			{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels: []prompb.Label{
+							{Name: "__name__", Value: "up"},
+							{Name: "instance", Value: "1"},
+						},
+						Samples: []prompb.Sample{
+							{Timestamp: 1655164800000, Value: 1},
+							{Timestamp: 1655164860000, Value: staleNaN},
+							{Timestamp: 1655164920000, Value: math.NaN()},
+						},
+					},
+				},
+			},
+		},
+	}
+	data, err := resp.Marshal()
+	require.NoError(t, err)
+	fixture := snappy.Encode(nil, data)
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		_, _ = w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithRemoteRead(), promapi.WithCacheCompression())
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*2), time.Minute)
+
+	for i := 0; i < 2; i++ {
+		qr, err := prom.RemoteRead(context.Background(), "up", params, promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		require.Len(t, qr.Samples, 1)
+		require.Len(t, qr.Samples[0].Values, 3)
+		require.True(t, value.IsStaleNaN(float64(qr.Samples[0].Values[1].Value)), "stale marker should be preserved")
+		require.False(t, value.IsStaleNaN(float64(qr.Samples[0].Values[2].Value)), "NaN shouldn't become a stale marker")
+	}
+	require.Equal(t, 1, requests, "second query should be served from the cache")
+}
+
+func TestRemoteReadRequestHandling(t *testing.T) {
+	fixture := remoteReadFixture(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "bar", r.Header.Get("X-Foo"))
+		require.Equal(t, "v1", r.Header.Get("X-Prometheus-API-Version"))
+		w.Header().Set("X-Prometheus-API-Version", "v1")
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		w.WriteHeader(200)
+		_, _ = w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+		promapi.WithRemoteRead(), promapi.WithHeaders(map[string]string{"X-Foo": "bar"}), promapi.WithAPIVersion("v1"))
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*2), time.Minute)
+	_, err := prom.RemoteRead(context.Background(), "up", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "v1", prom.APIVersion(), "remote read responses should be tracked like any other")
+}
@@ -0,0 +1,311 @@
+package promapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/rs/zerolog/log"
+)
+
+// WithRecordDir makes the client save every successful response to
+// a fixture file in dir, so it can later be used with WithReplayDir.
+func WithRecordDir(dir string) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.recordDir = dir
+	}
+}
+
+// WithReplayDir makes the client answer all queries using fixtures
+// previously saved with WithRecordDir, no requests are sent to Prometheus.
+// Fixtures are looked up using query cache keys, which depend on query
+// time, so the clock is pinned to the time fixtures were recorded at.
+// Queries without a fixture return an error with the missing cache key.
+func WithReplayDir(dir string) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.replayDir = dir
+	}
+}
+
+const (
+	fixtureString    = "string"
+	fixtureStrings   = "strings"
+	fixtureVector    = "vector"
+	fixtureMatrix    = "matrix"
+	fixtureFlags     = "flags"
+	fixtureMetadata  = "metadata"
+	fixtureRules     = "rules"
+	fixtureDuration  = "duration"
+	fixtureExtension = ".json"
+	// fixtureClock is the file with the time fixtures were recorded at.
+	fixtureClock = "clock.json"
+)
+
+type recordedClock struct {
+	Time time.Time `json:"time"`
+}
+
+type fixture struct {
+	Endpoint string          `json:"endpoint"`
+	Query    string          `json:"query"`
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value"`
+	Status   string          `json:"status,omitempty"`
+	Stats    *QueryStats     `json:"stats,omitempty"`
+}
+
+func fixturePath(dir, cacheKey string) string {
+	return filepath.Join(dir, cacheKey+fixtureExtension)
+}
+
+// record saves the result of a query to the record directory.
+func (prom *Prometheus) record(q querier, cacheKey string, result queryResult) {
+	if prom.recordDir == "" || cacheKey == "" || result.err != nil {
+		return
+	}
+	prom.recordClock.Do(func() {
+		if err := writeRecordedClock(prom.recordDir, prom.clock()); err != nil {
+			log.Warn().
+				Err(err).
+				Str("uri", prom.uri).
+				Str("dir", prom.recordDir).
+				Msg("Failed to record query time")
+		}
+	})
+	if err := writeFixture(prom.recordDir, cacheKey, q, result); err != nil {
+		log.Warn().
+			Err(err).
+			Str("uri", prom.uri).
+			Str("query", q.String()).
+			Str("key", cacheKey).
+			Msg("Failed to record query response")
+	}
+}
+
+func writeFixture(dir, cacheKey string, q querier, result queryResult) (err error) {
+	f := fixture{
+		Endpoint: q.Endpoint(),
+		Query:    q.String(),
+		Status:   result.status,
+		Stats:    result.stats,
+	}
+	if f.Type, f.Value, err = encodeFixtureValue(result.value); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(fixturePath(dir, cacheKey), data, 0o644)
+}
+
+// writeRecordedClock saves the time queries are recorded at, unless it was
+// already saved by another client recording to the same directory.
+func writeRecordedClock(dir string, now time.Time) error {
+	data, err := json.Marshal(recordedClock{Time: now})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, fixtureClock), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pinReplayClock makes the client use the time fixtures were recorded at
+// as the current time, so replayed queries get the same cache keys.
+// Fixtures recorded without that time are used with the configured clock.
+func (prom *Prometheus) pinReplayClock() {
+	if prom.replayDir == "" {
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(prom.replayDir, fixtureClock))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var rc recordedClock
+	if err == nil {
+		err = json.Unmarshal(data, &rc)
+	}
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("uri", prom.uri).
+			Str("dir", prom.replayDir).
+			Msg("Failed to read the time fixtures were recorded at, using current time")
+		return
+	}
+	prom.clock = func() time.Time { return rc.Time }
+}
+
+// replay returns the recorded result of a query.
+func (prom *Prometheus) replay(q querier, cacheKey string) (qr queryResult) {
+	if u, err := prom.endpointURI(q.Endpoint()); err == nil {
+		qr.request.URI = u.Redacted()
+	}
+
+	if cacheKey == "" {
+		qr.err = APIError{
+			Status:    "error",
+			ErrorType: v1.ErrClient,
+			Err:       fmt.Sprintf("query to %s can't be replayed because it has no cache key", q.Endpoint()),
+		}
+		return qr
+	}
+
+	data, err := os.ReadFile(fixturePath(prom.replayDir, cacheKey))
+	if errors.Is(err, os.ErrNotExist) {
+		qr.err = APIError{
+			Status:    "error",
+			ErrorType: v1.ErrClient,
+			Err:       fmt.Sprintf("no recorded response for %s query %q, missing fixture with cache key %s in %s", q.Endpoint(), q.String(), cacheKey, prom.replayDir),
+		}
+		return qr
+	}
+	if err != nil {
+		qr.err = fmt.Errorf("failed to read recorded response: %w", err)
+		return qr
+	}
+
+	var f fixture
+	if err = json.Unmarshal(data, &f); err != nil {
+		qr.err = fmt.Errorf("failed to parse recorded response %s: %w", cacheKey, err)
+		return qr
+	}
+	if qr.value, err = decodeFixtureValue(f.Type, f.Value); err != nil {
+		qr.err = fmt.Errorf("failed to parse recorded response %s: %w", cacheKey, err)
+		return qr
+	}
+	qr.status = f.Status
+	qr.stats = f.Stats
+	return qr
+}
+
+func encodeFixtureValue(v any) (typ string, data json.RawMessage, err error) {
+	switch val := v.(type) {
+	case string:
+		typ = fixtureString
+	case []string:
+		typ = fixtureStrings
+	case []model.Sample:
+		typ = fixtureVector
+	case []model.SampleStream:
+		typ = fixtureMatrix
+	case v1.FlagsResult:
+		typ = fixtureFlags
+	case map[string][]v1.Metadata:
+		typ = fixtureMetadata
+	case time.Duration:
+		typ = fixtureDuration
+	case []v1.RuleGroup:
+		// Rules are decoded using the type field, which isn't included
+		// when they're marshaled, so it needs to be added here.
+		data, err = encodeRuleGroups(val)
+		return fixtureRules, data, err
+	default:
+		return "", nil, fmt.Errorf("unsupported value type %T", v)
+	}
+	data, err = json.Marshal(v)
+	return typ, data, err
+}
+
+func decodeFixtureValue(typ string, data json.RawMessage) (any, error) {
+	var err error
+	switch typ {
+	case fixtureString:
+		var v string
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case fixtureStrings:
+		var v []string
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case fixtureVector:
+		var v []model.Sample
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case fixtureMatrix:
+		var v []model.SampleStream
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case fixtureFlags:
+		var v v1.FlagsResult
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case fixtureMetadata:
+		var v map[string][]v1.Metadata
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case fixtureDuration:
+		var v time.Duration
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case fixtureRules:
+		var v []v1.RuleGroup
+		err = json.Unmarshal(data, &v)
+		return v, err
+	default:
+		return nil, fmt.Errorf("unsupported value type %q", typ)
+	}
+}
+
+func encodeRuleGroups(groups []v1.RuleGroup) (json.RawMessage, error) {
+	type ruleGroup struct {
+		Name     string            `json:"name"`
+		File     string            `json:"file"`
+		Interval float64           `json:"interval"`
+		Rules    []json.RawMessage `json:"rules"`
+	}
+
+	out := make([]ruleGroup, 0, len(groups))
+	for _, g := range groups {
+		rg := ruleGroup{Name: g.Name, File: g.File, Interval: g.Interval, Rules: make([]json.RawMessage, 0, len(g.Rules))}
+		for _, r := range g.Rules {
+			var typ string
+			switch r.(type) {
+			case v1.AlertingRule:
+				typ = string(v1.RuleTypeAlerting)
+			case v1.RecordingRule:
+				typ = string(v1.RuleTypeRecording)
+			default:
+				return nil, fmt.Errorf("unsupported rule type %T", r)
+			}
+			data, err := json.Marshal(r)
+			if err != nil {
+				return nil, err
+			}
+			var fields map[string]json.RawMessage
+			if err = json.Unmarshal(data, &fields); err != nil {
+				return nil, err
+			}
+			fields["type"], _ = json.Marshal(typ)
+			if data, err = json.Marshal(fields); err != nil {
+				return nil, err
+			}
+			rg.Rules = append(rg.Rules, data)
+		}
+		out = append(out, rg)
+	}
+	return json.Marshal(out)
+}
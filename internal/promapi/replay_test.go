@@ -0,0 +1,129 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"1"},"value":[1655164800,"1"]}]}}`))
+		case "/api/v1/query_range":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"],[1655164860,"2"]]}]}}`))
+		case "/api/v1/status/flags":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"storage.tsdb.retention.time":"30d"}}`))
+		case "/api/v1/rules":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"groups":[{"name":"foo","file":"foo.yml","interval":60,"rules":[
+				{"type":"recording","name":"job:up:sum","query":"sum(up) by (job)","labels":{"team":"bar"},"health":"ok"},
+				{"type":"alerting","name":"Down","query":"up == 0","duration":300,"labels":{},"annotations":{"summary":"down"},"alerts":[],"health":"ok"}
+			]}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	dir := t.TempDir()
+	now := time.Unix(1655164800, 0)
+	clock := func() time.Time { return now }
+	rr := promapi.NewAbsoluteRange(now.Add(-time.Minute*5), now, time.Minute)
+
+	type results struct {
+		query *promapi.QueryResult
+		rng   *promapi.RangeQueryResult
+		flags *promapi.FlagsResult
+		rules *promapi.RulesResult
+	}
+	run := func(t *testing.T, prom *promapi.Prometheus) (r results) {
+		var err error
+		r.query, err = prom.Query(context.Background(), "up")
+		require.NoError(t, err)
+		r.rng, err = prom.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		r.flags, err = prom.Flags(context.Background())
+		require.NoError(t, err)
+		r.rules, err = prom.Rules(context.Background())
+		require.NoError(t, err)
+		return r
+	}
+
+	rec := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithClock(clock), promapi.WithRecordDir(dir))
+	rec.StartWorkers()
+	recorded := run(t, rec)
+	rec.Close()
+	srv.Close()
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 5)
+
+	replay := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100, promapi.WithClock(clock), promapi.WithReplayDir(dir))
+	replay.StartWorkers()
+	defer replay.Close()
+	replayed := run(t, replay)
+
+	require.Equal(t, recorded.query.Series, replayed.query.Series)
+	require.Equal(t, recorded.rng.Samples, replayed.rng.Samples)
+	require.Equal(t, recorded.flags.Flags, replayed.flags.Flags)
+	require.Equal(t, recorded.rules.Groups, replayed.rules.Groups)
+	rule, ok := replayed.rules.AlertingRule("Down")
+	require.True(t, ok)
+	require.Equal(t, "up == 0", rule.Query)
+
+	_, err = replay.Query(context.Background(), "down")
+	require.Error(t, err)
+	require.Regexp(t, regexp.MustCompile(`no recorded response for /api/v1/query query "down", missing fixture with cache key [0-9a-f]{40} in `), err.Error())
+	require.False(t, promapi.IsUnavailableError(err), "missing fixture shouldn't be treated as unavailable server")
+}
+
+func TestReplayWithDifferentClock(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"1"},"value":[1655164800,"1"]}]}}`))
+		case "/api/v1/query_range":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"1"},"values":[[1655164800,"1"],[1655164860,"2"]]}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	dir := t.TempDir()
+	recordedAt := time.Unix(1655164800, 0)
+	rr := promapi.NewRelativeRange(time.Minute*5, time.Minute)
+
+	rec := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+		promapi.WithClock(func() time.Time { return recordedAt }), promapi.WithRecordDir(dir))
+	rec.StartWorkers()
+	query, err := rec.Query(context.Background(), "up")
+	require.NoError(t, err)
+	rng, err := rec.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	rec.Close()
+	srv.Close()
+
+	replayedAt := recordedAt.Add(time.Hour)
+	replay := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+		promapi.WithClock(func() time.Time { return replayedAt }), promapi.WithReplayDir(dir))
+	replay.StartWorkers()
+	defer replay.Close()
+
+	replayedQuery, err := replay.Query(context.Background(), "up")
+	require.NoError(t, err)
+	require.Equal(t, query.Series, replayedQuery.Series)
+	replayedRange, err := replay.RangeQuery(context.Background(), "up", rr, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, rng.Samples, replayedRange.Samples)
+}
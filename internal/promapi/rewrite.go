@@ -0,0 +1,37 @@
+package promapi
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// QueryRewriter can modify a query before it's sent to Prometheus.
+type QueryRewriter func(expr string) (string, error)
+
+// WithQueryRewriters adds rewriters that are applied in order to every
+// instant and range query before it's sent. The rewritten query is used
+// both for the request and as the cache key.
+func WithQueryRewriters(rewriters ...QueryRewriter) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.rewriters = append(prom.rewriters, rewriters...)
+	}
+}
+
+func (prom *Prometheus) rewriteQuery(expr string) (string, error) {
+	orig := expr
+	for _, rw := range prom.rewriters {
+		var err error
+		if expr, err = rw(expr); err != nil {
+			return "", fmt.Errorf("failed to rewrite query %q: %w", orig, err)
+		}
+	}
+	if expr != orig {
+		log.Debug().
+			Str("uri", prom.uri).
+			Str("query", orig).
+			Str("rewritten", expr).
+			Msg("Query was rewritten")
+	}
+	return expr, nil
+}
@@ -0,0 +1,81 @@
+package promapi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestQueryRewriters(t *testing.T) {
+	var mtx sync.Mutex
+	queries := map[string][]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtx.Lock()
+		queries[r.URL.Path] = append(queries[r.URL.Path], r.Form.Get("query"))
+		mtx.Unlock()
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	rename := func(expr string) (string, error) {
+		return strings.ReplaceAll(expr, "deprecated_metric", "new_metric"), nil
+	}
+	prefix := func(expr string) (string, error) {
+		return strings.ReplaceAll(expr, "new_metric", "job:new_metric:sum"), nil
+	}
+	reject := func(expr string) (string, error) {
+		if strings.Contains(expr, "forbidden") {
+			return "", errors.New("forbidden metric")
+		}
+		return expr, nil
+	}
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+		promapi.WithQueryRewriters(rename, prefix),
+		promapi.WithQueryRewriters(reject),
+	)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	_, err := prom.Query(context.Background(), "deprecated_metric")
+	require.NoError(t, err)
+	_, err = prom.Query(context.Background(), "new_metric")
+	require.NoError(t, err)
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*5), time.Minute)
+	_, err = prom.RangeQuery(context.Background(), "rate(deprecated_metric[5m])", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	_, err = prom.RangeQuery(context.Background(), "rate(new_metric[5m])", params, promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+
+	_, err = prom.Query(context.Background(), "forbidden")
+	require.EqualError(t, err, `failed to rewrite query "forbidden": forbidden metric`)
+	_, err = prom.RangeQuery(context.Background(), "forbidden", params, promapi.RangeQueryOptions{})
+	require.EqualError(t, err, `failed to rewrite query "forbidden": forbidden metric`)
+
+	require.Equal(t, map[string][]string{
+		"/api/v1/query":       {"job:new_metric:sum"},
+		"/api/v1/query_range": {"rate(job:new_metric:sum[5m])"},
+	}, queries, "rewritten queries should be sent and share cache")
+}
@@ -0,0 +1,135 @@
+package promapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/rs/zerolog/log"
+)
+
+type RulesResult struct {
+	URI    string
+	Groups []v1.RuleGroup
+}
+
+// RecordingRule returns the first recording rule with given name.
+func (rr RulesResult) RecordingRule(name string) (rule v1.RecordingRule, ok bool) {
+	for _, group := range rr.Groups {
+		for _, r := range group.Rules {
+			if rule, ok = r.(v1.RecordingRule); ok && rule.Name == name {
+				return rule, true
+			}
+		}
+	}
+	return v1.RecordingRule{}, false
+}
+
+// AlertingRule returns the first alerting rule with given name.
+func (rr RulesResult) AlertingRule(name string) (rule v1.AlertingRule, ok bool) {
+	for _, group := range rr.Groups {
+		for _, r := range group.Rules {
+			if rule, ok = r.(v1.AlertingRule); ok && rule.Name == name {
+				return rule, true
+			}
+		}
+	}
+	return v1.AlertingRule{}, false
+}
+
+type rulesQuery struct {
+	prom *Prometheus
+	ctx  context.Context
+}
+
+func (q rulesQuery) Run() queryResult {
+	log.Debug().
+		Str("uri", q.prom.uri).
+		Msg("Getting prometheus rules")
+
+	ctx, cancel := context.WithTimeout(q.ctx, q.prom.timeout)
+	defer cancel()
+
+	// Rules are only loaded once per process, so results never expire.
+	qr := queryResult{}
+
+	args := url.Values{}
+	qr.request = q.prom.describeRequest(http.MethodGet, q.Endpoint(), args)
+	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args, nil)
+	if err != nil {
+		qr.err = fmt.Errorf("failed to query Prometheus rules: %w", err)
+		return qr
+	}
+	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
+
+	if resp.StatusCode/100 != 2 {
+		qr.err = tryDecodingAPIError(resp)
+		return qr
+	}
+
+	qr.value, qr.err = decodeRules(resp.Body)
+	return qr
+}
+
+func (q rulesQuery) Endpoint() string {
+	return "/api/v1/rules"
+}
+
+func (q rulesQuery) String() string {
+	return "/api/v1/rules"
+}
+
+func (q rulesQuery) CacheKey() string {
+	h := q.prom.newCacheKeyHash()
+	_, _ = io.WriteString(h, q.Endpoint())
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func (p *Prometheus) Rules(ctx context.Context) (*RulesResult, error) {
+	log.Debug().Str("uri", p.uri).Msg("Scheduling Prometheus rules query")
+
+	key := "/api/v1/rules"
+	p.locker.lock(key)
+	defer p.locker.unlock(key)
+
+	resultChan := make(chan queryResult)
+	p.enqueue(ctx, queryRequest{
+		query:  rulesQuery{prom: p, ctx: ctx},
+		result: resultChan,
+	})
+
+	result := <-resultChan
+	if result.err != nil {
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
+	}
+
+	r := RulesResult{URI: p.uri, Groups: result.value.([]v1.RuleGroup)}
+
+	return &r, nil
+}
+
+func decodeRules(r io.Reader) (groups []v1.RuleGroup, err error) {
+	defer dummyReadAll(r)
+
+	var resp struct {
+		Status    string         `json:"status"`
+		ErrorType string         `json:"errorType"`
+		Error     string         `json:"error"`
+		Data      v1.RulesResult `json:"data"`
+	}
+
+	if err = json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, APIError{Status: resp.Status, ErrorType: v1.ErrBadResponse, Err: fmt.Sprintf("JSON parse error: %s", err)}
+	}
+
+	if resp.Status != "success" {
+		return nil, APIError{Status: resp.Status, ErrorType: decodeErrorType(resp.ErrorType), Err: resp.Error}
+	}
+
+	return resp.Data.Groups, nil
+}
@@ -0,0 +1,213 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+const rulesFixture = `{
+  "status": "success",
+  "data": {
+    "groups": [
+      {
+        "name": "recording",
+        "file": "/etc/prometheus/rules/recording.yml",
+        "interval": 60,
+        "rules": [
+          {
+            "name": "job:up:sum",
+            "query": "sum(up) by (job)",
+            "labels": {"team": "infra"},
+            "health": "ok",
+            "evaluationTime": 0.001,
+            "lastEvaluation": "2022-06-01T10:00:00Z",
+            "type": "recording"
+          }
+        ]
+      },
+      {
+        "name": "alerting",
+        "file": "/etc/prometheus/rules/alerting.yml",
+        "interval": 30,
+        "rules": [
+          {
+            "name": "JobDown",
+            "query": "job:up:sum == 0",
+            "duration": 300,
+            "labels": {"severity": "critical"},
+            "annotations": {"summary": "job is down"},
+            "alerts": [],
+            "health": "ok",
+            "evaluationTime": 0.002,
+            "lastEvaluation": "2022-06-01T10:00:00Z",
+            "state": "inactive",
+            "type": "alerting"
+          }
+        ]
+      }
+    ]
+  }
+}`
+
+func TestRules(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/default/api/v1/rules":
+			calls.Add(1)
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(rulesFixture))
+		case "/empty/api/v1/rules":
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+		case "/slow/api/v1/rules":
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			time.Sleep(time.Second)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+		case "/error/api/v1/rules":
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte("fake error\n"))
+		case "/badJson/api/v1/rules":
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"groups":[{"rules":[{"type":"foo"}]}]}}`))
+		default:
+			w.WriteHeader(400)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"unhandled path"}`))
+		}
+	}))
+	defer srv.Close()
+
+	lastEvaluation := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	type testCaseT struct {
+		prefix  string
+		timeout time.Duration
+		rules   promapi.RulesResult
+		err     string
+	}
+
+	testCases := []testCaseT{
+		{
+			prefix:  "/default",
+			timeout: time.Second,
+			rules: promapi.RulesResult{
+				URI: srv.URL + "/default",
+				Groups: []v1.RuleGroup{
+					{
+						Name:     "recording",
+						File:     "/etc/prometheus/rules/recording.yml",
+						Interval: 60,
+						Rules: v1.Rules{
+							v1.RecordingRule{
+								Name:           "job:up:sum",
+								Query:          "sum(up) by (job)",
+								Labels:         model.LabelSet{"team": "infra"},
+								Health:         v1.RuleHealthGood,
+								EvaluationTime: 0.001,
+								LastEvaluation: lastEvaluation,
+							},
+						},
+					},
+					{
+						Name:     "alerting",
+						File:     "/etc/prometheus/rules/alerting.yml",
+						Interval: 30,
+						Rules: v1.Rules{
+							v1.AlertingRule{
+								Name:           "JobDown",
+								Query:          "job:up:sum == 0",
+								Duration:       300,
+								Labels:         model.LabelSet{"severity": "critical"},
+								Annotations:    model.LabelSet{"summary": "job is down"},
+								Alerts:         []*v1.Alert{},
+								Health:         v1.RuleHealthGood,
+								EvaluationTime: 0.002,
+								LastEvaluation: lastEvaluation,
+								State:          "inactive",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			prefix:  "/empty",
+			timeout: time.Second,
+			rules: promapi.RulesResult{
+				URI:    srv.URL + "/empty",
+				Groups: []v1.RuleGroup{},
+			},
+		},
+		{
+			prefix:  "/slow",
+			timeout: time.Millisecond * 10,
+			err:     "connection timeout",
+		},
+		{
+			prefix:  "/error",
+			timeout: time.Second,
+			err:     "server_error: server error: 500",
+		},
+		{
+			prefix:  "/badJson",
+			timeout: time.Second,
+			err:     "bad_response: JSON parse error: failed to decode JSON into an alerting or recording rule",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.TrimPrefix(tc.prefix, "/"), func(t *testing.T) {
+			prom := promapi.NewPrometheus("test", srv.URL+tc.prefix, tc.timeout, 1, 1000, 100)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			rules, err := prom.Rules(context.Background())
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err, tc)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.rules, *rules)
+			}
+		})
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL+"/default", time.Second, 1, 1000, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		calls.Store(0)
+		for i := 0; i < 3; i++ {
+			rules, err := prom.Rules(context.Background())
+			require.NoError(t, err)
+
+			rule, ok := rules.RecordingRule("job:up:sum")
+			require.True(t, ok)
+			require.Equal(t, "sum(up) by (job)", rule.Query)
+
+			alert, ok := rules.AlertingRule("JobDown")
+			require.True(t, ok)
+			require.Equal(t, float64(300), alert.Duration)
+
+			_, ok = rules.RecordingRule("JobDown")
+			require.False(t, ok)
+		}
+		require.Equal(t, int32(1), calls.Load())
+	})
+}
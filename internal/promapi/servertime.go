@@ -0,0 +1,186 @@
+package promapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/cloudflare/pint/internal/output"
+)
+
+// serverTimePrecision is the precision of the Date header used to get the
+// server time, skew that isn't bigger than that can't be detected reliably.
+const serverTimePrecision = time.Second
+
+// WithServerTimeClamp enables clock skew detection for range queries.
+// If pint clock is ahead of the Prometheus server by more than maxSkew
+// then the time range of each range query will be moved back, so it ends
+// at the current server time, instead of querying server's future.
+// If pint clock is behind the server by more than maxSkew then ranges
+// ending at the current local time or later are moved forward, so they
+// also end at the current server time and include the most recent data.
+// Skew of up to one second is always ignored, since that's the precision
+// of the Date header used to get the server time.
+// Default is 0, which disables clock skew detection.
+func WithServerTimeClamp(maxSkew time.Duration) PrometheusOption {
+	return func(prom *Prometheus) {
+		prom.maxSkew = maxSkew
+	}
+}
+
+type ServerTimeResult struct {
+	URI  string
+	Time time.Time
+	// Skew is the difference between local and server clocks.
+	// Positive value means that local clock is ahead of the server.
+	Skew time.Duration
+}
+
+type serverTimeQuery struct {
+	prom      *Prometheus
+	ctx       context.Context
+	timestamp time.Time
+}
+
+func (q serverTimeQuery) Run() queryResult {
+	log.Debug().
+		Str("uri", q.prom.uri).
+		Msg("Getting prometheus server time")
+
+	ctx, cancel := context.WithTimeout(q.ctx, q.prom.timeout)
+	defer cancel()
+
+	qr := queryResult{expires: q.timestamp.Add(cacheExpiry * 2)}
+
+	args := url.Values{}
+	args.Set("query", "time()")
+	qr.request = q.prom.describeRequest(http.MethodGet, q.Endpoint(), args)
+	start := q.prom.clock()
+	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args, nil)
+	if err != nil {
+		qr.err = fmt.Errorf("failed to query Prometheus server time: %w", err)
+		return qr
+	}
+	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
+	defer dummyReadAll(resp.Body)
+	end := q.prom.clock()
+
+	date := resp.Header.Get("Date")
+	if date == "" {
+		qr.err = errors.New("missing Date header in Prometheus response")
+		return qr
+	}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		qr.err = fmt.Errorf("failed to parse Date header in Prometheus response: %w", err)
+		return qr
+	}
+	// Date header has a second precision, actual server time is somewhere
+	// within that second.
+	serverTime = serverTime.Add(time.Millisecond * 500)
+	localTime := start.Add(end.Sub(start) / 2)
+
+	qr.value = localTime.Sub(serverTime).Round(time.Second)
+	return qr
+}
+
+func (q serverTimeQuery) Endpoint() string {
+	return "/api/v1/query"
+}
+
+func (q serverTimeQuery) String() string {
+	return "time()"
+}
+
+func (q serverTimeQuery) CacheKey() string {
+	h := q.prom.newCacheKeyHash()
+	_, _ = io.WriteString(h, "servertime")
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.timestamp.Round(cacheExpiry).Format(time.RFC3339))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// ServerTime returns current time on the Prometheus server, using the Date
+// header of a query response.
+func (p *Prometheus) ServerTime(ctx context.Context) (*ServerTimeResult, error) {
+	log.Debug().Str("uri", p.uri).Msg("Scheduling Prometheus server time query")
+
+	key := "/api/v1/query/servertime"
+	p.locker.lock(key)
+	defer p.locker.unlock(key)
+
+	resultChan := make(chan queryResult)
+	p.enqueue(ctx, queryRequest{
+		query:  serverTimeQuery{prom: p, ctx: ctx, timestamp: p.clock()},
+		result: resultChan,
+	})
+
+	result := <-resultChan
+	if result.err != nil {
+		return nil, QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
+	}
+
+	skew := result.value.(time.Duration)
+	r := ServerTimeResult{URI: p.uri, Time: p.clock().Add(-skew), Skew: skew}
+
+	return &r, nil
+}
+
+// clampRange moves given time range so it ends at the current time of
+// the Prometheus server, if it's outside of it because of clock skew.
+// It returns a warning if range was modified.
+func (p *Prometheus) clampRange(ctx context.Context, params RangeQueryTimes) (RangeQueryTimes, string) {
+	if p.maxSkew <= 0 {
+		return params, ""
+	}
+
+	st, err := p.ServerTime(ctx)
+	if err != nil {
+		log.Debug().Err(err).Str("uri", p.uri).Msg("Failed to get server time, skipping clock skew detection")
+		return params, ""
+	}
+	skew := st.Skew.Abs()
+	if skew <= p.maxSkew || skew <= serverTimePrecision {
+		return params, ""
+	}
+
+	end := params.End()
+	if st.Skew > 0 {
+		if !end.After(st.Time) {
+			return params, ""
+		}
+		diff := end.Sub(st.Time)
+
+		msg := fmt.Sprintf("local clock is %s ahead of %s, query range was moved back by %s",
+			output.HumanizeDuration(skew), p.uri, output.HumanizeDuration(diff))
+		log.Warn().
+			Str("uri", p.uri).
+			Str("skew", output.HumanizeDuration(skew)).
+			Msg("Clock skew detected, local clock is ahead of Prometheus server")
+
+		return NewAbsoluteRange(params.Start().Add(-diff), st.Time, params.Step()), msg
+	}
+
+	// Only ranges ending now are moved forward, older ranges were
+	// requested for a specific time and are left as they are.
+	if end.Before(p.clock()) || !end.Before(st.Time) {
+		return params, ""
+	}
+	diff := st.Time.Sub(end)
+
+	msg := fmt.Sprintf("local clock is %s behind %s, query range was moved forward by %s",
+		output.HumanizeDuration(skew), p.uri, output.HumanizeDuration(diff))
+	log.Warn().
+		Str("uri", p.uri).
+		Str("skew", output.HumanizeDuration(skew)).
+		Msg("Clock skew detected, local clock is behind Prometheus server")
+
+	return NewAbsoluteRange(params.Start().Add(diff), st.Time, params.Step()), msg
+}
@@ -0,0 +1,143 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestServerTime(t *testing.T) {
+	serverTime := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	var lock sync.Mutex
+	var ends []float64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/query":
+			w.Header().Set("Date", serverTime.Format(http.TimeFormat))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1654077600,"1654077600"]}}`))
+		case "/api/v1/query_range":
+			err := r.ParseForm()
+			if err != nil {
+				t.Fatal(err)
+			}
+			end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+			lock.Lock()
+			ends = append(ends, end)
+			lock.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		default:
+			w.WriteHeader(400)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"unhandled path"}`))
+		}
+	}))
+	defer srv.Close()
+
+	type testCaseT struct {
+		name     string
+		skew     time.Duration
+		maxSkew  time.Duration
+		end      time.Time
+		warnings []string
+	}
+
+	testCases := []testCaseT{
+		{
+			name:    "no skew",
+			maxSkew: time.Minute,
+			end:     serverTime.Add(time.Millisecond * 500),
+		},
+		{
+			name:    "ahead, clamp disabled",
+			skew:    time.Hour,
+			maxSkew: 0,
+			end:     serverTime.Add(time.Hour).Add(time.Millisecond * 500),
+		},
+		{
+			name:    "ahead within tolerance",
+			skew:    time.Second * 30,
+			maxSkew: time.Minute,
+			end:     serverTime.Add(time.Second * 30).Add(time.Millisecond * 500),
+		},
+		{
+			name:    "ahead",
+			skew:    time.Hour,
+			maxSkew: time.Minute,
+			end:     serverTime.Add(time.Millisecond * 500),
+			warnings: []string{
+				"local clock is 1h ahead of " + srv.URL + ", query range was moved back by 1h",
+			},
+		},
+		{
+			name:    "ahead within Date precision",
+			skew:    time.Second,
+			maxSkew: time.Millisecond,
+			end:     serverTime.Add(time.Second).Add(time.Millisecond * 500),
+		},
+		{
+			name:    "behind",
+			skew:    time.Hour * -1,
+			maxSkew: time.Minute,
+			end:     serverTime.Add(time.Millisecond * 500),
+			warnings: []string{
+				"local clock is 1h behind " + srv.URL + ", query range was moved forward by 1h",
+			},
+		},
+		{
+			name:    "behind within tolerance",
+			skew:    time.Second * -30,
+			maxSkew: time.Minute,
+			end:     serverTime.Add(time.Second * -30).Add(time.Millisecond * 500),
+		},
+		{
+			name:    "behind within Date precision",
+			skew:    time.Second * -1,
+			maxSkew: time.Millisecond,
+			end:     serverTime.Add(time.Second * -1).Add(time.Millisecond * 500),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := serverTime.Add(tc.skew).Add(time.Millisecond * 500)
+			clock := func() time.Time { return now }
+
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100,
+				promapi.WithClock(clock), promapi.WithServerTimeClamp(tc.maxSkew))
+			prom.StartWorkers()
+			defer prom.Close()
+
+			st, err := prom.ServerTime(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, tc.skew, st.Skew)
+			require.Equal(t, serverTime.Add(time.Millisecond*500), st.Time)
+
+			lock.Lock()
+			ends = nil
+			lock.Unlock()
+
+			qr, err := prom.RangeQuery(context.Background(), "up", promapi.NewAbsoluteRange(now.Add(time.Hour*-1), now, time.Minute), promapi.RangeQueryOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tc.end, qr.End)
+			require.Equal(t, tc.warnings, qr.Warnings)
+
+			lock.Lock()
+			defer lock.Unlock()
+			require.NotEmpty(t, ends)
+			require.Equal(t, float64(tc.end.UnixMilli())/1000, ends[len(ends)-1])
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package promapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/exp/slices"
+)
+
+// RangeQuerySharded runs a range query split into up to maxShards queries,
+// each one only selecting series with some of the values of given label.
+// Label values are discovered by first asking Prometheus for all values of
+// that label on series matching any selector in the query, they are then
+// spread across shards which are all run in parallel and their results
+// merged together, with no more shards running at the same time than there
+// are query workers. Series without that label are included in one of the
+// shards. If no values are found a single query is sent.
+// This can be used for queries that would return too many series to be run
+// in a single request, but it only makes sense for queries that preserve the
+// label, since aggregations across label values would be calculated per
+// shard instead of across all series. Queries that don't preserve the label
+// are sent as a single query.
+// Series are returned in shard order, series merge order is preserved within
+// each shard. Requests, Stats and Transfers are also in shard order.
+func (p *Prometheus) RangeQuerySharded(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions, label string, maxShards int) (*RangeQueryResult, error) {
+	if maxShards <= 0 {
+		return nil, fmt.Errorf("invalid number of shards %d, it must be greater than zero", maxShards)
+	}
+
+	node, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query %q: %w", expr, err)
+	}
+
+	plan := p.newRangePlan(ctx, params, opts)
+	if !preservesLabel(node, label) {
+		log.Debug().
+			Str("uri", p.uri).
+			Str("query", expr).
+			Str("label", label).
+			Msg("Query doesn't preserve the shard label, running it without sharding")
+		return p.rangeQuery(ctx, expr, plan)
+	}
+
+	selectors, err := querySelectors(expr)
+	if err != nil {
+		return nil, err
+	}
+	lv, err := p.LabelValues(ctx, label, selectors, plan.start, plan.end)
+	if err != nil {
+		return nil, err
+	}
+	if len(lv.Values) == 0 {
+		return p.rangeQuery(ctx, expr, plan)
+	}
+
+	shards, err := shardQuery(expr, label, append([]string{""}, lv.Values...), maxShards)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().
+		Str("uri", p.uri).
+		Str("query", expr).
+		Str("label", label).
+		Int("values", len(lv.Values)).
+		Int("shards", len(shards)).
+		Msg("Running sharded range query")
+
+	var wg sync.WaitGroup
+	workers := p.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	results := make([]*RangeQueryResult, len(shards))
+	errs := make([]error, len(shards))
+	for i, shard := range shards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, shard string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = p.rangeQuery(ctx, shard, plan)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mergeShards(results), nil
+}
+
+// preservesLabel returns true if every series returned by the query keeps
+// given label from the series it was calculated from, so running the query
+// separately for different label values gives the same results.
+func preservesLabel(node parser.Node, label string) (ok bool) {
+	ok = true
+	parser.Inspect(node, func(n parser.Node, _ []parser.Node) error {
+		switch n := n.(type) {
+		case *parser.AggregateExpr:
+			if n.Without == slices.Contains(n.Grouping, label) {
+				ok = false
+			}
+			if n.Op == parser.COUNT_VALUES {
+				if s, isString := n.Param.(*parser.StringLiteral); !isString || s.Val == label {
+					ok = false
+				}
+			}
+		case *parser.BinaryExpr:
+			if vm := n.VectorMatching; vm != nil &&
+				n.LHS.Type() == parser.ValueTypeVector && n.RHS.Type() == parser.ValueTypeVector &&
+				vm.On != slices.Contains(vm.MatchingLabels, label) {
+				ok = false
+			}
+		case *parser.Call:
+			switch n.Func.Name {
+			case "absent", "absent_over_time", "scalar", "vector", "time":
+				ok = false
+			case "label_replace", "label_join":
+				if s, isString := n.Args[1].(*parser.StringLiteral); !isString || s.Val == label {
+					ok = false
+				}
+			}
+		}
+		if !ok {
+			return errors.New("label is not preserved")
+		}
+		return nil
+	})
+	return ok
+}
+
+// querySelectors returns all vector selectors used in the query.
+func querySelectors(expr string) ([]string, error) {
+	node, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query %q: %w", expr, err)
+	}
+
+	var selectors []string
+	parser.Inspect(node, func(n parser.Node, _ []parser.Node) error {
+		if vs, ok := n.(*parser.VectorSelector); ok {
+			s := (&parser.VectorSelector{Name: vs.Name, LabelMatchers: vs.LabelMatchers}).String()
+			for _, o := range selectors {
+				if o == s {
+					return nil
+				}
+			}
+			selectors = append(selectors, s)
+		}
+		return nil
+	})
+	sort.Strings(selectors)
+	return selectors, nil
+}
+
+// shardQuery returns a copy of the query for every shard, with a regexp
+// matcher for all label values of that shard added to every selector.
+// Values are spread evenly across up to maxShards shards.
+func shardQuery(expr, label string, values []string, maxShards int) ([]string, error) {
+	n := len(values)
+	if n > maxShards {
+		n = maxShards
+	}
+	groups := make([][]string, n)
+	for i, v := range values {
+		groups[i%n] = append(groups[i%n], regexp.QuoteMeta(v))
+	}
+
+	shards := make([]string, 0, n)
+	for _, group := range groups {
+		node, err := parser.ParseExpr(expr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse query %q: %w", expr, err)
+		}
+		m, err := labels.NewMatcher(labels.MatchRegexp, label, strings.Join(group, "|"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to shard query %q: %w", expr, err)
+		}
+		parser.Inspect(node, func(n parser.Node, _ []parser.Node) error {
+			if vs, ok := n.(*parser.VectorSelector); ok {
+				vs.LabelMatchers = append(vs.LabelMatchers, m)
+			}
+			return nil
+		})
+		shards = append(shards, node.String())
+	}
+	return shards, nil
+}
+
+// mergeShards merges results of all shards into a single result.
+func mergeShards(results []*RangeQueryResult) *RangeQueryResult {
+	merged := RangeQueryResult{
+		URI:   results[0].URI,
+		Start: results[0].Start,
+		End:   results[0].End,
+	}
+	for _, r := range results {
+		merged.Samples = append(merged.Samples, r.Samples...)
+		merged.Coverage = append(merged.Coverage, r.Coverage...)
+		merged.Requests = append(merged.Requests, r.Requests...)
+		merged.Warnings = append(merged.Warnings, r.Warnings...)
+		merged.Stats = append(merged.Stats, r.Stats...)
+		merged.Transfers = append(merged.Transfers, r.Transfers...)
+		merged.MatchedSeries += r.MatchedSeries
+		merged.RetainedSeries += r.RetainedSeries
+		merged.DroppedSeries += r.DroppedSeries
+		merged.EmptySeries += r.EmptySeries
+		merged.StaleMarkers += r.StaleMarkers
+		for name, n := range r.DroppedLabelValues {
+			if merged.DroppedLabelValues == nil {
+				merged.DroppedLabelValues = map[string]int{}
+			}
+			merged.DroppedLabelValues[name] += n
+		}
+		if merged.Status == "" || (merged.Status == "success" && r.Status != "") {
+			merged.Status = r.Status
+		}
+	}
+	return &merged
+}
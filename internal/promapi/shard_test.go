@@ -0,0 +1,201 @@
+package promapi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestRangeQuerySharded(t *testing.T) {
+	shardRe := regexp.MustCompile(`job=~"([^"]*)"`)
+
+	var mtx sync.Mutex
+	var queries []string
+	var labelValues []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/label/job/values":
+			require.Equal(t, []string{"up"}, r.Form["match[]"])
+			mtx.Lock()
+			data := `["` + strings.Join(labelValues, `","`) + `"]`
+			if len(labelValues) == 0 {
+				data = "[]"
+			}
+			mtx.Unlock()
+			_, _ = w.Write([]byte(`{"status":"success","data":` + data + `}`))
+		case "/api/v1/query_range":
+			query := r.Form.Get("query")
+			mtx.Lock()
+			queries = append(queries, query)
+			mtx.Unlock()
+
+			// Return one series for every job value selected by the shard.
+			var series []string
+			jobs := []string{"a", "b", "c", "d", "e"}
+			if m := shardRe.FindStringSubmatch(query); m != nil {
+				jobs = strings.Split(m[1], "|")
+			}
+			for _, job := range jobs {
+				if job != "" {
+					series = append(series, fmt.Sprintf(`{"metric":{"job":"%s"},"values":[[1655164800,"1"]]}`, job))
+				}
+			}
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` + strings.Join(series, ",") + `]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+
+	type testCaseT struct {
+		name      string
+		expr      string
+		values    []string
+		maxShards int
+		queries   []string
+		jobs      []string
+	}
+
+	testCases := []testCaseT{
+		{
+			name:      "no values",
+			maxShards: 10,
+			queries:   []string{"up"},
+			jobs:      []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:      "one shard per value",
+			values:    []string{"a", "b"},
+			maxShards: 10,
+			queries:   []string{`up{job=~""}`, `up{job=~"a"}`, `up{job=~"b"}`},
+			jobs:      []string{"a", "b"},
+		},
+		{
+			name:      "bounded",
+			values:    []string{"a", "b", "c", "d"},
+			maxShards: 2,
+			queries:   []string{`up{job=~"a|c"}`, `up{job=~"|b|d"}`},
+			jobs:      []string{"b", "d", "a", "c"},
+		},
+		{
+			name:      "escaped",
+			values:    []string{"a.b"},
+			maxShards: 2,
+			queries:   []string{`up{job=~""}`, `up{job=~"a\\.b"}`},
+			jobs:      []string{`a\.b`},
+		},
+		{
+			name:      "aggregation by label",
+			expr:      "sum by (job) (up)",
+			values:    []string{"a", "b"},
+			maxShards: 10,
+			queries:   []string{`sum by (job) (up{job=~""})`, `sum by (job) (up{job=~"a"})`, `sum by (job) (up{job=~"b"})`},
+			jobs:      []string{"a", "b"},
+		},
+		{
+			name:      "aggregation across label",
+			expr:      "sum(up)",
+			values:    []string{"a", "b"},
+			maxShards: 10,
+			queries:   []string{"sum(up)"},
+			jobs:      []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:      "aggregation without label",
+			expr:      "sum without (job) (up)",
+			values:    []string{"a", "b"},
+			maxShards: 10,
+			queries:   []string{"sum without (job) (up)"},
+			jobs:      []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:      "matching on other labels",
+			expr:      "up / on (instance) up",
+			values:    []string{"a", "b"},
+			maxShards: 10,
+			queries:   []string{"up / on (instance) up"},
+			jobs:      []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:      "label replaced",
+			expr:      `label_replace(up, "job", "x", "", "")`,
+			values:    []string{"a", "b"},
+			maxShards: 10,
+			queries:   []string{`label_replace(up, "job", "x", "", "")`},
+			jobs:      []string{"a", "b", "c", "d", "e"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mtx.Lock()
+			queries = nil
+			labelValues = tc.values
+			mtx.Unlock()
+
+			prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 4, 100, 100)
+			prom.StartWorkers()
+			defer prom.Close()
+
+			expr := tc.expr
+			if expr == "" {
+				expr = "up"
+			}
+			qr, err := prom.RangeQuerySharded(context.Background(), expr, params, promapi.RangeQueryOptions{}, "job", tc.maxShards)
+			require.NoError(t, err)
+
+			jobs := make([]string, 0, len(qr.Samples))
+			for _, s := range qr.Samples {
+				jobs = append(jobs, string(s.Metric["job"]))
+			}
+			require.Equal(t, tc.jobs, jobs)
+			require.Equal(t, len(tc.jobs), qr.MatchedSeries)
+			require.Len(t, qr.Coverage, len(tc.jobs))
+			require.Len(t, qr.Requests, len(tc.queries))
+			require.Equal(t, model.SampleValue(1), qr.Samples[0].Values[0].Value)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			sort.Strings(queries)
+			require.Equal(t, tc.queries, queries)
+		})
+	}
+}
+
+func TestRangeQueryShardedInvalidShards(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 4, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Unix(1655164800, 0)
+	params := promapi.NewAbsoluteRange(start, start.Add(time.Hour), time.Minute)
+	for _, maxShards := range []int{0, -1} {
+		_, err := prom.RangeQuerySharded(context.Background(), "up", params, promapi.RangeQueryOptions{}, "job", maxShards)
+		require.EqualError(t, err, fmt.Sprintf("invalid number of shards %d, it must be greater than zero", maxShards))
+	}
+}
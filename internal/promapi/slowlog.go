@@ -0,0 +1,91 @@
+package promapi
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SlowQuery describes a single query sent to Prometheus.
+type SlowQuery struct {
+	URI      string
+	Endpoint string
+	Expr     string
+	// Start and End are only set for range query slices.
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+}
+
+// windowedQuery is implemented by queries that cover a time range.
+type windowedQuery interface {
+	window() (start, end time.Time)
+}
+
+// slowLog keeps the slowest queries sent to Prometheus, slowest first.
+type slowLog struct {
+	mu      sync.Mutex
+	size    int
+	entries []SlowQuery
+}
+
+func newSlowLog(size int) *slowLog {
+	return &slowLog{size: size}
+}
+
+func (sl *slowLog) record(uri string, q querier, dur time.Duration) {
+	if sl == nil || sl.size <= 0 {
+		return
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if len(sl.entries) >= sl.size && dur <= sl.entries[len(sl.entries)-1].Duration {
+		return
+	}
+
+	sq := SlowQuery{URI: uri, Endpoint: q.Endpoint(), Expr: q.String(), Duration: dur}
+	if wq, ok := q.(windowedQuery); ok {
+		sq.Start, sq.End = wq.window()
+	}
+
+	i := sort.Search(len(sl.entries), func(i int) bool {
+		return sl.entries[i].Duration < dur
+	})
+	sl.entries = append(sl.entries, SlowQuery{})
+	copy(sl.entries[i+1:], sl.entries[i:])
+	sl.entries[i] = sq
+	if len(sl.entries) > sl.size {
+		sl.entries = sl.entries[:sl.size]
+	}
+}
+
+func (sl *slowLog) list() []SlowQuery {
+	if sl == nil {
+		return nil
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	entries := make([]SlowQuery, len(sl.entries))
+	copy(entries, sl.entries)
+	return entries
+}
+
+// slowestQueries merges slow queries from multiple servers, keeping at most
+// size entries.
+func slowestQueries(size int, lists ...[]SlowQuery) []SlowQuery {
+	var entries []SlowQuery
+	for _, l := range lists {
+		entries = append(entries, l...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Duration > entries[j].Duration
+	})
+	if len(entries) > size {
+		entries = entries[:size]
+	}
+	return entries
+}
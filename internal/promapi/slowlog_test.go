@@ -0,0 +1,93 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestSlowestQueries(t *testing.T) {
+	delays := map[string]time.Duration{
+		"fast":    0,
+		"slow":    time.Millisecond * 200,
+		"slower":  time.Millisecond * 300,
+		"slowest": time.Millisecond * 400,
+		"range":   time.Millisecond * 100,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		time.Sleep(delays[r.Form.Get("query")])
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		default:
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	t.Run("disabled", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		_, err := prom.Query(context.Background(), "fast")
+		require.NoError(t, err)
+		require.Empty(t, prom.SlowestQueries())
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100, promapi.WithSlowQueryLog(3))
+		prom.StartWorkers()
+		defer prom.Close()
+
+		for _, expr := range []string{"slow", "fast", "slowest", "slower", "fast"} {
+			_, err := prom.Query(context.Background(), expr)
+			require.NoError(t, err)
+		}
+		// Cached results shouldn't be recorded.
+		_, err := prom.Query(context.Background(), "slowest")
+		require.NoError(t, err)
+
+		slowest := prom.SlowestQueries()
+		require.Len(t, slowest, 3)
+		for i, expr := range []string{"slowest", "slower", "slow"} {
+			require.Equal(t, expr, slowest[i].Expr)
+			require.Equal(t, srv.URL, slowest[i].URI)
+			require.Equal(t, "/api/v1/query", slowest[i].Endpoint)
+			require.True(t, slowest[i].Start.IsZero())
+			require.GreaterOrEqual(t, slowest[i].Duration, delays[expr])
+		}
+
+		fg := promapi.NewFailoverGroup("test", []*promapi.Prometheus{prom}, true)
+		require.Equal(t, slowest[:2], fg.SlowestQueries(2))
+	})
+
+	t.Run("range", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100, promapi.WithSlowQueryLog(1))
+		prom.StartWorkers()
+		defer prom.Close()
+
+		start := time.Unix(1655164800, 0).UTC()
+		params := promapi.NewAbsoluteRange(start, start.Add(time.Minute*30), time.Minute)
+		_, err := prom.RangeQuery(context.Background(), "range", params, promapi.RangeQueryOptions{})
+		require.NoError(t, err)
+		_, err = prom.Query(context.Background(), "fast")
+		require.NoError(t, err)
+
+		slowest := prom.SlowestQueries()
+		require.Len(t, slowest, 1)
+		require.Equal(t, "range", slowest[0].Expr)
+		require.Equal(t, "/api/v1/query_range", slowest[0].Endpoint)
+		require.Equal(t, start, slowest[0].Start)
+		require.Equal(t, start.Add(time.Minute*30), slowest[0].End)
+	})
+}
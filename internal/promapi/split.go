@@ -0,0 +1,79 @@
+package promapi
+
+import (
+	"context"
+
+	"github.com/prometheus/common/model"
+)
+
+// SplitByWindow splits the result of a range query back into the slices
+// that would be used to run it, keyed by the cache key of each slice.
+// This allows to populate the cache of slice results using the result of
+// a single query covering the whole range, for example one sent directly
+// to Prometheus or loaded from a file, see SeedRangeCache.
+// Each slice gets all values with timestamps within its window, both ends
+// included, just like Prometheus response for that slice would. Series
+// without any values in a slice are omitted from it, but every slice is
+// returned even if it's empty.
+// The time range isn't adjusted for clock skew or data freshness, so no
+// requests are sent to Prometheus. Slices and their keys are the same as
+// DescribeCacheKey returns for the same arguments, unless it moved the range.
+func (p *Prometheus) SplitByWindow(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions, result *RangeQueryResult) (map[string]*RangeQueryResult, error) {
+	plan := newSizedRangePlan(p.resolveRange(params), opts, p.sliceSize(opts.Timeout))
+	expr, err := p.rangeExpr(expr, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	split := make(map[string]*RangeQueryResult, len(plan.slices))
+	for i, r := range splitByWindow(result, plan.slices) {
+		split[plan.query(p, ctx, expr, "", i).CacheKey()] = r
+	}
+	return split, nil
+}
+
+// SeedRangeCache stores the result of a range query in the cache, split
+// into slices using SplitByWindow, so range queries with the same arguments
+// are answered from the cache without sending any requests to Prometheus.
+func (p *Prometheus) SeedRangeCache(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions, result *RangeQueryResult) error {
+	split, err := p.SplitByWindow(ctx, expr, params, opts, result)
+	if err != nil {
+		return err
+	}
+
+	now := p.clock()
+	for key, r := range split {
+		samples := make([]model.SampleStream, 0, len(r.Samples))
+		for _, s := range r.Samples {
+			samples = append(samples, *s)
+		}
+		p.cache.add(key, rangeQuery{}.Endpoint(), queryResult{value: samples, status: r.Status}, now)
+	}
+	prometheusCacheSize.WithLabelValues(p.name).Set(float64(p.cache.len()))
+	return nil
+}
+
+// splitByWindow returns a result for every slice, in the same order.
+func splitByWindow(result *RangeQueryResult, slices []timeRange) []*RangeQueryResult {
+	split := make([]*RangeQueryResult, 0, len(slices))
+	for _, s := range slices {
+		r := RangeQueryResult{URI: result.URI, Start: s.start, End: s.end, Status: result.Status}
+		start := model.TimeFromUnixNano(s.start.UnixNano())
+		end := model.TimeFromUnixNano(s.end.UnixNano())
+		for _, series := range result.Samples {
+			var values []model.SamplePair
+			for _, v := range series.Values {
+				if v.Timestamp.Before(start) || v.Timestamp.After(end) {
+					continue
+				}
+				values = append(values, v)
+			}
+			if len(values) == 0 {
+				continue
+			}
+			r.Samples = append(r.Samples, &model.SampleStream{Metric: series.Metric, Values: values})
+		}
+		split = append(split, &r)
+	}
+	return split
+}
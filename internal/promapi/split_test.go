@@ -0,0 +1,121 @@
+package promapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitByWindow(t *testing.T) {
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	mid := start.Add(time.Hour * 3)
+
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		from, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		to, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+
+		var one, two []string
+		for ts := from; ts <= to; ts += step {
+			one = append(one, fmt.Sprintf(`[%d,"%d"]`, int64(ts), int64(ts)))
+			if ts < float64(mid.Unix()) {
+				two = append(two, fmt.Sprintf(`[%d,"1"]`, int64(ts)))
+			}
+		}
+		series := []string{fmt.Sprintf(`{"metric":{"instance":"1"},"values":[%s]}`, strings.Join(one, ","))}
+		if len(two) > 0 {
+			series = append(series, fmt.Sprintf(`{"metric":{"instance":"2"},"values":[%s]}`, strings.Join(two, ",")))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, strings.Join(series, ","))))
+	}))
+	defer srv.Close()
+
+	params := NewAbsoluteRange(start, start.Add(time.Hour*8), time.Minute)
+
+	// Get the whole range using as few slices as possible.
+	bulk := NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+	bulk.StartWorkers()
+	defer bulk.Close()
+	whole, err := bulk.RangeQuery(context.Background(), "up", params, RangeQueryOptions{MaxSlices: 1})
+	require.NoError(t, err)
+	require.Len(t, whole.Samples, 2)
+
+	prom := NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	keys, err := prom.DescribeCacheKey(context.Background(), "up", params, RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Greater(t, len(keys), len(whole.Requests))
+
+	split, err := prom.SplitByWindow(context.Background(), "up", params, RangeQueryOptions{}, whole)
+	require.NoError(t, err)
+	require.Len(t, split, len(keys))
+	for i, key := range keys {
+		r, ok := split[key.Key]
+		require.True(t, ok, "missing slice %d", i)
+		require.False(t, r.Start.Before(params.Start()))
+		require.False(t, r.End.After(params.End()))
+
+		for _, s := range r.Samples {
+			for _, v := range s.Values {
+				require.False(t, v.Timestamp.Time().Before(r.Start))
+				require.False(t, v.Timestamp.Time().After(r.End))
+			}
+		}
+	}
+	require.Len(t, split[keys[len(keys)-1].Key].Samples, 1, "last slice shouldn't have the second series")
+
+	requests.Store(0)
+	require.NoError(t, prom.SeedRangeCache(context.Background(), "up", params, RangeQueryOptions{}, whole))
+	require.Equal(t, int64(0), requests.Load(), "seeding the cache shouldn't send any requests")
+	require.Len(t, prom.CacheEntries(), len(keys))
+
+	sliced, err := prom.RangeQuery(context.Background(), "up", params, RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, sliced.Requests, len(keys))
+	require.Equal(t, int64(0), requests.Load(), "all slices should be served from the cache")
+	require.Equal(t, whole.Samples, sliced.Samples)
+}
+
+func TestSplitByWindowNoProbes(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	prom := NewPrometheus("test", srv.URL, time.Second*5, 1, 100, 100,
+		WithServerTimeClamp(time.Second), WithFreshnessCheck(time.Minute))
+	prom.StartWorkers()
+	defer prom.Close()
+
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	params := NewAbsoluteRange(start, start.Add(time.Hour*4), time.Minute)
+	result := RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{Metric: model.Metric{"instance": "1"}, Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(start.Unix()), Value: 1}}},
+		},
+	}
+	split, err := prom.SplitByWindow(context.Background(), "up", params, RangeQueryOptions{}, &result)
+	require.NoError(t, err)
+	require.NotEmpty(t, split)
+	require.Equal(t, int64(0), requests.Load(), "splitting a result shouldn't send any requests")
+}
@@ -0,0 +1,57 @@
+package promapi
+
+import "time"
+
+// QueryStats holds query statistics returned by the server when they were
+// requested via RangeQueryOptions.
+// Decoding is best effort, any field not returned by the server is left empty.
+type QueryStats struct {
+	Timings  QueryTimings   `json:"timings"`
+	Samples  QuerySamples   `json:"samples"`
+	Analysis *QueryAnalysis `json:"-"`
+}
+
+// QueryTimings holds query timings, all values are in seconds.
+type QueryTimings struct {
+	EvalTotalTime        float64 `json:"evalTotalTime"`
+	ResultSortTime       float64 `json:"resultSortTime"`
+	QueryPreparationTime float64 `json:"queryPreparationTime"`
+	InnerEvalTime        float64 `json:"innerEvalTime"`
+	ExecQueueTime        float64 `json:"execQueueTime"`
+	ExecTotalTime        float64 `json:"execTotalTime"`
+}
+
+type QuerySamples struct {
+	TotalQueryableSamples int `json:"totalQueryableSamples"`
+	PeakSamples           int `json:"peakSamples"`
+}
+
+// QueryAnalysis is the query plan returned by servers supporting query
+// analysis, like Thanos.
+type QueryAnalysis struct {
+	Name          string          `json:"name"`
+	ExecutionTime string          `json:"executionTime"`
+	Children      []QueryAnalysis `json:"children"`
+}
+
+// TransferStats describes how long it took to fetch and decode a single
+// response, it's measured by pint and doesn't need any server support.
+type TransferStats struct {
+	// BytesRead is the size of the response body after decompression.
+	BytesRead int64
+	// NetworkDuration is the time spent waiting for response headers and
+	// for the body to be read from the network.
+	NetworkDuration time.Duration
+	// DecodeDuration is the time spent decoding the body, without the time
+	// spent reading it.
+	DecodeDuration time.Duration
+	// Cached is true if the response was served from the query cache,
+	// all other fields are empty in that case.
+	Cached bool
+}
+
+func (ts *TransferStats) add(other TransferStats) {
+	ts.BytesRead += other.BytesRead
+	ts.NetworkDuration += other.NetworkDuration
+	ts.DecodeDuration += other.DecodeDuration
+}
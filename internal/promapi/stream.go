@@ -0,0 +1,89 @@
+package promapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prymitive/current"
+)
+
+// jsonValue decodes the entire JSON value using the standard decoder,
+// it can be used together with current.Key for values that don't need
+// to be streamed.
+type jsonValue[T any] struct {
+	dst *T
+}
+
+func (v jsonValue[T]) String() string {
+	return fmt.Sprintf("JSON[%T]", *v.dst)
+}
+
+func (v *jsonValue[T]) Stream(dec *json.Decoder) error {
+	return dec.Decode(v.dst)
+}
+
+// jsonObject works like current.Object but it skips values of all keys it
+// doesn't know about, instead of trying to decode them as object keys,
+// which would break decoding of nested objects under unknown keys.
+func jsonObject(keys ...current.NamedStreamer) *object {
+	return &object{keys: keys}
+}
+
+type object struct {
+	keys []current.NamedStreamer
+}
+
+func (o object) String() string {
+	names := make([]string, 0, len(o.keys))
+	for _, key := range o.keys {
+		names = append(names, key.Name())
+	}
+	return fmt.Sprintf("Object{%s}", strings.Join(names, ","))
+}
+
+func (o *object) Stream(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("invalid token at offset %d decoded by %s, expected { got %v", dec.InputOffset(), o, tok)
+	}
+	for dec.More() {
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+		if err = o.streamKey(dec, tok); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func (o *object) streamKey(dec *json.Decoder, name json.Token) error {
+	for _, key := range o.keys {
+		if key.Name() == name {
+			return key.Stream(dec)
+		}
+	}
+	var skip json.RawMessage
+	return dec.Decode(&skip)
+}
+
+// presence wraps another streamer and records if its key was present
+// in the decoded JSON object.
+type presence struct {
+	str   current.Streamer
+	found *bool
+}
+
+func (p presence) String() string {
+	return fmt.Sprint(p.str)
+}
+
+func (p *presence) Stream(dec *json.Decoder) error {
+	*p.found = true
+	return p.str.Stream(dec)
+}
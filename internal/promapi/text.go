@@ -0,0 +1,50 @@
+package promapi
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WriteText writes all series in a human readable format, one line with
+// series labels followed by one line per value:
+//
+//	up{instance="1"}
+//	  2022-06-14T00:00:00Z 1
+//
+// Output is written as each value is formatted, without building it all
+// in memory first, so it's safe to use with large results.
+func (rqr *RangeQueryResult) WriteText(w io.Writer) error {
+	return rqr.WriteTextInLocation(w, time.UTC)
+}
+
+// WriteTextInLocation works like WriteText but renders timestamps in given
+// location, which is useful for displaying results to users.
+// Values stored in the result are not modified. Nil location means UTC.
+func (rqr *RangeQueryResult) WriteTextInLocation(w io.Writer, loc *time.Location) error {
+	if loc == nil {
+		loc = time.UTC
+	}
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 0, 64)
+	for _, s := range rqr.Samples {
+		if _, err := bw.WriteString(s.Metric.String()); err != nil {
+			return err
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+		for _, v := range s.Values {
+			buf = append(buf[:0], "  "...)
+			buf = v.Timestamp.Time().In(loc).AppendFormat(buf, time.RFC3339Nano)
+			buf = append(buf, ' ')
+			buf = strconv.AppendFloat(buf, float64(v.Value), 'f', -1, 64)
+			buf = append(buf, '\n')
+			if _, err := bw.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
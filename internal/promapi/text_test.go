@@ -0,0 +1,104 @@
+package promapi_test
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gkampitakis/go-snaps/snaps"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestMain(t *testing.M) {
+	v := t.Run()
+	snaps.Clean(t)
+	os.Exit(v)
+}
+
+func TestRangeQueryResultWriteText(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+	ts := func(d time.Duration) model.Time {
+		return model.TimeFromUnixNano(start.Add(d).UnixNano())
+	}
+
+	rqr := promapi.RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{
+				Metric: model.Metric{"__name__": "up", "job": "foo", "instance": "1"},
+				Values: []model.SamplePair{
+					{Timestamp: ts(0), Value: 1},
+					{Timestamp: ts(time.Minute), Value: 0},
+					{Timestamp: ts(time.Minute*2 + time.Millisecond*500), Value: 1},
+				},
+			},
+			{
+				Metric: model.Metric{"job": "bar"},
+				Values: []model.SamplePair{
+					{Timestamp: ts(0), Value: 0.125},
+					{Timestamp: ts(time.Minute), Value: model.SampleValue(math.NaN())},
+					{Timestamp: ts(time.Minute * 2), Value: model.SampleValue(math.Inf(-1))},
+					{Timestamp: ts(time.Minute * 3), Value: 1e21},
+				},
+			},
+			{
+				Metric: model.Metric{"__name__": "empty"},
+			},
+		},
+	}
+
+	var buf strings.Builder
+	require.NoError(t, rqr.WriteText(&buf))
+	snaps.MatchSnapshot(t, buf.String())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestRangeQueryResultWriteTextError(t *testing.T) {
+	rqr := promapi.RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{Metric: model.Metric{"__name__": "up"}, Values: []model.SamplePair{{Timestamp: 0, Value: 1}}},
+		},
+	}
+	require.EqualError(t, rqr.WriteText(failingWriter{}), "write failed")
+}
+
+func TestRangeQueryResultWriteTextInLocation(t *testing.T) {
+	start := time.Unix(1655164800, 0)
+	values := []model.SamplePair{
+		{Timestamp: model.TimeFromUnixNano(start.UnixNano()), Value: 1},
+		{Timestamp: model.TimeFromUnixNano(start.Add(time.Hour*20 + time.Millisecond*250).UnixNano()), Value: 2},
+	}
+	rqr := promapi.RangeQueryResult{
+		Samples: []*model.SampleStream{
+			{Metric: model.Metric{"__name__": "up"}, Values: append([]model.SamplePair(nil), values...)},
+		},
+	}
+
+	var utc, local, def, nilLoc strings.Builder
+	require.NoError(t, rqr.WriteTextInLocation(&utc, time.UTC))
+	require.NoError(t, rqr.WriteTextInLocation(&local, time.FixedZone("IST", 5*3600+1800)))
+	require.NoError(t, rqr.WriteText(&def))
+	require.NoError(t, rqr.WriteTextInLocation(&nilLoc, nil))
+
+	require.Equal(t, `up
+  2022-06-14T00:00:00Z 1
+  2022-06-14T20:00:00.25Z 2
+`, utc.String())
+	require.Equal(t, `up
+  2022-06-14T05:30:00+05:30 1
+  2022-06-15T01:30:00.25+05:30 2
+`, local.String())
+	require.Equal(t, utc.String(), def.String(), "WriteText should use UTC")
+	require.Equal(t, utc.String(), nilLoc.String(), "nil location should use UTC")
+	require.Equal(t, values, rqr.Samples[0].Values, "stored timestamps shouldn't be modified")
+}
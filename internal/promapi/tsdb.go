@@ -0,0 +1,200 @@
+package promapi
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/tsdb"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// TSDB runs queries against a local Prometheus data directory, like
+// a snapshot, instead of a running server. Data is opened read-only.
+type TSDB struct {
+	dir    string
+	db     *tsdb.DBReadOnly
+	engine *promql.Engine
+	// maxt is the timestamp of the newest sample in all blocks, it's zero
+	// if there are no blocks.
+	maxt time.Time
+}
+
+// OpenTSDB opens the Prometheus data directory for querying.
+func OpenTSDB(dir string) (*TSDB, error) {
+	db, err := tsdb.OpenDBReadOnly(dir, log.NewNopLogger())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TSDB at %s: %w", dir, err)
+	}
+
+	// Blocks are loaded from disk on every call, so it's only done once.
+	blocks, err := db.Blocks()
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to load TSDB blocks from %s: %w", dir, err)
+	}
+	var maxt time.Time
+	if m := blocksMaxTime(blocks); m != math.MinInt64 {
+		// Block MaxTime is exclusive.
+		maxt = time.UnixMilli(m - 1)
+	}
+
+	engine := promql.NewEngine(promql.EngineOpts{
+		MaxSamples: 50000000,
+		Timeout:    time.Minute * 2,
+		NoStepSubqueryIntervalFn: func(int64) int64 {
+			return time.Minute.Milliseconds()
+		},
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+
+	return &TSDB{dir: dir, db: db, engine: engine, maxt: maxt}, nil
+}
+
+func (t *TSDB) Close() error {
+	return t.db.Close()
+}
+
+// blocksMaxTime returns the highest MaxTime of all blocks, or math.MinInt64
+// if there are no blocks.
+func blocksMaxTime(blocks []tsdb.BlockReader) int64 {
+	maxt := int64(math.MinInt64)
+	for _, b := range blocks {
+		if m := b.Meta().MaxTime; m > maxt {
+			maxt = m
+		}
+	}
+	return maxt
+}
+
+// maxTime returns the timestamp of the newest block.
+func (t *TSDB) maxTime() (time.Time, error) {
+	if t.maxt.IsZero() {
+		return time.Time{}, fmt.Errorf("no blocks found in %s", t.dir)
+	}
+	return t.maxt, nil
+}
+
+func (t *TSDB) queryError(err error) error {
+	return QueryError{err: err, msg: decodeError(err)}
+}
+
+// Query runs an instant query at the time of the newest sample stored
+// in the TSDB, rather than the current time, since snapshots
+// are usually older than that.
+func (t *TSDB) Query(ctx context.Context, expr string) (*QueryResult, error) {
+	ts, err := t.maxTime()
+	if err != nil {
+		return nil, t.queryError(err)
+	}
+
+	zlog.Debug().Str("dir", t.dir).Str("query", expr).Msg("Running TSDB query")
+
+	q, err := t.engine.NewInstantQuery(t.db, nil, expr, ts)
+	if err != nil {
+		return nil, t.queryError(err)
+	}
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	if res.Err != nil {
+		return nil, t.queryError(res.Err)
+	}
+
+	qr := QueryResult{URI: t.dir, Series: []model.Sample{}}
+	switch v := res.Value.(type) {
+	case promql.Vector:
+		for _, s := range v {
+			qr.Series = append(qr.Series, model.Sample{
+				Metric:    labelsToMetric(s.Metric),
+				Value:     model.SampleValue(s.V),
+				Timestamp: model.Time(s.T),
+			})
+		}
+	case promql.Scalar:
+		qr.Series = append(qr.Series, model.Sample{
+			Metric:    model.Metric{},
+			Value:     model.SampleValue(v.V),
+			Timestamp: model.Time(v.T),
+		})
+	default:
+		return nil, t.queryError(fmt.Errorf("invalid result type, expected vector, got %s", res.Value.Type()))
+	}
+	return &qr, nil
+}
+
+// RangeQuery runs a range query using given time range as is.
+// Relative ranges end at the current time, so they're likely to return
+// no data for older snapshots.
+func (t *TSDB) RangeQuery(ctx context.Context, expr string, params RangeQueryTimes, opts RangeQueryOptions) (*RangeQueryResult, error) {
+	start := params.Start().UTC()
+	end := params.End().UTC()
+
+	zlog.Debug().
+		Str("dir", t.dir).
+		Str("query", expr).
+		Str("range", params.String()).
+		Msg("Running TSDB range query")
+
+	q, err := t.engine.NewRangeQuery(t.db, nil, expr, start, end, params.Step())
+	if err != nil {
+		return nil, t.queryError(err)
+	}
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	if res.Err != nil {
+		return nil, t.queryError(res.Err)
+	}
+
+	matrix, ok := res.Value.(promql.Matrix)
+	if !ok {
+		return nil, t.queryError(fmt.Errorf("invalid result type, expected matrix, got %s", res.Value.Type()))
+	}
+
+	samples := make([]model.SampleStream, 0, len(matrix))
+	for _, s := range matrix {
+		sample := model.SampleStream{
+			Metric: labelsToMetric(s.Metric),
+			Values: make([]model.SamplePair, 0, len(s.Points)),
+		}
+		for _, p := range s.Points {
+			sample.Values = append(sample.Values, model.SamplePair{
+				Timestamp: model.Time(p.T),
+				Value:     model.SampleValue(p.V),
+			})
+		}
+		samples = append(samples, sample)
+	}
+
+	rqr := RangeQueryResult{
+		URI:    t.dir,
+		Start:  start,
+		End:    end,
+		Status: "success",
+	}
+	merger := newRangeMerger(&rqr, opts, params.Step())
+	defer merger.close()
+	merger.add(samples)
+	if merger.err != nil {
+		return nil, t.queryError(merger.err)
+	}
+	if err = merger.finish(); err != nil {
+		return nil, t.queryError(err)
+	}
+	return &rqr, nil
+}
+
+func labelsToMetric(ls labels.Labels) model.Metric {
+	m := make(model.Metric, len(ls))
+	for _, l := range ls {
+		m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return m
+}
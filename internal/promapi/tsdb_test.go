@@ -0,0 +1,102 @@
+package promapi_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+type tsdbSample struct {
+	t int64
+	v float64
+}
+
+func (s tsdbSample) T() int64   { return s.t }
+func (s tsdbSample) V() float64 { return s.v }
+
+func TestTSDB(t *testing.T) {
+	start := time.Unix(1655164800, 0).UTC()
+
+	newSeries := func(lset labels.Labels, value float64) storage.Series {
+		var samples []tsdbutil.Sample
+		for i := 0; i <= 60; i++ {
+			samples = append(samples, tsdbSample{t: start.Add(time.Minute * time.Duration(i)).UnixMilli(), v: value})
+		}
+		return storage.NewListSeries(lset, samples)
+	}
+
+	dir := t.TempDir()
+	_, err := tsdb.CreateBlock([]storage.Series{
+		newSeries(labels.FromStrings("__name__", "up", "job", "foo", "instance", "1"), 1),
+		newSeries(labels.FromStrings("__name__", "up", "job", "foo", "instance", "2"), 0),
+		newSeries(labels.FromStrings("__name__", "up", "job", "bar", "instance", "1"), 1),
+	}, dir, 0, log.NewNopLogger())
+	require.NoError(t, err)
+
+	db, err := promapi.OpenTSDB(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	qr, err := db.Query(context.Background(), `up{job="foo"}`)
+	require.NoError(t, err)
+	require.Equal(t, dir, qr.URI)
+	require.ElementsMatch(t, []model.Sample{
+		{
+			Metric:    model.Metric{"__name__": "up", "job": "foo", "instance": "1"},
+			Value:     1,
+			Timestamp: model.TimeFromUnix(start.Add(time.Hour).Unix()),
+		},
+		{
+			Metric:    model.Metric{"__name__": "up", "job": "foo", "instance": "2"},
+			Value:     0,
+			Timestamp: model.TimeFromUnix(start.Add(time.Hour).Unix()),
+		},
+	}, qr.Series)
+
+	qr, err = db.Query(context.Background(), `count(up == 1)`)
+	require.NoError(t, err)
+	require.Len(t, qr.Series, 1)
+	require.Equal(t, model.SampleValue(2), qr.Series[0].Value)
+
+	rqr, err := db.RangeQuery(context.Background(), `up{job="bar"}`, promapi.NewAbsoluteRange(start, start.Add(time.Minute*30), time.Minute*5), promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, rqr.Samples, 1)
+	require.Equal(t, model.Metric{"__name__": "up", "job": "bar", "instance": "1"}, rqr.Samples[0].Metric)
+	require.Len(t, rqr.Samples[0].Values, 7)
+	require.Equal(t, model.TimeFromUnix(start.Unix()), rqr.Samples[0].Values[0].Timestamp)
+	require.Equal(t, model.TimeFromUnix(start.Add(time.Minute*30).Unix()), rqr.Samples[0].Values[6].Timestamp)
+
+	rqr, err = db.RangeQuery(context.Background(), `up{job="missing"}`, promapi.NewAbsoluteRange(start, start.Add(time.Minute*30), time.Minute*5), promapi.RangeQueryOptions{})
+	require.NoError(t, err)
+	require.Empty(t, rqr.Samples)
+
+	_, err = db.Query(context.Background(), `up{`)
+	require.Error(t, err)
+	var qe promapi.QueryError
+	require.ErrorAs(t, err, &qe)
+
+	_, err = db.RangeQuery(context.Background(), `up{`, promapi.NewAbsoluteRange(start, start.Add(time.Minute*30), time.Minute*5), promapi.RangeQueryOptions{})
+	require.ErrorAs(t, err, &qe)
+}
+
+func TestTSDBNoBlocks(t *testing.T) {
+	dir := t.TempDir()
+	db, err := promapi.OpenTSDB(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Query(context.Background(), "up")
+	require.EqualError(t, err, "no blocks found in "+dir)
+	var qe promapi.QueryError
+	require.ErrorAs(t, err, &qe)
+}
@@ -0,0 +1,124 @@
+package promapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrInvalidExpr is returned by ValidateExpr when Prometheus rejects
+// the query expression.
+var ErrInvalidExpr = errors.New("invalid query expression")
+
+type validateQuery struct {
+	prom *Prometheus
+	ctx  context.Context
+	expr string
+}
+
+func (q validateQuery) Run() queryResult {
+	log.Debug().
+		Str("uri", q.prom.uri).
+		Str("query", q.expr).
+		Msg("Validating prometheus query")
+
+	ctx, cancel := context.WithTimeout(q.ctx, q.prom.timeout)
+	defer cancel()
+
+	// Whether a query is valid doesn't change, so results never expire.
+	qr := queryResult{}
+
+	args := url.Values{}
+	args.Set("query", q.expr)
+	qr.request = q.prom.describeRequest(http.MethodGet, q.Endpoint(), args)
+	resp, err := q.prom.doRequest(ctx, http.MethodGet, q.Endpoint(), args, nil)
+	if err != nil {
+		qr.err = err
+		return qr
+	}
+	defer resp.Body.Close()
+	qr.expires = q.prom.cacheExpires(resp, qr.expires)
+
+	if resp.StatusCode == http.StatusNotFound {
+		// Servers older than 2.38 don't have format_query, use the parser
+		// built into pint instead.
+		dummyReadAll(resp.Body)
+		log.Debug().
+			Str("uri", q.prom.uri).
+			Msg("Prometheus doesn't support format_query, validating query locally")
+		qr.value = ""
+		if _, err = parser.ParseExpr(q.expr); err != nil {
+			qr.value = err.Error()
+		}
+		return qr
+	}
+
+	if resp.StatusCode/100 != 2 {
+		err = tryDecodingAPIError(resp)
+		// Store validation errors as the value so they're cached.
+		var apiErr APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorType == v1.ErrBadData {
+			qr.value = apiErr.Err
+			return qr
+		}
+		qr.err = err
+		return qr
+	}
+
+	dummyReadAll(resp.Body)
+	qr.value = ""
+	return qr
+}
+
+func (q validateQuery) Endpoint() string {
+	return "/api/v1/format_query"
+}
+
+func (q validateQuery) String() string {
+	return q.expr
+}
+
+func (q validateQuery) CacheKey() string {
+	h := q.prom.newCacheKeyHash()
+	_, _ = io.WriteString(h, q.Endpoint())
+	_, _ = io.WriteString(h, "\n")
+	_, _ = io.WriteString(h, q.expr)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// ValidateExpr checks if Prometheus accepts given query expression without
+// running it. It returns ErrInvalidExpr if the expression is not valid.
+// It uses the format_query API, added in Prometheus 2.38, which only checks
+// the syntax, so queries using unknown metrics or labels are still valid.
+// If the server doesn't support format_query then the query is parsed by
+// pint instead, which might not support the same syntax as the server.
+func (p *Prometheus) ValidateExpr(ctx context.Context, expr string) error {
+	log.Debug().Str("uri", p.uri).Str("query", expr).Msg("Scheduling prometheus query validation")
+
+	key := fmt.Sprintf("/api/v1/format_query/%s", expr)
+	p.locker.lock(key)
+	defer p.locker.unlock(key)
+
+	resultChan := make(chan queryResult)
+	p.enqueue(ctx, queryRequest{
+		query:  validateQuery{prom: p, ctx: ctx, expr: expr},
+		result: resultChan,
+	})
+
+	result := <-resultChan
+	if result.err != nil {
+		return QueryError{err: result.err, msg: decodeError(result.err), request: &result.request}
+	}
+
+	if msg := result.value.(string); msg != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidExpr, msg)
+	}
+	return nil
+}
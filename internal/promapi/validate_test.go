@@ -0,0 +1,101 @@
+package promapi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestValidateExpr(t *testing.T) {
+	var mtx sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, "/api/v1/format_query", r.URL.Path)
+		query := r.Form.Get("query")
+		mtx.Lock()
+		requests[query]++
+		mtx.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch query {
+		case "up", "sum(rate(foo[5m]))":
+			w.WriteHeader(200)
+			_, _ = w.Write([]byte(`{"status":"success","data":"` + query + `"}`))
+		case "failing":
+			w.WriteHeader(503)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"execution","error":"query failed"}`))
+		default:
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"1:4: parse error: unexpected end of input"}`))
+		}
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	type testCaseT struct {
+		expr    string
+		err     string
+		invalid bool
+	}
+
+	testCases := []testCaseT{
+		{expr: "up"},
+		{expr: "sum(rate(foo[5m]))"},
+		{expr: "up{", err: "invalid query expression: 1:4: parse error: unexpected end of input", invalid: true},
+		{expr: "failing", err: "execution: query failed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				err := prom.ValidateExpr(context.Background(), tc.expr)
+				if tc.err == "" {
+					require.NoError(t, err)
+				} else {
+					require.EqualError(t, err, tc.err)
+				}
+				require.Equal(t, tc.invalid, errors.Is(err, promapi.ErrInvalidExpr))
+			}
+		})
+	}
+
+	require.Equal(t, map[string]int{
+		"up":                 1,
+		"sum(rate(foo[5m]))": 1,
+		"up{":                1,
+		"failing":            2,
+	}, requests, "validation results should be cached")
+}
+
+func TestValidateExprNotSupported(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		_, _ = w.Write([]byte("404 page not found\n"))
+	}))
+	defer srv.Close()
+
+	prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+	prom.StartWorkers()
+	defer prom.Close()
+
+	require.NoError(t, prom.ValidateExpr(context.Background(), "sum(rate(foo[5m]))"))
+
+	err := prom.ValidateExpr(context.Background(), "up{")
+	require.ErrorIs(t, err, promapi.ErrInvalidExpr)
+	require.ErrorContains(t, err, "invalid query expression: 1:4: parse error: unexpected end of input")
+}
@@ -0,0 +1,31 @@
+package promapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Warmup sends a request to /-/healthy and reads the whole response, so the
+// connection is kept open and later queries don't need to wait for a new
+// connection and TLS handshake. Status code of the response is ignored,
+// only a failure to connect is returned as an error.
+func (p *Prometheus) Warmup(ctx context.Context) error {
+	log.Debug().Str("uri", p.uri).Msg("Opening connection to Prometheus server")
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	resp, err := p.doRequest(ctx, http.MethodGet, "/-/healthy", nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", p.uri, err)
+	}
+	defer resp.Body.Close()
+
+	// Body must be fully read for the connection to be reused.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,103 @@
+package promapi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudflare/pint/internal/promapi"
+)
+
+func TestWarmup(t *testing.T) {
+	var mtx sync.Mutex
+	paths := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		paths = append(paths, r.URL.Path)
+		mtx.Unlock()
+		if r.URL.Path == "/-/healthy" {
+			_, _ = w.Write([]byte("Prometheus Server is Healthy.\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	traced := func(reused *bool) context.Context {
+		return httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				*reused = info.Reused
+			},
+		})
+	}
+
+	t.Run("cold", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		var reused bool
+		_, err := prom.Query(traced(&reused), "cold")
+		require.NoError(t, err)
+		require.False(t, reused, "first query shouldn't reuse any connection")
+	})
+
+	t.Run("warm", func(t *testing.T) {
+		prom := promapi.NewPrometheus("test", srv.URL, time.Second, 1, 100, 100)
+		prom.StartWorkers()
+		defer prom.Close()
+
+		require.NoError(t, prom.Warmup(context.Background()))
+
+		var reused bool
+		_, err := prom.Query(traced(&reused), "warm")
+		require.NoError(t, err)
+		require.True(t, reused, "query should reuse the warmed up connection")
+	})
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, []string{"/api/v1/query", "/-/healthy", "/api/v1/query"}, paths)
+}
+
+func TestWarmupError(t *testing.T) {
+	prom := promapi.NewPrometheus("test", "http://127.0.0.1:1", time.Second, 1, 100, 100)
+	err := prom.Warmup(context.Background())
+	require.ErrorContains(t, err, "failed to connect to http://127.0.0.1:1: ")
+
+	fg := promapi.NewFailoverGroup("test", []*promapi.Prometheus{prom}, true)
+	require.ErrorContains(t, fg.Warmup(context.Background(), time.Second), "failed to connect to http://127.0.0.1:1: ")
+}
+
+func TestWarmupTimeout(t *testing.T) {
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(done)
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer fast.Close()
+
+	fg := promapi.NewFailoverGroup("test", []*promapi.Prometheus{
+		promapi.NewPrometheus("slow", slow.URL, time.Minute, 1, 100, 100),
+		promapi.NewPrometheus("fast", fast.URL, time.Minute, 1, 100, 100),
+	}, true)
+
+	start := time.Now()
+	require.NoError(t, fg.Warmup(context.Background(), time.Millisecond*100))
+	require.Less(t, time.Since(start), time.Second*5, "slow server should be skipped after the timeout")
+}